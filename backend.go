@@ -0,0 +1,252 @@
+package rmq
+
+import (
+	"log"
+	"time"
+
+	"gopkg.in/redis.v5"
+)
+
+// backend is the storage connections, queues and cleaners keep their
+// deliveries and bookkeeping in. Keys are built from the templates in
+// queue.go, lists are pushed to at their head and consumed from their tail.
+// Missing keys read as empty, so implementations never return redis.Nil.
+// redisBackend is the default, other backends must pass the conformance suite
+// in backend_test.go. Features built on scripts or pipelines (visibility
+// timeouts, retries, stats and the like) still talk to Redis directly.
+// Of duplicate payloads removeFromUnacked and move remove the newest one,
+// unless the backend uses the positional commands, see connection.ServerInfo()
+type backend interface {
+	// push adds the payloads to the head of the list at key
+	push(key string, payloads ...string) error
+	// popToUnacked moves up to n payloads from the tail of the list at readyKey
+	// to the head of the one at unackedKey and returns them, oldest first.
+	// Payloads moved before an error are returned along with it
+	popToUnacked(readyKey, unackedKey string, n int) ([][]byte, error)
+	// removeFromUnacked removes payload from the list at unackedKey along with
+	// its attempts in the hash at attemptsKey and, unless inflightKey is empty,
+	// its visibility deadline. Unless deadline is zero payload is only removed
+	// while that's still its visibility deadline. Returns false if payload
+	// wasn't unacked
+	removeFromUnacked(unackedKey, attemptsKey, inflightKey string, deadline int64, payload []byte) (bool, error)
+	// move pushes payload to the head of the list at dstKey and removes it from
+	// the one at srcKey. It isn't atomic, the lists may live on different
+	// cluster nodes. Returns false if payload wasn't in the list at srcKey
+	move(srcKey, dstKey string, payload []byte) (bool, error)
+
+	// addMember adds member to the set at key, returns false if it was a
+	// member already
+	addMember(key, member string) (bool, error)
+	// removeMember removes member from the set at key, returns false if it
+	// wasn't a member
+	removeMember(key, member string) (bool, error)
+	isMember(key, member string) (bool, error)
+	members(key string) ([]string, error)
+
+	// setTTLKey sets key to expire after ttl, zero to never expire
+	setTTLKey(key string, ttl time.Duration) error
+	// ttl returns the time until key expires, a negative duration if it
+	// doesn't exist or doesn't expire
+	ttl(key string) (time.Duration, error)
+
+	// count returns the length of the list at key
+	count(key string) (int64, error)
+	// scan returns the entries start to stop (inclusive) of the list at key,
+	// counted from its head. Negative indexes count from its tail
+	scan(key string, start, stop int64) ([]string, error)
+	// del deletes the keys and returns how many existed
+	del(keys ...string) (int64, error)
+
+	// lock sets key to token, expiring after ttl, unless it exists. Returns
+	// false if it did
+	lock(key, token string, ttl time.Duration) (bool, error)
+	// renewLock sets the lock at key to expire after ttl if it's still held
+	// with token. Returns false if it isn't
+	renewLock(key, token string, ttl time.Duration) (bool, error)
+	// unlock deletes the lock at key if it's still held with token
+	unlock(key, token string) error
+}
+
+// redisBackend is the backend of a redis.Cmdable
+type redisBackend struct {
+	client     redis.Cmdable
+	positional bool // whether to use LMOVE and LPOS, see connection.ServerInfo()
+}
+
+var _ backend = redisBackend{}
+
+func newRedisBackend(client redis.Cmdable) redisBackend {
+	return redisBackend{client: client}
+}
+
+func (backend redisBackend) push(key string, payloads ...string) error {
+	args := make([]interface{}, len(payloads))
+	for i, payload := range payloads {
+		args[i] = payload
+	}
+	return redisErr(backend.client.LPush(key, args...))
+}
+
+func (backend redisBackend) popToUnacked(readyKey, unackedKey string, n int) ([][]byte, error) {
+	if backend.positional {
+		result := popScript.pick(true).run(backend.client, []string{readyKey, unackedKey}, n)
+		if err := redisErr(result); err != nil {
+			return nil, err
+		}
+		values, _ := result.Val().([]interface{})
+		popped := make([][]byte, 0, len(values))
+		for _, value := range values {
+			if data, ok := value.(string); ok && data != "" {
+				popped = append(popped, []byte(data))
+			}
+		}
+		return popped, nil
+	}
+
+	results, err := backend.client.Pipelined(func(pipe *redis.Pipeline) error {
+		for i := 0; i < n; i++ {
+			pipe.RPopLPush(readyKey, unackedKey)
+		}
+		return nil
+	})
+	err = pipelineErr(err) // redis.Nil if some deliveries weren't ready anymore
+
+	popped := make([][]byte, 0, len(results))
+	for _, result := range results {
+		result, ok := result.(*redis.StringCmd)
+		if !ok {
+			continue
+		}
+		data, cmdErr := result.Bytes()
+		if cmdErr != nil || len(data) == 0 {
+			continue
+		}
+		popped = append(popped, data)
+	}
+	return popped, err
+}
+
+func (backend redisBackend) removeFromUnacked(unackedKey, attemptsKey, inflightKey string, deadline int64, payload []byte) (bool, error) {
+	keys := []string{unackedKey, attemptsKey}
+	args := []interface{}{payload}
+	if inflightKey != "" {
+		keys = append(keys, inflightKey)
+		if deadline != 0 {
+			args = append(args, deadline)
+		}
+	}
+	result := removeUnackedScript.pick(backend.positional).run(backend.client, keys, args...)
+	if err := redisErr(result); err != nil {
+		return false, err
+	}
+	return result.Val() == int64(1), nil
+}
+
+func (backend redisBackend) move(srcKey, dstKey string, payload []byte) (bool, error) {
+	var removed *redis.Cmd
+	_, err := backend.client.Pipelined(func(pipe *redis.Pipeline) error {
+		pipe.LPush(dstKey, payload)
+		removed = removeScript.pick(backend.positional).eval(backend.client, pipe, []string{srcKey}, payload)
+		return nil
+	})
+	if err := pipelineErr(err); err != nil {
+		return false, err
+	}
+	return removed.Val() == int64(1), nil
+}
+
+func (backend redisBackend) addMember(key, member string) (bool, error) {
+	result := backend.client.SAdd(key, member)
+	if err := redisErr(result); err != nil {
+		return false, err
+	}
+	return result.Val() == 1, nil
+}
+
+func (backend redisBackend) removeMember(key, member string) (bool, error) {
+	result := backend.client.SRem(key, member)
+	if err := redisErr(result); err != nil {
+		return false, err
+	}
+	return result.Val() == 1, nil
+}
+
+func (backend redisBackend) isMember(key, member string) (bool, error) {
+	result := backend.client.SIsMember(key, member)
+	if err := redisErr(result); err != nil {
+		return false, err
+	}
+	return result.Val(), nil
+}
+
+func (backend redisBackend) members(key string) ([]string, error) {
+	result := backend.client.SMembers(key)
+	if err := redisErr(result); err != nil {
+		return nil, err
+	}
+	return result.Val(), nil
+}
+
+func (backend redisBackend) setTTLKey(key string, ttl time.Duration) error {
+	return redisErr(backend.client.Set(key, "1", ttl))
+}
+
+func (backend redisBackend) ttl(key string) (time.Duration, error) {
+	result := backend.client.TTL(key)
+	if err := redisErr(result); err != nil {
+		return 0, err
+	}
+	return result.Val(), nil
+}
+
+func (backend redisBackend) count(key string) (int64, error) {
+	result := backend.client.LLen(key)
+	if err := redisErr(result); err != nil {
+		return 0, err
+	}
+	return result.Val(), nil
+}
+
+func (backend redisBackend) scan(key string, start, stop int64) ([]string, error) {
+	result := backend.client.LRange(key, start, stop)
+	if err := redisErr(result); err != nil {
+		return nil, err
+	}
+	return result.Val(), nil
+}
+
+func (backend redisBackend) del(keys ...string) (int64, error) {
+	result := backend.client.Del(keys...)
+	if err := redisErr(result); err != nil {
+		return 0, err
+	}
+	return result.Val(), nil
+}
+
+func (backend redisBackend) lock(key, token string, ttl time.Duration) (bool, error) {
+	result := backend.client.SetNX(key, token, ttl)
+	if err := redisErr(result); err != nil {
+		return false, err
+	}
+	return result.Val(), nil
+}
+
+func (backend redisBackend) renewLock(key, token string, ttl time.Duration) (bool, error) {
+	result := renewLockScript.run(backend.client, []string{key}, token, int64(ttl/time.Millisecond))
+	if err := redisErr(result); err != nil {
+		return false, err
+	}
+	return result.Val() == int64(1), nil
+}
+
+func (backend redisBackend) unlock(key, token string) error {
+	return redisErr(releaseLockScript.run(backend.client, []string{key}, token))
+}
+
+// backendErr panics on backend errors, for the methods which panic on Redis
+// errors like redisErrIsNil does
+func backendErr(err error) {
+	if err != nil {
+		log.Panicf("rmq backend error is not nil %s", err)
+	}
+}
@@ -0,0 +1,206 @@
+package rmq
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/adjust/gocheck"
+	"gopkg.in/redis.v5"
+)
+
+func TestBackendSuite(t *testing.T) {
+	TestingSuiteT(&BackendSuite{}, t)
+}
+
+// BackendSuite is the conformance suite all backends must pass, each test
+// runs it against every backend of newTestBackends()
+type BackendSuite struct{}
+
+// newTestBackends returns the backends to check by name, opening a backend
+// empties it
+func newTestBackends(c *C) map[string]func() backend {
+	redisClient := redis.NewClient(&redis.Options{Addr: testRedisAddr, DB: 1})
+	flushed := func(opened backend) func() backend {
+		return func() backend {
+			c.Assert(redisClient.FlushDb().Err(), IsNil)
+			return opened
+		}
+	}
+	return map[string]func() backend{
+		"redis":            flushed(newRedisBackend(redisClient)),
+		"redis-positional": flushed(redisBackend{client: redisClient, positional: true}),
+	}
+}
+
+func (suite *BackendSuite) TestBackendLists(c *C) {
+	for name, open := range newTestBackends(c) {
+		backend := open()
+		comment := Commentf("backend %s", name)
+		count, err := backend.count("list")
+		c.Check(err, IsNil, comment)
+		c.Check(count, Equals, int64(0), comment)
+		entries, err := backend.scan("list", 0, -1)
+		c.Check(err, IsNil, comment)
+		c.Check(entries, HasLen, 0, comment)
+
+		c.Check(backend.push("list", "a"), IsNil, comment)
+		c.Check(backend.push("list", "b", "c"), IsNil, comment)
+		count, _ = backend.count("list")
+		c.Check(count, Equals, int64(3), comment)
+		entries, _ = backend.scan("list", 0, -1)
+		c.Check(entries, DeepEquals, []string{"c", "b", "a"}, comment)
+		entries, _ = backend.scan("list", 1, 1)
+		c.Check(entries, DeepEquals, []string{"b"}, comment)
+		entries, _ = backend.scan("list", -2, -1)
+		c.Check(entries, DeepEquals, []string{"b", "a"}, comment)
+
+		moved, err := backend.move("list", "other", []byte("b"))
+		c.Check(err, IsNil, comment)
+		c.Check(moved, Equals, true, comment)
+		entries, _ = backend.scan("list", 0, -1)
+		c.Check(entries, DeepEquals, []string{"c", "a"}, comment)
+		entries, _ = backend.scan("other", 0, -1)
+		c.Check(entries, DeepEquals, []string{"b"}, comment)
+
+		deleted, err := backend.del("list", "other", "nope")
+		c.Check(err, IsNil, comment)
+		c.Check(deleted, Equals, int64(2), comment)
+		count, _ = backend.count("list")
+		c.Check(count, Equals, int64(0), comment)
+	}
+}
+
+func (suite *BackendSuite) TestBackendUnacked(c *C) {
+	for name, open := range newTestBackends(c) {
+		backend := open()
+		comment := Commentf("backend %s", name)
+		c.Check(backend.push("ready", "d1", "d2", "d3"), IsNil, comment)
+
+		popped, err := backend.popToUnacked("ready", "unacked", 2)
+		c.Check(err, IsNil, comment)
+		c.Check(popped, DeepEquals, [][]byte{[]byte("d1"), []byte("d2")}, comment)
+		popped, err = backend.popToUnacked("ready", "unacked", 2)
+		c.Check(err, IsNil, comment)
+		c.Check(popped, DeepEquals, [][]byte{[]byte("d3")}, comment)
+		popped, _ = backend.popToUnacked("ready", "unacked", 2)
+		c.Check(popped, HasLen, 0, comment)
+		entries, _ := backend.scan("unacked", 0, -1)
+		c.Check(entries, DeepEquals, []string{"d3", "d2", "d1"}, comment)
+
+		removed, err := backend.removeFromUnacked("unacked", "attempts", "", 0, []byte("d2"))
+		c.Check(err, IsNil, comment)
+		c.Check(removed, Equals, true, comment)
+		removed, _ = backend.removeFromUnacked("unacked", "attempts", "inflight", 0, []byte("d2"))
+		c.Check(removed, Equals, false, comment)
+		entries, _ = backend.scan("unacked", 0, -1)
+		c.Check(entries, DeepEquals, []string{"d3", "d1"}, comment)
+
+		moved, _ := backend.move("unacked", "rejected", []byte("nope"))
+		c.Check(moved, Equals, false, comment)
+	}
+}
+
+func (suite *BackendSuite) TestBackendDuplicates(c *C) {
+	for name, open := range newTestBackends(c) {
+		backend := open()
+		comment := Commentf("backend %s", name)
+		c.Check(backend.push("unacked", "dup", "mid", "dup"), IsNil, comment)
+
+		removed, err := backend.removeFromUnacked("unacked", "attempts", "", 0, []byte("dup"))
+		c.Check(err, IsNil, comment)
+		c.Check(removed, Equals, true, comment)
+		entries, _ := backend.scan("unacked", 0, -1)
+		if name == "redis-positional" {
+			c.Check(entries, DeepEquals, []string{"dup", "mid"}, comment) // the oldest one
+		} else {
+			c.Check(entries, DeepEquals, []string{"mid", "dup"}, comment)
+		}
+
+		backend.push("unacked", "dup")
+		moved, err := backend.move("unacked", "rejected", []byte("dup"))
+		c.Check(err, IsNil, comment)
+		c.Check(moved, Equals, true, comment)
+		entries, _ = backend.scan("unacked", 0, -1)
+		c.Check(entries, HasLen, 2, comment)
+		c.Check(entries[1] == "mid", Equals, name == "redis-positional", comment)
+	}
+}
+
+func (suite *BackendSuite) TestBackendSets(c *C) {
+	for name, open := range newTestBackends(c) {
+		backend := open()
+		comment := Commentf("backend %s", name)
+		members, err := backend.members("set")
+		c.Check(err, IsNil, comment)
+		c.Check(members, HasLen, 0, comment)
+
+		added, err := backend.addMember("set", "m1")
+		c.Check(err, IsNil, comment)
+		c.Check(added, Equals, true, comment)
+		added, _ = backend.addMember("set", "m1")
+		c.Check(added, Equals, false, comment)
+		backend.addMember("set", "m2")
+		members, _ = backend.members("set")
+		c.Check(members, HasLen, 2, comment)
+
+		isMember, err := backend.isMember("set", "m2")
+		c.Check(err, IsNil, comment)
+		c.Check(isMember, Equals, true, comment)
+		removed, err := backend.removeMember("set", "m2")
+		c.Check(err, IsNil, comment)
+		c.Check(removed, Equals, true, comment)
+		removed, _ = backend.removeMember("set", "m2")
+		c.Check(removed, Equals, false, comment)
+		isMember, _ = backend.isMember("set", "m2")
+		c.Check(isMember, Equals, false, comment)
+		members, _ = backend.members("set")
+		c.Check(members, DeepEquals, []string{"m1"}, comment)
+	}
+}
+
+func (suite *BackendSuite) TestBackendTTL(c *C) {
+	for name, open := range newTestBackends(c) {
+		backend := open()
+		comment := Commentf("backend %s", name)
+		ttl, err := backend.ttl("heartbeat")
+		c.Check(err, IsNil, comment)
+		c.Check(ttl < 0, Equals, true, comment)
+
+		c.Check(backend.setTTLKey("heartbeat", time.Minute), IsNil, comment)
+		ttl, _ = backend.ttl("heartbeat")
+		c.Check(ttl > 0 && ttl <= time.Minute, Equals, true, comment)
+
+		c.Check(backend.setTTLKey("protected", 0), IsNil, comment)
+		ttl, _ = backend.ttl("protected")
+		c.Check(ttl < 0, Equals, true, comment)
+		deleted, _ := backend.del("protected")
+		c.Check(deleted, Equals, int64(1), comment)
+	}
+}
+
+func (suite *BackendSuite) TestBackendLock(c *C) {
+	for name, open := range newTestBackends(c) {
+		backend := open()
+		comment := Commentf("backend %s", name)
+		locked, err := backend.lock("lock", "t1", time.Minute)
+		c.Check(err, IsNil, comment)
+		c.Check(locked, Equals, true, comment)
+		locked, _ = backend.lock("lock", "t2", time.Minute)
+		c.Check(locked, Equals, false, comment)
+
+		renewed, err := backend.renewLock("lock", "t2", time.Hour)
+		c.Check(err, IsNil, comment)
+		c.Check(renewed, Equals, false, comment)
+		renewed, _ = backend.renewLock("lock", "t1", time.Hour)
+		c.Check(renewed, Equals, true, comment)
+		ttl, _ := backend.ttl("lock")
+		c.Check(ttl > time.Minute, Equals, true, comment)
+
+		c.Check(backend.unlock("lock", "t2"), IsNil, comment)
+		locked, _ = backend.lock("lock", "t2", time.Minute)
+		c.Check(locked, Equals, false, comment)
+		c.Check(backend.unlock("lock", "t1"), IsNil, comment)
+		locked, _ = backend.lock("lock", "t2", time.Minute)
+		c.Check(locked, Equals, true, comment)
+	}
+}
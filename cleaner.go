@@ -1,12 +1,82 @@
 package rmq
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/adjust/uniuri"
+	"gopkg.in/redis.v5"
+)
+
+// maxCleanBackoff is the longest time Run waits after failed cleans
+const maxCleanBackoff = 5 * time.Minute
+
+var (
+	// renewLockScript extends the lock at KEYS[1] to ARGV[2] ms if it's still
+	// held with the token ARGV[1]
+	renewLockScript = newScript("renewLock", `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+	// releaseLockScript deletes the lock at KEYS[1] if it's still held with
+	// the token ARGV[1]
+	releaseLockScript = newScript("releaseLock", `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+)
 
 // Cleaner is a utility class for doing housekeeping to remove abandoned records
 // from RMQ within Redis. It is good practice to have at least one client
 // periodically call Clean.
 type Cleaner struct {
-	connection *RedisConnection
+	connection  *RedisConnection
+	onClean     func(report CleanReport, err error) // called by Run after each clean, nil to skip
+	gracePeriod time.Duration                       // how long connections must be dead before they get cleaned
+	lockTTL     time.Duration                       // TTL of connection locks, zero to clean without locking
+	hooks       CleanerHooks
+	retention   time.Duration // how long empty queues must be unused before they get pruned, zero to not prune
+	protected   []string      // patterns of connection names which must not be cleaned
+	concurrency int           // number of connections cleaned at the same time, 1 if not positive
+	minIdle     time.Duration // how long stream entries must be pending before they get reclaimed, see SetStreamMinIdle()
+
+	statsMutex sync.Mutex
+	stats      CleanerStats
+}
+
+// CleanerStats are counters of all cleans of a cleaner, see cleaner.Stats()
+type CleanerStats struct {
+	Runs            int64         // number of cleans
+	Connections     int64         // number of dead connections cleaned
+	Returned        int64         // number of unacked deliveries returned to ready
+	Reclaimed       int64         // number of idle stream entries made ready again
+	Errors          int64         // number of cleans which failed, completely or partially
+	LastRunDuration time.Duration // how long the last clean took
+}
+
+// CleanReport describes what a clean did
+type CleanReport struct {
+	Connections int      // number of dead connections cleaned
+	Returned    int      // number of unacked deliveries returned to ready
+	Grace       int      // number of dead connections not cleaned yet because of the grace period
+	Locked      int      // number of dead connections skipped or given up because another cleaner holds their lock
+	Keys        int      // number of keys of cleaned connections deleted
+	Reclaimed   int      // number of idle stream entries made ready again
+	Pruned      []string // names of unused empty queues removed from the list of queues
+	Protected   []string // names of dead connections not cleaned because they are protected
 }
 
 // NewCleaner returns an initialized Cleaner object.
@@ -14,58 +84,687 @@ func NewCleaner(connection *RedisConnection) *Cleaner {
 	return &Cleaner{connection: connection}
 }
 
+// SetOnClean sets a function Run calls after each clean with its report and
+// error
+func (cleaner *Cleaner) SetOnClean(onClean func(report CleanReport, err error)) {
+	cleaner.onClean = onClean
+}
+
+// SetHooks sets the hooks the cleaner invokes while cleaning, see
+// CleanerHooks
+func (cleaner *Cleaner) SetHooks(hooks CleanerHooks) {
+	cleaner.hooks = hooks
+}
+
+// SetGracePeriod makes the cleaner only clean connections which were seen
+// without heartbeat for at least gracePeriod, so that consumers which missed
+// their heartbeat for a while (e.g. because of a long GC pause) don't get
+// their unacked deliveries returned underneath them. The first time a
+// connection is seen without heartbeat is stored in Redis, so it's shared
+// between cleaners. Defaults to zero, cleaning dead connections right away
+func (cleaner *Cleaner) SetGracePeriod(gracePeriod time.Duration) {
+	cleaner.gracePeriod = gracePeriod
+}
+
+// SetLocking makes the cleaner lock each dead connection in Redis while
+// cleaning it, so that concurrent cleaners don't clean the same connection.
+// Locks expire after ttl unless they are renewed, which happens every third of
+// ttl while cleaning. If the lock gets lost anyway the clean of the
+// connection is given up before its next queue. Zero disables locking
+func (cleaner *Cleaner) SetLocking(ttl time.Duration) {
+	cleaner.lockTTL = ttl
+}
+
+// Protect makes the cleaner never clean connections whose names match
+// pattern, like "batch-aggregator-*" (see path.Match for the syntax), even if
+// their heartbeat stopped. Connections can also protect themselves with
+// connection.SetProtected(). Returns an error if the pattern is malformed
+func (cleaner *Cleaner) Protect(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return err
+	}
+	cleaner.protected = append(cleaner.protected, pattern)
+	return nil
+}
+
+// SetConcurrency makes the cleaner clean up to concurrency dead connections at
+// the same time. A failing connection doesn't stop the others. Hooks may get
+// called concurrently then. Defaults to 1, cleaning one connection at a time
+func (cleaner *Cleaner) SetConcurrency(concurrency int) {
+	cleaner.concurrency = concurrency
+}
+
+// SetPruneQueues makes the cleaner remove queues from the list of queues if
+// they have no ready, rejected or delayed deliveries, no connection consumes
+// them and they weren't opened or published to for retention. Queues whose
+// activity wasn't tracked yet are kept for retention from now on. Zero
+// disables pruning, which is the default. Stream queues are never pruned
+func (cleaner *Cleaner) SetPruneQueues(retention time.Duration) {
+	cleaner.retention = retention
+}
+
+// SetStreamMinIdle makes the cleaner reclaim entries of stream queues which
+// were pending for at least minIdle without being settled or extended, so
+// they're ready again. Unlike unacked list deliveries they're reclaimed no
+// matter whether their connection is still alive. Defaults to 10 minutes,
+// negative disables reclaiming
+func (cleaner *Cleaner) SetStreamMinIdle(minIdle time.Duration) {
+	cleaner.minIdle = minIdle
+}
+
 // Clean inspects the set of active connections and removes any connections
 // it detects that are no longer alive. Further,it calls `CleanConnection` for
-// any each connection that it purges.
+// any each connection that it purges. If some connections can't be cleaned the
+// others are cleaned anyway and a PartialCleanError is returned. Errors caused
+// by Redis being unreachable wrap ErrRedisUnavailable
 func (cleaner *Cleaner) Clean() error {
-	connectionNames := cleaner.connection.GetConnections()
-	for _, connectionName := range connectionNames {
-		connection := cleaner.connection.hijackConnection(connectionName)
-		if connection.Check() {
-			continue // skip active connections!
+	_, err := cleaner.CleanWithReport()
+	return err
+}
+
+// Stats returns the counters of all cleans of this cleaner so far, for example
+// to export them as metrics of a process running the cleaner in the
+// background
+func (cleaner *Cleaner) Stats() CleanerStats {
+	cleaner.statsMutex.Lock()
+	defer cleaner.statsMutex.Unlock()
+	return cleaner.stats
+}
+
+// CleanWithReport is like Clean, but also returns what was cleaned
+func (cleaner *Cleaner) CleanWithReport() (report CleanReport, err error) {
+	start := time.Now()
+	report, err = cleaner.clean()
+
+	cleaner.statsMutex.Lock()
+	defer cleaner.statsMutex.Unlock()
+	cleaner.stats.Runs++
+	cleaner.stats.Connections += int64(report.Connections)
+	cleaner.stats.Returned += int64(report.Returned)
+	cleaner.stats.Reclaimed += int64(report.Reclaimed)
+	if err != nil {
+		cleaner.stats.Errors++
+	}
+	cleaner.stats.LastRunDuration = time.Since(start)
+	return report, err
+}
+
+func (cleaner *Cleaner) clean() (report CleanReport, err error) {
+	connectionNames, err := cleaner.connection.backend.members(connectionsKey)
+	if err != nil {
+		return report, cleaner.hooks.failed("list connections", cleanErr(err))
+	}
+
+	report, failed := cleaner.cleanAll(connectionNames)
+
+	if report.Reclaimed, err = cleaner.reclaimStreams(); err != nil {
+		return report, cleaner.hooks.failed("reclaim streams", cleanErr(err))
+	}
+
+	if cleaner.retention > 0 && len(failed) == 0 {
+		if report.Pruned, err = cleaner.pruneQueues(); err != nil {
+			return report, cleaner.hooks.failed("prune queues", cleanErr(err))
+		}
+	}
+
+	if len(failed) > 0 {
+		return report, &PartialCleanError{Connections: failed}
+	}
+	return report, nil
+}
+
+// cleanAll cleans the dead connections among the given ones using up to
+// concurrency goroutines and returns the merged report along with the
+// connections which failed
+func (cleaner *Cleaner) cleanAll(connectionNames []string) (report CleanReport, failed []*ConnectionCleanError) {
+	if cleaner.concurrency <= 1 {
+		for _, connectionName := range connectionNames {
+			if err := cleaner.cleanDead(connectionName, &report); err != nil {
+				failed = append(failed, &ConnectionCleanError{Connection: connectionName, Err: err})
+			}
 		}
+		return report, failed
+	}
+
+	names := make(chan string)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < cleaner.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for connectionName := range names {
+				connectionReport := CleanReport{}
+				err := cleaner.cleanDead(connectionName, &connectionReport)
+
+				mutex.Lock()
+				report.add(connectionReport)
+				if err != nil {
+					failed = append(failed, &ConnectionCleanError{Connection: connectionName, Err: err})
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	for _, connectionName := range connectionNames {
+		names <- connectionName
+	}
+	close(names)
+	wg.Wait()
+	return report, failed
+}
+
+// add adds the connection counts of other to the report
+func (report *CleanReport) add(other CleanReport) {
+	report.Connections += other.Connections
+	report.Returned += other.Returned
+	report.Grace += other.Grace
+	report.Locked += other.Locked
+	report.Keys += other.Keys
+	report.Protected = append(report.Protected, other.Protected...)
+}
+
+// cleanDead cleans the connection with the given name if it's dead, adding
+// what it did to report
+func (cleaner *Cleaner) cleanDead(connectionName string, report *CleanReport) error {
+	backend := cleaner.connection.backend
+	connection := cleaner.connection.hijackConnection(connectionName)
+	staleKey := strings.Replace(connectionStaleTemplate, phConnection, connectionName, 1)
 
-		if err := cleaner.CleanConnection(nil); err != nil {
+	alive, err := cleaner.alive(connection)
+	if err != nil {
+		return err
+	}
+	if !alive {
+		protected, err := cleaner.isProtected(connectionName)
+		if err != nil {
 			return err
 		}
+		if protected {
+			report.Protected = append(report.Protected, connectionName)
+			return nil
+		}
+	}
+	if alive {
+		if cleaner.gracePeriod > 0 {
+			if _, err := backend.del(staleKey); err != nil { // it came back
+				return cleaner.hooks.failed("grace period", cleanErr(err))
+			}
+		}
+		return nil // skip active connections!
+	}
+	if cleaner.gracePeriod > 0 {
+		expired, err := cleaner.graceExpired(staleKey)
+		if err != nil {
+			return cleaner.hooks.failed("grace period", cleanErr(err))
+		}
+		if !expired {
+			report.Grace++
+			return nil
+		}
 	}
 
+	connectionReport, err := cleaner.cleanLocked(connection, false)
+	report.Returned += connectionReport.Returned
+	report.Keys += connectionReport.Keys
+	if err == errLockNotHeld {
+		report.Locked++
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	report.Connections++
+
+	deleted, err := backend.del(staleKey, connection.heartbeatKey)
+	if err != nil {
+		return cleaner.hooks.failed("delete keys", cleanErr(err))
+	}
+	report.Keys += int(deleted)
 	return nil
 }
 
-// CleanConnection calls CleanQueue on any queues marked open by a passed in connection.
-// If connection is nil, the connection held by the Cleaner will be cleaned.
-func (cleaner *Cleaner) CleanConnection(connection *RedisConnection) error {
-	if connection == nil {
-		connection = cleaner.connection
+// pruneQueues removes unused empty queues from the list of queues and returns
+// their names
+func (cleaner *Cleaner) pruneQueues() (pruned []string, err error) {
+	redisClient := cleaner.connection.redisClient
+	backend := cleaner.connection.backend
+	queueNames, err := backend.members(queuesKey)
+	if err != nil {
+		return nil, err
 	}
-	queueNames := connection.GetConsumingQueues()
+	connectionNames, err := backend.members(connectionsKey)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
 	for _, queueName := range queueNames {
-		queue, ok := connection.OpenQueue(queueName).(*redisQueue)
-		if !ok {
-			return fmt.Errorf("rmq cleaner failed to open queue %s", queueName)
+		unused, err := cleaner.unusedQueue(queueName, connectionNames, now)
+		if err != nil {
+			return pruned, err
+		}
+		if !unused {
+			continue
+		}
+		if isStream, err := backend.isMember(streamQueuesKey, queueName); err != nil || isStream {
+			if err != nil {
+				return pruned, err
+			}
+			continue
 		}
 
-		cleaner.CleanQueue(queue)
+		if _, err := backend.removeMember(queuesKey, queueName); err != nil {
+			return pruned, err
+		}
+		// a publisher might have used it in the meantime
+		empty, emptyErr := cleaner.emptyQueue(queueName)
+		if emptyErr != nil || !empty {
+			if _, err := backend.addMember(queuesKey, queueName); err != nil {
+				return pruned, err
+			}
+			if emptyErr != nil {
+				return pruned, emptyErr
+			}
+			continue
+		}
+		for _, key := range []string{queuesActivityKey, pushQueuesKey} {
+			if err := redisErr(redisClient.HDel(key, queueName)); err != nil {
+				return pruned, err
+			}
+		}
+		pruned = append(pruned, queueName)
 	}
+	return pruned, nil
+}
 
-	if !connection.Close() {
-		return fmt.Errorf("rmq cleaner failed to close connection %s", connection)
+// reclaimStreams reclaims the idle entries of all stream queues, see
+// SetStreamMinIdle(), and returns how many it reclaimed
+func (cleaner *Cleaner) reclaimStreams() (reclaimed int, err error) {
+	minIdle := cleaner.minIdle
+	if minIdle < 0 {
+		return 0, nil
+	}
+	if minIdle == 0 {
+		minIdle = defaultStreamMinIdle
 	}
 
-	if err := connection.CloseAllQueuesInConnection(); err != nil {
-		return fmt.Errorf("rmq cleaner failed to close all queues %s %s", connection.String(), err)
+	queueNames, err := cleaner.connection.backend.members(streamQueuesKey)
+	if err != nil {
+		return 0, err
+	}
+	for _, queueName := range queueNames {
+		streamKey, _ := streamQueueKeys(queueName)
+		queueReclaimed, err := reclaimIdle(cleaner.connection.redisClient, streamKey, cleaner.connection.Name, minIdle)
+		reclaimed += queueReclaimed
+		if err != nil {
+			return reclaimed, err
+		}
+	}
+	return reclaimed, nil
+}
+
+// unusedQueue returns true if the queue with the given name is empty, isn't
+// consumed by any of the connections and wasn't active for the retention
+func (cleaner *Cleaner) unusedQueue(queueName string, connectionNames []string, now int64) (bool, error) {
+	redisClient := cleaner.connection.redisClient
+	activity := redisClient.HGet(queuesActivityKey, queueName)
+	if err := redisErr(activity); err != nil {
+		return false, err
+	}
+	last, err := activity.Int64()
+	if err != nil { // not tracked yet
+		return false, redisErr(redisClient.HSetNX(queuesActivityKey, queueName, now))
+	}
+	if time.Duration(now-last)*time.Millisecond < cleaner.retention {
+		return false, nil
 	}
 
+	if empty, err := cleaner.emptyQueue(queueName); err != nil || !empty {
+		return false, err
+	}
+
+	results, err := redisClient.Pipelined(func(pipe *redis.Pipeline) error {
+		for _, connectionName := range connectionNames {
+			pipe.SIsMember(strings.Replace(connectionQueuesTemplate, phConnection, connectionName, 1), queueName)
+		}
+		return nil
+	})
+	if err := pipelineErr(err); err != nil {
+		return false, err
+	}
+	for _, result := range results {
+		consumed, ok := result.(*redis.BoolCmd)
+		if !ok || redisErr(result) != nil {
+			return false, redisErr(result)
+		}
+		if consumed.Val() {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// emptyQueue returns true if the queue with the given name has no ready,
+// rejected or delayed deliveries
+func (cleaner *Cleaner) emptyQueue(queueName string) (bool, error) {
+	results, err := cleaner.connection.redisClient.Pipelined(func(pipe *redis.Pipeline) error {
+		pipe.Exists(strings.Replace(queueReadyTemplate, phQueue, queueName, 1))
+		pipe.Exists(strings.Replace(queueRejectedTemplate, phQueue, queueName, 1))
+		pipe.Exists(strings.Replace(queueDelayedTemplate, phQueue, queueName, 1))
+		return nil
+	})
+	if err := pipelineErr(err); err != nil {
+		return false, err
+	}
+	for _, result := range results {
+		exists, ok := result.(*redis.BoolCmd)
+		if !ok || redisErr(result) != nil {
+			return false, redisErr(result)
+		}
+		if exists.Val() {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// isProtected returns true if the connection with the given name matches a
+// protected pattern or protected itself
+func (cleaner *Cleaner) isProtected(connectionName string) (bool, error) {
+	for _, pattern := range cleaner.protected {
+		if matched, _ := path.Match(pattern, connectionName); matched {
+			return true, nil
+		}
+	}
+
+	protectedKey := strings.Replace(connectionProtectedTemplate, phConnection, connectionName, 1)
+	result := cleaner.connection.redisClient.Exists(protectedKey)
+	if err := redisErr(result); err != nil {
+		return false, cleaner.hooks.failed("check protection", cleanErr(err))
+	}
+	return result.Val(), nil
+}
+
+// alive returns true if the connection has a heartbeat
+func (cleaner *Cleaner) alive(connection *RedisConnection) (bool, error) {
+	ttl, err := connection.backend.ttl(connection.heartbeatKey)
+	if err != nil {
+		return false, cleaner.hooks.failed("check heartbeat", cleanErr(err))
+	}
+	return ttl > 0, nil
+}
+
+// graceExpired returns true if the connection of staleKey was first seen
+// without heartbeat at least the grace period ago, remembering now as that
+// time if it's the first time
+func (cleaner *Cleaner) graceExpired(staleKey string) (bool, error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	redisClient := cleaner.connection.redisClient
+	first := redisClient.SetNX(staleKey, now, 0)
+	if err := redisErr(first); err != nil {
+		return false, err
+	}
+	if first.Val() {
+		return false, nil // first seen dead just now
+	}
+
+	result := redisClient.Get(staleKey)
+	if err := redisErr(result); err != nil {
+		return false, err
+	}
+	since, err := result.Int64()
+	if err != nil {
+		return false, nil
+	}
+	return time.Duration(now-since)*time.Millisecond >= cleaner.gracePeriod, nil
+}
+
+// Run cleans every interval (with some jitter) until ctx is done. After
+// failed cleans it backs off exponentially up to five minutes, so it doesn't
+// spin while Redis is down. See SetOnClean to get each clean's report
+func (cleaner *Cleaner) Run(ctx context.Context, interval time.Duration) {
+	failures := 0
+	for {
+		report, err := cleaner.safeClean()
+		if err != nil {
+			failures++
+		} else {
+			failures = 0
+		}
+		if cleaner.onClean != nil {
+			cleaner.onClean(report, err)
+		}
+
+		timer := time.NewTimer(cleanWait(interval, failures))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// safeClean is like CleanWithReport, but returns Redis errors instead of
+// panicking
+func (cleaner *Cleaner) safeClean() (report CleanReport, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("rmq cleaner failed to clean: %v", r)
+			cleaner.statsMutex.Lock()
+			cleaner.stats.Runs++
+			cleaner.stats.Errors++
+			cleaner.statsMutex.Unlock()
+		}
+	}()
+	return cleaner.CleanWithReport()
+}
+
+// cleanWait returns how long Run waits before the next clean, after the given
+// number of consecutive failed cleans
+func cleanWait(interval time.Duration, failures int) time.Duration {
+	wait := interval
+	for i := 0; i < failures && wait < maxCleanBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxCleanBackoff {
+		wait = maxCleanBackoff
+	}
+	if jitter := int64(wait / 5); jitter > 0 {
+		wait += time.Duration(rand.Int63n(jitter)) // up to 20%
+	}
+	return wait
+}
+
+// errLockNotHeld is returned by cleanLocked if another cleaner holds or took
+// over the lock of the connection
+var errLockNotHeld = errors.New("rmq cleaner lock not held")
+
+// cleanLocked cleans the connection while holding its lock, if locking is
+// enabled. Returns errLockNotHeld if the lock couldn't be acquired or got
+// lost while cleaning
+func (cleaner *Cleaner) cleanLocked(connection *RedisConnection, force bool) (report ConnectionCleanReport, err error) {
+	if cleaner.lockTTL <= 0 {
+		return cleaner.cleanConnection(connection, nil, force)
+	}
+
+	backend := cleaner.connection.backend
+	lockKey := strings.Replace(connectionCleaningTemplate, phConnection, connection.Name, 1)
+	token := cleaner.connection.Name + "-" + uniuri.NewLen(6)
+	locked, err := backend.lock(lockKey, token, cleaner.lockTTL)
+	if err != nil {
+		return report, cleaner.hooks.failed("lock", cleanErr(err))
+	}
+	if !locked {
+		return report, errLockNotHeld
+	}
+	defer backend.unlock(lockKey, token)
+
+	var lost int32
+	stopRenewing := make(chan struct{})
+	defer close(stopRenewing)
+	renewInterval := cleaner.lockTTL / 3
+	if renewInterval < time.Millisecond {
+		renewInterval = time.Millisecond
+	}
+	go func() {
+		ticker := time.NewTicker(renewInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopRenewing:
+				return
+			case <-ticker.C:
+			}
+			if renewed, err := backend.renewLock(lockKey, token, cleaner.lockTTL); err != nil || !renewed {
+				atomic.StoreInt32(&lost, 1)
+				return
+			}
+		}
+	}()
+
+	return cleaner.cleanConnection(connection, func() bool { return atomic.LoadInt32(&lost) == 0 }, force)
+}
+
+// ConnectionCleanReport describes what cleaner.CleanConnection() did
+type ConnectionCleanReport struct {
+	Queues   map[string]int // number of returned unacked deliveries by queue name
+	Returned int            // number of returned unacked deliveries in total
+	Keys     int            // number of deleted keys of the connection
+}
+
+// CleanConnection cleans the connection with the given name right away,
+// without waiting for the next clean of all connections: It returns the
+// unacked deliveries of all its queues back to ready, removes it from the
+// list of connections and deletes its keys. Returns ErrConnectionAlive if the
+// connection still has a heartbeat. Protection and the grace period are
+// ignored
+func (cleaner *Cleaner) CleanConnection(name string) (ConnectionCleanReport, error) {
+	return cleaner.cleanNamed(name, false)
+}
+
+// ForceCleanConnection is like CleanConnection but also cleans connections
+// which still have a heartbeat. Deliveries they are still working on might
+// get consumed twice then
+func (cleaner *Cleaner) ForceCleanConnection(name string) (ConnectionCleanReport, error) {
+	return cleaner.cleanNamed(name, true)
+}
+
+func (cleaner *Cleaner) cleanNamed(name string, force bool) (report ConnectionCleanReport, err error) {
+	connection := cleaner.connection.hijackConnection(name)
+	if !force {
+		alive, err := cleaner.alive(connection)
+		if err != nil {
+			return report, err
+		}
+		if alive {
+			return report, ErrConnectionAlive
+		}
+	}
+
+	report, err = cleaner.cleanLocked(connection, force)
+	if err == errLockNotHeld {
+		return report, ErrConnectionLocked
+	}
+	if err != nil {
+		return report, err
+	}
+
+	staleKey := strings.Replace(connectionStaleTemplate, phConnection, name, 1)
+	protectedKey := strings.Replace(connectionProtectedTemplate, phConnection, name, 1)
+	deleted, err := cleaner.connection.backend.del(staleKey, connection.heartbeatKey, protectedKey)
+	if err != nil {
+		return report, cleaner.hooks.failed("delete keys", cleanErr(err))
+	}
+	report.Keys += int(deleted)
+	return report, nil
+}
+
+// cleanConnection cleans the connection and returns the number of returned
+// unacked deliveries and deleted keys. Only keys of the connection get
+// deleted, never the ready or rejected lists of its queues. If held isn't nil
+// it's checked before each step and the clean is given up with
+// errLockNotHeld once it returns false. Unless force is set the clean fails
+// with ErrConnectionBusy if the connection got a heartbeat again meanwhile
+func (cleaner *Cleaner) cleanConnection(connection *RedisConnection, held func() bool, force bool) (report ConnectionCleanReport, err error) {
+	queueNames, err := connection.backend.members(connection.queuesKey)
+	if err != nil {
+		return report, cleaner.hooks.failed("list queues", cleanErr(err))
+	}
+
+	report.Queues = make(map[string]int, len(queueNames))
+	for _, queueName := range queueNames {
+		if held != nil && !held() {
+			return report, errLockNotHeld
+		}
+		if _, err := connection.backend.addMember(queuesKey, queueName); err != nil {
+			return report, cleaner.hooks.failed("open queue", cleanErr(err))
+		}
+		queue := connection.openQueue(queueName)
+
+		queueReturned, queueKeys, err := cleaner.cleanQueue(queue)
+		report.Returned += queueReturned
+		report.Keys += queueKeys
+		if err != nil {
+			return report, cleaner.hooks.failed("return unacked", cleanErr(err))
+		}
+		report.Queues[queueName] = queueReturned
+		cleaner.hooks.queueReturned(connection.Name, queueName, queueReturned)
+	}
+
+	if held != nil && !held() {
+		return report, errLockNotHeld
+	}
+	if !force {
+		alive, err := cleaner.alive(connection)
+		if err != nil {
+			return report, err
+		}
+		if alive {
+			return report, cleaner.hooks.failed("close connection", ErrConnectionBusy)
+		}
+	}
+
+	if _, err := connection.backend.removeMember(connectionsKey, connection.Name); err != nil {
+		return report, cleaner.hooks.failed("close connection", cleanErr(err))
+	}
+
+	deleted, err := connection.backend.del(connection.queuesKey)
+	if err != nil {
+		return report, cleaner.hooks.failed("close queues", cleanErr(err))
+	}
+	report.Keys += int(deleted)
+
 	// log.Printf("rmq cleaner cleaned connection %s", connection)
-	return nil
+	cleaner.hooks.connectionCleaned(connection.Name, report.Queues)
+	return report, nil
 }
 
 // CleanQueue returns all unacknowledged messages in the provided queue back to
 // the ready queue.
 func (cleaner *Cleaner) CleanQueue(queue *redisQueue) {
-	returned := queue.ReturnAllUnacked()
-	queue.CloseInConnection()
-	_ = returned
+	if _, _, err := cleaner.cleanQueue(queue); err != nil {
+		log.Panicf("rmq cleaner failed to return unacked deliveries %s %s", queue, err)
+	}
+}
+
+// cleanQueue returns the unacked deliveries of the queue of a dead connection
+// in batches, each one atomically in a script
+func (cleaner *Cleaner) cleanQueue(queue *redisQueue) (returned, keys int, err error) {
+	if queue.consumersActive() {
+		return 0, 0, ErrConsumersActive
+	}
+	returned, err = queue.returnAllUnacked(func(returned int) {
+		cleaner.hooks.returnProgress(queue.connectionName, queue.name, returned)
+	})
+	if err != nil {
+		return returned, 0, err
+	}
+	// the connection's set of queues gets deleted as a whole once all its
+	// queues are cleaned, so it's counted as a deleted key then
+	keys, err = queue.deleteConnectionKeys()
 	// log.Printf("rmq cleaner cleaned queue %s %d", queue, returned)
+	return returned, keys, err
 }
@@ -0,0 +1,84 @@
+package rmq
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrRedisUnavailable is wrapped by cleaner errors caused by Redis not
+	// being reachable, so cleaning again later is likely to succeed
+	ErrRedisUnavailable = errors.New("rmq redis unavailable")
+
+	// ErrConnectionBusy is wrapped by cleaner errors for connections whose
+	// heartbeat came back while they were being cleaned. The deliveries
+	// returned so far might get consumed twice
+	ErrConnectionBusy = errors.New("rmq connection came back while cleaning")
+
+	// ErrConnectionAlive is returned by cleaner.CleanConnection() for
+	// connections which still have a heartbeat
+	ErrConnectionAlive = errors.New("rmq connection is alive")
+
+	// ErrConnectionLocked is returned by cleaner.CleanConnection() if another
+	// cleaner is cleaning the connection
+	ErrConnectionLocked = errors.New("rmq connection is being cleaned by another cleaner")
+
+	// ErrPartialClean is matched by the PartialCleanError returned by
+	// cleaner.Clean() if some connections couldn't be cleaned
+	ErrPartialClean = errors.New("rmq cleaner failed to clean some connections")
+)
+
+// ConnectionCleanError is the error of cleaning a single connection
+type ConnectionCleanError struct {
+	Connection string
+	Err        error
+}
+
+func (err *ConnectionCleanError) Error() string {
+	return fmt.Sprintf("rmq cleaner failed to clean connection %s: %s", err.Connection, err.Err)
+}
+
+func (err *ConnectionCleanError) Unwrap() error {
+	return err.Err
+}
+
+// PartialCleanError is returned by cleaner.Clean() if some connections
+// couldn't be cleaned, the other connections were cleaned anyway. It matches
+// ErrPartialClean as well as the errors of its connections
+type PartialCleanError struct {
+	Connections []*ConnectionCleanError
+}
+
+func (err *PartialCleanError) Error() string {
+	messages := make([]string, len(err.Connections))
+	for i, connectionErr := range err.Connections {
+		messages[i] = connectionErr.Error()
+	}
+	return fmt.Sprintf("%s: %s", ErrPartialClean, strings.Join(messages, "; "))
+}
+
+func (err *PartialCleanError) Is(target error) bool {
+	return target == ErrPartialClean
+}
+
+func (err *PartialCleanError) Unwrap() []error {
+	errs := make([]error, len(err.Connections))
+	for i, connectionErr := range err.Connections {
+		errs[i] = connectionErr
+	}
+	return errs
+}
+
+// cleanErr wraps Redis errors which mean that Redis isn't reachable with
+// ErrRedisUnavailable
+func cleanErr(err error) error {
+	if err == nil || errors.Is(err, ErrRedisUnavailable) {
+		return err
+	}
+
+	if unreachable(err) {
+		return fmt.Errorf("%w: %w", ErrRedisUnavailable, err)
+	}
+	return err
+}
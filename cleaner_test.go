@@ -1,6 +1,10 @@
 package rmq
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
 	"testing"
 	"time"
 
@@ -11,14 +15,48 @@ func TestCleanerSuite(t *testing.T) {
 	TestingSuiteT(&CleanerSuite{}, t)
 }
 
+func TestCleanWait(t *testing.T) {
+	if wait := cleanWait(time.Second, 0); wait < time.Second || wait >= 1200*time.Millisecond {
+		t.Error("unexpected wait without failures", wait)
+	}
+	if wait := cleanWait(time.Second, 3); wait < 8*time.Second || wait >= 9600*time.Millisecond {
+		t.Error("unexpected wait after failures", wait)
+	}
+	if wait := cleanWait(time.Second, 100); wait < maxCleanBackoff || wait >= maxCleanBackoff*6/5 {
+		t.Error("unexpected wait after many failures", wait)
+	}
+}
+
+func TestCleanerErrors(t *testing.T) {
+	unavailable := cleanErr(io.EOF)
+	if !errors.Is(unavailable, ErrRedisUnavailable) || !errors.Is(unavailable, io.EOF) {
+		t.Error("EOF should mean Redis is unavailable", unavailable)
+	}
+	if other := errors.New("WRONGTYPE"); cleanErr(other) != other {
+		t.Error("other errors should be kept")
+	}
+
+	err := error(&PartialCleanError{Connections: []*ConnectionCleanError{
+		{Connection: "conn-1", Err: unavailable},
+		{Connection: "conn-2", Err: ErrConnectionBusy},
+	}})
+	if !errors.Is(err, ErrPartialClean) || !errors.Is(err, ErrRedisUnavailable) || !errors.Is(err, ErrConnectionBusy) {
+		t.Error("partial clean error should match its connection errors", err)
+	}
+	var connectionErr *ConnectionCleanError
+	if !errors.As(err, &connectionErr) || connectionErr.Connection != "conn-1" {
+		t.Error("partial clean error should unwrap to connection errors", err)
+	}
+}
+
 type CleanerSuite struct{}
 
 func (suite *CleanerSuite) TestCleaner(c *C) {
-	flushConn := OpenConnection("cleaner-flush", "localhost:6379", 1)
+	flushConn := OpenConnection("cleaner-flush", testRedisAddr, 1)
 	flushConn.flushDb()
 	flushConn.StopHeartbeat()
 
-	conn := OpenConnection("cleaner-conn1", "localhost:6379", 1)
+	conn := OpenConnection("cleaner-conn1", testRedisAddr, 1)
 	c.Check(conn.GetOpenQueues(), HasLen, 0)
 	queue := conn.OpenQueue("q1").(*redisQueue)
 	c.Check(conn.GetOpenQueues(), HasLen, 1)
@@ -71,7 +109,7 @@ func (suite *CleanerSuite) TestCleaner(c *C) {
 	conn.StopHeartbeat()
 	time.Sleep(time.Millisecond)
 
-	conn = OpenConnection("cleaner-conn1", "localhost:6379", 1)
+	conn = OpenConnection("cleaner-conn1", testRedisAddr, 1)
 	queue = conn.OpenQueue("q1").(*redisQueue)
 
 	queue.Publish("del7")
@@ -118,13 +156,13 @@ func (suite *CleanerSuite) TestCleaner(c *C) {
 
 	// TODO: come back and fix this test
 
-	// cleanerConn := OpenConnection("cleaner-conn", "localhost:6379", 1)
+	// cleanerConn := OpenConnection("cleaner-conn", testRedisAddr, 1)
 	// cleaner := NewCleaner(cleanerConn)
 	// c.Check(cleaner.Clean(), IsNil)
 	// c.Check(queue.ReadyCount(), Equals, 9) // 2 of 11 were acked above
 	// c.Check(conn.GetOpenQueues(), HasLen, 2)
 	//
-	// conn = OpenConnection("cleaner-conn1", "localhost:6379", 1)
+	// conn = OpenConnection("cleaner-conn1", testRedisAddr, 1)
 	// queue = conn.OpenQueue("q1").(*redisQueue)
 	// queue.StartConsuming(10, time.Millisecond)
 	// consumer = NewTestConsumer("c-C")
@@ -140,3 +178,282 @@ func (suite *CleanerSuite) TestCleaner(c *C) {
 	// c.Check(cleaner.Clean(), IsNil)
 	// cleanerConn.StopHeartbeat()
 }
+
+func (suite *CleanerSuite) TestRun(c *C) {
+	conn := OpenConnection("cleaner-run-conn", testRedisAddr, 1)
+	queue := conn.OpenQueue("cleaner-run-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.Publish("cleaner-run-d1")
+	queue.StartConsuming(1, time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	c.Check(queue.UnackedCount(), Equals, 1)
+	queue.StopConsuming()
+	conn.StopHeartbeat()
+
+	reports := make(chan CleanReport, 10)
+	cleanerConn := OpenConnection("cleaner-run", testRedisAddr, 1)
+	cleanerConn.StartCleaner(time.Millisecond, func(report CleanReport, err error) {
+		c.Check(err, IsNil)
+		reports <- report
+	})
+	report := <-reports
+	c.Check(report.Connections >= 1, Equals, true)
+	c.Check(report.Returned >= 1, Equals, true)
+	c.Check(queue.ReadyCount(), Equals, 1)
+
+	cleanerConn.StopHeartbeat()
+	queue.PurgeReady()
+}
+
+func (suite *CleanerSuite) TestGracePeriod(c *C) {
+	flushConn := OpenConnection("cleaner-flush", testRedisAddr, 1)
+	flushConn.flushDb()
+	flushConn.StopHeartbeat()
+
+	conn := OpenConnection("cleaner-grace-conn", testRedisAddr, 1)
+	queue := conn.OpenQueue("cleaner-grace-q").(*redisQueue)
+	queue.Publish("cleaner-grace-d1")
+	queue.StartConsuming(1, time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	queue.StopConsuming()
+	conn.StopHeartbeat()
+	conn.redisClient.Del(conn.heartbeatKey) // let it die right away
+
+	cleanerConn := OpenConnection("cleaner-grace", testRedisAddr, 1)
+	cleaner := NewCleaner(cleanerConn)
+	cleaner.SetGracePeriod(20 * time.Millisecond)
+
+	report, err := cleaner.CleanWithReport()
+	c.Check(err, IsNil)
+	c.Check(report, DeepEquals, CleanReport{Grace: 1})
+	c.Check(queue.UnackedCount(), Equals, 1)
+
+	time.Sleep(25 * time.Millisecond)
+	report, err = cleaner.CleanWithReport()
+	c.Check(err, IsNil)
+	c.Check(report, DeepEquals, CleanReport{Connections: 1, Returned: 1, Keys: 2})
+	c.Check(queue.ReadyCount(), Equals, 1)
+
+	cleanerConn.StopHeartbeat()
+	queue.PurgeReady()
+}
+
+func (suite *CleanerSuite) TestLocking(c *C) {
+	flushConn := OpenConnection("cleaner-flush", testRedisAddr, 1)
+	flushConn.flushDb()
+	flushConn.StopHeartbeat()
+
+	conn := OpenConnection("cleaner-lock-conn", testRedisAddr, 1)
+	queue := conn.OpenQueue("cleaner-lock-q").(*redisQueue)
+	queue.Publish("cleaner-lock-d1")
+	queue.StartConsuming(1, time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	queue.StopConsuming()
+	conn.StopHeartbeat()
+	conn.redisClient.Del(conn.heartbeatKey) // let it die right away
+
+	cleanerConn := OpenConnection("cleaner-lock", testRedisAddr, 1)
+	cleaner := NewCleaner(cleanerConn)
+	cleaner.SetLocking(time.Second)
+
+	lockKey := strings.Replace(connectionCleaningTemplate, phConnection, conn.Name, 1)
+	cleanerConn.redisClient.Set(lockKey, "other-cleaner", time.Second)
+	report, err := cleaner.CleanWithReport()
+	c.Check(err, IsNil)
+	c.Check(report, DeepEquals, CleanReport{Locked: 1})
+	c.Check(queue.UnackedCount(), Equals, 1)
+
+	cleanerConn.redisClient.Del(lockKey)
+	report, err = cleaner.CleanWithReport()
+	c.Check(err, IsNil)
+	c.Check(report, DeepEquals, CleanReport{Connections: 1, Returned: 1, Keys: 1})
+	stats := cleaner.Stats()
+	c.Check(stats.Runs, Equals, int64(2))
+	c.Check(stats.Connections, Equals, int64(1))
+	c.Check(stats.Returned, Equals, int64(1))
+	c.Check(stats.Errors, Equals, int64(0))
+	c.Check(stats.LastRunDuration > 0, Equals, true)
+	c.Check(queue.ReadyCount(), Equals, 1)
+	c.Check(cleanerConn.redisClient.Exists(lockKey).Val(), Equals, false)
+
+	cleanerConn.StopHeartbeat()
+	queue.PurgeReady()
+}
+
+func (suite *CleanerSuite) TestHooks(c *C) {
+	flushConn := OpenConnection("cleaner-flush", testRedisAddr, 1)
+	flushConn.flushDb()
+	flushConn.StopHeartbeat()
+
+	conn := OpenConnection("cleaner-hooks-conn", testRedisAddr, 1)
+	queue := conn.OpenQueue("cleaner-hooks-q").(*redisQueue)
+	queue.Publish("cleaner-hooks-d1")
+	queue.StartConsuming(1, time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	queue.StopConsuming()
+	conn.StopHeartbeat()
+	conn.redisClient.Del(conn.heartbeatKey) // let it die right away
+
+	var cleaned map[string]int
+	var progress []int
+	returned := 0
+	cleanerConn := OpenConnection("cleaner-hooks", testRedisAddr, 1)
+	cleaner := NewCleaner(cleanerConn)
+	cleaner.SetHooks(CleanerHooks{
+		OnQueueReturned: func(connection, queue string, count int) {
+			returned += count
+			panic("hooks must not abort cleans")
+		},
+		OnReturnProgress: func(connection, queue string, returned int) {
+			progress = append(progress, returned)
+		},
+		OnConnectionCleaned: func(name string, queues map[string]int) {
+			c.Check(name, Equals, conn.Name)
+			cleaned = queues
+		},
+	})
+
+	report, err := cleaner.CleanWithReport()
+	c.Check(err, IsNil)
+	c.Check(report.Connections, Equals, 1)
+	c.Check(report.Keys, Equals, 1) // the connection's queues set
+	c.Check(cleanerConn.redisClient.Keys("rmq::connection::"+conn.Name+"::*").Val(), HasLen, 0)
+	c.Check(returned, Equals, 1)
+	c.Check(cleaned, DeepEquals, map[string]int{"cleaner-hooks-q": 1})
+	c.Check(progress, DeepEquals, []int{1})
+
+	cleanerConn.StopHeartbeat()
+	queue.PurgeReady()
+}
+
+func (suite *CleanerSuite) TestPruneQueues(c *C) {
+	flushConn := OpenConnection("cleaner-flush", testRedisAddr, 1)
+	flushConn.flushDb()
+	flushConn.StopHeartbeat()
+
+	conn := OpenConnection("cleaner-prune-conn", testRedisAddr, 1)
+	conn.OpenQueue("cleaner-prune-empty-q")
+	conn.OpenQueue("cleaner-prune-full-q").Publish("cleaner-prune-d1")
+	conn.OpenQueue("cleaner-prune-fresh-q")
+	consumed := conn.OpenQueue("cleaner-prune-consumed-q")
+	consumed.StartConsuming(1, time.Millisecond)
+	old := time.Now().Add(-time.Hour).UnixNano() / int64(time.Millisecond)
+	for _, queueName := range []string{"cleaner-prune-empty-q", "cleaner-prune-full-q", "cleaner-prune-consumed-q"} {
+		conn.redisClient.HSet(queuesActivityKey, queueName, old)
+	}
+	conn.redisClient.SAdd(queuesKey, "cleaner-prune-untracked-q")
+
+	cleaner := NewCleaner(conn)
+	cleaner.SetPruneQueues(time.Minute)
+	report, err := cleaner.CleanWithReport()
+	c.Check(err, IsNil)
+	c.Check(report.Pruned, DeepEquals, []string{"cleaner-prune-empty-q"})
+	c.Check(conn.redisClient.SIsMember(queuesKey, "cleaner-prune-empty-q").Val(), Equals, false)
+	c.Check(conn.GetOpenQueues(), HasLen, 4)
+	c.Check(conn.redisClient.HExists(queuesActivityKey, "cleaner-prune-untracked-q").Val(), Equals, true)
+
+	consumed.StopConsuming()
+	conn.StopHeartbeat()
+}
+
+func (suite *CleanerSuite) TestProtect(c *C) {
+	flushConn := OpenConnection("cleaner-flush", testRedisAddr, 1)
+	flushConn.flushDb()
+	flushConn.StopHeartbeat()
+
+	batchConn := OpenConnection("batch-aggregator", testRedisAddr, 1)
+	selfConn := OpenConnection("cleaner-protect-self", testRedisAddr, 1)
+	selfConn.SetProtected(true)
+	for _, conn := range []*RedisConnection{batchConn, selfConn} {
+		conn.StopHeartbeat()
+		conn.redisClient.Del(conn.heartbeatKey) // let it die right away
+	}
+
+	cleanerConn := OpenConnection("cleaner-protect", testRedisAddr, 1)
+	cleaner := NewCleaner(cleanerConn)
+	c.Check(cleaner.Protect("["), NotNil)
+	c.Check(cleaner.Protect("batch-aggregator-*"), IsNil)
+
+	report, err := cleaner.CleanWithReport()
+	c.Check(err, IsNil)
+	c.Check(report.Connections, Equals, 0)
+	c.Check(report.Protected, HasLen, 2)
+	c.Check(cleanerConn.GetConnections(), HasLen, 3)
+
+	selfConn.SetProtected(false)
+	report, err = cleaner.CleanWithReport()
+	c.Check(err, IsNil)
+	c.Check(report.Connections, Equals, 1)
+	c.Check(report.Protected, DeepEquals, []string{batchConn.Name})
+
+	cleanerConn.StopHeartbeat()
+}
+
+func (suite *CleanerSuite) TestConcurrency(c *C) {
+	flushConn := OpenConnection("cleaner-flush", testRedisAddr, 1)
+	flushConn.flushDb()
+	flushConn.StopHeartbeat()
+
+	for i := 0; i < 4; i++ {
+		conn := OpenConnection(fmt.Sprintf("cleaner-concurrency-%d", i), testRedisAddr, 1)
+		queue := conn.OpenQueue("concurrency-q").(*redisQueue)
+		queue.Publish("c1")
+		queue.Publish("c2")
+		queue.StartConsuming(10, time.Millisecond)
+		time.Sleep(10 * time.Millisecond)
+		c.Check(queue.UnackedCount(), Equals, 2)
+		queue.StopConsuming() // so the returned deliveries stay ready
+		time.Sleep(10 * time.Millisecond)
+		conn.StopHeartbeat()
+		conn.redisClient.Del(conn.heartbeatKey) // let it die right away
+	}
+
+	cleanerConn := OpenConnection("cleaner-concurrency", testRedisAddr, 1)
+	queue := cleanerConn.OpenQueue("concurrency-q").(*redisQueue)
+	cleaner := NewCleaner(cleanerConn)
+	cleaner.SetConcurrency(3)
+
+	report, err := cleaner.CleanWithReport()
+	c.Check(err, IsNil)
+	c.Check(report.Connections, Equals, 4)
+	c.Check(report.Returned, Equals, 8)
+	c.Check(queue.ReadyCount(), Equals, 8)
+	c.Check(cleanerConn.GetConnections(), HasLen, 1)
+
+	cleanerConn.StopHeartbeat()
+}
+
+func (suite *CleanerSuite) TestCleanConnection(c *C) {
+	flushConn := OpenConnection("cleaner-flush", testRedisAddr, 1)
+	flushConn.flushDb()
+	flushConn.StopHeartbeat()
+
+	conn := OpenConnection("cleaner-targeted", testRedisAddr, 1)
+	queue := conn.OpenQueue("targeted-q").(*redisQueue)
+	queue.Publish("t1")
+	queue.Publish("t2")
+	queue.StartConsuming(10, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queue.UnackedCount(), Equals, 2)
+	queue.StopConsuming()
+	time.Sleep(10 * time.Millisecond)
+
+	cleanerConn := OpenConnection("cleaner-targeted-cleaner", testRedisAddr, 1)
+	cleaner := NewCleaner(cleanerConn)
+
+	report, err := cleaner.CleanConnection(conn.Name)
+	c.Check(err, Equals, ErrConnectionAlive)
+	c.Check(report.Returned, Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 2)
+
+	report, err = cleaner.ForceCleanConnection(conn.Name)
+	c.Check(err, IsNil)
+	c.Check(report.Returned, Equals, 2)
+	c.Check(report.Queues, DeepEquals, map[string]int{"targeted-q": 2})
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 2)
+	c.Check(cleanerConn.GetConnections(), HasLen, 1)
+
+	conn.StopHeartbeat()
+	cleanerConn.StopHeartbeat()
+}
@@ -0,0 +1,57 @@
+package rmq
+
+import "time"
+
+// Clock is the source of time of a connection and its queues, see
+// connection.SetClock(). It's used for heartbeats, poll sleeps, visibility
+// and retry deadlines and the deadline hook of consumers. rmqtest.FakeClock
+// is a clock tests can advance by hand
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a timer started by Clock.AfterFunc()
+type Timer interface {
+	Stop() bool
+}
+
+// Ticker is a ticker started by Clock.NewTicker()
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// systemClock is the default Clock using the time package
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (ticker systemTicker) C() <-chan time.Time {
+	return ticker.Ticker.C
+}
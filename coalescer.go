@@ -0,0 +1,143 @@
+package rmq
+
+import (
+	"sync"
+	"time"
+)
+
+// ackBufferSize is the number of buffered acks which makes the coalescer
+// flush before its interval passed
+const ackBufferSize = 256
+
+// ackCoalescer buffers the acks of a queue's deliveries and removes them from
+// unacked in one round trip every interval, see queue.SetAckCoalescing()
+type ackCoalescer struct {
+	interval time.Duration
+	clock    Clock
+	done     <-chan struct{} // the connection's, flushes and stops the coalescer
+	stop     chan struct{}   // closed to flush and stop the coalescer
+	full     chan struct{}   // wakes the flusher once ackBufferSize acks are buffered
+	flushed  chan struct{}   // closed once the flusher stopped
+
+	flushMutex sync.Mutex // held while flushing, so FlushAcks() waits for a running flush
+	mutex      sync.Mutex
+	pending    []*wrapDelivery
+	stopped    bool
+}
+
+func newAckCoalescer(interval time.Duration, clock Clock, done <-chan struct{}) *ackCoalescer {
+	return &ackCoalescer{
+		interval: interval,
+		clock:    clock,
+		done:     done,
+		stop:     make(chan struct{}),
+		full:     make(chan struct{}, 1),
+		flushed:  make(chan struct{}),
+	}
+}
+
+// add buffers the ack of a delivery settled as acked. Returns false if the
+// coalescer stopped, the delivery must be acked right away then
+func (coalescer *ackCoalescer) add(delivery *wrapDelivery) bool {
+	coalescer.mutex.Lock()
+	defer coalescer.mutex.Unlock()
+	if coalescer.stopped {
+		return false
+	}
+
+	coalescer.pending = append(coalescer.pending, delivery)
+	if len(coalescer.pending) == ackBufferSize {
+		select {
+		case coalescer.full <- struct{}{}:
+		default: // already woken
+		}
+	}
+	return true
+}
+
+// run flushes the buffered acks every interval until the coalescer or its
+// connection stops, flushing one last time then
+func (coalescer *ackCoalescer) run() {
+	defer close(coalescer.flushed)
+	for {
+		select {
+		case <-coalescer.clock.After(coalescer.interval):
+		case <-coalescer.full:
+		case <-coalescer.stop:
+			coalescer.close()
+			return
+		case <-coalescer.done:
+			coalescer.close()
+			return
+		}
+		coalescer.flush()
+	}
+}
+
+// close makes further acks bypass the coalescer and flushes the buffered ones
+func (coalescer *ackCoalescer) close() {
+	coalescer.mutex.Lock()
+	coalescer.stopped = true
+	coalescer.mutex.Unlock()
+	coalescer.flush()
+}
+
+// flush removes the buffered acks from unacked. Deliveries which couldn't be
+// removed are unacked again and passed to the OnAckFailed hook. Returns the
+// Redis error, if any
+func (coalescer *ackCoalescer) flush() error {
+	coalescer.flushMutex.Lock()
+	defer coalescer.flushMutex.Unlock()
+
+	coalescer.mutex.Lock()
+	pending := coalescer.pending
+	coalescer.pending = nil
+	coalescer.mutex.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	_, failed, err := ackGroup(pending)
+	for _, delivery := range failed {
+		if hook := delivery.hooks.OnAckFailed; hook != nil {
+			if err != nil {
+				hook(delivery, err)
+			} else {
+				hook(delivery, ErrDeliveryNotFound)
+			}
+		}
+	}
+	return err
+}
+
+// SetAckCoalescing makes acks of the queue's deliveries get buffered and
+// removed from unacked in one round trip every interval (or once 256 acks are
+// buffered) instead of one round trip each. delivery.Ack() then returns true
+// once the ack got buffered, acks which fail later roll the delivery back to
+// Unacked and get passed to the OnAckFailed hook. Call FlushAcks() to wait
+// for the buffered acks, e.g. before ReturnAllUnacked(). Stopping the
+// connection flushes them too. Zero flushes and disables coalescing, which
+// is the default. Stream queues don't coalesce acks
+func (queue *redisQueue) SetAckCoalescing(interval time.Duration) {
+	if queue.acks != nil {
+		close(queue.acks.stop)
+		<-queue.acks.flushed
+		queue.acks = nil
+	}
+	if interval > 0 {
+		queue.acks = newAckCoalescer(interval, queue.clock, queue.connectionDone)
+		go queue.acks.run()
+	}
+	queue.resetShared()
+}
+
+// FlushAcks removes the acks buffered by the ack coalescer from unacked and
+// returns once they're removed, see SetAckCoalescing(). Returns the Redis
+// error if flushing failed, the failed acks are passed to the OnAckFailed
+// hook as well
+func (queue *redisQueue) FlushAcks() error {
+	if queue.acks == nil {
+		return nil
+	}
+	return queue.acks.flush()
+}
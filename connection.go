@@ -1,9 +1,13 @@
 package rmq
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"gopkg.in/redis.v5"
@@ -17,6 +21,7 @@ const heartbeatDuration = time.Minute
 type Connection interface {
 	OpenQueue(name string) Queue
 	CollectStats(queueList []string) Stats
+	CollectStatsCtx(ctx context.Context, queueList []string) (Stats, error)
 	GetOpenQueues() []string
 }
 
@@ -24,10 +29,27 @@ type Connection interface {
 // Each connection has a single heartbeat shared among all consumers
 type RedisConnection struct {
 	Name             string
-	heartbeatKey     string // key to keep alive
-	queuesKey        string // key to list of queues consumed by this connection
+	heartbeatKey     string          // key to keep alive
+	queuesKey        string          // key to list of queues consumed by this connection
+	deadKey          string          // key to list of dead lettered deliveries of queues opened afterwards
+	tracer           Tracer          // tracer of queues opened afterwards, nil to disable tracing
+	countersDisabled bool            // whether queues opened afterwards don't count deliveries, see queue.Counters()
+	synchronous      bool            // whether queues opened afterwards consume only on ConsumeOnce(), see SetSynchronous()
+	poller           *sharedPoller   // fetches for queues opened afterwards, nil if they fetch on their own, see SetSharedPoller()
+	pooling          bool            // whether queues opened afterwards recycle deliveries, see SetDeliveryPooling()
+	consuming        consumingQueues // queues which started consuming, see StopAllConsuming()
+	health           healthSampler
+	clock            atomic.Value // Clock, see SetClock()
+	countersMutex    sync.Mutex
+	counters         map[string]*queueCounters // by queue name, shared by all queues opened with the same name
 	redisClient      redis.Cmdable
-	heartbeatStopped bool
+	backend          backend         // the storage of queues opened on the connection, a redisBackend of redisClient
+	positional       bool            // whether queues opened afterwards use LMOVE and LPOS, see ServerInfo()
+	heartbeatStopped int32           // 1 once the heartbeat stopped, accessed atomically
+	heartbeatDone    chan struct{}   // closed once the heartbeat goroutine returned, nil without heartbeat
+	scriptsRetained  int32           // 1 while the connection retains the script registry of its client, see releaseScripts()
+	ctx              context.Context // cancelled on StopHeartbeat and Close, nil for hijacked connections
+	cancel           context.CancelFunc
 }
 
 // OpenConnectionWithRedisCmdable opens and returns a new connection
@@ -39,14 +61,21 @@ func OpenConnectionWithRedisCmdable(tag string, redisClient redis.Cmdable) *Redi
 		heartbeatKey: strings.Replace(connectionHeartbeatTemplate, phConnection, name, 1),
 		queuesKey:    strings.Replace(connectionQueuesTemplate, phConnection, name, 1),
 		redisClient:  redisClient,
+		backend:      newRedisBackend(redisClient),
 	}
+	connection.ctx, connection.cancel = context.WithCancel(context.Background())
+	connection.heartbeatDone = make(chan struct{})
+	retainScripts(redisClient)
+	connection.scriptsRetained = 1
+	connection.detectServer()
 
 	if !connection.updateHeartbeat() { // checks the connection
 		log.Panicf("rmq connection failed to update heartbeat %s", connection)
 	}
 
 	// add to connection set after setting heartbeat to avoid race with cleaner
-	redisErrIsNil(redisClient.SAdd(connectionsKey, name))
+	_, err := connection.backend.addMember(connectionsKey, name)
+	backendErr(err)
 
 	go connection.heartbeat()
 	// log.Printf("rmq connection connected to %s %s:%s %d", name, network, address, db)
@@ -55,32 +84,157 @@ func OpenConnectionWithRedisCmdable(tag string, redisClient redis.Cmdable) *Redi
 
 // OpenConnection opens and returns a new connection
 func OpenConnection(tag, address string, db int) *RedisConnection {
-	redisClient := redis.NewClient(&redis.Options{
-		Addr: address,
-		DB:   db,
-	})
-	return OpenConnectionWithRedisCmdable(tag, redisClient)
+	return OpenConnectionWithOptions(tag, address, db, ConnectionOptions{})
 }
 
 // OpenClusterConnection opens and returns a new connection to a Redis Cluster
 func OpenClusterConnection(tag string, addresses []string) *RedisConnection {
-	redisClient := redis.NewClusterClient(&redis.ClusterOptions{
-		Addrs: addresses,
+	return OpenClusterConnectionWithOptions(tag, addresses, ConnectionOptions{})
+}
+
+// OpenInspectorWithRedisCmdable returns a connection which can be used to
+// inspect queues (e.g. with PeekReady()) and collect stats. It has no
+// heartbeat and isn't visible to other connections, so don't consume from
+// queues opened on it
+func OpenInspectorWithRedisCmdable(redisClient redis.Cmdable) *RedisConnection {
+	return &RedisConnection{
+		Name:        "inspector",
+		queuesKey:   strings.Replace(connectionQueuesTemplate, phConnection, "inspector", 1),
+		redisClient: redisClient,
+		backend:     newRedisBackend(redisClient),
+	}
+}
+
+// OpenInspector returns an inspector connection, see
+// OpenInspectorWithRedisCmdable()
+func OpenInspector(address string, db int) *RedisConnection {
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: address,
+		DB:   db,
 	})
-	return OpenConnectionWithRedisCmdable(tag, redisClient)
+	return OpenInspectorWithRedisCmdable(redisClient)
 }
 
 // OpenQueue opens and returns the queue with a given name
 func (connection *RedisConnection) OpenQueue(name string) Queue {
-	redisErrIsNil(connection.redisClient.SAdd(queuesKey, name))
-	queue := newQueue(name, connection.Name, connection.queuesKey, connection.redisClient)
+	_, err := connection.backend.addMember(queuesKey, name)
+	backendErr(err)
+	queue := connection.openQueue(name)
+	queue.touch()
 	return queue
 }
 
+// OpenStreamQueue opens and returns the stream queue with a given name. Its
+// deliveries are kept in a Redis stream read by a consumer group instead of
+// lists, which needs Redis 6.2 or later. A queue must always be opened the
+// same way, see the README for what stream queues don't support
+func (connection *RedisConnection) OpenStreamQueue(name string) Queue {
+	_, err := connection.backend.addMember(queuesKey, name)
+	backendErr(err)
+	_, err = connection.backend.addMember(streamQueuesKey, name)
+	backendErr(err)
+	queue := connection.openStreamQueue(name)
+	queue.touch()
+	return queue
+}
+
+// SetDeadLetterQueue opens the queue with the given name and makes it the
+// dead letter queue of all queues opened on this connection afterwards
+func (connection *RedisConnection) SetDeadLetterQueue(name string) {
+	_, err := connection.backend.addMember(queuesKey, name)
+	backendErr(err)
+	connection.deadKey = strings.Replace(queueReadyTemplate, phQueue, name, 1)
+}
+
+// SetProtected makes cleaners never clean this connection, even after its
+// heartbeat stopped, e.g. for a process which intentionally keeps deliveries
+// unacked for a long time. The protection stays in Redis until it's removed
+// by calling SetProtected(false) or Close()
+func (connection *RedisConnection) SetProtected(protected bool) {
+	protectedKey := strings.Replace(connectionProtectedTemplate, phConnection, connection.Name, 1)
+	if protected {
+		backendErr(connection.backend.setTTLKey(protectedKey, 0))
+	} else {
+		_, err := connection.backend.del(protectedKey)
+		backendErr(err)
+	}
+}
+
+// SetTracer sets the tracer of all queues opened on this connection
+// afterwards, see Tracer
+func (connection *RedisConnection) SetTracer(tracer Tracer) {
+	connection.tracer = tracer
+}
+
+// SetClock sets the clock of the connection's heartbeat and of all queues
+// opened on this connection afterwards, the system clock by default. Tests
+// can pass an rmqtest.FakeClock to advance time by hand
+func (connection *RedisConnection) SetClock(clock Clock) {
+	connection.clock.Store(clockValue{clock})
+}
+
+// clockValue wraps a Clock to store it in an atomic.Value, which requires the
+// same concrete type for all stored values
+type clockValue struct {
+	Clock
+}
+
+// getClock returns the clock set by SetClock(), the system clock if there's
+// none
+func (connection *RedisConnection) getClock() Clock {
+	if value, ok := connection.clock.Load().(clockValue); ok && value.Clock != nil {
+		return value.Clock
+	}
+	return systemClock{}
+}
+
+// SetCounters enables or disables the cumulative counters of all queues opened
+// on this connection afterwards, see queue.Counters(). They are enabled by
+// default and cost a pipelined write per second and queue while in use
+func (connection *RedisConnection) SetCounters(enabled bool) {
+	connection.countersDisabled = !enabled
+}
+
+// SetSynchronous makes all queues opened on this connection afterwards
+// consume synchronously, for deterministic tests: StartConsuming and adding
+// consumers start no goroutines and nothing gets delivered until the test
+// calls queue.ConsumeOnce(), see there. Their counters and consumer stats are
+// written right away too. The heartbeat of the connection keeps running
+func (connection *RedisConnection) SetSynchronous(enabled bool) {
+	connection.synchronous = enabled
+}
+
+// SetDeliveryPooling makes all queues opened on this connection afterwards
+// recycle their deliveries, which saves an allocation per delivery at high
+// rates: Once Consume() returns, a delivery it settled is reused for a later
+// delivery. Consumers must not keep deliveries (or WithHeader copies of them)
+// past Consume() then, settling one before it's reused panics, afterwards it's
+// another delivery. Deliveries left unsettled by Consume(), for example to be
+// settled by another goroutine, are never recycled. Off by default
+func (connection *RedisConnection) SetDeliveryPooling(enabled bool) {
+	connection.pooling = enabled
+}
+
 // CollectStats returns a populated Stats object for all RMQ queues visible to
 // the connection.
 func (connection *RedisConnection) CollectStats(queueList []string) Stats {
-	return collectStats(queueList, connection)
+	stats, _ := collectStats(context.Background(), queueList, connection)
+	return stats
+}
+
+// CollectStatsCtx is like CollectStats, but stops waiting for Redis once ctx
+// is done. It then returns the stats collected so far with Incomplete set and
+// the context's error: Queues and connections may be missing and consuming
+// connections may lack details. Redis errors are returned instead of
+// panicking, also with Incomplete set
+func (connection *RedisConnection) CollectStatsCtx(ctx context.Context, queueList []string) (stats Stats, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			stats.Incomplete = true
+			err = fmt.Errorf("rmq failed to collect stats: %v", r)
+		}
+	}()
+	return collectStats(ctx, queueList, connection)
 }
 
 // String returns the connection name
@@ -90,88 +244,264 @@ func (connection *RedisConnection) String() string {
 
 // GetConnections returns a list of all open connections
 func (connection *RedisConnection) GetConnections() []string {
-	result := connection.redisClient.SMembers(connectionsKey)
-	if redisErrIsNil(result) {
-		return []string{}
-	}
-	return result.Val()
+	connections, err := connection.backend.members(connectionsKey)
+	backendErr(err)
+	return connections
 }
 
 // Check retuns true if the connection is currently active in terms of heartbeat
 func (connection *RedisConnection) Check() bool {
 	heartbeatKey := strings.Replace(connectionHeartbeatTemplate, phConnection, connection.Name, 1)
-	result := connection.redisClient.TTL(heartbeatKey)
-	if redisErrIsNil(result) {
-		return false
-	}
-	return result.Val() > 0
+	ttl, err := connection.backend.ttl(heartbeatKey)
+	return err == nil && ttl > 0
 }
 
 // StopHeartbeat stops the heartbeat of the connection
 // it does not remove it from the list of connections so it can later be found by the cleaner
 func (connection *RedisConnection) StopHeartbeat() bool {
-	connection.heartbeatStopped = true
-	return !redisErrIsNil(connection.redisClient.Del(connection.heartbeatKey))
+	backendErr(connection.stopHeartbeat())
+	return true
+}
+
+// stopHeartbeat stops the connection, waits for the heartbeat goroutine to
+// return, so it can't set the heartbeat key again, and deletes the key
+func (connection *RedisConnection) stopHeartbeat() error {
+	atomic.StoreInt32(&connection.heartbeatStopped, 1)
+	connection.stop()
+	if connection.heartbeatDone != nil {
+		<-connection.heartbeatDone
+	}
+	_, err := connection.backend.del(connection.heartbeatKey)
+	return err
 }
 
 // Close safely shuts down the client and removes the active connection from the
 // set of active RMQ connections
 func (connection *RedisConnection) Close() bool {
-	return !redisErrIsNil(connection.redisClient.SRem(connectionsKey, connection.Name))
+	connection.stop()
+	backendErr(connection.close())
+	return true
+}
+
+// StartCleaner starts a cleaner which cleans every interval until the
+// connection is stopped, calling onClean (if not nil) after each clean. See
+// cleaner.Run()
+func (connection *RedisConnection) StartCleaner(interval time.Duration, onClean func(report CleanReport, err error)) {
+	cleaner := NewCleaner(connection)
+	cleaner.SetOnClean(onClean)
+	ctx := connection.ctx
+	if ctx == nil {
+		ctx = context.Background() // hijacked connections are never stopped
+	}
+	go cleaner.Run(ctx, interval)
+}
+
+// WatchRejected calls fn for each open queue whose rejected list reached
+// threshold, checking every interval until the connection is stopped. Like
+// queue.WatchRejected() fn isn't called again for a queue before its rejected
+// list dropped below half the threshold
+func (connection *RedisConnection) WatchRejected(threshold int64, interval time.Duration, fn func(queueName string, count int64)) {
+	go connection.watchRejected(threshold, interval, fn)
+}
+
+func (connection *RedisConnection) watchRejected(threshold int64, interval time.Duration, fn func(queueName string, count int64)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	watches := map[string]*rejectedWatch{}
+	for {
+		select {
+		case <-connection.done():
+			return
+		case <-ticker.C:
+		}
+
+		queueNames := connection.GetOpenQueues()
+		results, err := connection.redisClient.Pipelined(func(pipe *redis.Pipeline) error {
+			for _, queueName := range queueNames {
+				pipe.LLen(strings.Replace(queueRejectedTemplate, phQueue, queueName, 1))
+			}
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			continue // try again next interval
+		}
+
+		for i, result := range results {
+			count, ok := result.(*redis.IntCmd)
+			if !ok || i >= len(queueNames) {
+				continue
+			}
+
+			queueName := queueNames[i]
+			watch, ok := watches[queueName]
+			if !ok {
+				watch = &rejectedWatch{threshold: threshold}
+				watches[queueName] = watch
+			}
+			if watch.check(count.Val()) {
+				fn(queueName, count.Val())
+			}
+		}
+	}
+}
+
+// done returns a channel which is closed once the connection is stopped
+func (connection *RedisConnection) done() <-chan struct{} {
+	if connection.ctx == nil {
+		return nil // hijacked connections are never stopped
+	}
+	return connection.ctx.Done()
+}
+
+func (connection *RedisConnection) stop() {
+	if connection.cancel != nil {
+		connection.cancel()
+	}
+	connection.releaseScripts()
 }
 
 // GetOpenQueues returns a list of all open queues
 func (connection *RedisConnection) GetOpenQueues() []string {
-	result := connection.redisClient.SMembers(queuesKey)
-	if redisErrIsNil(result) {
-		return []string{}
-	}
-	return result.Val()
+	queues, err := connection.backend.members(queuesKey)
+	backendErr(err)
+	return queues
 }
 
 // CloseAllQueues closes all queues by removing them from the global list
 func (connection *RedisConnection) CloseAllQueues() int {
-	result := connection.redisClient.Del(queuesKey)
-	if redisErrIsNil(result) {
-		return 0
-	}
-	return int(result.Val())
+	deleted, err := connection.backend.del(queuesKey)
+	backendErr(err)
+	return int(deleted)
 }
 
 // CloseAllQueuesInConnection closes all queues in the associated connection by removing all related keys
 func (connection *RedisConnection) CloseAllQueuesInConnection() error {
-	redisErrIsNil(connection.redisClient.Del(connection.queuesKey))
+	_, err := connection.backend.del(connection.queuesKey)
+	backendErr(err)
 	// debug(fmt.Sprintf("connection closed all queues %s %d", connection, connection.queuesKey)) // COMMENTOUT
 	return nil
 }
 
 // GetConsumingQueues returns a list of all queues consumed by this connection
 func (connection *RedisConnection) GetConsumingQueues() []string {
-	result := connection.redisClient.SMembers(connection.queuesKey)
-	if redisErrIsNil(result) {
-		return []string{}
-	}
-	return result.Val()
+	queues, err := connection.backend.members(connection.queuesKey)
+	backendErr(err)
+	return queues
 }
 
-// heartbeat keeps the heartbeat key alive
+// heartbeat keeps the heartbeat key alive. Failed updates are retried each
+// second, the key lives for heartbeatDuration, so the cleaner only sees the
+// connection as dead if Redis was unreachable for that long
 func (connection *RedisConnection) heartbeat() {
+	defer close(connection.heartbeatDone)
 	for {
 		if !connection.updateHeartbeat() {
 			// log.Printf("rmq connection failed to update heartbeat %s", connection)
 		}
 
-		time.Sleep(time.Second)
-
-		if connection.heartbeatStopped {
+		select {
+		case <-connection.done():
 			// log.Printf("rmq connection stopped heartbeat %s", connection)
 			return
+		case <-connection.getClock().After(time.Second):
+		}
+
+		if atomic.LoadInt32(&connection.heartbeatStopped) == 1 {
+			return
 		}
 	}
 }
 
+// updateHeartbeat sets the heartbeat key and returns false if that failed
 func (connection *RedisConnection) updateHeartbeat() bool {
-	return !redisErrIsNil(connection.redisClient.Set(connection.heartbeatKey, "1", heartbeatDuration))
+	return connection.backend.setTTLKey(connection.heartbeatKey, heartbeatDuration) == nil
+}
+
+// InspectConnection returns the connection with the given name, for example
+// to call UnackedSnapshot() on the connection of a stuck consumer. No
+// heartbeat is started, so don't consume from queues opened on it
+func (connection *RedisConnection) InspectConnection(name string) *RedisConnection {
+	return connection.hijackConnection(name)
+}
+
+// UnackedSnapshot returns the payloads currently unacked by this connection,
+// by queue name, newest first
+func (connection *RedisConnection) UnackedSnapshot() map[string][]string {
+	snapshot := map[string][]string{}
+	for _, queueName := range connection.GetConsumingQueues() {
+		queue := connection.openQueue(queueName)
+		snapshot[queueName] = queue.PeekUnacked(queue.UnackedCount())
+	}
+	return snapshot
+}
+
+// ErrQueueNotEmpty is returned by connection.CopyQueue() if the destination
+// queue has ready deliveries
+var ErrQueueNotEmpty = errors.New("rmq destination queue is not empty")
+
+// CopyQueue copies the ready list of the queue src to the queue dst, entry by
+// entry as stored, without consuming src. It's copied in chunks, so if src is
+// being consumed or published to at the same time the copy is only roughly
+// a snapshot. Returns ErrQueueNotEmpty if dst has ready deliveries, see
+// ForceCopyQueue()
+func (connection *RedisConnection) CopyQueue(src, dst string) (copied int64, err error) {
+	return connection.copyQueue(src, dst, false)
+}
+
+// ForceCopyQueue is like CopyQueue, but replaces the ready deliveries of dst
+func (connection *RedisConnection) ForceCopyQueue(src, dst string) (copied int64, err error) {
+	return connection.copyQueue(src, dst, true)
+}
+
+func (connection *RedisConnection) copyQueue(src, dst string, force bool) (copied int64, err error) {
+	srcKey := strings.Replace(queueReadyTemplate, phQueue, src, 1)
+	dstKey := strings.Replace(queueReadyTemplate, phQueue, dst, 1)
+
+	if force {
+		if _, err := connection.backend.del(dstKey); err != nil {
+			return 0, err
+		}
+	} else {
+		ready, err := connection.backend.count(dstKey)
+		if err != nil {
+			return 0, err
+		}
+		if ready > 0 {
+			return 0, ErrQueueNotEmpty
+		}
+	}
+	if _, err := connection.backend.addMember(queuesKey, dst); err != nil {
+		return 0, err
+	}
+
+	for start := int64(0); ; start += returnBatchSize {
+		entries, err := connection.backend.scan(srcKey, start, start+returnBatchSize-1)
+		if err != nil {
+			return copied, err
+		}
+
+		if len(entries) > 0 {
+			args := make([]interface{}, len(entries))
+			for i, entry := range entries {
+				args[i] = entry
+			}
+			if err := redisErr(connection.redisClient.RPush(dstKey, args...)); err != nil {
+				return copied, err
+			}
+			copied += int64(len(entries))
+		}
+
+		if len(entries) < returnBatchSize {
+			return copied, nil
+		}
+	}
+}
+
+// PeekReady returns up to count entries of the ready list of the queue with
+// the given name without opening it, see queue.PeekReady()
+func (connection *RedisConnection) PeekReady(queueName string, offset, count int) []string {
+	return connection.openQueue(queueName).PeekReady(offset, count)
 }
 
 // hijackConnection reopens an existing connection for inspection purposes without starting a heartbeat
@@ -181,12 +511,47 @@ func (connection *RedisConnection) hijackConnection(name string) *RedisConnectio
 		heartbeatKey: strings.Replace(connectionHeartbeatTemplate, phConnection, name, 1),
 		queuesKey:    strings.Replace(connectionQueuesTemplate, phConnection, name, 1),
 		redisClient:  connection.redisClient,
+		backend:      connection.backend,
+		positional:   connection.positional,
 	}
 }
 
 // openQueue opens a queue without adding it to the set of queues
 func (connection *RedisConnection) openQueue(name string) *redisQueue {
-	return newQueue(name, connection.Name, connection.queuesKey, connection.redisClient)
+	queue := newQueue(name, connection.Name, connection.queuesKey, connection.deadKey, connection.redisClient)
+	queue.tracer = connection.tracer
+	queue.connectionDone = connection.done()
+	queue.backend = connection.backend
+	queue.positional = connection.positional
+	queue.clock = connection.getClock()
+	queue.synchronous = connection.synchronous
+	queue.poller = connection.poller
+	queue.pooling = connection.pooling
+	queue.consuming = &connection.consuming
+	if !connection.countersDisabled {
+		queue.cumulative = connection.queueCounters(queue)
+	}
+	return queue
+}
+
+// queueCounters returns the counters of the queue, opening a queue again must
+// not start another flusher for the same counts
+func (connection *RedisConnection) queueCounters(queue *redisQueue) *queueCounters {
+	connection.countersMutex.Lock()
+	defer connection.countersMutex.Unlock()
+	if counters, ok := connection.counters[queue.name]; ok {
+		return counters
+	}
+	if connection.counters == nil {
+		connection.counters = map[string]*queueCounters{}
+	}
+	done := queue.connectionDone
+	if connection.synchronous {
+		done = nil // flush on each count, without a flusher goroutine
+	}
+	counters := newCounters(queue.countersKey, connection.redisClient, done)
+	connection.counters[queue.name] = counters
+	return counters
 }
 
 // flushDb flushes the redis database to reset everything, used in tests
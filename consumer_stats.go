@@ -0,0 +1,125 @@
+package rmq
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/redis.v5"
+)
+
+// consumerStatsInterval is how often consuming queues publish the stats of
+// their consumers to Redis
+const consumerStatsInterval = 5 * time.Second
+
+// ConsumerStat counts the deliveries a consumer consumed since it was added.
+// They are published every few seconds by the consuming process
+type ConsumerStat struct {
+	Processed int64 `json:"processed"`
+	Acked     int64 `json:"acked"`
+	Rejected  int64 `json:"rejected"`
+	Busy      bool  `json:"busy"` // consuming a delivery or batch when the stat was published
+}
+
+// consumerCounters are the in process counts of a consumer, accessed
+// atomically
+type consumerCounters struct {
+	processed int64
+	acked     int64
+	rejected  int64
+	busy      int32
+}
+
+// start marks the consumer busy
+func (counters *consumerCounters) start() {
+	atomic.StoreInt32(&counters.busy, 1)
+}
+
+// done counts the consumed deliveries by their state and marks the consumer
+// idle. Deliveries settled after the consumer returned are counted as
+// processed only
+func (counters *consumerCounters) done(deliveries ...Delivery) {
+	for _, delivery := range deliveries {
+		atomic.AddInt64(&counters.processed, 1)
+		switch delivery.State() {
+		case Acked:
+			atomic.AddInt64(&counters.acked, 1)
+		case Rejected, Delayed:
+			atomic.AddInt64(&counters.rejected, 1)
+		}
+	}
+	atomic.StoreInt32(&counters.busy, 0)
+}
+
+func (counters *consumerCounters) stat() ConsumerStat {
+	return ConsumerStat{
+		Processed: atomic.LoadInt64(&counters.processed),
+		Acked:     atomic.LoadInt64(&counters.acked),
+		Rejected:  atomic.LoadInt64(&counters.rejected),
+		Busy:      atomic.LoadInt32(&counters.busy) == 1,
+	}
+}
+
+// counters returns the counters of the consumer with the given name. Counts
+// of removed consumers aren't published anymore
+func (queue *redisQueue) counters(name string) *consumerCounters {
+	if counters, ok := queue.consumerCounters.Load(name); ok {
+		return counters.(*consumerCounters)
+	}
+	return &consumerCounters{}
+}
+
+// removeConsumerCounters stops publishing the stats of the consumer and
+// removes its published stat
+func (queue *redisQueue) removeConsumerCounters(name string) {
+	queue.consumerCounters.Delete(name)
+	queue.redisClient.HDel(queue.statsKey, name)
+}
+
+// publishConsumerStats periodically publishes the stats and latencies of the
+// consumers until the queue stops consuming
+func (queue *redisQueue) publishConsumerStats() {
+	for {
+		time.Sleep(consumerStatsInterval)
+
+		if queue.consumingStopped {
+			return
+		}
+
+		queue.publishConsumerStatsOnce()
+		queue.publishLatency(time.Now())
+	}
+}
+
+func (queue *redisQueue) publishConsumerStatsOnce() {
+	queue.redisClient.Pipelined(func(pipe *redis.Pipeline) error {
+		queue.consumerCounters.Range(func(name, counters interface{}) bool {
+			if bytes, err := json.Marshal(counters.(*consumerCounters).stat()); err == nil {
+				pipe.HSet(queue.statsKey, name.(string), string(bytes))
+			}
+			return true
+		})
+		return nil
+	})
+}
+
+// getConsumerStats returns the published stats of the consumers by name
+func (queue *redisQueue) getConsumerStats() map[string]ConsumerStat {
+	result := queue.redisClient.HGetAll(queue.statsKey)
+	if redisErrIsNil(result) {
+		return map[string]ConsumerStat{}
+	}
+	return parseConsumerStats(result.Val())
+}
+
+// parseConsumerStats decodes the fields of a consumer stats hash
+func parseConsumerStats(fields map[string]string) map[string]ConsumerStat {
+	stats := map[string]ConsumerStat{}
+	for name, value := range fields {
+		var stat ConsumerStat
+		if err := json.Unmarshal([]byte(value), &stat); err == nil {
+			stats[name] = stat
+		}
+	}
+	return stats
+}
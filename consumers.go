@@ -1,11 +1,30 @@
 package rmq
 
+import "context"
+
 // Consumer is the interface that must be implemented by users of RMQ for handling
 // single messages (a delivery) at a time.
 type Consumer interface {
 	Consume(delivery Delivery)
 }
 
+// ConsumerFunc adapts a function to the Consumer interface, see
+// queue.AddConsumerFunc()
+type ConsumerFunc func(delivery Delivery)
+
+// Consume calls consumerFunc(delivery)
+func (consumerFunc ConsumerFunc) Consume(delivery Delivery) {
+	consumerFunc(delivery)
+}
+
+// ConsumerWithContext is the interface to implement for consumers which need a
+// context, see queue.AddContextConsumer(). The context is cancelled when the
+// queue stops consuming and carries the queue's per delivery timeout as
+// deadline if one is set.
+type ConsumerWithContext interface {
+	Consume(ctx context.Context, delivery Delivery)
+}
+
 // BatchConsumer is the interface that must be satisfied by users of RMQ if
 // necessary or desired to handle batches of messages at a time.
 type BatchConsumer interface {
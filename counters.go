@@ -0,0 +1,221 @@
+package rmq
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/redis.v5"
+)
+
+const (
+	counterFlushInterval = time.Second // pending counts get flushed at least this often
+	counterFlushOps      = 100         // and after this many operations
+)
+
+// indexes of the counters in queueCounters.pending
+const (
+	counterPublished = iota
+	counterAcked
+	counterRejected
+	counterPushed
+	counterDead
+	counterCount
+)
+
+// resetCountersScript deletes a counters hash and returns its fields, so no
+// increments get lost between reading and deleting it
+var resetCountersScript = newScript("resetCounters", `
+local fields = redis.call('HGETALL', KEYS[1])
+redis.call('DEL', KEYS[1])
+return fields
+`)
+
+// counterFields are the fields of the counters hash by counter index
+var counterFields = [counterCount]string{"published", "acked", "rejected", "pushed", "dead"}
+
+// QueueCounters are cumulative counts of a queue's deliveries across all
+// connections since the queue was created or destroyed, see queue.Counters()
+type QueueCounters struct {
+	Published int64 `json:"published"`
+	Acked     int64 `json:"acked"`
+	Rejected  int64 `json:"rejected"` // including deliveries scheduled for a retry
+	Pushed    int64 `json:"pushed"`
+	Dead      int64 `json:"dead"` // moved to the dead letter queue, see delivery.Dead()
+}
+
+// newQueueCounters parses the fields of a counters hash
+func newQueueCounters(fields map[string]string) QueueCounters {
+	var values [counterCount]int64
+	for i, field := range counterFields {
+		values[i], _ = strconv.ParseInt(fields[field], 10, 64)
+	}
+	return QueueCounters{
+		Published: values[counterPublished],
+		Acked:     values[counterAcked],
+		Rejected:  values[counterRejected],
+		Pushed:    values[counterPushed],
+		Dead:      values[counterDead],
+	}
+}
+
+// queueCounters counts operations in process and flushes them to the counters
+// hash of the queue in the background, so counting doesn't cost a round trip.
+// Without done there's no background flush and each count gets flushed right
+// away, like for hijacked connections which are never stopped
+type queueCounters struct {
+	key         string
+	redisClient redis.Cmdable
+	done        <-chan struct{} // counts are flushed a last time once closed, nil to flush each count
+	pending     [counterCount]int64
+	ops         int64 // accessed atomically
+	flush       chan struct{}
+	start       sync.Once
+}
+
+func newCounters(key string, redisClient redis.Cmdable, done <-chan struct{}) *queueCounters {
+	return &queueCounters{
+		key:         key,
+		redisClient: redisClient,
+		done:        done,
+		flush:       make(chan struct{}, 1),
+	}
+}
+
+// add counts one operation, nil counters count nothing
+func (counters *queueCounters) add(counter int) {
+	if counters == nil {
+		return
+	}
+	atomic.AddInt64(&counters.pending[counter], 1)
+	if counters.done == nil {
+		counters.flushPending()
+		return
+	}
+	counters.start.Do(func() { go counters.flushPeriodically() })
+	if atomic.AddInt64(&counters.ops, 1)%counterFlushOps == 0 {
+		select {
+		case counters.flush <- struct{}{}:
+		default: // a flush is already due
+		}
+	}
+}
+
+func (counters *queueCounters) flushPeriodically() {
+	ticker := time.NewTicker(counterFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-counters.done:
+			counters.flushPending()
+			return
+		case <-ticker.C:
+		case <-counters.flush:
+		}
+		counters.flushPending()
+	}
+}
+
+// flushPending increments the counters hash by the pending counts. They are
+// kept pending if that fails
+func (counters *queueCounters) flushPending() {
+	var increments [counterCount]int64
+	flush := false
+	for i := range increments {
+		increments[i] = atomic.SwapInt64(&counters.pending[i], 0)
+		flush = flush || increments[i] != 0
+	}
+	if !flush {
+		return
+	}
+
+	_, err := counters.redisClient.Pipelined(func(pipe *redis.Pipeline) error {
+		for i, increment := range increments {
+			if increment != 0 {
+				pipe.HIncrBy(counters.key, counterFields[i], increment)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		for i, increment := range increments {
+			atomic.AddInt64(&counters.pending[i], increment)
+		}
+	}
+}
+
+// pendingCounts returns the counts not flushed yet
+func (counters *queueCounters) pendingCounts() (pending QueueCounters) {
+	if counters == nil {
+		return pending
+	}
+	return QueueCounters{
+		Published: atomic.LoadInt64(&counters.pending[counterPublished]),
+		Acked:     atomic.LoadInt64(&counters.pending[counterAcked]),
+		Rejected:  atomic.LoadInt64(&counters.pending[counterRejected]),
+		Pushed:    atomic.LoadInt64(&counters.pending[counterPushed]),
+		Dead:      atomic.LoadInt64(&counters.pending[counterDead]),
+	}
+}
+
+func (counts QueueCounters) add(other QueueCounters) QueueCounters {
+	return QueueCounters{
+		Published: counts.Published + other.Published,
+		Acked:     counts.Acked + other.Acked,
+		Rejected:  counts.Rejected + other.Rejected,
+		Pushed:    counts.Pushed + other.Pushed,
+		Dead:      counts.Dead + other.Dead,
+	}
+}
+
+// Counters returns the cumulative counters of the queue, including counts of
+// this queue not flushed to Redis yet. Counts of other connections lag
+// behind by up to a second
+func (queue *redisQueue) Counters() QueueCounters {
+	result := queue.redisClient.HGetAll(queue.countersKey)
+	if redisErrIsNil(result) {
+		return queue.cumulative.pendingCounts()
+	}
+	return newQueueCounters(result.Val()).add(queue.cumulative.pendingCounts())
+}
+
+// ResetCounters sets the counters of the queue to zero and returns their
+// values before the reset, including counts of this queue not flushed yet.
+// Counts of other connections not flushed yet are counted after the reset
+func (queue *redisQueue) ResetCounters() (QueueCounters, error) {
+	if queue.cumulative != nil {
+		queue.cumulative.flushPending()
+	}
+	result := resetCountersScript.run(queue.redisClient, []string{queue.countersKey})
+	if err := redisErr(result); err != nil {
+		return QueueCounters{}, err
+	}
+	values, _ := result.Val().([]interface{})
+	fields := make(map[string]string, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		field, _ := values[i].(string)
+		value, _ := values[i+1].(string)
+		fields[field] = value
+	}
+	return newQueueCounters(fields).add(queue.cumulative.pendingCounts()), nil
+}
+
+// ResetAllCounters resets the counters of all open queues whose names start
+// with prefix, see queue.ResetCounters(). Returns the values before the reset
+// by queue name, including those reset before an error occurred
+func (connection *RedisConnection) ResetAllCounters(prefix string) (map[string]QueueCounters, error) {
+	previous := map[string]QueueCounters{}
+	for _, queueName := range connection.GetOpenQueues() {
+		if !strings.HasPrefix(queueName, prefix) {
+			continue
+		}
+		counters, err := connection.openQueue(queueName).ResetCounters()
+		if err != nil {
+			return previous, err
+		}
+		previous[queueName] = counters
+	}
+	return previous, nil
+}
@@ -0,0 +1,142 @@
+package rmq
+
+import (
+	"github.com/adjust/uniuri"
+	"gopkg.in/redis.v5"
+)
+
+// renameListScript renames the list at KEYS[1] to KEYS[2] unless it's empty
+// and returns its length
+var renameListScript = newScript("renameList", `
+local length = redis.call('LLEN', KEYS[1])
+if length > 0 then
+	redis.call('RENAME', KEYS[1], KEYS[2])
+end
+return length
+`)
+
+// mergeDedupedScript moves up to ARGV[1] entries from the left of the list at
+// KEYS[1] to the right (oldest) end of the ready list at KEYS[2] and returns
+// how many it moved. If the ready list is empty the whole list is renamed
+var mergeDedupedScript = newScript("mergeDeduped", `
+if redis.call('LLEN', KEYS[2]) == 0 then
+	local length = redis.call('LLEN', KEYS[1])
+	if length > 0 then
+		redis.call('RENAME', KEYS[1], KEYS[2])
+	end
+	return length
+end
+local moved = 0
+for i = 1, tonumber(ARGV[1]) do
+	local payload = redis.call('LPOP', KEYS[1])
+	if not payload then
+		break
+	end
+	redis.call('RPUSH', KEYS[2], payload)
+	moved = moved + 1
+end
+return moved
+`)
+
+// DedupeReady removes exact duplicates from the ready list, keeping the oldest
+// occurrence of each entry, and returns the number of removed entries. The
+// ready list is renamed away while it's rebuilt, so deliveries published in
+// the meantime are kept (but not deduped), while consumers only get those
+// until the rebuilt list is back in place
+func (queue *redisQueue) DedupeReady() (removed int64, err error) {
+	return queue.dedupeReady(func(entry string) string { return entry })
+}
+
+// DedupeReadyPayloads is like DedupeReady, but considers deliveries with the
+// same payload duplicates, ignoring their headers (like their id)
+func (queue *redisQueue) DedupeReadyPayloads() (removed int64, err error) {
+	return queue.dedupeReady(decodePayload)
+}
+
+// dedupeReady rebuilds the ready list keeping only the oldest entry of each
+// identity
+func (queue *redisQueue) dedupeReady(identity func(entry string) string) (removed int64, err error) {
+	suffix := uniuri.NewLen(6) // keys are in the same hash slot as readyKey
+	dedupingKey := queue.readyKey + "::deduping::" + suffix
+	dedupedKey := queue.readyKey + "::deduped::" + suffix
+	seenKey := queue.readyKey + "::seen::" + suffix
+
+	// pendingKey holds the entries which still have to be put back, they are
+	// put back as they are if anything fails
+	pendingKey := dedupingKey
+	defer func() {
+		if err != nil {
+			queue.mergeDeduped(pendingKey)
+		}
+		queue.redisClient.Del(dedupingKey, dedupedKey, seenKey)
+	}()
+
+	result := renameListScript.run(queue.redisClient, []string{queue.readyKey, dedupingKey})
+	if err := redisErr(result); err != nil {
+		return 0, err
+	}
+	length, _ := result.Val().(int64)
+	if length == 0 {
+		return 0, nil
+	}
+
+	// walk the renamed list from its right (oldest) end and push kept entries
+	// to the left of the deduped list, so it ends up in the same order
+	for offset := int64(0); offset < length; offset += returnBatchSize {
+		entries := queue.redisClient.LRange(dedupingKey, -offset-returnBatchSize, -offset-1)
+		if err := redisErr(entries); err != nil {
+			return 0, err
+		}
+
+		chunk := entries.Val()
+		results, err := queue.redisClient.Pipelined(func(pipe *redis.Pipeline) error {
+			for i := len(chunk) - 1; i >= 0; i-- {
+				pipe.SAdd(seenKey, identity(chunk[i]))
+			}
+			return nil
+		})
+		if err := pipelineErr(err); err != nil {
+			return 0, err
+		}
+
+		var kept []interface{}
+		for i, result := range results {
+			added, ok := result.(*redis.IntCmd)
+			if !ok || redisErr(added) != nil {
+				return 0, redisErr(result)
+			}
+			if added.Val() > 0 {
+				kept = append(kept, chunk[len(chunk)-1-i])
+			} else {
+				removed++
+			}
+		}
+		if len(kept) > 0 {
+			if err := redisErr(queue.redisClient.LPush(dedupedKey, kept...)); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	pendingKey = dedupedKey
+	if err := queue.mergeDeduped(dedupedKey); err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// mergeDeduped moves all entries of the list at key to the oldest end of the
+// ready list
+func (queue *redisQueue) mergeDeduped(key string) error {
+	keys := []string{key, queue.readyKey}
+	for {
+		result := mergeDedupedScript.run(queue.redisClient, keys, returnBatchSize)
+		if err := redisErr(result); err != nil {
+			return err
+		}
+		moved, _ := result.Val().(int64)
+		if moved < returnBatchSize {
+			return nil
+		}
+	}
+}
@@ -1,20 +1,17 @@
 package rmq
 
+import "gopkg.in/redis.v5"
+
 // Deliveries represents a batch or slice of individual Delivery structs. This
 // type includes additional convenience methods for managing a set of Delivery
 // structs.
 type Deliveries []Delivery
 
-// Ack loops through the Delivery objects and Ack's (acknowledges) each
-// Delivery. The function returns the number of failures encountered.
+// Ack acknowledges all Delivery objects, sharing one round trip per unacked
+// list. The function returns the number of failures encountered.
 func (deliveries Deliveries) Ack() int {
-	failedCount := 0
-	for _, delivery := range deliveries {
-		if !delivery.Ack() {
-			failedCount++
-		}
-	}
-	return failedCount
+	_, failed, _ := ackMany(deliveries)
+	return len(failed)
 }
 
 // Reject loops through the Delivery objects and Rejects each
@@ -28,3 +25,75 @@ func (deliveries Deliveries) Reject() int {
 	}
 	return failedCount
 }
+
+// ackMany acknowledges the given deliveries by pipelining the commands acking
+// each of them (see delivery.AckErr()) for each unacked list. Deliveries not
+// backed by Redis are acked one by one. Deliveries which were already settled
+// are reported in failed without touching Redis. A delivery which could not be
+// removed (for example because the cleaner already returned it) is reported in
+// failed and stays unacked without failing the others, err is only set if
+// Redis returned an error.
+func ackMany(deliveries []Delivery) (acked int, failed []Delivery, err error) {
+	unackedKeys := []string{}
+	groups := map[string][]*wrapDelivery{}
+	for _, delivery := range deliveries {
+		wrapped, ok := delivery.(*wrapDelivery)
+		if !ok {
+			if delivery.Ack() {
+				acked++
+			} else {
+				failed = append(failed, delivery)
+			}
+			continue
+		}
+		if !wrapped.settle(Acked) {
+			failed = append(failed, delivery)
+			continue
+		}
+
+		if _, ok := groups[wrapped.unackedKey]; !ok {
+			unackedKeys = append(unackedKeys, wrapped.unackedKey)
+		}
+		groups[wrapped.unackedKey] = append(groups[wrapped.unackedKey], wrapped)
+	}
+
+	for _, unackedKey := range unackedKeys {
+		groupAcked, groupFailed, groupErr := ackGroup(groups[unackedKey])
+		acked += groupAcked
+		for _, delivery := range groupFailed {
+			failed = append(failed, delivery)
+		}
+		if groupErr != nil && err == nil {
+			err = groupErr
+		}
+	}
+
+	return acked, failed, err
+}
+
+// ackGroup removes deliveries sharing an unacked list, which were settled as
+// acked already, in one round trip. Deliveries which couldn't be removed are
+// rolled back to Unacked and returned in failed, err is only set if Redis
+// returned an error
+func ackGroup(group []*wrapDelivery) (acked int, failed []*wrapDelivery, err error) {
+	results, err := group[0].redisClient.Pipelined(func(pipe *redis.Pipeline) error {
+		for _, delivery := range group {
+			delivery.pipeAck(pipe)
+		}
+		return nil
+	})
+	err = pipelineErr(err)
+
+	for i, delivery := range group {
+		if i < len(results) {
+			if ackedResult(results[i]) {
+				delivery.counters.add(counterAcked)
+				acked++
+				continue
+			}
+		}
+		delivery.setState(Unacked) // see delivery.settled()
+		failed = append(failed, delivery)
+	}
+	return acked, failed, err
+}
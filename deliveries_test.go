@@ -16,14 +16,14 @@ func TestDeliveriesAck(t *testing.T) {
 	if result != 2 {
 		t.Error("Unexpected successful ack count. Expected", 2, "; got", result)
 	}
-	if d1.State != Acked {
-		t.Error("d1 should be acked. State =", d1.State)
+	if d1.State() != Acked {
+		t.Error("d1 should be acked. State =", d1.State())
 	}
-	if d2.State != Acked {
-		t.Error("d2 should be acked. State =", d2.State)
+	if d2.State() != Acked {
+		t.Error("d2 should be acked. State =", d2.State())
 	}
-	if d3.State != Acked {
-		t.Error("d3 should be acked. State =", d3.State)
+	if d3.State() != Acked {
+		t.Error("d3 should be acked. State =", d3.State())
 	}
 }
 
@@ -39,13 +39,13 @@ func TestDeliveriesReject(t *testing.T) {
 	if result != 1 {
 		t.Error("Unexpected successful ack count. Expected", 2, "; got", result)
 	}
-	if d1.State != Rejected {
-		t.Error("d1 should be rejected. State =", d1.State)
+	if d1.State() != Rejected {
+		t.Error("d1 should be rejected. State =", d1.State())
 	}
-	if d2.State != Rejected {
-		t.Error("d2 should be rejected. State =", d2.State)
+	if d2.State() != Rejected {
+		t.Error("d2 should be rejected. State =", d2.State())
 	}
-	if d3.State != Rejected {
-		t.Error("d3 should be rejected. State =", d3.State)
+	if d3.State() != Rejected {
+		t.Error("d3 should be rejected. State =", d3.State())
 	}
 }
@@ -1,39 +1,219 @@
 package rmq
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"gopkg.in/redis.v5"
 )
 
+var (
+	// ErrDeliveryNotFound is returned by delivery.AckErr() if the delivery
+	// wasn't unacked anymore, for example because it was already acked
+	ErrDeliveryNotFound = errors.New("rmq delivery not found in unacked list")
+
+	// ErrNoDeadLetterQueue is returned by delivery.Dead() if the delivery got
+	// rejected because its queue has no dead letter queue
+	ErrNoDeadLetterQueue = errors.New("rmq delivery rejected, no dead letter queue configured")
+
+	// ErrAlreadySettled is returned by the error variants of the settle methods
+	// if the delivery was already acked, rejected, pushed or dead lettered
+	ErrAlreadySettled = errors.New("rmq delivery already settled")
+
+	// ErrPushChainTooDeep is returned by delivery.PushErr() if the delivery got
+	// rejected because it was already pushed maxPushDepth times
+	ErrPushChainTooDeep = fmt.Errorf("rmq delivery pushed more than %d times, rejected", maxPushDepth)
+)
+
+var (
+	// removeUnackedScript removes a delivery from unacked along with its
+	// attempts and its visibility deadline if KEYS[3] is given. If ARGV[2] is
+	// given too the delivery is only removed while its deadline is ARGV[2], so
+	// a stale copy of a delivery which timed out and got redelivered doesn't
+	// remove the redelivered one. Destinations may live in another cluster
+	// slot, so pushing there is left to the caller
+	removeUnackedScript = newListScript("removeUnacked", `
+if KEYS[3] and ARGV[2] and tonumber(redis.call('ZSCORE', KEYS[3], ARGV[1])) ~= tonumber(ARGV[2]) then
+	return 0
+end
+local removed = remove(KEYS[1], ARGV[1])
+if removed == 1 then
+	redis.call('HDEL', KEYS[2], ARGV[1])
+end
+if KEYS[3] then
+	redis.call('ZREM', KEYS[3], ARGV[1])
+end
+return removed
+`)
+
+	// rejectReasonScript moves a delivery from unacked to rejected and stores
+	// its rejection reason, moving its attempts from the attempts hash into the
+	// stored rejection. Removes its visibility deadline if KEYS[5] is given,
+	// returning 0 without moving it if ARGV[3] is given and isn't its deadline
+	// anymore, like removeUnackedScript
+	rejectReasonScript = newListScript("rejectReason", `
+if KEYS[5] and ARGV[3] and tonumber(redis.call('ZSCORE', KEYS[5], ARGV[1])) ~= tonumber(ARGV[3]) then
+	return 0
+end
+redis.call('LPUSH', KEYS[2], ARGV[1])
+remove(KEYS[1], ARGV[1])
+local rejection = ARGV[2]
+local attempts = redis.call('HGET', KEYS[4], ARGV[1])
+if attempts then
+	redis.call('HDEL', KEYS[4], ARGV[1])
+	rejection = string.sub(rejection, 1, -2) .. ',"attempts":' .. attempts .. '}'
+end
+redis.call('HSET', KEYS[3], ARGV[1], rejection)
+if KEYS[5] then
+	redis.call('ZREM', KEYS[5], ARGV[1])
+end
+return 1
+`)
+
+	// extendScript pushes the visibility deadline of a delivery out to ARGV[2]
+	// if it's still tracked, with the deadline ARGV[3] if that's given
+	extendScript = newScript("extend", `
+local deadline = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if deadline and (not ARGV[3] or tonumber(deadline) == tonumber(ARGV[3])) then
+	redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+	return 1
+end
+return 0
+`)
+)
+
 // Delivery wraps an RMQ message returned from Redis. All Delivery messages should be acknowledged
 // once by calling either the `Ack()`, `Reject()`, or `Push()` functions.
 type Delivery interface {
 	Payload() string
 	PayloadBytes() []byte
+	PayloadReader() io.Reader
 	Ack() bool
+	AckErr() error
 	Reject() bool
+	RejectErr() error
+	RejectWithReason(reason string) bool
+	RejectWithError(err error) bool
 	Push() bool
+	PushErr() error
+	Dead() error
+	CopyTo(queueName string) error
+	Extend(timeout time.Duration) bool
+	State() State
+	Headers() map[string]string
+	Header(key string) (string, bool)
+	WithHeader(key, value string) Delivery
 }
 
 type wrapDelivery struct {
-	payload     []byte
+	*deliveryShared
+	wire     []byte // payload as stored in Redis, possibly wrapped in an envelope
+	payload  []byte
+	headers  map[string]string // as on the wire
+	view     map[string]string // headers including WithHeader overrides, nil if there are none
+	checksum string
+	corrupt  bool   // payload doesn't match the envelope's checksum
+	state    *int32 // State, points to own and is shared with WithHeader copies
+	own      int32
+	deadline *int64 // visibility deadline the delivery was fetched or extended with, zero if untracked, points to ownDeadline like state
+	consumer string // name of the consumer consuming the delivery, empty if unknown
+
+	ownDeadline int64
+}
+
+// deliveryShared is what all deliveries of a queue have in common, so they
+// don't carry a copy each, see redisQueue.shared()
+type deliveryShared struct {
 	unackedKey  string
 	rejectedKey string
 	pushKey     string
 	redisClient redis.Cmdable
+	backend     backend
+	hooks       Hooks
+
+	// optional queue features, see redisQueue.shared
+	queueName   string
+	connection  string
+	deadKey     string // empty if there's no dead letter queue
+	inflightKey string // empty if the queue has no visibility timeout
+	positional  bool   // whether to remove from unacked by position, see connection.ServerInfo()
+	reasonsKey  string
+	attemptsKey string
+	rejectedMax int64        // max length of the rejected list, zero to not trim
+	retry       *RetryPolicy // nil if rejected deliveries aren't retried
+	delayedKey  string
+	counters    *queueCounters // nil if the queue doesn't count deliveries
+	acks        *ackCoalescer  // nil if acks aren't coalesced, see queue.SetAckCoalescing()
+	clock       Clock
 }
 
-func newDelivery(payload []byte, unackedKey, rejectedKey, pushKey string, redisClient redis.Cmdable) *wrapDelivery {
-	return &wrapDelivery{
-		payload:     payload,
+func newDelivery(wire []byte, unackedKey, rejectedKey, pushKey string, redisClient redis.Cmdable) *wrapDelivery {
+	delivery := &wrapDelivery{}
+	delivery.init(wire, &deliveryShared{
 		unackedKey:  unackedKey,
 		rejectedKey: rejectedKey,
 		pushKey:     pushKey,
 		redisClient: redisClient,
+		backend:     newRedisBackend(redisClient),
+		clock:       systemClock{},
+	})
+	return delivery
+}
+
+// init (re)initializes the delivery with the given wire form
+func (delivery *wrapDelivery) init(wire []byte, shared *deliveryShared) {
+	*delivery = wrapDelivery{deliveryShared: shared, wire: wire, payload: wire}
+	delivery.state = &delivery.own
+	delivery.deadline = &delivery.ownDeadline
+
+	if envelope, ok := decodeEnvelope(wire); ok {
+		delivery.payload = envelope.Payload
+		delivery.headers = envelope.Headers
+		delivery.checksum = envelope.Checksum
+		delivery.corrupt = !envelope.verify()
 	}
 }
 
+// deliveryPool holds the deliveries recycled by queues pooling deliveries, see
+// connection.SetDeliveryPooling()
+var deliveryPool = sync.Pool{New: func() interface{} { return &wrapDelivery{} }}
+
+// recycled is the state of deliveries returned to the delivery pool
+const recycled = -1
+
+// recycle returns the delivery to the delivery pool. Settling it until it's
+// reused panics, afterwards it's another delivery
+func (delivery *wrapDelivery) recycle() {
+	*delivery = wrapDelivery{own: recycled}
+	delivery.state = &delivery.own
+	delivery.deadline = &delivery.ownDeadline
+	deliveryPool.Put(delivery)
+}
+
+// track sets the visibility deadline the delivery was fetched with, as
+// visibilityScore(), see queue.SetVisibilityTimeout()
+func (delivery *wrapDelivery) track(deadline float64) {
+	atomic.StoreInt64(delivery.deadline, int64(deadline))
+}
+
+// tracked returns the visibility deadline arguments of the scripts removing
+// the delivery from unacked, none if it was fetched without a deadline
+func (delivery *wrapDelivery) tracked() []interface{} {
+	if deadline := atomic.LoadInt64(delivery.deadline); deadline != 0 && delivery.inflightKey != "" {
+		return []interface{}{deadline}
+	}
+	return nil
+}
+
 func (delivery *wrapDelivery) String() string {
 	return fmt.Sprintf("[%s %s]", delivery.payload, delivery.unackedKey)
 }
@@ -46,38 +226,447 @@ func (delivery *wrapDelivery) PayloadBytes() []byte {
 	return delivery.payload
 }
 
+// PayloadReader returns a new reader over the payload. Reading from it doesn't
+// affect Payload() or PayloadBytes()
+func (delivery *wrapDelivery) PayloadReader() io.Reader {
+	return bytes.NewReader(delivery.payload)
+}
+
+// State returns how the delivery was settled by this process, Unacked if it
+// wasn't settled yet
+func (delivery *wrapDelivery) State() State {
+	return State(atomic.LoadInt32(delivery.state))
+}
+
+// Headers returns the headers of the delivery's envelope, nil if it has none
+func (delivery *wrapDelivery) Headers() map[string]string {
+	if delivery.view != nil {
+		return delivery.view
+	}
+	return delivery.headers
+}
+
+// Header returns the value of the given header and whether it's set
+func (delivery *wrapDelivery) Header(key string) (string, bool) {
+	value, ok := delivery.Headers()[key]
+	return value, ok
+}
+
+// WithHeader returns a copy of the delivery with the given header set. The
+// header only exists in this process, it's not stored when the copy gets
+// rejected, pushed or dead lettered. Settling either the copy or the original
+// delivery settles both
+func (delivery *wrapDelivery) WithHeader(key, value string) Delivery {
+	view := make(map[string]string, len(delivery.Headers())+1)
+	for k, v := range delivery.Headers() {
+		view[k] = v
+	}
+	view[key] = value
+
+	copied := *delivery
+	copied.view = view
+	return &copied
+}
+
 func (delivery *wrapDelivery) Ack() bool {
+	return settleResult(delivery.AckErr())
+}
+
+// AckErr is like Ack, but returns Redis errors instead of panicking,
+// ErrDeliveryNotFound if the delivery wasn't unacked anymore and
+// ErrAlreadySettled if it was already settled by this process. The delivery
+// stays unacked if an error other than ErrAlreadySettled is returned
+func (delivery *wrapDelivery) AckErr() error {
 	// debug(fmt.Sprintf("delivery ack %s", delivery)) // COMMENTOUT
+	if !delivery.settle(Acked) {
+		return ErrAlreadySettled
+	}
+	return delivery.settled(delivery.ack())
+}
 
-	result := delivery.redisClient.LRem(delivery.unackedKey, 1, delivery.payload)
-	if redisErrIsNil(result) {
-		return false
+func (delivery *wrapDelivery) ack() error {
+	if delivery.acks != nil && delivery.acks.add(delivery) {
+		return nil // removed on the next flush
+	}
+	removed, err := delivery.backend.removeFromUnacked(delivery.unackedKey, delivery.attemptsKey, delivery.inflightKey, atomic.LoadInt64(delivery.deadline), delivery.wire)
+	if err != nil {
+		return err
 	}
+	if !removed {
+		return ErrDeliveryNotFound
+	}
+	delivery.counters.add(counterAcked)
+	return nil
+}
 
-	return result.Val() == 1
+// pipeAck adds the command acking the delivery to pipe, like AckErr() runs it
+func (delivery *wrapDelivery) pipeAck(pipe *redis.Pipeline) {
+	delivery.removeUnacked(pipe)
+}
+
+// ackedResult returns whether the pipelined result of pipeAck() removed the
+// delivery
+func ackedResult(result redis.Cmder) bool {
+	cmd, ok := result.(*redis.Cmd)
+	return ok && cmd.Err() == nil && cmd.Val() == int64(1)
 }
 
 func (delivery *wrapDelivery) Reject() bool {
-	return delivery.move(delivery.rejectedKey)
+	return settleResult(delivery.RejectErr())
+}
+
+// RejectErr is like Reject, but returns Redis errors instead of panicking and
+// ErrAlreadySettled if the delivery was already settled. The delivery stays
+// unacked if a Redis error is returned
+func (delivery *wrapDelivery) RejectErr() error {
+	if !delivery.settle(Rejected) {
+		return ErrAlreadySettled
+	}
+	return delivery.settled(delivery.reject())
+}
+
+func (delivery *wrapDelivery) reject() error {
+	if delivery.retry != nil {
+		return delivery.count(counterRejected, delivery.scheduleRetry())
+	}
+	return delivery.count(counterRejected, delivery.move(delivery.rejectedKey))
+}
+
+// RejectWithReason rejects the delivery and stores the reason and time of the
+// rejection, see queue.GetRejectedWithReasons(). If the queue has a retry
+// policy the delivery gets scheduled for a retry and the reason is dropped
+func (delivery *wrapDelivery) RejectWithReason(reason string) bool {
+	if !delivery.settle(Rejected) {
+		return false
+	}
+	if delivery.retry != nil {
+		return settleResult(delivery.settled(delivery.reject()))
+	}
+	return settleResult(delivery.settled(delivery.rejectWithReason(reason)))
+}
+
+// rejectWithReason moves the settled delivery to the rejected list and stores
+// the reason. If the reason can't be encoded it's moved without one
+func (delivery *wrapDelivery) rejectWithReason(reason string) error {
+	bytes, err := json.Marshal(rejection{
+		Reason:     reason,
+		RejectedAt: delivery.clock.Now(),
+		Connection: delivery.connection,
+		Consumer:   delivery.consumer,
+	})
+	if err != nil {
+		return delivery.count(counterRejected, delivery.move(delivery.rejectedKey))
+	}
+
+	keys := []string{delivery.unackedKey, delivery.rejectedKey, delivery.reasonsKey, delivery.attemptsKey}
+	if delivery.inflightKey != "" {
+		keys = append(keys, delivery.inflightKey)
+	}
+	args := append([]interface{}{delivery.wire, string(bytes)}, delivery.tracked()...)
+	result := rejectReasonScript.pick(delivery.positional).run(delivery.redisClient, keys, args...)
+	if err := redisErr(result); err != nil {
+		return err
+	}
+	if result.Val() == int64(0) {
+		return ErrDeliveryNotFound // redelivered after its visibility timeout
+	}
+	delivery.counters.add(counterRejected)
+
+	if delivery.rejectedMax > 0 {
+		result := trimRejectedScript.run(delivery.redisClient, []string{delivery.rejectedKey, delivery.reasonsKey}, delivery.rejectedMax)
+		if redisErr(result) == nil { // the delivery is rejected either way
+			dropped, _ := result.Val().(int64)
+			reportTrimmed(delivery.hooks, delivery.queueName, dropped)
+		}
+	}
+	return nil
+}
+
+// RejectWithError rejects the delivery using the error message as reason
+func (delivery *wrapDelivery) RejectWithError(err error) bool {
+	return delivery.RejectWithReason(errorReason(err))
 }
 
+// Push moves the delivery to the push queue (or rejects it if there's none).
+// The number of pushes is tracked in the HeaderPushCount header, deliveries
+// which would be pushed more than maxPushDepth times get rejected instead and
+// false is returned
 func (delivery *wrapDelivery) Push() bool {
-	if delivery.pushKey != "" {
-		return delivery.move(delivery.pushKey)
-	} else {
-		return delivery.move(delivery.rejectedKey)
+	return settleResult(delivery.PushErr())
+}
+
+// PushErr is like Push, but returns Redis errors instead of panicking,
+// ErrPushChainTooDeep if the delivery got rejected instead and
+// ErrAlreadySettled if it was already settled. The delivery stays unacked if
+// a Redis error is returned
+func (delivery *wrapDelivery) PushErr() error {
+	if !delivery.settle(Pushed) {
+		return ErrAlreadySettled
+	}
+	return delivery.settled(delivery.push())
+}
+
+func (delivery *wrapDelivery) push() error {
+	if delivery.pushKey == "" {
+		delivery.setState(Rejected)
+		return delivery.count(counterRejected, delivery.move(delivery.rejectedKey))
+	}
+
+	pushCount, _ := strconv.Atoi(delivery.headers[HeaderPushCount])
+	if pushCount >= maxPushDepth {
+		delivery.setState(Rejected)
+		if err := delivery.rejectWithReason(ErrPushChainTooDeep.Error()); err != nil {
+			return err
+		}
+		return ErrPushChainTooDeep
+	}
+
+	headers := delivery.copyHeaders()
+	headers[HeaderPushCount] = strconv.Itoa(pushCount + 1)
+	return delivery.count(counterPushed, delivery.moveWire(delivery.pushKey, delivery.rewrap(headers)))
+}
+
+// Dead moves the delivery straight to the dead letter queue, bypassing any
+// push queues. The name of the queue it was consumed from is recorded in the
+// HeaderOriginQueue header. If there's no dead letter queue the delivery gets
+// rejected and ErrNoDeadLetterQueue is returned. The delivery stays unacked if
+// a Redis error is returned
+func (delivery *wrapDelivery) Dead() error {
+	if !delivery.settle(Dead) {
+		return ErrAlreadySettled
 	}
+	return delivery.settled(delivery.dead())
 }
 
-func (delivery *wrapDelivery) move(key string) bool {
-	if redisErrIsNil(delivery.redisClient.LPush(key, delivery.payload)) {
+func (delivery *wrapDelivery) dead() error {
+	if delivery.deadKey == "" {
+		delivery.setState(Rejected)
+		if err := delivery.count(counterRejected, delivery.move(delivery.rejectedKey)); err != nil {
+			return err
+		}
+		return ErrNoDeadLetterQueue
+	}
+
+	headers := delivery.copyHeaders()
+	headers[HeaderOriginQueue] = delivery.queueName
+
+	return delivery.count(counterDead, delivery.moveWire(delivery.deadKey, delivery.rewrap(headers)))
+}
+
+// CopyTo publishes a copy of the delivery to the queue with the given name,
+// marked with the HeaderCopyOf header. The delivery itself stays unacked and
+// still needs to be settled
+func (delivery *wrapDelivery) CopyTo(queueName string) error {
+	headers := delivery.copyHeaders()
+	headers[HeaderCopyOf] = delivery.queueName
+	readyKey := strings.Replace(queueReadyTemplate, phQueue, queueName, 1)
+
+	results, err := delivery.redisClient.Pipelined(func(pipe *redis.Pipeline) error {
+		pipe.SAdd(queuesKey, queueName)
+		pipe.LPush(readyKey, delivery.rewrap(headers))
+		return nil
+	})
+	if err := pipelineErr(err); err != nil {
+		return err
+	}
+	for _, result := range results {
+		if err := redisErr(result); err != nil {
+			return err
+		}
+	}
+
+	if hook := delivery.hooks.OnCopy; hook != nil {
+		hook(delivery, queueName)
+	}
+	return nil
+}
+
+// Extend pushes the visibility deadline of the delivery out to timeout from
+// now. Returns false if the queue has no visibility timeout or the delivery
+// isn't tracked anymore (settled or already returned to ready, possibly
+// redelivered to another consumer)
+func (delivery *wrapDelivery) Extend(timeout time.Duration) bool {
+	if delivery.inflightKey == "" {
 		return false
 	}
 
-	if redisErrIsNil(delivery.redisClient.LRem(delivery.unackedKey, 1, delivery.payload)) {
+	deadline := visibilityScore(delivery.clock.Now().Add(timeout))
+	args := append([]interface{}{delivery.wire, int64(deadline)}, delivery.tracked()...)
+	result := extendScript.run(delivery.redisClient, []string{delivery.inflightKey}, args...)
+	if redisErrIsNil(result) || result.Val() != int64(1) {
 		return false
 	}
+	if delivery.tracked() != nil {
+		delivery.track(deadline)
+	}
+	return true
+}
+
+// scheduleRetry moves the delivery to the delayed set of its queue to be
+// retried according to the retry policy. Once its retries are exhausted it's
+// moved to the dead letter queue (or rejected if there's none) instead
+func (delivery *wrapDelivery) scheduleRetry() error {
+	retries, _ := strconv.Atoi(delivery.headers[HeaderRetryCount])
+	if delivery.retry.exhausted(retries) {
+		if delivery.deadKey == "" {
+			return delivery.move(delivery.rejectedKey)
+		}
+
+		delivery.setState(Dead)
+		headers := delivery.copyHeaders()
+		headers[HeaderOriginQueue] = delivery.queueName
+		return delivery.moveWire(delivery.deadKey, delivery.rewrap(headers))
+	}
+
+	delivery.setState(Delayed)
+	headers := delivery.copyHeaders()
+	headers[HeaderRetryCount] = strconv.Itoa(retries + 1)
+	due := visibilityScore(delivery.clock.Now().Add(delivery.retry.delay(retries)))
+	wire := delivery.rewrap(headers)
+
+	results, err := delivery.redisClient.Pipelined(func(pipe *redis.Pipeline) error {
+		pipe.ZAdd(delivery.delayedKey, redis.Z{Score: due, Member: wire})
+		delivery.removeUnacked(pipe)
+		return nil
+	})
+	return delivery.moveResult(delivery.delayedKey, results, err)
+}
+
+func (delivery *wrapDelivery) move(key string) error {
+	return delivery.moveWire(key, delivery.wire)
+}
+
+// moveWire pushes wire to the list at key and removes the delivery from
+// unacked, sharing one round trip. As these can't be atomic (the lists may
+// live on different cluster nodes) an error describes which half failed.
+// Moves to the rejected list trim it if the queue has a rejected max length
+func (delivery *wrapDelivery) moveWire(key string, wire []byte) error {
+	trim := key == delivery.rejectedKey && delivery.rejectedMax > 0
+	results, err := delivery.redisClient.Pipelined(func(pipe *redis.Pipeline) error {
+		pipe.LPush(key, wire)
+		delivery.removeUnacked(pipe)
+		if trim {
+			trimRejectedScript.eval(delivery.redisClient, pipe, []string{delivery.rejectedKey, delivery.reasonsKey}, delivery.rejectedMax)
+		}
+		return nil
+	})
+	if trim && len(results) == 3 {
+		if result, ok := results[2].(*redis.Cmd); ok && redisErr(result) == nil {
+			dropped, _ := result.Val().(int64)
+			reportTrimmed(delivery.hooks, delivery.queueName, dropped)
+		}
+		results = results[:2]
+	}
+	return delivery.moveResult(key, results, err)
+}
+
+// removeUnacked adds the command removing the delivery from unacked to pipe.
+// A stale copy of a delivery which got redelivered after its visibility
+// timeout doesn't remove the redelivered one, see removeUnackedScript
+func (delivery *wrapDelivery) removeUnacked(pipe *redis.Pipeline) {
+	args := append([]interface{}{delivery.wire}, delivery.tracked()...)
+	removeUnackedScript.pick(delivery.positional).eval(delivery.redisClient, pipe, delivery.removeUnackedKeys(), args...)
+}
+
+// removeUnackedKeys returns the keys of removeUnackedScript for the delivery
+func (delivery *wrapDelivery) removeUnackedKeys() []string {
+	if delivery.inflightKey != "" {
+		return []string{delivery.unackedKey, delivery.attemptsKey, delivery.inflightKey}
+	}
+	return []string{delivery.unackedKey, delivery.attemptsKey}
+}
+
+// moveResult describes which half of a move to key failed, given the results
+// of the pipelined push and removal from unacked
+func (delivery *wrapDelivery) moveResult(key string, results []redis.Cmder, err error) error {
+	if len(results) != 2 {
+		if err = pipelineErr(err); err == nil {
+			err = fmt.Errorf("rmq delivery failed to move to %s %s", key, delivery)
+		}
+		return err
+	}
+
+	pushErr, removeErr := redisErr(results[0]), redisErr(results[1])
+	switch {
+	case pushErr != nil && removeErr != nil:
+		return pushErr
+	case pushErr != nil:
+		return fmt.Errorf("rmq delivery removed from unacked, but failed to push to %s %s: %w", key, delivery, pushErr)
+	case removeErr != nil:
+		return fmt.Errorf("rmq delivery pushed to %s, but failed to remove from unacked %s: %w", key, delivery, removeErr)
+	}
 
 	// debug(fmt.Sprintf("delivery rejected %s", delivery)) // COMMENTOUT
-	return true
+	return nil
+}
+
+// settle marks the delivery as settled to the given state. Returns false if
+// it was already settled, in which case the OnDoubleSettle hook gets called
+func (delivery *wrapDelivery) settle(state State) bool {
+	if atomic.CompareAndSwapInt32(delivery.state, int32(Unacked), int32(state)) {
+		return true
+	}
+	if atomic.LoadInt32(delivery.state) == recycled {
+		log.Panicf("rmq delivery settled after it was recycled, don't keep deliveries of queues pooling deliveries once Consume() returned")
+	}
+	if hook := delivery.hooks.OnDoubleSettle; hook != nil {
+		hook(delivery)
+	}
+	return false
+}
+
+// settled passes on the error of settling the delivery. Unless the delivery
+// was settled successfully (possibly differently than asked for) it's rolled
+// back to Unacked, so its state doesn't claim a settlement which didn't happen
+func (delivery *wrapDelivery) settled(err error) error {
+	switch err {
+	case nil, ErrPushChainTooDeep, ErrNoDeadLetterQueue:
+	default:
+		delivery.setState(Unacked)
+	}
+	return err
+}
+
+// count counts the settlement if it succeeded and passes its error on
+func (delivery *wrapDelivery) count(counter int, err error) error {
+	if err == nil {
+		delivery.counters.add(counter)
+	}
+	return err
+}
+
+// setState overrides the state of a delivery settled differently than asked
+// for, like a push without push queue ending up rejected
+func (delivery *wrapDelivery) setState(state State) {
+	atomic.StoreInt32(delivery.state, int32(state))
+}
+
+// rewrap returns the wire form of the delivery with the given headers,
+// keeping its checksum
+func (delivery *wrapDelivery) rewrap(headers map[string]string) []byte {
+	rewrapped := &envelope{Payload: delivery.payload, Headers: headers, Checksum: delivery.checksum}
+	return rewrapped.encode()
+}
+
+// copyHeaders returns a copy of the wire headers which can be modified
+func (delivery *wrapDelivery) copyHeaders() map[string]string {
+	headers := make(map[string]string, len(delivery.headers)+1)
+	for key, value := range delivery.headers {
+		headers[key] = value
+	}
+	return headers
+}
+
+// settleResult converts the error returned by an error variant like AckErr
+// to the result of its bool variant, panicking on Redis errors
+func settleResult(err error) bool {
+	switch err {
+	case nil:
+		return true
+	case ErrDeliveryNotFound, ErrAlreadySettled, ErrPushChainTooDeep:
+		return false
+	default:
+		log.Panicf("rmq redis error is not nil %s", err)
+		return false
+	}
 }
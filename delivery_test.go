@@ -1 +1,223 @@
 package rmq
+
+import (
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"gopkg.in/redis.v5"
+)
+
+func TestDeliveryPayloadReader(t *testing.T) {
+	wire := (&envelope{Payload: []byte("large payload")}).encode()
+	delivery := newDelivery(wire, "unacked", "rejected", "", nil)
+
+	reader := delivery.PayloadReader()
+	part := make([]byte, 5)
+	if _, err := reader.Read(part); err != nil || string(part) != "large" {
+		t.Fatal("unexpected read", string(part), err)
+	}
+	if payload := delivery.Payload(); payload != "large payload" {
+		t.Error("unexpected payload after partial read", payload)
+	}
+
+	rest, err := ioutil.ReadAll(reader)
+	if err != nil || string(rest) != " payload" {
+		t.Error("unexpected rest", string(rest), err)
+	}
+	if all, _ := ioutil.ReadAll(delivery.PayloadReader()); string(all) != "large payload" {
+		t.Error("new reader should start at the beginning", string(all))
+	}
+}
+
+func TestDeliveryWithHeader(t *testing.T) {
+	wire := (&envelope{Payload: []byte("payload"), Headers: map[string]string{"trace": "abc"}}).encode()
+	delivery := newDelivery(wire, "unacked", "rejected", "", nil)
+
+	stamped := delivery.WithHeader("worker", "host-1")
+	if value, ok := stamped.Header("worker"); !ok || value != "host-1" {
+		t.Error("unexpected stamped header", value, ok)
+	}
+	if value, ok := stamped.Header("trace"); !ok || value != "abc" {
+		t.Error("unexpected original header", value, ok)
+	}
+	if _, ok := delivery.Header("worker"); ok {
+		t.Error("original delivery should not see stamped header")
+	}
+
+	decoded, _ := decodeEnvelope(stamped.(*wrapDelivery).rewrap(stamped.(*wrapDelivery).copyHeaders()))
+	if _, ok := decoded.Headers["worker"]; ok {
+		t.Error("stamped header should not reach the wire", decoded.Headers)
+	}
+	if decoded.Headers["trace"] != "abc" {
+		t.Error("unexpected wire headers", decoded.Headers)
+	}
+}
+
+func TestDeliverySettleOnce(t *testing.T) {
+	var doubleSettles int32
+	delivery := newDelivery([]byte("payload"), "unacked", "rejected", "", nil)
+	delivery.hooks.OnDoubleSettle = func(Delivery) { atomic.AddInt32(&doubleSettles, 1) }
+
+	var settled int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if delivery.settle(Acked) {
+				atomic.AddInt32(&settled, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if settled != 1 || doubleSettles != 9 {
+		t.Error("expected one settle and nine double settles", settled, doubleSettles)
+	}
+
+	// these would panic if they touched Redis
+	if err := delivery.RejectErr(); err != ErrAlreadySettled {
+		t.Error("unexpected reject error", err)
+	}
+	if delivery.Push() || delivery.RejectWithReason("again") {
+		t.Error("settled delivery should not settle again")
+	}
+	if err := delivery.WithHeader("key", "value").AckErr(); err != ErrAlreadySettled {
+		t.Error("copies should share the settle state", err)
+	}
+}
+
+func TestDeliveryRollbackOnError(t *testing.T) {
+	redisClient := redis.NewClient(&redis.Options{Addr: "localhost:1"}) // nothing listens there
+	defer redisClient.Close()
+	delivery := newDelivery([]byte("payload"), "unacked", "rejected", "", redisClient)
+
+	if err := delivery.AckErr(); err == nil || err == ErrAlreadySettled {
+		t.Error("unexpected ack error", err)
+	}
+	if state := delivery.State(); state != Unacked {
+		t.Error("failed ack should leave the delivery unacked", state)
+	}
+	if err := delivery.RejectErr(); err == nil || err == ErrAlreadySettled {
+		t.Error("failed ack should not block settling again", err)
+	}
+	if state := delivery.State(); state != Unacked {
+		t.Error("failed reject should leave the delivery unacked", state)
+	}
+}
+
+func TestDeliveryShared(t *testing.T) {
+	queue := newQueue("shared-q", "shared-conn", "shared-queues", "", nil)
+	first, second := queue.newDelivery([]byte("d1")), queue.newDelivery([]byte("d2"))
+	if first.deliveryShared != second.deliveryShared {
+		t.Error("deliveries of a queue should share their keys")
+	}
+
+	queue.SetRejectedMaxLength(10)
+	third := queue.newDelivery([]byte("d3"))
+	if third.deliveryShared == first.deliveryShared || third.rejectedMax != 10 || first.rejectedMax != 0 {
+		t.Error("setting should apply to deliveries consumed afterwards only", first.rejectedMax, third.rejectedMax)
+	}
+}
+
+func TestDeliveryRecycle(t *testing.T) {
+	queue := newQueue("recycle-q", "recycle-conn", "recycle-queues", "", nil)
+	queue.pooling = true
+	unsettled, settled := queue.newDelivery([]byte("d1")), queue.newDelivery([]byte("d2"))
+	settled.setState(Acked)
+	queue.recycle(unsettled, settled)
+	if unsettled.State() != Unacked || unsettled.Payload() != "d1" {
+		t.Error("unsettled delivery should not be recycled", unsettled.State())
+	}
+	if settled.State() != recycled || settled.deliveryShared != nil {
+		t.Error("settled delivery should be recycled", settled.State())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("settling a recycled delivery should panic")
+		}
+	}()
+	settled.Ack()
+}
+
+func benchmarkDelivery(b *testing.B, pooling bool) {
+	queue := newQueue("bench-q", "bench-conn", "bench-queues", "", nil)
+	queue.pooling = pooling
+	wire := []byte("payload")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		delivery := queue.newDelivery(wire)
+		delivery.setState(Acked)
+		queue.recycle(delivery)
+	}
+}
+
+func BenchmarkDelivery(b *testing.B) {
+	benchmarkDelivery(b, false)
+}
+
+func BenchmarkDeliveryPooled(b *testing.B) {
+	benchmarkDelivery(b, true)
+}
+
+// benchmarkMove settles b.N unacked deliveries with settle, run with
+// -bench 'Reject|Push' against a local Redis
+func benchmarkMove(b *testing.B, settle func(delivery *wrapDelivery) error) {
+	connection := OpenConnection("move-bench", testRedisAddr, 1)
+	defer connection.StopHeartbeat()
+	queue := connection.OpenQueue("move-bench-q").(*redisQueue)
+	pushQueue := connection.OpenQueue("move-bench-push-q").(*redisQueue)
+	if err := queue.SetPushQueue(pushQueue); err != nil {
+		b.Fatal(err)
+	}
+	cleanup := func() {
+		queue.PurgeRejected()
+		queue.PurgeUnacked()
+		pushQueue.PurgeReady()
+	}
+	cleanup()
+	defer cleanup()
+
+	wire := []byte("move-bench-d")
+	chunk := make([]string, 1000)
+	for i := range chunk {
+		chunk[i] = string(wire)
+	}
+	for pushed := 0; pushed < b.N; pushed += len(chunk) {
+		if err := connection.backend.push(queue.unackedKey, chunk...); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := settle(queue.newDelivery(wire)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReject pushes to rejected and removes from unacked in one round
+// trip, compare with BenchmarkRejectTwoRoundTrips
+func BenchmarkReject(b *testing.B) {
+	benchmarkMove(b, (*wrapDelivery).RejectErr)
+}
+
+func BenchmarkPush(b *testing.B) {
+	benchmarkMove(b, (*wrapDelivery).PushErr)
+}
+
+// BenchmarkRejectTwoRoundTrips rejects like Reject() did before it pipelined
+// the push and the removal from unacked
+func BenchmarkRejectTwoRoundTrips(b *testing.B) {
+	benchmarkMove(b, func(delivery *wrapDelivery) error {
+		if err := redisErr(delivery.redisClient.LPush(delivery.rejectedKey, delivery.wire)); err != nil {
+			return err
+		}
+		_, err := delivery.backend.removeFromUnacked(delivery.unackedKey, delivery.attemptsKey, "", 0, delivery.wire)
+		return err
+	})
+}
@@ -0,0 +1,123 @@
+package rmq
+
+import "strings"
+
+// PurgeCounts are the numbers of deliveries deleted by queue.Destroy()
+type PurgeCounts struct {
+	Ready       int64 // ready deliveries
+	Rejected    int64 // rejected deliveries
+	Delayed     int64 // deliveries waiting to be retried
+	Unacked     int64 // unacked deliveries of all connections
+	Connections int   // connections whose keys of the queue were deleted
+}
+
+// Destroy deletes all keys of the queue, including the unacked deliveries and
+// consumers of all connections, and removes it from the list of queues.
+// Returns ErrConsumersActive if any live connection has consumers registered
+// on the queue, see ForceDestroy
+func (queue *redisQueue) Destroy() (PurgeCounts, error) {
+	return queue.destroy(false)
+}
+
+// ForceDestroy is like Destroy, but also deletes the queue if live
+// connections still consume it. Their consumers keep running on a queue which
+// doesn't exist anymore
+func (queue *redisQueue) ForceDestroy() (PurgeCounts, error) {
+	return queue.destroy(true)
+}
+
+func (queue *redisQueue) destroy(force bool) (counts PurgeCounts, err error) {
+	result := queue.redisClient.SMembers(connectionsKey)
+	if err := redisErr(result); err != nil {
+		return counts, err
+	}
+	connectionNames := result.Val()
+
+	if !force {
+		for _, connectionName := range connectionNames {
+			active, err := queue.consumedBy(connectionName)
+			if err != nil {
+				return counts, err
+			}
+			if active {
+				return counts, ErrConsumersActive
+			}
+		}
+	}
+
+	if counts.Ready, err = queue.purge(queue.readyKey); err != nil {
+		return counts, err
+	}
+	if counts.Rejected, err = queue.purge(queue.rejectedKey, queue.reasonsKey); err != nil {
+		return counts, err
+	}
+	delayed := queue.redisClient.ZCard(queue.delayedKey)
+	if err := redisErr(delayed); err != nil {
+		return counts, err
+	}
+	counts.Delayed = delayed.Val()
+	for _, key := range []string{queue.delayedKey, queue.attemptsKey, queue.checksumKey, queue.quarantinedKey, queue.historyKey, queue.countersKey} {
+		if err := redisErr(queue.redisClient.Del(key)); err != nil {
+			return counts, err
+		}
+	}
+
+	for _, connectionName := range connectionNames {
+		unacked, err := queue.purge(
+			connectionQueueKey(connectionQueueUnackedTemplate, connectionName, queue.name),
+			connectionQueueKey(connectionQueueInflightTemplate, connectionName, queue.name),
+			connectionQueueKey(connectionQueueConsumersTemplate, connectionName, queue.name),
+			connectionQueueKey(connectionQueueStatsTemplate, connectionName, queue.name),
+			connectionQueueKey(connectionQueueLatencyTemplate, connectionName, queue.name),
+		)
+		if err != nil {
+			return counts, err
+		}
+		connectionQueuesKey := strings.Replace(connectionQueuesTemplate, phConnection, connectionName, 1)
+		removed := queue.redisClient.SRem(connectionQueuesKey, queue.name)
+		if err := redisErr(removed); err != nil {
+			return counts, err
+		}
+		counts.Unacked += unacked
+		if unacked > 0 || removed.Val() > 0 {
+			counts.Connections++
+		}
+	}
+
+	if err := redisErr(queue.redisClient.HDel(pushQueuesKey, queue.name)); err != nil {
+		return counts, err
+	}
+	if err := redisErr(queue.redisClient.HDel(queuesActivityKey, queue.name)); err != nil {
+		return counts, err
+	}
+	if err := redisErr(queue.redisClient.SRem(queuesKey, queue.name)); err != nil {
+		return counts, err
+	}
+	return counts, nil
+}
+
+// consumedBy returns true if the connection with the given name is alive and
+// has consumers registered on the queue
+func (queue *redisQueue) consumedBy(connectionName string) (bool, error) {
+	heartbeatKey := strings.Replace(connectionHeartbeatTemplate, phConnection, connectionName, 1)
+	heartbeat := queue.redisClient.Exists(heartbeatKey)
+	if err := redisErr(heartbeat); err != nil {
+		return false, err
+	}
+	if !heartbeat.Val() {
+		return false, nil
+	}
+
+	consumersKey := connectionQueueKey(connectionQueueConsumersTemplate, connectionName, queue.name)
+	consumers := queue.redisClient.SCard(consumersKey)
+	if err := redisErr(consumers); err != nil {
+		return false, err
+	}
+	return consumers.Val() > 0, nil
+}
+
+// connectionQueueKey returns the key of a connection queue template
+func connectionQueueKey(template, connectionName, queueName string) string {
+	key := strings.Replace(template, phConnection, connectionName, 1)
+	return strings.Replace(key, phQueue, queueName, 1)
+}
@@ -0,0 +1,136 @@
+package rmq
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+const (
+	// envelopePrefix marks payloads which are wrapped in an envelope on the
+	// wire. It starts with a NUL byte to not collide with text payloads.
+	envelopePrefix = "\x00rmq:"
+
+	// HeaderOriginQueue is the header holding the name of the queue a dead
+	// lettered delivery was consumed from
+	HeaderOriginQueue = "rmq-origin-queue"
+
+	// HeaderPushCount is the header holding the number of times a delivery
+	// was pushed along a chain of push queues
+	HeaderPushCount = "rmq-push-count"
+
+	// HeaderRetryCount is the header holding the number of times a delivery
+	// was retried according to its queue's retry policy
+	HeaderRetryCount = "rmq-retry-count"
+
+	// HeaderID is the header holding the unique id assigned to deliveries
+	// published in an envelope, see queue.DeleteRejectedByID()
+	HeaderID = "rmq-id"
+
+	// HeaderPublishedAt is the header holding the time a delivery was
+	// published in an envelope, formatted as RFC 3339 with nanoseconds
+	HeaderPublishedAt = "rmq-published-at"
+
+	// HeaderCopyOf is the header holding the name of the queue a delivery
+	// copied by delivery.CopyTo() was consumed from
+	HeaderCopyOf = "rmq-copy-of"
+)
+
+// ErrChecksumMismatch is the rejection reason of deliveries whose payload
+// doesn't match the checksum of their envelope, see queue.SetChecksums()
+var ErrChecksumMismatch = errors.New("rmq delivery payload checksum mismatch")
+
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// envelope wraps a payload along with its headers on the wire
+type envelope struct {
+	Payload  []byte            `json:"payload"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Checksum string            `json:"checksum,omitempty"` // of Payload as stored, empty if not checked
+}
+
+// encode returns the wire representation of the envelope
+func (envelope *envelope) encode() []byte {
+	bytes, err := json.Marshal(envelope)
+	if err != nil { // can't happen for these field types
+		return envelope.Payload
+	}
+	return append([]byte(envelopePrefix), bytes...)
+}
+
+// checksum returns the checksum of a payload as stored in envelopes. It covers
+// the payload bytes as they are on the wire, so it's verified before any later
+// decoding (like decompression or decryption) of the payload
+func checksum(payload []byte) string {
+	return fmt.Sprintf("crc32c:%08x", crc32.Checksum(payload, checksumTable))
+}
+
+// verify returns false if the envelope has a checksum which doesn't match its
+// payload
+func (envelope *envelope) verify() bool {
+	return envelope.Checksum == "" || envelope.Checksum == checksum(envelope.Payload)
+}
+
+// decodeEnvelope unwraps a payload read from the wire. Returns false if the
+// payload isn't wrapped in an envelope
+func decodeEnvelope(wire []byte) (*envelope, bool) {
+	if !bytes.HasPrefix(wire, []byte(envelopePrefix)) {
+		return nil, false
+	}
+
+	decoded := &envelope{}
+	if err := json.Unmarshal(wire[len(envelopePrefix):], decoded); err != nil {
+		return nil, false
+	}
+	return decoded, true
+}
+
+// matchPayload returns a function reporting whether a wire payload carries the
+// given payload, wrapped in an envelope or not
+func matchPayload(payload []byte) func(wire string) bool {
+	return func(wire string) bool {
+		return decodePayload(wire) == string(payload)
+	}
+}
+
+// matchID returns a function reporting whether a wire payload is wrapped in an
+// envelope with the given id
+func matchID(id string) func(wire string) bool {
+	return func(wire string) bool {
+		decoded, ok := decodeEnvelope([]byte(wire))
+		return ok && decoded.Headers[HeaderID] == id
+	}
+}
+
+// publishedAt returns the publishing time stored in the envelope of a wire
+// payload. Returns false if the payload has no envelope or no valid time
+func publishedAt(wire string) (time.Time, bool) {
+	decoded, ok := decodeEnvelope([]byte(wire))
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, decoded.Headers[HeaderPublishedAt])
+	return t, err == nil
+}
+
+// DecodeEntry returns the payload and headers of an entry as returned by
+// queue.PeekReady(). Entries published without headers are returned as they
+// are, along with nil headers
+func DecodeEntry(entry string) (payload string, headers map[string]string) {
+	if decoded, ok := decodeEnvelope([]byte(entry)); ok {
+		return string(decoded.Payload), decoded.Headers
+	}
+	return entry, nil
+}
+
+// decodePayload returns the payload of a wire payload, unwrapping it in case
+// it's wrapped in an envelope
+func decodePayload(wire string) string {
+	if decoded, ok := decodeEnvelope([]byte(wire)); ok {
+		return string(decoded.Payload)
+	}
+	return wire
+}
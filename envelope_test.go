@@ -0,0 +1,76 @@
+package rmq
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	original := &envelope{
+		Payload: []byte("binary \x00\xff payload"),
+		Headers: map[string]string{HeaderOriginQueue: "things"},
+	}
+
+	decoded, ok := decodeEnvelope(original.encode())
+	if !ok {
+		t.Fatal("encoded envelope should decode")
+	}
+	if string(decoded.Payload) != string(original.Payload) {
+		t.Error("unexpected payload", decoded.Payload)
+	}
+	if decoded.Headers[HeaderOriginQueue] != "things" {
+		t.Error("unexpected headers", decoded.Headers)
+	}
+
+	payload, headers := DecodeEntry(string(original.encode()))
+	if payload != string(original.Payload) || headers[HeaderOriginQueue] != "things" {
+		t.Error("unexpected entry", payload, headers)
+	}
+}
+
+func TestEnvelopePlainPayload(t *testing.T) {
+	if _, ok := decodeEnvelope([]byte(`{"payload":"not wrapped"}`)); ok {
+		t.Error("plain payload should not decode as envelope")
+	}
+	if _, ok := decodeEnvelope([]byte(envelopePrefix + "not json")); ok {
+		t.Error("invalid envelope should not decode")
+	}
+	if payload := decodePayload("plain"); payload != "plain" {
+		t.Error("unexpected payload", payload)
+	}
+	if payload, headers := DecodeEntry("plain"); payload != "plain" || headers != nil {
+		t.Error("unexpected entry", payload, headers)
+	}
+}
+
+func TestEnvelopeChecksum(t *testing.T) {
+	payload := []byte("checked payload")
+	checked := &envelope{Payload: payload, Checksum: checksum(payload)}
+
+	decoded, ok := decodeEnvelope(checked.encode())
+	if !ok || !decoded.verify() {
+		t.Fatal("checked envelope should verify")
+	}
+
+	decoded.Payload[0] = 'C'
+	if decoded.verify() {
+		t.Error("corrupted envelope should not verify")
+	}
+	if !(&envelope{Payload: payload}).verify() {
+		t.Error("envelope without checksum should verify")
+	}
+}
+
+func BenchmarkEnvelopeVerify(b *testing.B) {
+	payload := bytes.Repeat([]byte("x"), 64*1024)
+	wire := (&envelope{Payload: payload, Checksum: checksum(payload)}).encode()
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		decoded, _ := decodeEnvelope(wire)
+		if !decoded.verify() {
+			b.Fatal("envelope should verify")
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package rmq
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"gopkg.in/redis.v5"
+)
+
+// The errors below classify what went wrong, match them with errors.Is().
+// Other sentinel errors are declared next to the code returning them, like
+// ErrDeliveryNotFound and ErrAlreadySettled in delivery.go or the cleaner's
+// errors in cleaner_errors.go. Errors returned by Redis are wrapped in a
+// *RedisError, see IsRetryable() to tell errors worth retrying apart
+var (
+	// ErrNotConnected is returned by queue.StartConsumingErr() if the queue's
+	// connection was stopped already
+	ErrNotConnected = errors.New("rmq connection stopped")
+
+	// ErrAlreadyConsuming is returned by queue.StartConsumingErr() if the
+	// queue is consuming already
+	ErrAlreadyConsuming = errors.New("rmq queue already consuming")
+
+	// ErrNotConsuming is returned by queue.StopConsumingErr() if the queue
+	// wasn't consuming or was stopped already
+	ErrNotConsuming = errors.New("rmq queue not consuming")
+
+	// ErrQueueNotOpen is for operations on queues which aren't open (anymore),
+	// for example because they were closed or destroyed by another process.
+	// rmq's own queues don't return it yet, middleware wrapping queues can
+	ErrQueueNotOpen = errors.New("rmq queue not open")
+
+	// ErrQueueFull is for publishers refusing payloads because a queue reached
+	// its capacity, which is worth retrying later. rmq's own queues are
+	// unbounded and don't return it, middleware limiting them can
+	ErrQueueFull = errors.New("rmq queue full")
+
+	// ErrPayloadTooLarge is for publishers refusing payloads above a size
+	// limit, which isn't worth retrying. rmq's own queues don't limit payload
+	// sizes and don't return it, middleware limiting them can
+	ErrPayloadTooLarge = errors.New("rmq payload too large")
+)
+
+// RedisError is an error returned by Redis or the Redis client, along with
+// the command and the key it was run on
+type RedisError struct {
+	Command string // like "LLEN" or "EVALSHA", "PIPELINE" for pipelines
+	Key     string // the first key of the command, empty if unknown
+	Err     error  // the error of the Redis client
+}
+
+func (err *RedisError) Error() string {
+	if err.Key == "" {
+		return fmt.Sprintf("rmq redis %s failed: %s", err.Command, err.Err)
+	}
+	return fmt.Sprintf("rmq redis %s %s failed: %s", err.Command, err.Key, err.Err)
+}
+
+func (err *RedisError) Unwrap() error {
+	return err.Err
+}
+
+// Retryable returns true if running the command again later might succeed,
+// because Redis wasn't reachable or was busy (LOADING, BUSY, TRYAGAIN,
+// CLUSTERDOWN, MASTERDOWN). Errors like WRONGTYPE or script errors aren't
+func (err *RedisError) Retryable() bool {
+	if unreachable(err.Err) {
+		return true
+	}
+	for _, prefix := range []string{"LOADING ", "BUSY ", "TRYAGAIN ", "CLUSTERDOWN ", "MASTERDOWN "} {
+		if strings.HasPrefix(err.Err.Error(), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsRetryable returns true if err is worth retrying later: retryable Redis
+// errors, ErrRedisUnavailable and ErrQueueFull. Other errors are permanent
+func IsRetryable(err error) bool {
+	var redisErr *RedisError
+	if errors.As(err, &redisErr) && redisErr.Retryable() {
+		return true
+	}
+	return errors.Is(err, ErrRedisUnavailable) || errors.Is(err, ErrQueueFull)
+}
+
+// unreachable returns true if err means that Redis couldn't be reached
+func unreachable(err error) bool {
+	var redisErr *RedisError
+	if errors.As(err, &redisErr) {
+		err = redisErr.Err
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		strings.HasPrefix(err.Error(), "redis: connection pool") || err.Error() == "redis: client is closed"
+}
+
+// newRedisError wraps the error of a command with the command's name and key
+func newRedisError(result redis.Cmder, err error) *RedisError {
+	command, key := commandOf(result.String())
+	return &RedisError{Command: command, Key: key, Err: err}
+}
+
+// pipelineErr wraps the error of a pipeline, ignoring redis.Nil like redisErr()
+func pipelineErr(err error) error {
+	if err == nil || err == redis.Nil {
+		return nil
+	}
+	return &RedisError{Command: "PIPELINE", Err: err}
+}
+
+// commandOf returns the name and first key of a command described by its
+// String(), like "evalsha 1a2b 2 key1 key2 arg: ERR ...". The client doesn't
+// export them otherwise
+func commandOf(description string) (command, key string) {
+	if i := strings.Index(description, ": "); i >= 0 {
+		description = description[:i]
+	}
+	args := strings.Fields(description)
+	if len(args) == 0 {
+		return "", ""
+	}
+
+	command = strings.ToUpper(args[0])
+	position := 1
+	if command == "EVAL" || command == "EVALSHA" {
+		if len(args) < 4 || args[2] == "0" {
+			return command, ""
+		}
+		position = 3
+	}
+	if position < len(args) {
+		key = args[position]
+	}
+	return command, key
+}
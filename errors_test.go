@@ -0,0 +1,62 @@
+package rmq
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"gopkg.in/redis.v5"
+)
+
+func TestCommandOf(t *testing.T) {
+	for _, test := range []struct {
+		description, command, key string
+	}{
+		{"llen rmq::queue::[things]::ready: ERR", "LLEN", "rmq::queue::[things]::ready"},
+		{"evalsha 1a2b 2 key1 key2 arg: NOSCRIPT", "EVALSHA", "key1"},
+		{"eval return 0 0: ERR", "EVAL", ""},
+		{"ping: EOF", "PING", ""},
+		{"", "", ""},
+	} {
+		command, key := commandOf(test.description)
+		if command != test.command || key != test.key {
+			t.Errorf("commandOf(%q) = %q %q, want %q %q", test.description, command, key, test.command, test.key)
+		}
+	}
+}
+
+func TestRedisError(t *testing.T) {
+	err := fmt.Errorf("publishing: %w", &RedisError{Command: "LPUSH", Key: "ready", Err: io.EOF})
+	var redisErr *RedisError
+	if !errors.As(err, &redisErr) || redisErr.Command != "LPUSH" || !errors.Is(err, io.EOF) {
+		t.Errorf("unwrapped %v", err)
+	}
+	if redisErr.Error() != "rmq redis LPUSH ready failed: EOF" {
+		t.Errorf("error %q", redisErr)
+	}
+	if pipelineErr(nil) != nil || pipelineErr(redis.Nil) != nil {
+		t.Errorf("pipeline errors for nil results")
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, test := range []struct {
+		err       error
+		retryable bool
+	}{
+		{&RedisError{Command: "LLEN", Err: io.EOF}, true},
+		{&RedisError{Command: "LLEN", Err: errors.New("LOADING Redis is loading the dataset in memory")}, true},
+		{&RedisError{Command: "EVALSHA", Err: errors.New("BUSY Redis is busy running a script")}, true},
+		{&RedisError{Command: "LLEN", Err: errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")}, false},
+		{fmt.Errorf("cleaning: %w", ErrRedisUnavailable), true},
+		{ErrQueueFull, true},
+		{ErrPayloadTooLarge, false},
+		{ErrAlreadyConsuming, false},
+		{nil, false},
+	} {
+		if IsRetryable(test.err) != test.retryable {
+			t.Errorf("IsRetryable(%v) = %t", test.err, !test.retryable)
+		}
+	}
+}
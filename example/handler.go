@@ -1,34 +1,358 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/adjust/rmq"
 )
 
+// statsTimeout bounds collecting stats for one request, the page shows the
+// stats collected so far if it expires
+const statsTimeout = 5 * time.Second
+
 func main() {
 	connection := rmq.OpenConnection("handler", "tcp", "localhost:6379", 2)
-	http.Handle("/overview", NewHandler(connection))
+	defer rmq.StartStatsRecorder(connection, time.Minute, 24*time.Hour)()
+	handler := NewHandler(connection)
+	// only allow actions from localhost, use proper authentication like
+	// BearerAuthorize() in production
+	handler.SetAuthorize(func(request *http.Request) (allowed, readOnly bool) {
+		return true, !strings.HasPrefix(request.RemoteAddr, "127.0.0.1:")
+	})
+	http.Handle("/overview", handler)
+	http.Handle("/queues/", handler)
 	fmt.Printf("Handler listening on http://localhost:3333/overview\n")
 	http.ListenAndServe(":3333", nil)
 }
 
 type Handler struct {
 	connection rmq.Connection
+	rates      *rmq.RateTracker
+	authorize  func(request *http.Request) (allowed, readOnly bool) // nil to serve the overview to everyone and disable actions
 }
 
 func NewHandler(connection rmq.Connection) *Handler {
-	return &Handler{connection: connection}
+	return &Handler{connection: connection, rates: rmq.NewRateTracker(connection)}
+}
+
+// SetAuthorize restricts the handler to requests authorize allows. Read-only
+// requests only get the overview, the others also the POST
+// /queues/{name}/{action} endpoints and the GET /queues/{name} detail pages.
+// Without authorize the overview is public and the others are disabled
+func (handler *Handler) SetAuthorize(authorize func(request *http.Request) (allowed, readOnly bool)) {
+	handler.authorize = authorize
+}
+
+// BearerAuthorize returns an authorize function for SetAuthorize() allowing
+// requests with an "Authorization: Bearer <token>" header. token grants full
+// access, readOnlyToken only the overview. Empty tokens grant nothing
+func BearerAuthorize(token, readOnlyToken string) func(request *http.Request) (allowed, readOnly bool) {
+	return func(request *http.Request) (allowed, readOnly bool) {
+		header := request.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			return false, false
+		}
+		given := strings.TrimPrefix(header, "Bearer ")
+		switch {
+		case token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1:
+			return true, false
+		case readOnlyToken != "" && subtle.ConstantTimeCompare([]byte(given), []byte(readOnlyToken)) == 1:
+			return true, true
+		}
+		return false, false
+	}
+}
+
+// access is what a request may do
+type access int
+
+const (
+	noAccess       access = iota
+	readOnlyAccess        // overview only
+	fullAccess            // also actions and payloads
+)
+
+func (handler *Handler) access(request *http.Request) access {
+	if handler.authorize == nil {
+		return readOnlyAccess
+	}
+	switch allowed, readOnly := handler.authorize(request); {
+	case !allowed:
+		return noAccess
+	case readOnly:
+		return readOnlyAccess
+	}
+	return fullAccess
 }
 
 func (handler *Handler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	layout := request.FormValue("layout")
-	refresh := request.FormValue("refresh")
+	access := handler.access(request)
+	if access == noAccess {
+		// don't tell unauthorized requests anything about the queues
+		if request.Header.Get("Authorization") == "" {
+			writer.Header().Set("WWW-Authenticate", `Bearer realm="rmq"`)
+			http.Error(writer, "unauthorized", http.StatusUnauthorized)
+		} else {
+			http.Error(writer, "forbidden", http.StatusForbidden)
+		}
+		return
+	}
+
+	if strings.HasPrefix(request.URL.Path, "/queues/") {
+		if !handler.requireFullAccess(writer, request, access) {
+			return
+		}
+		if request.Method == http.MethodGet {
+			handler.serveQueue(writer, request)
+		} else {
+			handler.serveAction(writer, request)
+		}
+		return
+	}
+
+	queues := filterQueues(handler.connection.GetOpenQueues(), request)
+	ctx, cancel := context.WithTimeout(request.Context(), statsTimeout)
+	defer cancel()
+	stats, rates, err := handler.rates.CollectStatsCtx(ctx, queues)
+	if err != nil {
+		log.Printf("failed to collect all queue stats: %s", err)
+	}
+	if request.FormValue("hide-empty") == "true" {
+		hideEmpty(stats)
+	}
+	if request.FormValue("hide-idle") == "true" {
+		stats = stats.WithoutIdleConnections()
+	}
+	generatedAt := time.Now().UTC()
+	writer.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+
+	if request.FormValue("format") == "csv" {
+		writer.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		writer.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="rmq-stats-%s.csv"`, generatedAt.Format("20060102-150405")))
+		stats.WriteCSV(writer)
+		return
+	}
+
+	if wantsJSON(request) {
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(struct {
+			GeneratedAt time.Time `json:"generated_at"`
+			Stats       rmq.Stats `json:"stats"`
+		}{generatedAt, stats})
+		return
+	}
 
-	queues := handler.connection.GetOpenQueues()
-	stats := handler.connection.CollectStats(queues)
 	log.Printf("queue stats\n%s", stats)
-	fmt.Fprint(writer, stats.GetHtml(layout, refresh))
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	refresh, _ := strconv.Atoi(request.FormValue("refresh"))
+	stats.RenderHtml(writer, rmq.HtmlOptions{
+		Condensed:   request.FormValue("layout") == "condensed",
+		Refresh:     refresh,
+		Sort:        request.FormValue("sort"),
+		Descending:  request.FormValue("order") == "desc",
+		GeneratedAt: generatedAt,
+		Actions:     access == fullAccess,
+		Rates:       rates,
+		History:     handler.history(ctx, stats),
+		Health:      handler.health(stats),
+	})
+}
+
+// wantsJSON returns true if the request asks for JSON using ?format=json or
+// the Accept header
+func wantsJSON(request *http.Request) bool {
+	if format := request.FormValue("format"); format != "" {
+		return format == "json"
+	}
+	return strings.Contains(request.Header.Get("Accept"), "application/json")
+}
+
+// filterQueues returns the queues selected by ?queues=a,b,c and
+// ?prefix=orders-, so only their stats get collected
+func filterQueues(queues []string, request *http.Request) []string {
+	var selected map[string]bool
+	if names := request.FormValue("queues"); names != "" {
+		selected = map[string]bool{}
+		for _, name := range strings.Split(names, ",") {
+			selected[strings.TrimSpace(name)] = true
+		}
+	}
+	prefix := request.FormValue("prefix")
+
+	filtered := []string{}
+	for _, queue := range queues {
+		if selected != nil && !selected[queue] {
+			continue
+		}
+		if !strings.HasPrefix(queue, prefix) {
+			continue
+		}
+		filtered = append(filtered, queue)
+	}
+	return filtered
+}
+
+// hideEmpty removes queues without ready, rejected and unacked deliveries
+func hideEmpty(stats rmq.Stats) {
+	for name, queueStat := range stats.QueueStats {
+		if queueStat.ReadyCount == 0 && queueStat.RejectedCount == 0 && queueStat.UnackedCount() == 0 {
+			delete(stats.QueueStats, name)
+		}
+	}
+}
+
+// actions are the actions served by serveAction()
+var actions = map[string]bool{
+	"purge-rejected":  true,
+	"purge-ready":     true,
+	"return-rejected": true,
+	"reset-counters":  true,
+}
+
+// contains returns true if names contains name
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// serveAction serves POST /queues/{name}/purge-rejected, return-rejected
+// (with optional ?max=), purge-ready and reset-counters of open queues,
+// responding with the affected count or the counters before the reset
+func (handler *Handler) serveAction(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(request.URL.Path, "/queues/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		http.NotFound(writer, request)
+		return
+	}
+	// check both before opening the queue, OpenQueue() would register unknown
+	// names as new queues
+	name, action := parts[0], parts[1]
+	if !actions[action] || !contains(handler.connection.GetOpenQueues(), name) {
+		http.NotFound(writer, request)
+		return
+	}
+	queue := handler.connection.OpenQueue(name)
+
+	var count int64
+	var counters *rmq.QueueCounters
+	var err error
+	switch action {
+	case "purge-rejected":
+		count, err = queue.PurgeRejectedErr()
+	case "purge-ready":
+		count, err = queue.PurgeReadyErr()
+	case "return-rejected":
+		max := queue.RejectedCount()
+		if value := request.FormValue("max"); value != "" {
+			if max, err = strconv.Atoi(value); err != nil || max < 0 {
+				http.Error(writer, "invalid max", http.StatusBadRequest)
+				return
+			}
+		}
+		var returned int
+		returned, err = queue.ReturnRejectedErr(max)
+		count = int64(returned)
+	case "reset-counters":
+		var previous rmq.QueueCounters
+		previous, err = queue.ResetCounters()
+		counters = &previous
+	}
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("%s %s: %d", action, name, count)
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(struct {
+		Queue    string             `json:"queue"`
+		Action   string             `json:"action"`
+		Count    int64              `json:"count"`
+		Counters *rmq.QueueCounters `json:"counters,omitempty"`
+	}{name, action, count, counters})
+}
+
+// health returns the health of the queues in stats unless the connection
+// can't tell
+func (handler *Handler) health(stats rmq.Stats) *rmq.HealthReport {
+	connection, ok := handler.connection.(*rmq.RedisConnection)
+	if !ok {
+		return nil
+	}
+	report := connection.HealthSummaryOf(stats)
+	return &report
+}
+
+// serveQueue serves GET /queues/{name}, the detail page of a queue showing up
+// to ?count= (10 by default) ready and rejected payloads. As payloads can be
+// sensitive it's only served to requests with full access
+func (handler *Handler) serveQueue(writer http.ResponseWriter, request *http.Request) {
+	connection, ok := handler.connection.(*rmq.RedisConnection)
+	name := strings.TrimPrefix(request.URL.Path, "/queues/")
+	if !ok || name == "" || strings.Contains(name, "/") {
+		http.NotFound(writer, request)
+		return
+	}
+	count := 10
+	if value := request.FormValue("count"); value != "" {
+		var err error
+		if count, err = strconv.Atoi(value); err != nil || count < 0 {
+			http.Error(writer, "invalid count", http.StatusBadRequest)
+			return
+		}
+	}
+
+	writer.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	connection.QueueDetail(name, count).RenderHtml(writer)
+}
+
+// requireFullAccess returns true if the request may use actions and see
+// payloads, otherwise it responds with not found if actions are disabled or
+// forbidden
+func (handler *Handler) requireFullAccess(writer http.ResponseWriter, request *http.Request, access access) bool {
+	if handler.authorize == nil {
+		http.NotFound(writer, request)
+		return false
+	}
+	if access != fullAccess {
+		http.Error(writer, "forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// history returns the ready history of the last day of all queues in stats,
+// the queues fetched so far if ctx is done first
+func (handler *Handler) history(ctx context.Context, stats rmq.Stats) map[string][]rmq.StatPoint {
+	connection, ok := handler.connection.(*rmq.RedisConnection)
+	if !ok {
+		return nil
+	}
+	queueNames := make([]string, 0, len(stats.QueueStats))
+	for queueName := range stats.QueueStats {
+		queueNames = append(queueNames, queueName)
+	}
+	history, err := connection.QueueHistoriesCtx(ctx, queueNames, time.Now().Add(-24*time.Hour))
+	if err != nil {
+		log.Printf("failed to fetch all queue histories: %s", err)
+	}
+	return history
 }
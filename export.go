@@ -0,0 +1,182 @@
+package rmq
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"gopkg.in/redis.v5"
+)
+
+// Lists of a queue which can be exported by queue.Export()
+const (
+	ExportReady    = "ready"
+	ExportRejected = "rejected"
+	ExportDelayed  = "delayed"
+)
+
+// exportVersion is the version of the export format, bump it on incompatible
+// changes and keep importing older versions
+const exportVersion = 1
+
+// exportRecord is a line written by queue.Export(). Each line is a JSON
+// object like {"v":1,"list":"ready","entry":"aGVsbG8="} where entry is the
+// base64 encoded entry exactly as stored in Redis (envelopes included) and
+// due is the time in Unix milliseconds delayed entries are due. Records are
+// written oldest first
+type exportRecord struct {
+	Version int    `json:"v"`
+	List    string `json:"list"`
+	Entry   []byte `json:"entry"`
+	Due     int64  `json:"due,omitempty"`
+}
+
+// Export writes the ready entries of the queue to w as newline delimited
+// records and returns the number of written records. Pass ExportRejected
+// and ExportDelayed (and ExportReady) to export those lists instead. Entries
+// are read in chunks without being consumed, entries consumed or published
+// while exporting may be missed or written twice
+func (queue *redisQueue) Export(w io.Writer, lists ...string) (n int, err error) {
+	if len(lists) == 0 {
+		lists = []string{ExportReady}
+	}
+
+	encoder := json.NewEncoder(w)
+	for _, list := range lists {
+		var exported int
+		switch list {
+		case ExportReady:
+			exported, err = queue.exportList(encoder, list, queue.readyKey)
+		case ExportRejected:
+			exported, err = queue.exportList(encoder, list, queue.rejectedKey)
+		case ExportDelayed:
+			exported, err = queue.exportDelayed(encoder)
+		default:
+			err = fmt.Errorf("rmq queue can't export unknown list %q", list)
+		}
+		n += exported
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// exportList exports the list at key from its right (oldest) end
+func (queue *redisQueue) exportList(encoder *json.Encoder, list, key string) (n int, err error) {
+	for offset := 0; ; offset += returnBatchSize {
+		result := queue.redisClient.LRange(key, int64(-offset-returnBatchSize), int64(-offset-1))
+		if err := redisErr(result); err != nil {
+			return n, err
+		}
+
+		entries := result.Val()
+		for i := len(entries) - 1; i >= 0; i-- {
+			record := exportRecord{Version: exportVersion, List: list, Entry: []byte(entries[i])}
+			if err := encoder.Encode(record); err != nil {
+				return n, err
+			}
+			n++
+		}
+
+		if len(entries) < returnBatchSize {
+			return n, nil
+		}
+	}
+}
+
+// exportDelayed exports the delayed set, the earliest due entries first
+func (queue *redisQueue) exportDelayed(encoder *json.Encoder) (n int, err error) {
+	for offset := int64(0); ; offset += returnBatchSize {
+		result := queue.redisClient.ZRangeWithScores(queue.delayedKey, offset, offset+returnBatchSize-1)
+		if err := redisErr(result); err != nil {
+			return n, err
+		}
+
+		entries := result.Val()
+		for _, entry := range entries {
+			member, _ := entry.Member.(string)
+			record := exportRecord{Version: exportVersion, List: ExportDelayed, Entry: []byte(member), Due: int64(entry.Score)}
+			if err := encoder.Encode(record); err != nil {
+				return n, err
+			}
+			n++
+		}
+
+		if len(entries) < returnBatchSize {
+			return n, nil
+		}
+	}
+}
+
+// Import adds the records written by queue.Export() to the lists of this
+// queue (which doesn't have to be the exporting one) and returns the number
+// of imported records. Entries are added in pipelined chunks, as they are, so
+// imported deliveries keep their headers and ids
+func (queue *redisQueue) Import(r io.Reader) (n int, err error) {
+	reader := bufio.NewReader(r)
+	records := make([]exportRecord, 0, returnBatchSize)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			record := exportRecord{}
+			if err := json.Unmarshal(line, &record); err != nil {
+				return n, fmt.Errorf("rmq queue failed to import record %d: %s", n+len(records)+1, err)
+			}
+			if record.Version > exportVersion {
+				return n, fmt.Errorf("rmq queue can't import export version %d", record.Version)
+			}
+			records = append(records, record)
+		}
+
+		if len(records) == returnBatchSize || (readErr != nil && len(records) > 0) {
+			if err := queue.importRecords(records); err != nil {
+				return n, err
+			}
+			n += len(records)
+			records = records[:0]
+		}
+
+		if readErr == io.EOF {
+			return n, nil
+		}
+		if readErr != nil {
+			return n, readErr
+		}
+	}
+}
+
+// importRecords adds the records to their lists in a single pipeline
+func (queue *redisQueue) importRecords(records []exportRecord) error {
+	for _, record := range records {
+		switch record.List {
+		case ExportReady, ExportRejected, ExportDelayed:
+		default:
+			return fmt.Errorf("rmq queue can't import unknown list %q", record.List)
+		}
+	}
+
+	results, err := queue.redisClient.Pipelined(func(pipe *redis.Pipeline) error {
+		for _, record := range records {
+			switch record.List {
+			case ExportReady:
+				pipe.LPush(queue.readyKey, record.Entry)
+			case ExportRejected:
+				pipe.LPush(queue.rejectedKey, record.Entry)
+			case ExportDelayed:
+				pipe.ZAdd(queue.delayedKey, redis.Z{Score: float64(record.Due), Member: record.Entry})
+			}
+		}
+		return nil
+	})
+	if err := pipelineErr(err); err != nil {
+		return err
+	}
+	for _, result := range results {
+		if err := redisErr(result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
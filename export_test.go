@@ -0,0 +1,24 @@
+package rmq
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestExportRecordFormat(t *testing.T) {
+	line, err := json.Marshal(exportRecord{Version: exportVersion, List: ExportReady, Entry: []byte("hello")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(line) != `{"v":1,"list":"ready","entry":"aGVsbG8="}` {
+		t.Error("unexpected record", string(line))
+	}
+
+	record := exportRecord{}
+	if err := json.Unmarshal([]byte(`{"v":1,"list":"delayed","entry":"AP8=","due":42}`), &record); err != nil {
+		t.Fatal(err)
+	}
+	if string(record.Entry) != "\x00\xff" || record.Due != 42 {
+		t.Error("unexpected record", record)
+	}
+}
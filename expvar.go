@@ -0,0 +1,96 @@
+package rmq
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// PublishExpvars collects the stats of the given queues every interval and
+// publishes them in the "rmq" expvar map: Its "queues" map holds the ready,
+// rejected, unacked and consumers counts by queue name. Failed collections
+// keep the previous counts and increment "errors". Values are published from
+// a goroutine, so serving /debug/vars never waits for Redis. Call the
+// returned function to stop publishing
+func PublishExpvars(connection Connection, queues []string, interval time.Duration) (stop func()) {
+	vars := expvarMap()
+	queueVars := subMap(vars, "queues")
+	errorCount, ok := vars.Get("errors").(*expvar.Int)
+	if !ok {
+		errorCount = new(expvar.Int)
+		vars.Set("errors", errorCount)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := publishExpvars(connection, queues, queueVars); err != nil {
+				errorCount.Add(1)
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+var expvarMutex sync.Mutex
+
+// expvarMap returns the "rmq" expvar map, publishing it on first use
+func expvarMap() *expvar.Map {
+	expvarMutex.Lock()
+	defer expvarMutex.Unlock()
+	if vars, ok := expvar.Get("rmq").(*expvar.Map); ok {
+		return vars
+	}
+	return expvar.NewMap("rmq")
+}
+
+// subMap returns the map with the given key in vars, adding it if missing
+func subMap(vars *expvar.Map, key string) *expvar.Map {
+	expvarMutex.Lock()
+	defer expvarMutex.Unlock()
+	if sub, ok := vars.Get(key).(*expvar.Map); ok {
+		return sub
+	}
+	sub := new(expvar.Map)
+	vars.Set(key, sub)
+	return sub
+}
+
+// publishExpvars collects the stats and replaces the counts of each queue in
+// queueVars. Nothing is replaced if collecting fails
+func publishExpvars(connection Connection, queues []string, queueVars *expvar.Map) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("rmq failed to collect stats: %v", r)
+		}
+	}()
+
+	stats := connection.CollectStats(queues)
+	for queueName, queueStat := range stats.QueueStats {
+		counts := new(expvar.Map)
+		for key, value := range map[string]int{
+			"ready":     queueStat.ReadyCount,
+			"rejected":  queueStat.RejectedCount,
+			"unacked":   queueStat.UnackedCount(),
+			"consumers": queueStat.ConsumerCount(),
+		} {
+			count := new(expvar.Int)
+			count.Set(int64(value))
+			counts.Set(key, count)
+		}
+		queueVars.Set(queueName, counts)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package rmq
+
+import (
+	"expvar"
+	"testing"
+	"time"
+)
+
+type expvarConnection struct {
+	TestConnection
+	stats chan Stats
+}
+
+func (connection expvarConnection) CollectStats(queueList []string) Stats {
+	stats, ok := <-connection.stats
+	if !ok {
+		panic("redis down")
+	}
+	return stats
+}
+
+func TestPublishExpvars(t *testing.T) {
+	connection := expvarConnection{TestConnection: NewTestConnection(), stats: make(chan Stats)}
+	stop := PublishExpvars(connection, []string{"expvar-q"}, time.Millisecond)
+	defer stop()
+
+	stats := NewStats()
+	queueStat := NewQueueStat(4, 2)
+	queueStat.ConnectionStats["conn1"] = ConnectionStat{UnackedCount: 3, Consumers: []string{"c1", "c2"}}
+	stats.QueueStats["expvar-q"] = queueStat
+	connection.stats <- stats
+	connection.stats <- stats // wait for the first stats to be published
+
+	vars := expvar.Get("rmq").(*expvar.Map)
+	counts := vars.Get("queues").(*expvar.Map).Get("expvar-q").(*expvar.Map)
+	for key, expected := range map[string]int64{"ready": 4, "rejected": 2, "unacked": 3, "consumers": 2} {
+		if value := counts.Get(key).(*expvar.Int).Value(); value != expected {
+			t.Errorf("expected %s to be %d, got %d", key, expected, value)
+		}
+	}
+
+	errorCount := vars.Get("errors").(*expvar.Int)
+	errors := errorCount.Value()
+	close(connection.stats)
+	for i := 0; i < 100 && errorCount.Value() == errors; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if errorCount.Value() == errors {
+		t.Errorf("expected failed collections to be counted")
+	}
+	counts = vars.Get("queues").(*expvar.Map).Get("expvar-q").(*expvar.Map)
+	if value := counts.Get("ready").(*expvar.Int).Value(); value != 4 {
+		t.Errorf("expected previous counts to be kept, got ready %d", value)
+	}
+}
@@ -0,0 +1,138 @@
+package rmq
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultRejectedRatio is the ratio of rejected to ready deliveries above
+// which HealthSummary() reports a queue, see SetHealthRejectedRatio()
+const defaultRejectedRatio = 1.0
+
+// healthSampleInterval is how often HealthSummary() samples the ready count
+// of a queue at most, a queue is stuck if it didn't decrease between samples
+const healthSampleInterval = time.Minute
+
+// HealthReport flags problems of all open queues and connections, see
+// connection.HealthSummary(). Queue and connection names are sorted
+type HealthReport struct {
+	Healthy          bool      `json:"healthy"` // true if nothing was flagged
+	CheckedAt        time.Time `json:"checked_at"`
+	UnconsumedQueues []string  `json:"unconsumed_queues"` // ready deliveries, but no consumers in live connections
+	DeadConnections  []string  `json:"dead_connections"`  // no heartbeat, waiting to be cleaned
+	RejectingQueues  []string  `json:"rejecting_queues"`  // more rejected deliveries than the rejected ratio of ready ones
+	StuckQueues      []string  `json:"stuck_queues"`      // ready count didn't decrease between the last two samples
+}
+
+// healthSampler samples the ready counts of the queues in health summaries,
+// at most once per healthSampleInterval so frequent summaries don't shorten
+// the period over which a queue must make progress
+type healthSampler struct {
+	mutex         sync.Mutex
+	rejectedRatio float64
+	samples       map[string]readySample // by queue name
+}
+
+// readySample is the latest ready count sample of a queue and the one before
+type readySample struct {
+	ready       int
+	sampledAt   time.Time
+	previous    int
+	hasPrevious bool
+}
+
+// SetHealthRejectedRatio sets the ratio of rejected to ready deliveries above
+// which HealthSummary() reports a queue as rejecting, 1 by default
+func (connection *RedisConnection) SetHealthRejectedRatio(ratio float64) {
+	connection.health.mutex.Lock()
+	defer connection.health.mutex.Unlock()
+	connection.health.rejectedRatio = ratio
+}
+
+// HealthSummary collects the stats of all open queues and reports queues
+// nobody consumes, dead connections, queues with many rejected deliveries
+// and queues whose ready count didn't decrease between the last two samples
+// of this connection. Samples are taken by the calls at least a minute
+// apart, so stuck queues are only reported a minute after the first call
+func (connection *RedisConnection) HealthSummary() HealthReport {
+	return connection.HealthSummaryOf(connection.CollectStats(connection.GetOpenQueues()))
+}
+
+// HealthSummaryOf is like HealthSummary, but reports the health of already
+// collected stats, only covering the queues in them
+func (connection *RedisConnection) HealthSummaryOf(stats Stats) HealthReport {
+	return connection.health.report(stats, time.Now())
+}
+
+func (sampler *healthSampler) report(stats Stats, now time.Time) HealthReport {
+	sampler.mutex.Lock()
+	defer sampler.mutex.Unlock()
+	ratio := sampler.rejectedRatio
+	if ratio == 0 {
+		ratio = defaultRejectedRatio
+	}
+
+	report := HealthReport{
+		CheckedAt:        now,
+		UnconsumedQueues: []string{},
+		DeadConnections:  []string{},
+		RejectingQueues:  []string{},
+		StuckQueues:      []string{},
+	}
+	if sampler.samples == nil {
+		sampler.samples = map[string]readySample{}
+	}
+	for _, queueName := range stats.sortedQueueNames() {
+		queueStat := stats.QueueStats[queueName]
+		sample := sampler.sample(queueName, queueStat.ReadyCount, now)
+		if queueStat.ReadyCount > 0 && liveConsumerCount(queueStat) == 0 {
+			report.UnconsumedQueues = append(report.UnconsumedQueues, queueName)
+		}
+		if float64(queueStat.RejectedCount) > ratio*float64(queueStat.ReadyCount) {
+			report.RejectingQueues = append(report.RejectingQueues, queueName)
+		}
+		if sample.hasPrevious && sample.ready > 0 && sample.ready >= sample.previous {
+			report.StuckQueues = append(report.StuckQueues, queueName)
+		}
+	}
+
+	for name, active := range stats.Connections() {
+		if !active {
+			report.DeadConnections = append(report.DeadConnections, name)
+		}
+	}
+	sort.Strings(report.DeadConnections)
+
+	report.Healthy = len(report.UnconsumedQueues) == 0 && len(report.DeadConnections) == 0 &&
+		len(report.RejectingQueues) == 0 && len(report.StuckQueues) == 0
+	return report
+}
+
+// sample takes a new sample of the ready count of the queue if the latest one
+// is due and returns the samples, the caller must hold the mutex
+func (sampler *healthSampler) sample(queueName string, ready int, now time.Time) readySample {
+	sample, ok := sampler.samples[queueName]
+	switch {
+	case !ok:
+		sample = readySample{ready: ready, sampledAt: now}
+	case now.Sub(sample.sampledAt) >= healthSampleInterval:
+		sample = readySample{ready: ready, sampledAt: now, previous: sample.ready, hasPrevious: true}
+	default:
+		return sample
+	}
+	sampler.samples[queueName] = sample
+	return sample
+}
+
+// liveConsumerCount returns the number of consumers of the queue in
+// connections with a heartbeat
+func liveConsumerCount(stat QueueStat) int {
+	count := 0
+	for _, connectionStat := range stat.ConnectionStats {
+		if connectionStat.Active {
+			count += len(connectionStat.Consumers)
+		}
+	}
+	return count
+}
@@ -0,0 +1,53 @@
+package rmq
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHealthReport(t *testing.T) {
+	stats := NewStats()
+	consumed := NewQueueStat(5, 0)
+	consumed.ConnectionStats["live"] = ConnectionStat{Active: true, Consumers: []string{"c1"}}
+	stats.QueueStats["consumed"] = consumed
+	unconsumed := NewQueueStat(5, 6)
+	unconsumed.ConnectionStats["dead"] = ConnectionStat{Consumers: []string{"c1"}}
+	stats.QueueStats["unconsumed"] = unconsumed
+	stats.QueueStats["empty"] = NewQueueStat(0, 0)
+	stats.otherConnections["idle"] = true
+
+	now := time.Now()
+	sampler := &healthSampler{}
+	report := sampler.report(stats, now)
+	expected := HealthReport{
+		CheckedAt:        report.CheckedAt,
+		UnconsumedQueues: []string{"unconsumed"},
+		DeadConnections:  []string{"dead"},
+		RejectingQueues:  []string{"unconsumed"},
+		StuckQueues:      []string{}, // no previous sample
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("expected %+v, got %+v", expected, report)
+	}
+
+	consumed.ReadyCount = 4
+	stats.QueueStats["consumed"] = consumed
+	report = sampler.report(stats, now.Add(time.Second))
+	if len(report.StuckQueues) != 0 {
+		t.Errorf("expected no stuck queues before the next sample, got %v", report.StuckQueues)
+	}
+	report = sampler.report(stats, now.Add(healthSampleInterval))
+	if !reflect.DeepEqual(report.StuckQueues, []string{"unconsumed"}) {
+		t.Errorf("expected unconsumed to be stuck, got %v", report.StuckQueues)
+	}
+
+	sampler = &healthSampler{rejectedRatio: 2}
+	delete(stats.QueueStats, "unconsumed")
+	rejecting := NewQueueStat(1, 2) // not above the ratio
+	rejecting.ConnectionStats["live"] = ConnectionStat{Active: true, Consumers: []string{"c2"}}
+	stats.QueueStats["rejecting"] = rejecting
+	if report := sampler.report(stats, time.Now()); !report.Healthy {
+		t.Errorf("expected healthy report, got %+v", report)
+	}
+}
@@ -0,0 +1,130 @@
+package rmq
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/adjust/uniuri"
+	"gopkg.in/redis.v5"
+)
+
+// StatPoint is the recorded stat of a queue at some point in time
+type StatPoint struct {
+	Time     time.Time `json:"time"`
+	Ready    int       `json:"ready"`
+	Rejected int       `json:"rejected"`
+	Unacked  int       `json:"unacked"`
+}
+
+// StartStatsRecorder collects the stats of all open queues every interval and
+// records their counts in Redis, see connection.QueueHistory(). Points older
+// than retention get removed. If several processes run recorders with the
+// same interval only one of them records per interval. Call the returned
+// function to stop recording
+func StartStatsRecorder(connection *RedisConnection, interval, retention time.Duration) (stop func()) {
+	token := connection.Name + "-" + uniuri.NewLen(6)
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			connection.recordStats(token, interval, retention)
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// recordStats records the stats of all open queues unless another recorder
+// did so within the interval. Errors are ignored, recording is tried again
+// next interval
+func (connection *RedisConnection) recordStats(token string, interval, retention time.Duration) {
+	// a bit shorter than the interval so this recorder keeps the slot
+	// even if its ticks are slightly early
+	locked := connection.redisClient.SetNX(statsRecorderKey, token, interval*9/10)
+	if redisErr(locked) != nil || !locked.Val() {
+		return
+	}
+
+	defer func() {
+		recover() // stats collection panics on Redis errors
+	}()
+	stats := connection.CollectStats(connection.GetOpenQueues())
+	now := time.Now()
+	nowMs := now.UnixNano() / int64(time.Millisecond)
+	oldestMs := now.Add(-retention).UnixNano() / int64(time.Millisecond)
+
+	connection.redisClient.Pipelined(func(pipe *redis.Pipeline) error {
+		for queueName, queueStat := range stats.QueueStats {
+			historyKey := connection.openQueue(queueName).historyKey
+			member := fmt.Sprintf("%d:%d:%d:%d", nowMs, queueStat.ReadyCount, queueStat.RejectedCount, queueStat.UnackedCount())
+			pipe.ZAdd(historyKey, redis.Z{Score: float64(nowMs), Member: member})
+			pipe.ZRemRangeByScore(historyKey, "-inf", "("+strconv.FormatInt(oldestMs, 10))
+		}
+		return nil
+	})
+}
+
+// QueueHistory returns the stats of the queue recorded since the given time,
+// oldest first. See StartStatsRecorder()
+func (connection *RedisConnection) QueueHistory(name string, since time.Time) []StatPoint {
+	historyKey := connection.openQueue(name).historyKey
+	sinceMs := since.UnixNano() / int64(time.Millisecond)
+	result := connection.redisClient.ZRangeByScore(historyKey, redis.ZRangeBy{Min: strconv.FormatInt(sinceMs, 10), Max: "+inf"})
+	if redisErrIsNil(result) {
+		return []StatPoint{}
+	}
+	return parseStatPoints(result.Val())
+}
+
+// QueueHistoriesCtx is like QueueHistory for several queues, fetching their
+// histories in pipelines and returning them by queue name. Queues whose
+// history wasn't fetched before ctx was done or failed to be fetched are
+// missing, the error says why
+func (connection *RedisConnection) QueueHistoriesCtx(ctx context.Context, names []string, since time.Time) (map[string][]StatPoint, error) {
+	sinceMs := since.UnixNano() / int64(time.Millisecond)
+	rangeBy := redis.ZRangeBy{Min: strconv.FormatInt(sinceMs, 10), Max: "+inf"}
+	results := make([]*redis.StringSliceCmd, len(names))
+	fetched, err := pipelineChunked(ctx, connection.redisClient, len(names), 1, func(pipe *redis.Pipeline, i int) {
+		results[i] = pipe.ZRangeByScore(connection.openQueue(names[i]).historyKey, rangeBy)
+	})
+
+	histories := make(map[string][]StatPoint, fetched)
+	for i, name := range names[:fetched] {
+		if resultErr := redisErr(results[i]); resultErr != nil {
+			if err == nil {
+				err = resultErr
+			}
+			continue
+		}
+		histories[name] = parseStatPoints(results[i].Val())
+	}
+	return histories, err
+}
+
+// parseStatPoints parses the members of a history sorted set, skipping
+// invalid ones
+func parseStatPoints(members []string) []StatPoint {
+	points := make([]StatPoint, 0, len(members))
+	for _, member := range members {
+		var ms int64
+		var point StatPoint
+		if _, err := fmt.Sscanf(member, "%d:%d:%d:%d", &ms, &point.Ready, &point.Rejected, &point.Unacked); err != nil {
+			continue
+		}
+		point.Time = time.Unix(0, ms*int64(time.Millisecond))
+		points = append(points, point)
+	}
+	return points
+}
@@ -0,0 +1,116 @@
+package rmq
+
+import "log"
+
+// Hooks are optional callbacks a queue invokes for observability. Hooks are
+// called synchronously from the goroutine triggering them, so they should
+// return quickly. Nil hooks are skipped.
+type Hooks struct {
+	// OnDeadlineExceeded is called when a consumer added via AddContextConsumer
+	// is still consuming a delivery after the queue's per delivery timeout.
+	// The delivery is not settled, the consumer stays responsible for it.
+	OnDeadlineExceeded func(delivery Delivery)
+
+	// OnDoubleSettle is called when a delivery which was already acked,
+	// rejected, pushed or dead lettered gets settled again. Redis isn't
+	// touched by the second call, this hook helps to find such code paths.
+	OnDoubleSettle func(delivery Delivery)
+
+	// OnCopy is called after a copy of the delivery was published to the
+	// queue with the given name by delivery.CopyTo().
+	OnCopy func(delivery Delivery, queueName string)
+
+	// OnUnsettled is called when a consumer returned without acking,
+	// rejecting, pushing or dead lettering a delivery. The delivery stays
+	// unacked until it's settled or returned by the cleaner.
+	OnUnsettled func(delivery Delivery)
+
+	// OnReturnProgress is called by queue.ReturnAllRejectedThrottled() after
+	// each batch with the total number of deliveries returned so far.
+	OnReturnProgress func(returned int)
+
+	// OnRejectedTrimmed is called when rejected deliveries of the queue with
+	// the given name were dropped by queue.TrimRejected() or because the
+	// queue has a rejected max length.
+	OnRejectedTrimmed func(queueName string, dropped int64)
+
+	// OnConsumeError is called when fetching deliveries of the queue with the
+	// given name failed. The queue keeps trying, backing off exponentially
+	// from its poll duration up to 10s.
+	OnConsumeError func(queueName string, err error)
+
+	// OnAckFailed is called when a buffered ack couldn't be removed from
+	// unacked, see queue.SetAckCoalescing(). The delivery is unacked again,
+	// err is ErrDeliveryNotFound or the Redis error. It's called from the
+	// flushing goroutine or from FlushAcks().
+	OnAckFailed func(delivery Delivery, err error)
+}
+
+// CleanerHooks are optional callbacks a cleaner invokes while cleaning, see
+// cleaner.SetHooks(). They are called synchronously, panics in them are
+// recovered so they don't abort the clean. Nil hooks are skipped.
+type CleanerHooks struct {
+	// OnConnectionCleaned is called after the dead connection with the given
+	// name was cleaned, with the number of returned unacked deliveries by
+	// queue name.
+	OnConnectionCleaned func(name string, queues map[string]int)
+
+	// OnQueueReturned is called after the unacked deliveries of a queue of a
+	// dead connection were returned to ready.
+	OnQueueReturned func(connection, queue string, count int)
+
+	// OnReturnProgress is called while returning the unacked deliveries of a
+	// queue of a dead connection, after each batch of up to 1000 deliveries
+	// with the number of deliveries returned so far.
+	OnReturnProgress func(connection, queue string, returned int)
+
+	// OnError is called when a clean fails at the given stage, like
+	// "return unacked" or "close connection".
+	OnError func(stage string, err error)
+}
+
+// call calls hook, recovering any panic
+func (hooks CleanerHooks) call(hook func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("rmq cleaner hook panicked: %v", r)
+		}
+	}()
+	hook()
+}
+
+// connectionCleaned calls the OnConnectionCleaned hook
+func (hooks CleanerHooks) connectionCleaned(name string, queues map[string]int) {
+	if hook := hooks.OnConnectionCleaned; hook != nil {
+		hooks.call(func() { hook(name, queues) })
+	}
+}
+
+// queueReturned calls the OnQueueReturned hook
+func (hooks CleanerHooks) queueReturned(connection, queue string, count int) {
+	if hook := hooks.OnQueueReturned; hook != nil {
+		hooks.call(func() { hook(connection, queue, count) })
+	}
+}
+
+// returnProgress calls the OnReturnProgress hook
+func (hooks CleanerHooks) returnProgress(connection, queue string, returned int) {
+	if hook := hooks.OnReturnProgress; hook != nil {
+		hooks.call(func() { hook(connection, queue, returned) })
+	}
+}
+
+// failed calls the OnError hook and returns err
+func (hooks CleanerHooks) failed(stage string, err error) error {
+	if hook := hooks.OnError; hook != nil {
+		hooks.call(func() { hook(stage, err) })
+	}
+	return err
+}
+
+// reportTrimmed calls the OnRejectedTrimmed hook if anything was dropped
+func reportTrimmed(hooks Hooks, queueName string, dropped int64) {
+	if hook := hooks.OnRejectedTrimmed; hook != nil && dropped > 0 {
+		hook(queueName, dropped)
+	}
+}
@@ -0,0 +1,157 @@
+package rmq
+
+import (
+	"math"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/redis.v5"
+)
+
+// latencyWindow is how long latency observations count towards the published
+// percentiles, they are kept for one to two windows
+const latencyWindow = time.Minute
+
+// latencyBuckets are the upper bounds of the latency histogram buckets, the
+// last bucket has no upper bound
+var latencyBuckets = [...]time.Duration{
+	time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 20 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 200 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2 * time.Second, 5 * time.Second,
+	10 * time.Second, 30 * time.Second, time.Minute,
+	5 * time.Minute, 15 * time.Minute, time.Hour,
+}
+
+type latencyCounts [len(latencyBuckets) + 1]int64
+
+// latencyHistogram counts latencies of the current and the previous window in
+// fixed buckets without allocating
+type latencyHistogram struct {
+	windows   [2]latencyCounts
+	current   int32 // index of the current window, accessed atomically
+	rotatedAt time.Time
+}
+
+// observe counts the latency in the current window
+func (histogram *latencyHistogram) observe(latency time.Duration) {
+	bucket := len(latencyBuckets)
+	for i, bound := range latencyBuckets {
+		if latency <= bound {
+			bucket = i
+			break
+		}
+	}
+	atomic.AddInt64(&histogram.windows[atomic.LoadInt32(&histogram.current)][bucket], 1)
+}
+
+// snapshot returns the counts of both windows, rotating them first if the
+// current window is over. Must not be called concurrently
+func (histogram *latencyHistogram) snapshot(now time.Time) (counts latencyCounts, total int64) {
+	if histogram.rotatedAt.IsZero() {
+		histogram.rotatedAt = now
+	}
+	if now.Sub(histogram.rotatedAt) >= latencyWindow {
+		next := 1 - atomic.LoadInt32(&histogram.current)
+		for i := range histogram.windows[next] {
+			atomic.StoreInt64(&histogram.windows[next][i], 0)
+		}
+		atomic.StoreInt32(&histogram.current, next)
+		histogram.rotatedAt = now
+	}
+
+	for w := range histogram.windows {
+		for i := range counts {
+			count := atomic.LoadInt64(&histogram.windows[w][i])
+			counts[i] += count
+			total += count
+		}
+	}
+	return counts, total
+}
+
+// LatencyStat holds percentiles of the time from publishing deliveries until
+// they were consumed during the last minute or two. They are the upper bounds
+// of the histogram buckets the percentiles fall into
+type LatencyStat struct {
+	Count int64         `json:"count"`
+	P50   time.Duration `json:"p50"`
+	P95   time.Duration `json:"p95"`
+	P99   time.Duration `json:"p99"`
+}
+
+// newLatencyStat returns the percentiles of the counts, nil if there are none
+func newLatencyStat(counts latencyCounts) *LatencyStat {
+	var total int64
+	for _, count := range counts {
+		total += count
+	}
+	if total == 0 {
+		return nil
+	}
+	return &LatencyStat{
+		Count: total,
+		P50:   latencyPercentile(counts, total, 0.50),
+		P95:   latencyPercentile(counts, total, 0.95),
+		P99:   latencyPercentile(counts, total, 0.99),
+	}
+}
+
+func latencyPercentile(counts latencyCounts, total int64, percentile float64) time.Duration {
+	rank := int64(math.Ceil(percentile * float64(total))) // nearest rank
+	var seen int64
+	for i, count := range counts {
+		seen += count
+		if seen >= rank && i < len(latencyBuckets) {
+			return latencyBuckets[i]
+		}
+	}
+	return latencyBuckets[len(latencyBuckets)-1] // in the unbounded bucket
+}
+
+// observeLatency counts the time since the delivery was published, if it was
+// published in an envelope
+func (queue *redisQueue) observeLatency(delivery Delivery) {
+	wrapped, ok := unwrapDelivery(delivery)
+	if !ok {
+		return
+	}
+	value, ok := wrapped.headers[HeaderPublishedAt]
+	if !ok {
+		return
+	}
+	published, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return
+	}
+	queue.latency.observe(time.Since(published))
+}
+
+// publishLatency stores the latency histogram of this connection's consumers
+// of the queue so stats can aggregate them across connections
+func (queue *redisQueue) publishLatency(now time.Time) {
+	counts, total := queue.latency.snapshot(now)
+	if total == 0 {
+		queue.redisClient.Del(queue.latencyKey)
+		return
+	}
+	queue.redisClient.Pipelined(func(pipe *redis.Pipeline) error {
+		for i, count := range counts {
+			pipe.HSet(queue.latencyKey, strconv.Itoa(i), count)
+		}
+		return nil
+	})
+}
+
+// addLatencyFields adds the fields of a latency histogram hash to counts
+func addLatencyFields(counts *latencyCounts, fields map[string]string) {
+	for field, value := range fields {
+		i, err := strconv.Atoi(field)
+		if err != nil || i < 0 || i >= len(counts) {
+			continue
+		}
+		count, _ := strconv.ParseInt(value, 10, 64)
+		counts[i] += count
+	}
+}
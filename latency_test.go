@@ -0,0 +1,46 @@
+package rmq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	histogram := &latencyHistogram{}
+	for i := 0; i < 98; i++ {
+		histogram.observe(3 * time.Millisecond)
+	}
+	histogram.observe(700 * time.Millisecond)
+	histogram.observe(2 * time.Hour)
+
+	now := time.Now()
+	counts, total := histogram.snapshot(now)
+	if total != 100 {
+		t.Fatalf("expected 100 observations, got %d", total)
+	}
+	stat := newLatencyStat(counts)
+	expected := LatencyStat{Count: 100, P50: 5 * time.Millisecond, P95: 5 * time.Millisecond, P99: time.Second}
+	if *stat != expected {
+		t.Errorf("expected %+v, got %+v", expected, *stat)
+	}
+
+	// observations are kept for one more window after rotating
+	histogram.observe(time.Millisecond)
+	if _, total := histogram.snapshot(now.Add(latencyWindow)); total != 101 {
+		t.Errorf("expected 101 observations after one window, got %d", total)
+	}
+	if _, total := histogram.snapshot(now.Add(2 * latencyWindow)); total != 0 {
+		t.Errorf("expected no observations after two windows, got %d", total)
+	}
+	if stat := newLatencyStat(latencyCounts{}); stat != nil {
+		t.Errorf("expected no stat without observations, got %+v", stat)
+	}
+}
+
+func BenchmarkLatencyObserve(b *testing.B) {
+	histogram := &latencyHistogram{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		histogram.observe(time.Duration(i%1000) * time.Millisecond)
+	}
+}
@@ -0,0 +1,121 @@
+package rmq
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/adjust/uniuri"
+)
+
+// MemoryConnection is a Connection keeping its queues in process memory, for
+// unit tests of code using rmq which shouldn't need a Redis. Unlike
+// TestConnection its queues consume, settle and push deliveries like queues
+// of a RedisConnection: Consumers get prefetched deliveries one at a time,
+// rejected deliveries keep their reasons and pushed ones move along the push
+// queues. There are no heartbeats, cleaners, visibility timeouts, retry
+// policies, checksums, quarantine filters or tracers, the corresponding
+// setters are ignored
+type MemoryConnection struct {
+	Name string
+
+	mutex       sync.Mutex // guards the lists of all queues, so deliveries can move between them
+	queues      map[string]*memoryQueue
+	synchronous bool // whether queues opened afterwards consume only on ConsumeOnce()
+}
+
+// NewMemoryConnection returns a new connection without any queues
+func NewMemoryConnection() *MemoryConnection {
+	return &MemoryConnection{
+		Name:   fmt.Sprintf("memory-%s", uniuri.NewLen(6)),
+		queues: map[string]*memoryQueue{},
+	}
+}
+
+// OpenQueue returns the queue with the given name, opening it the first time
+func (connection *MemoryConnection) OpenQueue(name string) Queue {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	return connection.queue(name)
+}
+
+// SetSynchronous makes all queues opened on this connection afterwards
+// consume synchronously like RedisConnection.SetSynchronous()
+func (connection *MemoryConnection) SetSynchronous(enabled bool) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	connection.synchronous = enabled
+}
+
+// queue returns the queue with the given name, the caller must hold the mutex
+func (connection *MemoryConnection) queue(name string) *memoryQueue {
+	if queue, ok := connection.queues[name]; ok {
+		return queue
+	}
+	queue := newMemoryQueue(name, connection)
+	connection.queues[name] = queue
+	return queue
+}
+
+// GetOpenQueues returns the names of all open queues, sorted
+func (connection *MemoryConnection) GetOpenQueues() []string {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	names := make([]string, 0, len(connection.queues))
+	for name := range connection.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CollectStats returns the stats of the given queues, the connection is
+// listed as consuming the queues it started consuming
+func (connection *MemoryConnection) CollectStats(queueList []string) Stats {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+
+	stats := NewStats()
+	consuming := false
+	for _, name := range queueList {
+		queue, ok := connection.queues[name]
+		if !ok {
+			stats.QueueStats[name] = NewQueueStat(0, 0)
+			continue
+		}
+
+		queueStat := NewQueueStat(len(queue.ready), len(queue.rejected))
+		queueStat.Counters = queue.counters
+		if queue.deliveryChan != nil {
+			consuming = true
+			connectionStat := ConnectionStat{
+				Active:        true,
+				UnackedCount:  len(queue.unacked),
+				Consumers:     []string{},
+				ConsumerStats: map[string]ConsumerStat{},
+			}
+			for consumer, counters := range queue.consumers {
+				connectionStat.Consumers = append(connectionStat.Consumers, consumer)
+				connectionStat.ConsumerStats[consumer] = counters.stat()
+			}
+			sort.Strings(connectionStat.Consumers)
+			queueStat.ConnectionStats[connection.Name] = connectionStat
+		}
+		stats.QueueStats[name] = queueStat
+	}
+	if !consuming {
+		stats.otherConnections[connection.Name] = true
+	}
+	return stats
+}
+
+// CollectStatsCtx is like CollectStats, collecting in memory can't time out
+func (connection *MemoryConnection) CollectStatsCtx(ctx context.Context, queueList []string) (Stats, error) {
+	if err := ctx.Err(); err != nil {
+		stats := NewStats()
+		stats.Incomplete = true
+		return stats, err
+	}
+	return connection.CollectStats(queueList), nil
+}
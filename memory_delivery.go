@@ -0,0 +1,259 @@
+package rmq
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// memoryDelivery is a delivery consumed from a memoryQueue, settling it moves
+// it between the lists of the queues like wrapDelivery does in Redis
+type memoryDelivery struct {
+	queue    *memoryQueue
+	wire     string // payload as stored in the lists, possibly wrapped in an envelope
+	payload  []byte
+	headers  map[string]string // as on the wire
+	view     map[string]string // headers including WithHeader overrides, nil if there are none
+	consumer string            // name of the consumer consuming the delivery
+	state    *int32            // State, shared with WithHeader copies
+}
+
+func newMemoryDelivery(queue *memoryQueue, wire string) *memoryDelivery {
+	delivery := &memoryDelivery{
+		queue:   queue,
+		wire:    wire,
+		payload: []byte(wire),
+		state:   new(int32),
+	}
+	if envelope, ok := decodeEnvelope([]byte(wire)); ok {
+		delivery.payload = envelope.Payload
+		delivery.headers = envelope.Headers
+	}
+	return delivery
+}
+
+func (delivery *memoryDelivery) String() string {
+	return fmt.Sprintf("[%s %s]", delivery.payload, delivery.queue)
+}
+
+func (delivery *memoryDelivery) Payload() string {
+	return string(delivery.payload)
+}
+
+func (delivery *memoryDelivery) PayloadBytes() []byte {
+	return delivery.payload
+}
+
+func (delivery *memoryDelivery) PayloadReader() io.Reader {
+	return bytes.NewReader(delivery.payload)
+}
+
+func (delivery *memoryDelivery) State() State {
+	return State(atomic.LoadInt32(delivery.state))
+}
+
+func (delivery *memoryDelivery) Headers() map[string]string {
+	if delivery.view != nil {
+		return delivery.view
+	}
+	return delivery.headers
+}
+
+func (delivery *memoryDelivery) Header(key string) (string, bool) {
+	value, ok := delivery.Headers()[key]
+	return value, ok
+}
+
+// WithHeader returns a copy of the delivery with the given header set, see
+// wrapDelivery.WithHeader()
+func (delivery *memoryDelivery) WithHeader(key, value string) Delivery {
+	view := make(map[string]string, len(delivery.Headers())+1)
+	for k, v := range delivery.Headers() {
+		view[k] = v
+	}
+	view[key] = value
+
+	copied := *delivery
+	copied.view = view
+	return &copied
+}
+
+func (delivery *memoryDelivery) Ack() bool {
+	return delivery.AckErr() == nil
+}
+
+func (delivery *memoryDelivery) AckErr() error {
+	if !delivery.settle(Acked) {
+		return ErrAlreadySettled
+	}
+
+	queue := delivery.queue
+	queue.connection.mutex.Lock()
+	defer queue.connection.mutex.Unlock()
+	if !queue.removeUnacked(delivery.wire) {
+		delivery.setState(Unacked) // see wrapDelivery.settled()
+		return ErrDeliveryNotFound
+	}
+	queue.counters.Acked++
+	return nil
+}
+
+func (delivery *memoryDelivery) Reject() bool {
+	return delivery.RejectErr() == nil
+}
+
+func (delivery *memoryDelivery) RejectErr() error {
+	if !delivery.settle(Rejected) {
+		return ErrAlreadySettled
+	}
+	delivery.reject("")
+	return nil
+}
+
+func (delivery *memoryDelivery) RejectWithReason(reason string) bool {
+	if !delivery.settle(Rejected) {
+		return false
+	}
+	delivery.reject(reason)
+	return true
+}
+
+func (delivery *memoryDelivery) RejectWithError(err error) bool {
+	return delivery.RejectWithReason(errorReason(err))
+}
+
+// reject moves the delivery to the rejected list, storing the reason and the
+// attempts unless the reason is empty
+func (delivery *memoryDelivery) reject(reason string) {
+	queue := delivery.queue
+	queue.connection.mutex.Lock()
+	var encoded string
+	if reason != "" {
+		bytes, _ := json.Marshal(rejection{
+			Reason:     reason,
+			RejectedAt: time.Now(),
+			Connection: queue.connection.Name,
+			Consumer:   delivery.consumer,
+			Attempts:   queue.attempts[delivery.wire],
+		})
+		encoded = string(bytes)
+	}
+	queue.removeUnacked(delivery.wire)
+	dropped := queue.addRejected(delivery.wire, encoded)
+	queue.counters.Rejected++
+	queue.connection.mutex.Unlock()
+	reportTrimmed(queue.hooks, queue.name, dropped)
+}
+
+// Push moves the delivery to the push queue or rejects it if there's none,
+// see wrapDelivery.Push()
+func (delivery *memoryDelivery) Push() bool {
+	return delivery.PushErr() == nil
+}
+
+func (delivery *memoryDelivery) PushErr() error {
+	if !delivery.settle(Pushed) {
+		return ErrAlreadySettled
+	}
+
+	queue := delivery.queue
+	if queue.pushQueue == nil {
+		delivery.setState(Rejected)
+		delivery.reject("")
+		return nil
+	}
+
+	pushCount, _ := strconv.Atoi(delivery.headers[HeaderPushCount])
+	if pushCount >= maxPushDepth {
+		delivery.setState(Rejected)
+		delivery.reject(ErrPushChainTooDeep.Error())
+		return ErrPushChainTooDeep
+	}
+
+	headers := delivery.copyHeaders()
+	headers[HeaderPushCount] = strconv.Itoa(pushCount + 1)
+	queue.connection.mutex.Lock()
+	queue.removeUnacked(delivery.wire)
+	queue.pushQueue.addReady(delivery.rewrap(headers))
+	queue.counters.Pushed++
+	queue.connection.mutex.Unlock()
+	return nil
+}
+
+// Dead moves the delivery to the dead letter queue or rejects it if there's
+// none, see wrapDelivery.Dead()
+func (delivery *memoryDelivery) Dead() error {
+	if !delivery.settle(Dead) {
+		return ErrAlreadySettled
+	}
+
+	queue := delivery.queue
+	if queue.deadQueue == nil {
+		delivery.setState(Rejected)
+		delivery.reject("")
+		return ErrNoDeadLetterQueue
+	}
+
+	headers := delivery.copyHeaders()
+	headers[HeaderOriginQueue] = queue.name
+	queue.connection.mutex.Lock()
+	queue.removeUnacked(delivery.wire)
+	queue.deadQueue.addReady(delivery.rewrap(headers))
+	queue.counters.Dead++
+	queue.connection.mutex.Unlock()
+	return nil
+}
+
+// CopyTo publishes a copy of the delivery to the queue with the given name of
+// the same connection, see wrapDelivery.CopyTo()
+func (delivery *memoryDelivery) CopyTo(queueName string) error {
+	headers := delivery.copyHeaders()
+	headers[HeaderCopyOf] = delivery.queue.name
+
+	connection := delivery.queue.connection
+	connection.mutex.Lock()
+	connection.queue(queueName).addReady(delivery.rewrap(headers))
+	connection.mutex.Unlock()
+
+	if hook := delivery.queue.hooks.OnCopy; hook != nil {
+		hook(delivery, queueName)
+	}
+	return nil
+}
+
+// Extend returns false, in memory queues have no visibility timeouts
+func (delivery *memoryDelivery) Extend(timeout time.Duration) bool {
+	return false
+}
+
+func (delivery *memoryDelivery) rewrap(headers map[string]string) string {
+	rewrapped := &envelope{Payload: delivery.payload, Headers: headers}
+	return string(rewrapped.encode())
+}
+
+func (delivery *memoryDelivery) copyHeaders() map[string]string {
+	headers := make(map[string]string, len(delivery.headers)+1)
+	for key, value := range delivery.headers {
+		headers[key] = value
+	}
+	return headers
+}
+
+// settle marks the delivery as settled, see wrapDelivery.settle()
+func (delivery *memoryDelivery) settle(state State) bool {
+	if atomic.CompareAndSwapInt32(delivery.state, int32(Unacked), int32(state)) {
+		return true
+	}
+	if hook := delivery.queue.hooks.OnDoubleSettle; hook != nil {
+		hook(delivery)
+	}
+	return false
+}
+
+func (delivery *memoryDelivery) setState(state State) {
+	atomic.StoreInt32(delivery.state, int32(state))
+}
@@ -0,0 +1,1026 @@
+package rmq
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/adjust/uniuri"
+)
+
+// memoryQueue is a queue of a MemoryConnection. Its lists hold the entries
+// like the Redis lists of a redisQueue, including envelopes, and are guarded
+// by the connection's mutex
+type memoryQueue struct {
+	name       string
+	connection *MemoryConnection
+
+	ready       []string          // oldest first
+	rejected    []string          // newest first
+	reasons     map[string]string // encoded rejection by entry, like the reasons hash
+	attempts    map[string]int    // redelivery attempts by entry, like the attempts hash
+	unacked     []string          // oldest first
+	counters    QueueCounters
+	consumers   map[string]*consumerCounters
+	pushQueue   *memoryQueue
+	deadQueue   *memoryQueue
+	rejectedMax int64
+
+	hooks           Hooks
+	deliveryTimeout time.Duration
+	published       chan struct{} // wakes up consume() when deliveries become ready
+
+	prefetchLimit    int
+	pollDuration     time.Duration
+	deliveryChan     chan Delivery // nil before StartConsuming
+	consumingCtx     context.Context
+	stopConsuming    context.CancelFunc
+	consumingStopped int32
+	activeConsumers  int32
+	synchronous      bool          // consume only on ConsumeOnce(), see connection.SetSynchronous()
+	syncConsumers    syncConsumers // consumers of a synchronous queue
+}
+
+func newMemoryQueue(name string, connection *MemoryConnection) *memoryQueue {
+	return &memoryQueue{
+		name:        name,
+		connection:  connection,
+		reasons:     map[string]string{},
+		attempts:    map[string]int{},
+		consumers:   map[string]*consumerCounters{},
+		published:   make(chan struct{}, 1),
+		synchronous: connection.synchronous,
+	}
+}
+
+func (queue *memoryQueue) String() string {
+	return fmt.Sprintf("[%s memory]", queue.name)
+}
+
+// addReady appends the entry to the ready list and wakes up consume(), the
+// caller must hold the mutex
+func (queue *memoryQueue) addReady(entry string) {
+	queue.ready = append(queue.ready, entry)
+	queue.wake()
+}
+
+// wake wakes up consume() if it's waiting for ready deliveries
+func (queue *memoryQueue) wake() {
+	select {
+	case queue.published <- struct{}{}:
+	default:
+	}
+}
+
+// addRejected adds the entry to the rejected list, along with its encoded
+// rejection if not empty, and returns the number of entries dropped by
+// trimming. The caller must hold the mutex
+func (queue *memoryQueue) addRejected(entry, encodedRejection string) (dropped int64) {
+	queue.rejected = append([]string{entry}, queue.rejected...)
+	if encodedRejection != "" {
+		queue.reasons[entry] = encodedRejection
+	}
+	if queue.rejectedMax > 0 {
+		dropped = queue.trimRejected(queue.rejectedMax)
+	}
+	return dropped
+}
+
+// removeUnacked removes one unacked entry along with its attempts, the caller
+// must hold the mutex
+func (queue *memoryQueue) removeUnacked(entry string) bool {
+	for i, unacked := range queue.unacked {
+		if unacked == entry {
+			queue.unacked = append(queue.unacked[:i], queue.unacked[i+1:]...)
+			delete(queue.attempts, entry)
+			return true
+		}
+	}
+	return false
+}
+
+// deleteAttempts deletes the attempts of the given entries, the caller must
+// hold the mutex
+func (queue *memoryQueue) deleteAttempts(entries []string) {
+	for _, entry := range entries {
+		delete(queue.attempts, entry)
+	}
+}
+
+// trimRejected drops all but the newest maxLength rejected entries, the
+// caller must hold the mutex
+func (queue *memoryQueue) trimRejected(maxLength int64) int64 {
+	if int64(len(queue.rejected)) <= maxLength {
+		return 0
+	}
+	dropped := queue.rejected[maxLength:]
+	for _, entry := range dropped {
+		delete(queue.reasons, entry)
+	}
+	queue.rejected = queue.rejected[:maxLength:maxLength]
+	return int64(len(dropped))
+}
+
+func (queue *memoryQueue) Publish(payload string) bool {
+	queue.connection.mutex.Lock()
+	defer queue.connection.mutex.Unlock()
+	queue.addReady(payload)
+	queue.counters.Published++
+	return true
+}
+
+func (queue *memoryQueue) PublishBytes(payload []byte) bool {
+	return queue.Publish(string(payload))
+}
+
+// PublishWithHeaders adds the delivery wrapped in an envelope with an id and
+// the publishing time, see redisQueue.PublishWithHeaders()
+func (queue *memoryQueue) PublishWithHeaders(payload string, headers map[string]string) bool {
+	wrappedHeaders := make(map[string]string, len(headers)+2)
+	for key, value := range headers {
+		wrappedHeaders[key] = value
+	}
+	if wrappedHeaders[HeaderID] == "" {
+		wrappedHeaders[HeaderID] = uniuri.NewLen(idLength)
+	}
+	wrappedHeaders[HeaderPublishedAt] = time.Now().UTC().Format(time.RFC3339Nano)
+	wrapped := &envelope{Payload: []byte(payload), Headers: wrappedHeaders}
+	return queue.Publish(string(wrapped.encode()))
+}
+
+// PublishWithContext is like Publish, there are no tracers
+func (queue *memoryQueue) PublishWithContext(ctx context.Context, payload string) bool {
+	return queue.Publish(payload)
+}
+
+// SetPushQueue sets the queue pushed deliveries move to, which must be a
+// queue of the same connection, nil removes it. Returns an error on cycles
+func (queue *memoryQueue) SetPushQueue(pushQueue Queue) error {
+	if pushQueue == nil {
+		queue.pushQueue = nil
+		return nil
+	}
+
+	memoryPushQueue, ok := pushQueue.(*memoryQueue)
+	if !ok || memoryPushQueue.connection != queue.connection {
+		return fmt.Errorf("rmq queue push queue must be a queue of the same memory connection %s", queue)
+	}
+
+	chain := append([]string{queue.name}, memoryPushQueue.PushChain()...)
+	for _, name := range chain[1:] {
+		if name == queue.name {
+			return fmt.Errorf("rmq queue push queue would introduce a cycle %s", strings.Join(chain, " -> "))
+		}
+	}
+	queue.pushQueue = memoryPushQueue
+	return nil
+}
+
+func (queue *memoryQueue) PushQueueName() string {
+	if queue.pushQueue == nil {
+		return ""
+	}
+	return queue.pushQueue.name
+}
+
+func (queue *memoryQueue) PushChain() []string {
+	chain := []string{queue.name}
+	for next := queue.pushQueue; next != nil && len(chain) <= maxPushDepth; next = next.pushQueue {
+		chain = append(chain, next.name)
+	}
+	return chain
+}
+
+// SetDeadLetterQueue sets the queue dead lettered deliveries move to, which
+// must be a queue of the same connection
+func (queue *memoryQueue) SetDeadLetterQueue(deadQueue Queue) {
+	if memoryDeadQueue, ok := deadQueue.(*memoryQueue); ok && memoryDeadQueue.connection == queue.connection {
+		queue.deadQueue = memoryDeadQueue
+	}
+}
+
+// StartConsuming starts moving up to prefetchLimit ready deliveries to
+// unacked and into a channel consumers read from, like
+// redisQueue.StartConsuming(). Publishing wakes it up, it checks for
+// deliveries at least every pollDuration otherwise
+func (queue *memoryQueue) StartConsuming(prefetchLimit int, pollDuration time.Duration) bool {
+	return queue.StartConsumingErr(prefetchLimit, pollDuration) == nil
+}
+
+// StartConsumingErr is like StartConsuming, but returns ErrAlreadyConsuming
+// if the queue is consuming already
+func (queue *memoryQueue) StartConsumingErr(prefetchLimit int, pollDuration time.Duration) error {
+	if queue.deliveryChan != nil {
+		return ErrAlreadyConsuming
+	}
+
+	queue.prefetchLimit = prefetchLimit
+	queue.pollDuration = pollDuration
+	queue.deliveryChan = make(chan Delivery, prefetchLimit)
+	if queue.consumingCtx == nil { // not created by WatchRejected()
+		queue.consumingCtx, queue.stopConsuming = context.WithCancel(context.Background())
+	}
+	if queue.synchronous {
+		return nil // ConsumeOnce() does the work
+	}
+	go queue.consume()
+	return nil
+}
+
+func (queue *memoryQueue) StopConsuming() bool {
+	return queue.StopConsumingErr() == nil
+}
+
+// StopConsumingErr is like StopConsuming, but returns ErrNotConsuming if the
+// queue wasn't consuming or was stopped already
+func (queue *memoryQueue) StopConsumingErr() error {
+	if queue.deliveryChan == nil || !atomic.CompareAndSwapInt32(&queue.consumingStopped, 0, 1) {
+		return ErrNotConsuming
+	}
+	queue.stopConsuming()
+	return nil
+}
+
+func (queue *memoryQueue) consume() {
+	for {
+		deliveries := queue.fetch()
+		for _, delivery := range deliveries {
+			queue.deliveryChan <- delivery // fetch() doesn't fetch more than fits
+		}
+		if len(deliveries) > 0 {
+			continue
+		}
+
+		timer := time.NewTimer(queue.pollDuration)
+		select {
+		case <-queue.consumingCtx.Done():
+			timer.Stop()
+			return
+		case <-queue.published:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// fetch moves as many ready deliveries to unacked as fit into the prefetch
+// channel
+func (queue *memoryQueue) fetch() []Delivery {
+	if atomic.LoadInt32(&queue.consumingStopped) == 1 {
+		return nil
+	}
+
+	queue.connection.mutex.Lock()
+	defer queue.connection.mutex.Unlock()
+	count := queue.prefetchLimit - len(queue.deliveryChan)
+	if count > len(queue.ready) {
+		count = len(queue.ready)
+	}
+	if count <= 0 {
+		return nil
+	}
+
+	deliveries := make([]Delivery, count)
+	for i, entry := range queue.ready[:count] {
+		deliveries[i] = newMemoryDelivery(queue, entry)
+	}
+	queue.unacked = append(queue.unacked, queue.ready[:count]...)
+	queue.ready = append([]string{}, queue.ready[count:]...)
+	return deliveries
+}
+
+// AddConsumer adds a consumer getting one delivery at a time, panics if
+// StartConsuming wasn't called before
+func (queue *memoryQueue) AddConsumer(tag string, consumer Consumer) (name string, stopper chan<- int) {
+	name = queue.addConsumer(tag)
+	stopChan := make(chan int, 1)
+	if queue.synchronous {
+		queue.syncConsumers.add(&syncConsumer{name: name, consumer: consumer, stopper: stopChan})
+		return name, stopChan
+	}
+	go queue.consumerConsume(consumer, name, stopChan)
+	return name, stopChan
+}
+
+func (queue *memoryQueue) AddConsumerFunc(tag string, consumerFunc ConsumerFunc) (name string, stopper chan<- int) {
+	return queue.AddConsumer(tag, consumerFunc)
+}
+
+func (queue *memoryQueue) AddContextConsumer(tag string, consumer ConsumerWithContext) (name string, stopper chan<- int) {
+	return queue.AddConsumer(tag, &memoryContextConsumer{queue: queue, consumer: consumer})
+}
+
+func (queue *memoryQueue) AddBatchConsumer(tag string, batchSize int, consumer BatchConsumer) string {
+	return queue.AddBatchConsumerWithTimeout(tag, batchSize, defaultBatchTimeout, consumer)
+}
+
+func (queue *memoryQueue) AddBatchConsumerWithTimeout(tag string, batchSize int, timeout time.Duration, consumer BatchConsumer) string {
+	name := queue.addConsumer(tag)
+	if queue.synchronous {
+		queue.syncConsumers.add(&syncConsumer{name: name, batch: consumer, batchSize: batchSize})
+		return name
+	}
+	go queue.consumerBatchConsume(name, batchSize, timeout, consumer)
+	return name
+}
+
+// ConsumeOnce fetches up to the prefetch limit of ready deliveries of a
+// synchronous queue and hands them to the consumers like
+// redisQueue.ConsumeOnce()
+func (queue *memoryQueue) ConsumeOnce() int {
+	if !queue.synchronous || queue.deliveryChan == nil || atomic.LoadInt32(&queue.consumingStopped) == 1 {
+		return 0
+	}
+
+	for _, delivery := range queue.fetch() {
+		queue.deliveryChan <- delivery
+	}
+	return queue.syncConsumers.dispatch(queue.deliveryChan, queue.removeConsumer, func(consumer *syncConsumer, deliveries []Delivery) {
+		counters := queue.consumerCounters(consumer.name)
+		if consumer.batch != nil {
+			queue.consumeDeliveryBatch(consumer.batch, consumer.name, counters, deliveries)
+			return
+		}
+		queue.consumeDelivery(consumer.consumer, consumer.name, counters, deliveries[0])
+	})
+}
+
+func (queue *memoryQueue) addConsumer(tag string) string {
+	if queue.deliveryChan == nil {
+		log.Panicf("rmq queue failed to add consumer, call StartConsuming first! %s", queue)
+	}
+
+	name := fmt.Sprintf("%s-%s", tag, uniuri.NewLen(6))
+	queue.connection.mutex.Lock()
+	queue.consumers[name] = &consumerCounters{}
+	queue.connection.mutex.Unlock()
+	return name
+}
+
+func (queue *memoryQueue) consumerCounters(name string) *consumerCounters {
+	queue.connection.mutex.Lock()
+	defer queue.connection.mutex.Unlock()
+	return queue.consumers[name]
+}
+
+func (queue *memoryQueue) removeConsumer(name string) {
+	queue.connection.mutex.Lock()
+	defer queue.connection.mutex.Unlock()
+	delete(queue.consumers, name)
+}
+
+func (queue *memoryQueue) consumerConsume(consumer Consumer, name string, stopper chan int) {
+	defer queue.removeConsumer(name)
+	counters := queue.consumerCounters(name)
+	for {
+		select {
+		case delivery := <-queue.deliveryChan:
+			queue.consumeDelivery(consumer, name, counters, delivery)
+		case <-stopper:
+			return
+		}
+	}
+}
+
+func (queue *memoryQueue) consumeDelivery(consumer Consumer, name string, counters *consumerCounters, delivery Delivery) {
+	if memory, ok := delivery.(*memoryDelivery); ok {
+		memory.consumer = name
+	}
+	atomic.AddInt32(&queue.activeConsumers, 1)
+	defer atomic.AddInt32(&queue.activeConsumers, -1)
+	counters.start()
+	defer counters.done(delivery)
+
+	consumer.Consume(delivery)
+	queue.checkSettled(delivery)
+}
+
+func (queue *memoryQueue) checkSettled(delivery Delivery) {
+	if hook := queue.hooks.OnUnsettled; hook != nil && delivery.State() == Unacked {
+		hook(delivery)
+	}
+}
+
+// consumeWithContext passes the delivery to the consumer with a context
+// derived from parent which expires after the per delivery timeout
+func (queue *memoryQueue) consumeWithContext(parent context.Context, consumer ConsumerWithContext, delivery Delivery) {
+	if queue.deliveryTimeout <= 0 {
+		consumer.Consume(parent, delivery)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(parent, queue.deliveryTimeout)
+	defer cancel()
+
+	if hook := queue.hooks.OnDeadlineExceeded; hook != nil {
+		timer := time.AfterFunc(queue.deliveryTimeout, func() { hook(delivery) })
+		defer timer.Stop()
+	}
+
+	consumer.Consume(ctx, delivery)
+}
+
+// memoryContextConsumer adapts a ConsumerWithContext to be added like a
+// Consumer
+type memoryContextConsumer struct {
+	queue    *memoryQueue
+	consumer ConsumerWithContext
+}
+
+func (consumer *memoryContextConsumer) Consume(delivery Delivery) {
+	consumer.queue.consumeWithContext(consumer.queue.consumingCtx, consumer.consumer, delivery)
+}
+
+func (queue *memoryQueue) consumerBatchConsume(name string, batchSize int, timeout time.Duration, consumer BatchConsumer) {
+	counters := queue.consumerCounters(name)
+	batch := []Delivery{}
+	timer := time.NewTimer(timeout)
+	stopTimer(timer) // timer not active yet
+
+	for {
+		select {
+		case <-timer.C:
+			// consume batch below
+
+		case delivery := <-queue.deliveryChan:
+			batch = append(batch, delivery)
+			if len(batch) == 1 { // added first delivery
+				timer.Reset(timeout)
+			}
+			if len(batch) < batchSize {
+				continue
+			}
+
+			// consume batch below
+		}
+
+		queue.consumeDeliveryBatch(consumer, name, counters, batch)
+
+		batch = batch[:0] // reset batch
+		stopTimer(timer)  // stop and drain the timer if it fired in between
+	}
+}
+
+func (queue *memoryQueue) consumeDeliveryBatch(consumer BatchConsumer, name string, counters *consumerCounters, batch []Delivery) {
+	for _, delivery := range batch {
+		if memory, ok := delivery.(*memoryDelivery); ok {
+			memory.consumer = name
+		}
+	}
+	atomic.AddInt32(&queue.activeConsumers, 1)
+	counters.start()
+	consumer.Consume(batch)
+	counters.done(batch...)
+	atomic.AddInt32(&queue.activeConsumers, -1)
+	for _, delivery := range batch {
+		queue.checkSettled(delivery)
+	}
+}
+
+func (queue *memoryQueue) AckMany(deliveries []Delivery) (acked int, failed []Delivery, err error) {
+	return ackMany(deliveries)
+}
+
+// SetVisibilityTimeout is ignored, in memory queues have no visibility
+// timeouts
+func (queue *memoryQueue) SetVisibilityTimeout(timeout time.Duration) {
+}
+
+func (queue *memoryQueue) SetPerDeliveryTimeout(timeout time.Duration) {
+	queue.deliveryTimeout = timeout
+}
+
+func (queue *memoryQueue) SetHooks(hooks Hooks) {
+	queue.hooks = hooks
+}
+
+// SetChecksums is ignored, in memory payloads can't get corrupted
+func (queue *memoryQueue) SetChecksums(enabled bool) {
+}
+
+// SetRetryPolicy is ignored, rejected deliveries of in memory queues always
+// end up in the rejected list
+func (queue *memoryQueue) SetRetryPolicy(policy *RetryPolicy) {
+}
+
+// SetAckCoalescing is ignored, in memory acks are cheap already
+func (queue *memoryQueue) SetAckCoalescing(interval time.Duration) {
+}
+
+// FlushAcks returns nil, in memory queues don't buffer acks
+func (queue *memoryQueue) FlushAcks() error {
+	return nil
+}
+
+// SetQuarantineFilter is ignored, in memory queues don't quarantine
+// deliveries
+func (queue *memoryQueue) SetQuarantineFilter(filter func(payload []byte) bool, quarantineQueue string) {
+}
+
+func (queue *memoryQueue) SetRejectedMaxLength(maxLength int64) {
+	queue.rejectedMax = maxLength
+}
+
+// DelayedCount returns 0, in memory queues don't retry deliveries
+func (queue *memoryQueue) DelayedCount() int {
+	return 0
+}
+
+func (queue *memoryQueue) PurgeReady() bool {
+	removed, _ := queue.PurgeReadyErr()
+	return removed > 0
+}
+
+func (queue *memoryQueue) PurgeReadyErr() (removed int64, err error) {
+	queue.connection.mutex.Lock()
+	defer queue.connection.mutex.Unlock()
+	removed = int64(len(queue.ready))
+	queue.deleteAttempts(queue.ready)
+	queue.ready = nil
+	return removed, nil
+}
+
+func (queue *memoryQueue) PurgeRejected() bool {
+	removed, _ := queue.PurgeRejectedErr()
+	return removed > 0
+}
+
+func (queue *memoryQueue) PurgeRejectedErr() (removed int64, err error) {
+	queue.connection.mutex.Lock()
+	defer queue.connection.mutex.Unlock()
+	removed = int64(len(queue.rejected))
+	queue.deleteAttempts(queue.rejected)
+	queue.rejected = nil
+	queue.reasons = map[string]string{}
+	return removed, nil
+}
+
+func (queue *memoryQueue) PurgeUnacked() (removed int64, err error) {
+	queue.connection.mutex.Lock()
+	defer queue.connection.mutex.Unlock()
+	removed = int64(len(queue.unacked))
+	queue.deleteAttempts(queue.unacked)
+	queue.unacked = nil
+	return removed, nil
+}
+
+func (queue *memoryQueue) TrimRejected(maxLength int64) (dropped int64, err error) {
+	if maxLength < 0 {
+		return 0, fmt.Errorf("rmq queue invalid rejected max length %d %s", maxLength, queue)
+	}
+
+	queue.connection.mutex.Lock()
+	dropped = queue.trimRejected(maxLength)
+	queue.connection.mutex.Unlock()
+	reportTrimmed(queue.hooks, queue.name, dropped)
+	return dropped, nil
+}
+
+func (queue *memoryQueue) DeleteRejected(payload []byte) (removed int64, err error) {
+	return queue.deleteRejected(matchPayload(payload)), nil
+}
+
+func (queue *memoryQueue) DeleteRejectedByID(id string) (removed int64, err error) {
+	return queue.deleteRejected(matchID(id)), nil
+}
+
+func (queue *memoryQueue) deleteRejected(match func(entry string) bool) (removed int64) {
+	queue.connection.mutex.Lock()
+	defer queue.connection.mutex.Unlock()
+	kept := queue.rejected[:0]
+	for _, entry := range queue.rejected {
+		if match(entry) {
+			delete(queue.reasons, entry)
+			removed++
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	queue.rejected = kept
+	return removed
+}
+
+// returnRejected moves up to max of the oldest rejected entries back to
+// ready, bumping their attempts. The caller must hold the mutex
+func (queue *memoryQueue) returnRejected(max int) int {
+	if max > len(queue.rejected) {
+		max = len(queue.rejected)
+	}
+	for i := 0; i < max; i++ {
+		last := len(queue.rejected) - 1
+		entry := queue.rejected[last]
+		queue.rejected = queue.rejected[:last]
+		delete(queue.reasons, entry)
+		queue.attempts[entry]++
+		queue.addReady(entry)
+	}
+	return max
+}
+
+func (queue *memoryQueue) ReturnRejected(count int) int {
+	returned, _ := queue.ReturnRejectedErr(count)
+	return returned
+}
+
+func (queue *memoryQueue) ReturnRejectedErr(max int) (returned int, err error) {
+	queue.connection.mutex.Lock()
+	defer queue.connection.mutex.Unlock()
+	return queue.returnRejected(max), nil
+}
+
+func (queue *memoryQueue) ReturnAllRejected() int {
+	return queue.ReturnRejected(queue.RejectedCount())
+}
+
+// ReturnAllRejectedThrottled returns all rejected deliveries at once, there's
+// no Redis to protect
+func (queue *memoryQueue) ReturnAllRejectedThrottled(ctx context.Context, perSecond int) (returned int, err error) {
+	if perSecond <= 0 {
+		return 0, fmt.Errorf("rmq queue invalid return rate %d %s", perSecond, queue)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	returned = queue.ReturnAllRejected()
+	if hook := queue.hooks.OnReturnProgress; hook != nil && returned > 0 {
+		hook(returned)
+	}
+	return returned, nil
+}
+
+func (queue *memoryQueue) ReturnRejectedMessage(payload []byte) (bool, error) {
+	return queue.returnRejectedMessage(matchPayload(payload)), nil
+}
+
+func (queue *memoryQueue) ReturnRejectedMessageByID(id string) (bool, error) {
+	return queue.returnRejectedMessage(matchID(id)), nil
+}
+
+// returnRejectedMessage moves the newest rejected entry matching match back
+// to ready, bumping its attempts
+func (queue *memoryQueue) returnRejectedMessage(match func(entry string) bool) bool {
+	queue.connection.mutex.Lock()
+	defer queue.connection.mutex.Unlock()
+	for i, entry := range queue.rejected {
+		if match(entry) {
+			queue.rejected = append(queue.rejected[:i], queue.rejected[i+1:]...)
+			delete(queue.reasons, entry)
+			queue.attempts[entry]++
+			queue.addReady(entry)
+			return true
+		}
+	}
+	return false
+}
+
+// ReturnAllUnacked moves all unacked deliveries back to ready, returns
+// ErrConsumersActive if the queue is still consuming
+func (queue *memoryQueue) ReturnAllUnacked() (returned int, err error) {
+	if queue.consumersActive() {
+		return 0, ErrConsumersActive
+	}
+	return queue.ForceReturnAllUnacked()
+}
+
+// ForceReturnAllUnacked is like ReturnAllUnacked, but also returns deliveries
+// which are still being consumed. Settling those afterwards fails
+func (queue *memoryQueue) ForceReturnAllUnacked() (returned int, err error) {
+	queue.connection.mutex.Lock()
+	defer queue.connection.mutex.Unlock()
+	returned = len(queue.unacked)
+	for _, entry := range queue.unacked {
+		queue.attempts[entry]++
+	}
+	// returned deliveries are consumed first, like the cleaner returns them
+	queue.ready = append(append([]string{}, queue.unacked...), queue.ready...)
+	queue.unacked = nil
+	queue.wake()
+	return returned, nil
+}
+
+func (queue *memoryQueue) consumersActive() bool {
+	if queue.deliveryChan == nil {
+		return false // never consumed
+	}
+	return atomic.LoadInt32(&queue.consumingStopped) == 0 || len(queue.deliveryChan) > 0 || atomic.LoadInt32(&queue.activeConsumers) > 0
+}
+
+func (queue *memoryQueue) DrainTo(destinationQueue string, max int) (moved int, err error) {
+	queue.connection.mutex.Lock()
+	defer queue.connection.mutex.Unlock()
+	if max <= 0 || max > len(queue.ready) {
+		max = len(queue.ready)
+	}
+	destination := queue.connection.queue(destinationQueue)
+	for _, entry := range queue.ready[:max] {
+		destination.addReady(entry)
+	}
+	queue.ready = append([]string{}, queue.ready[max:]...)
+	return max, nil
+}
+
+func (queue *memoryQueue) GetRejectedWithReasons(count int) []RejectedDelivery {
+	return queue.ListRejected(0, count)
+}
+
+func (queue *memoryQueue) ListRejected(offset, limit int) []RejectedDelivery {
+	queue.connection.mutex.Lock()
+	defer queue.connection.mutex.Unlock()
+	rejected := []RejectedDelivery{}
+	for _, entry := range page(queue.rejected, offset, limit) {
+		var rawRejection, rawAttempts interface{}
+		if encoded, ok := queue.reasons[entry]; ok {
+			rawRejection = encoded
+		}
+		if attempts, ok := queue.attempts[entry]; ok {
+			rawAttempts = fmt.Sprint(attempts)
+		}
+		rejected = append(rejected, newRejectedDelivery(entry, rawRejection, rawAttempts))
+	}
+	return rejected
+}
+
+func (queue *memoryQueue) GetRejected(count int) []string {
+	queue.connection.mutex.Lock()
+	defer queue.connection.mutex.Unlock()
+	payloads := []string{}
+	for _, entry := range page(queue.rejected, 0, count) {
+		payloads = append(payloads, decodePayload(entry))
+	}
+	return payloads
+}
+
+func (queue *memoryQueue) GetRejectedBytes(count int) [][]byte {
+	payloads := queue.GetRejected(count)
+	bytes := make([][]byte, len(payloads))
+	for i, payload := range payloads {
+		bytes[i] = []byte(payload)
+	}
+	return bytes
+}
+
+func (queue *memoryQueue) RejectedCount() int {
+	queue.connection.mutex.Lock()
+	defer queue.connection.mutex.Unlock()
+	return len(queue.rejected)
+}
+
+func (queue *memoryQueue) ReadyCount() int {
+	queue.connection.mutex.Lock()
+	defer queue.connection.mutex.Unlock()
+	return len(queue.ready)
+}
+
+func (queue *memoryQueue) UnackedCount() int {
+	queue.connection.mutex.Lock()
+	defer queue.connection.mutex.Unlock()
+	return len(queue.unacked)
+}
+
+// GetConsumers returns the names of the queue's consumers, sorted
+func (queue *memoryQueue) GetConsumers() []string {
+	names := queue.consumerNames()
+	sort.Strings(names)
+	return names
+}
+
+func (queue *memoryQueue) PeekReady(offset, count int) []string {
+	queue.connection.mutex.Lock()
+	defer queue.connection.mutex.Unlock()
+	return append([]string{}, page(queue.ready, offset, count)...)
+}
+
+// PeekUnacked returns the payloads of up to count unacked deliveries, newest
+// first
+func (queue *memoryQueue) PeekUnacked(count int) []string {
+	queue.connection.mutex.Lock()
+	defer queue.connection.mutex.Unlock()
+	payloads := []string{}
+	for i := len(queue.unacked) - 1; i >= 0 && len(payloads) < count; i-- {
+		payloads = append(payloads, decodePayload(queue.unacked[i]))
+	}
+	return payloads
+}
+
+func (queue *memoryQueue) OldestUnackedAge() (age time.Duration, ok bool) {
+	queue.connection.mutex.Lock()
+	defer queue.connection.mutex.Unlock()
+	if len(queue.unacked) == 0 {
+		return 0, false
+	}
+	published, ok := publishedAt(queue.unacked[0])
+	if !ok {
+		return 0, false
+	}
+	return time.Since(published), true
+}
+
+// page returns up to limit entries starting at offset
+func page(entries []string, offset, limit int) []string {
+	if offset < 0 || limit <= 0 || offset >= len(entries) {
+		return nil
+	}
+	end := offset + limit
+	if end > len(entries) {
+		end = len(entries)
+	}
+	return entries[offset:end]
+}
+
+// WatchRejected calls fn in a goroutine like redisQueue.WatchRejected(),
+// until the queue stops consuming
+func (queue *memoryQueue) WatchRejected(threshold int64, interval time.Duration, fn func(count int64)) {
+	if queue.consumingCtx == nil {
+		queue.consumingCtx, queue.stopConsuming = context.WithCancel(context.Background())
+	}
+	done := queue.consumingCtx.Done()
+	go func() {
+		watch := &rejectedWatch{threshold: threshold}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if count := int64(queue.RejectedCount()); watch.check(count) {
+				fn(count)
+			}
+		}
+	}()
+}
+
+func (queue *memoryQueue) Destroy() (PurgeCounts, error) {
+	if len(queue.consumerNames()) > 0 {
+		return PurgeCounts{}, ErrConsumersActive
+	}
+	return queue.ForceDestroy()
+}
+
+// ForceDestroy empties all lists and counters of the queue and removes it
+// from the connection, consumers keep running on the removed queue
+func (queue *memoryQueue) ForceDestroy() (PurgeCounts, error) {
+	queue.connection.mutex.Lock()
+	defer queue.connection.mutex.Unlock()
+	counts := PurgeCounts{
+		Ready:    int64(len(queue.ready)),
+		Rejected: int64(len(queue.rejected)),
+		Unacked:  int64(len(queue.unacked)),
+	}
+	if counts.Unacked > 0 || len(queue.consumers) > 0 {
+		counts.Connections = 1
+	}
+	queue.ready, queue.rejected, queue.unacked = nil, nil, nil
+	queue.reasons, queue.attempts = map[string]string{}, map[string]int{}
+	queue.counters = QueueCounters{}
+	delete(queue.connection.queues, queue.name)
+	return counts, nil
+}
+
+func (queue *memoryQueue) consumerNames() []string {
+	queue.connection.mutex.Lock()
+	defer queue.connection.mutex.Unlock()
+	names := []string{}
+	for name := range queue.consumers {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Export writes the ready (and rejected) entries like redisQueue.Export(),
+// there are no delayed entries to export
+func (queue *memoryQueue) Export(w io.Writer, lists ...string) (n int, err error) {
+	if len(lists) == 0 {
+		lists = []string{ExportReady}
+	}
+
+	queue.connection.mutex.Lock()
+	records := []exportRecord{}
+	for _, list := range lists {
+		switch list {
+		case ExportReady:
+			for _, entry := range queue.ready {
+				records = append(records, exportRecord{Version: exportVersion, List: list, Entry: []byte(entry)})
+			}
+		case ExportRejected:
+			for i := len(queue.rejected) - 1; i >= 0; i-- {
+				records = append(records, exportRecord{Version: exportVersion, List: list, Entry: []byte(queue.rejected[i])})
+			}
+		case ExportDelayed:
+		default:
+			err = fmt.Errorf("rmq queue can't export unknown list %q", list)
+		}
+	}
+	queue.connection.mutex.Unlock()
+
+	encoder := json.NewEncoder(w)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, err
+}
+
+// Import adds the records written by queue.Export() to the lists of this
+// queue, delayed entries are added to ready as there's no retrying
+func (queue *memoryQueue) Import(r io.Reader) (n int, err error) {
+	reader := bufio.NewReader(r)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			record := exportRecord{}
+			if err := json.Unmarshal(line, &record); err != nil {
+				return n, fmt.Errorf("rmq queue failed to import record %d: %s", n+1, err)
+			}
+			if record.Version > exportVersion {
+				return n, fmt.Errorf("rmq queue can't import export version %d", record.Version)
+			}
+
+			queue.connection.mutex.Lock()
+			switch record.List {
+			case ExportReady, ExportDelayed:
+				queue.addReady(string(record.Entry))
+			case ExportRejected:
+				queue.addRejected(string(record.Entry), "")
+			default:
+				err = fmt.Errorf("rmq queue can't import unknown list %q", record.List)
+			}
+			queue.connection.mutex.Unlock()
+			if err != nil {
+				return n, err
+			}
+			n++
+		}
+
+		if readErr == io.EOF {
+			return n, nil
+		}
+		if readErr != nil {
+			return n, readErr
+		}
+	}
+}
+
+func (queue *memoryQueue) DedupeReady() (removed int64, err error) {
+	return queue.dedupeReady(func(entry string) string { return entry }), nil
+}
+
+func (queue *memoryQueue) DedupeReadyPayloads() (removed int64, err error) {
+	return queue.dedupeReady(decodePayload), nil
+}
+
+// dedupeReady keeps only the oldest ready entry of each identity
+func (queue *memoryQueue) dedupeReady(identity func(entry string) string) (removed int64) {
+	queue.connection.mutex.Lock()
+	defer queue.connection.mutex.Unlock()
+	seen := map[string]bool{}
+	kept := queue.ready[:0]
+	for _, entry := range queue.ready {
+		if key := identity(entry); !seen[key] {
+			seen[key] = true
+			kept = append(kept, entry)
+			continue
+		}
+		removed++
+	}
+	queue.ready = kept
+	return removed
+}
+
+func (queue *memoryQueue) Counters() QueueCounters {
+	queue.connection.mutex.Lock()
+	defer queue.connection.mutex.Unlock()
+	return queue.counters
+}
+
+func (queue *memoryQueue) ResetCounters() (QueueCounters, error) {
+	queue.connection.mutex.Lock()
+	defer queue.connection.mutex.Unlock()
+	counters := queue.counters
+	queue.counters = QueueCounters{}
+	return counters, nil
+}
+
+// Close purges the ready and rejected deliveries and removes the queue from
+// the connection
+func (queue *memoryQueue) Close() bool {
+	queue.PurgeRejected()
+	queue.PurgeReady()
+	queue.connection.mutex.Lock()
+	defer queue.connection.mutex.Unlock()
+	if _, ok := queue.connection.queues[queue.name]; !ok {
+		return false
+	}
+	delete(queue.connection.queues, queue.name)
+	return true
+}
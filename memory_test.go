@@ -0,0 +1,168 @@
+package rmq
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/adjust/gocheck"
+)
+
+func TestMemorySuite(t *testing.T) {
+	TestingSuiteT(&MemorySuite{}, t)
+}
+
+type MemorySuite struct{}
+
+func (suite *MemorySuite) TestMemoryConsumer(c *C) {
+	connection := NewMemoryConnection()
+	var conn Connection
+	c.Check(connection, Implements, &conn)
+
+	queue := connection.OpenQueue("mem-q")
+	c.Check(connection.OpenQueue("mem-q"), Equals, queue)
+	consumer := NewTestConsumer("mem-A")
+	consumer.AutoAck = false
+	c.Check(queue.StartConsuming(10, time.Millisecond), Equals, true)
+	c.Check(queue.StartConsuming(10, time.Millisecond), Equals, false)
+	queue.AddConsumer("mem-cons", consumer)
+
+	c.Check(queue.Publish("mem-d1"), Equals, true)
+	c.Check(queue.Publish("mem-d2"), Equals, true)
+	c.Assert(consumer.WaitForDeliveries(2, time.Second), Equals, true)
+	deliveries := consumer.Deliveries()
+	c.Check(deliveries[0].Payload(), Equals, "mem-d1")
+	c.Check(queue.PeekUnacked(10), DeepEquals, []string{"mem-d2", "mem-d1"})
+
+	c.Check(deliveries[0].Ack(), Equals, true)
+	c.Check(deliveries[0].Ack(), Equals, false)
+	c.Check(deliveries[1].RejectWithReason("invalid"), Equals, true)
+	c.Check(queue.PeekUnacked(10), HasLen, 0)
+	rejected := queue.GetRejectedWithReasons(10)
+	c.Assert(rejected, HasLen, 1)
+	c.Check(rejected[0].Payload, Equals, "mem-d2")
+	c.Check(rejected[0].Reason, Equals, "invalid")
+	c.Check(rejected[0].Consumer, Matches, "mem-cons-.*")
+	c.Check(queue.Counters(), Equals, QueueCounters{Published: 2, Acked: 1, Rejected: 1})
+
+	c.Check(queue.ReturnAllRejected(), Equals, 1)
+	c.Assert(consumer.WaitForDeliveries(3, time.Second), Equals, true)
+	c.Check(consumer.Last().Payload(), Equals, "mem-d2")
+	c.Check(queue.RejectedCount(), Equals, 0)
+	c.Check(consumer.Last().RejectWithReason("still invalid"), Equals, true)
+	rejected = queue.GetRejectedWithReasons(10)
+	c.Assert(rejected, HasLen, 1)
+	c.Check(rejected[0].Attempts, Equals, 1) // bumped by ReturnAllRejected()
+	queue.StopConsuming()
+}
+
+func (suite *MemorySuite) TestMemoryPrefetch(c *C) {
+	connection := NewMemoryConnection()
+	queue := connection.OpenQueue("mem-prefetch")
+	for i := 0; i < 5; i++ {
+		queue.Publish("mem-p")
+	}
+	consumer := NewTestConsumer("mem-B")
+	consumer.AutoFinish = false
+	queue.StartConsuming(2, time.Millisecond)
+	queue.AddConsumer("mem-cons", consumer)
+	time.Sleep(delayMs * time.Millisecond)
+
+	// one delivery being consumed and two prefetched
+	c.Check(consumer.Deliveries(), HasLen, 1)
+	c.Check(queue.PeekReady(0, 10), HasLen, 2)
+	c.Check(queue.PeekUnacked(10), HasLen, 2)
+
+	consumer.Finish()
+	c.Check(consumer.WaitForDeliveries(2, time.Second), Equals, true)
+	time.Sleep(delayMs * time.Millisecond) // let the next one get prefetched
+	c.Check(queue.PeekReady(0, 10), HasLen, 1)
+	queue.StopConsuming()
+	for i := 0; i < 3; i++ { // the one being consumed and the prefetched ones
+		consumer.Finish()
+	}
+}
+
+func (suite *MemorySuite) TestMemoryPush(c *C) {
+	connection := NewMemoryConnection()
+	queue := connection.OpenQueue("mem-push1")
+	pushQueue := connection.OpenQueue("mem-push2")
+	c.Check(queue.SetPushQueue(pushQueue), IsNil)
+	c.Check(pushQueue.SetPushQueue(queue), NotNil)
+	c.Check(queue.PushChain(), DeepEquals, []string{"mem-push1", "mem-push2"})
+
+	consumer := NewTestConsumer("mem-C")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("mem-cons", consumer)
+	pushConsumer := NewTestConsumer("mem-D")
+	pushConsumer.AutoAck = false
+	pushQueue.StartConsuming(10, time.Millisecond)
+	pushQueue.AddConsumer("mem-cons", pushConsumer)
+
+	queue.PublishWithHeaders("mem-d", map[string]string{"key": "value"})
+	c.Assert(consumer.WaitForDeliveries(1, time.Second), Equals, true)
+	c.Check(consumer.Last().Push(), Equals, true)
+	c.Assert(pushConsumer.WaitForDeliveries(1, time.Second), Equals, true)
+	pushed := pushConsumer.Last()
+	c.Check(pushed.Payload(), Equals, "mem-d")
+	c.Check(pushed.Headers()["key"], Equals, "value")
+	c.Check(pushed.Headers()[HeaderPushCount], Equals, "1")
+
+	// push queues without push queue reject
+	c.Check(pushed.Push(), Equals, true)
+	c.Check(pushed.State(), Equals, Rejected)
+	c.Check(pushQueue.GetRejected(10), DeepEquals, []string{"mem-d"})
+
+	stats := connection.CollectStats(connection.GetOpenQueues())
+	c.Check(stats.QueueStats["mem-push1"].Counters, Equals, QueueCounters{Published: 1, Pushed: 1})
+	c.Check(stats.QueueStats["mem-push2"].RejectedCount, Equals, 1)
+	c.Check(stats.QueueStats["mem-push2"].ConsumerCount(), Equals, 1)
+	c.Check(stats.Connections(), DeepEquals, map[string]bool{connection.Name: true})
+	queue.StopConsuming()
+	pushQueue.StopConsuming()
+}
+
+func (suite *MemorySuite) TestMemoryBatchConsumer(c *C) {
+	connection := NewMemoryConnection()
+	queue := connection.OpenQueue("mem-batch")
+	consumer := NewTestBatchConsumer()
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddBatchConsumerWithTimeout("mem-cons", 2, 10*time.Millisecond, consumer)
+
+	queue.Publish("mem-b1")
+	queue.Publish("mem-b2")
+	queue.Publish("mem-b3")
+	time.Sleep(delayMs * time.Millisecond)
+	c.Check(consumer.LastBatch, HasLen, 2)
+	consumer.Finish()
+	time.Sleep(20 * time.Millisecond)
+	c.Check(consumer.LastBatch, HasLen, 1)
+	consumer.Finish()
+	queue.StopConsuming()
+}
+
+func (suite *MemorySuite) TestMemorySynchronous(c *C) {
+	connection := NewMemoryConnection()
+	connection.SetSynchronous(true)
+	queue := connection.OpenQueue("mem-sync")
+	queue.StartConsuming(2, time.Millisecond)
+	consumer := NewTestConsumer("mem-C")
+	_, stopper := queue.AddConsumer("mem-cons", consumer)
+	for i := 0; i < 3; i++ {
+		queue.Publish(fmt.Sprintf("mem-s%d", i))
+	}
+	c.Check(queue.ReadyCount(), Equals, 3)
+
+	c.Check(queue.ConsumeOnce(), Equals, 2)
+	c.Check(consumer.Deliveries(), HasLen, 2)
+	c.Check(queue.ReadyCount(), Equals, 1)
+	c.Check(queue.Counters().Acked, Equals, int64(2))
+
+	stopper <- 1
+	c.Check(queue.ConsumeOnce(), Equals, 0) // no consumers left
+	c.Check(queue.GetConsumers(), HasLen, 0)
+	c.Check(queue.UnackedCount(), Equals, 1) // stays prefetched
+	queue.StopConsuming()
+	c.Check(queue.ConsumeOnce(), Equals, 0)
+}
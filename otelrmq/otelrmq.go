@@ -0,0 +1,200 @@
+// Package otelrmq instruments rmq connections with OpenTelemetry traces and
+// metrics
+package otelrmq
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ryanleary/rmq"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/ryanleary/rmq/otelrmq"
+
+var systemAttribute = attribute.String("messaging.system", "rmq")
+
+// Instrumentation is an rmq.Tracer which traces publishing and consuming
+// deliveries and records metrics about consumed deliveries. Once a
+// connection is instrumented it also reports the counts of all open queues,
+// collected periodically
+type Instrumentation struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+	consumed   metric.Int64Counter
+	duration   metric.Float64Histogram
+
+	mutex sync.Mutex
+	stats rmq.Stats // of the instrumented connection, zero until collected
+}
+
+// New returns an instrumentation creating spans with the tracer provider and
+// instruments with the meter provider, pass otel.GetTracerProvider() and
+// otel.GetMeterProvider() to use the global ones. Trace contexts are
+// propagated in the rmq.HeaderTraceParent header of deliveries
+func New(tracerProvider trace.TracerProvider, meterProvider metric.MeterProvider) (*Instrumentation, error) {
+	meter := meterProvider.Meter(instrumentationName)
+	instrumentation := &Instrumentation{
+		tracer:     tracerProvider.Tracer(instrumentationName),
+		propagator: propagation.TraceContext{},
+	}
+
+	var err error
+	if instrumentation.consumed, err = meter.Int64Counter("rmq.messages.consumed",
+		metric.WithDescription("Number of deliveries consumed by this process by how consumers settled them.")); err != nil {
+		return nil, err
+	}
+	if instrumentation.duration, err = meter.Float64Histogram("rmq.process.duration", metric.WithUnit("s"),
+		metric.WithDescription("Time consumers of this process took to consume a delivery.")); err != nil {
+		return nil, err
+	}
+	if err := instrumentation.registerStats(meter); err != nil {
+		return nil, err
+	}
+	return instrumentation, nil
+}
+
+// registerStats registers the instruments reporting the last collected stats
+func (instrumentation *Instrumentation) registerStats(meter metric.Meter) error {
+	type gauge struct {
+		name, description string
+		value             func(rmq.QueueStat) int64
+	}
+	gauges := []gauge{
+		{"rmq.queue.ready", "Number of ready deliveries in the queue.",
+			func(stat rmq.QueueStat) int64 { return int64(stat.ReadyCount) }},
+		{"rmq.queue.rejected", "Number of rejected deliveries in the queue.",
+			func(stat rmq.QueueStat) int64 { return int64(stat.RejectedCount) }},
+		{"rmq.queue.unacked", "Number of unacked deliveries of the queue in all connections.",
+			func(stat rmq.QueueStat) int64 { return int64(stat.UnackedCount()) }},
+	}
+	counters := []gauge{
+		{"rmq.messages.published", "Number of deliveries published to the queue by all connections.",
+			func(stat rmq.QueueStat) int64 { return stat.Counters.Published }},
+		{"rmq.messages.acked", "Number of deliveries of the queue acked by all connections.",
+			func(stat rmq.QueueStat) int64 { return stat.Counters.Acked }},
+		{"rmq.messages.rejected", "Number of deliveries of the queue rejected by all connections.",
+			func(stat rmq.QueueStat) int64 { return stat.Counters.Rejected }},
+	}
+
+	var observables []metric.Observable
+	observed := map[metric.Int64Observable]func(rmq.QueueStat) int64{}
+	for _, gauge := range gauges {
+		instrument, err := meter.Int64ObservableGauge(gauge.name, metric.WithDescription(gauge.description))
+		if err != nil {
+			return err
+		}
+		observables = append(observables, instrument)
+		observed[instrument] = gauge.value
+	}
+	for _, counter := range counters {
+		instrument, err := meter.Int64ObservableCounter(counter.name, metric.WithDescription(counter.description))
+		if err != nil {
+			return err
+		}
+		observables = append(observables, instrument)
+		observed[instrument] = counter.value
+	}
+
+	_, err := meter.RegisterCallback(func(ctx context.Context, observer metric.Observer) error {
+		instrumentation.mutex.Lock()
+		stats := instrumentation.stats
+		instrumentation.mutex.Unlock()
+		for queueName, queueStat := range stats.QueueStats {
+			attributes := metric.WithAttributes(systemAttribute, attribute.String("messaging.destination.name", queueName))
+			for instrument, value := range observed {
+				observer.ObserveInt64(instrument, value(queueStat), attributes)
+			}
+		}
+		return nil
+	}, observables...)
+	return err
+}
+
+// Instrument sets the instrumentation as the tracer of queues opened on the
+// connection afterwards and collects the stats of all open queues every
+// interval for the queue instruments. Call the returned function to stop
+// collecting
+func (instrumentation *Instrumentation) Instrument(connection *rmq.RedisConnection, interval time.Duration) (stop func()) {
+	connection.SetTracer(instrumentation)
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if stats, err := collectStats(connection); err == nil {
+				instrumentation.mutex.Lock()
+				instrumentation.stats = stats
+				instrumentation.mutex.Unlock()
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// collectStats collects the stats of all open queues of the connection,
+// returning the panics rmq raises on Redis errors as errors
+func collectStats(connection rmq.Connection) (stats rmq.Stats, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("rmq stats collection failed: %v", r)
+		}
+	}()
+	return connection.CollectStats(connection.GetOpenQueues()), nil
+}
+
+// Inject implements rmq.Tracer. It records a producer span for the publish
+// and stores its context in the headers. rmq doesn't tell tracers the queue
+// or the outcome of a publish, so the span only marks when it happened
+func (instrumentation *Instrumentation) Inject(ctx context.Context, headers map[string]string) {
+	ctx, span := instrumentation.tracer.Start(ctx, "rmq publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(systemAttribute, attribute.String("messaging.operation", "publish")))
+	instrumentation.propagator.Inject(ctx, propagation.MapCarrier(headers))
+	span.End()
+}
+
+// StartConsume implements rmq.Tracer. It starts a consumer span as child of
+// the publishing span and records the consumed delivery and its duration
+// once the consumer returned
+func (instrumentation *Instrumentation) StartConsume(ctx context.Context, delivery rmq.Delivery, consume rmq.ConsumeSpan) (spanCtx context.Context, end func()) {
+	ctx = instrumentation.propagator.Extract(ctx, propagation.MapCarrier(delivery.Headers()))
+	spanCtx, span := instrumentation.tracer.Start(ctx, consume.Queue+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			systemAttribute,
+			attribute.String("messaging.operation", "process"),
+			attribute.String("messaging.destination.name", consume.Queue),
+			attribute.String("messaging.consumer.id", consume.Consumer),
+			attribute.Int("messaging.message.body.size", consume.PayloadSize),
+			attribute.Int("rmq.attempts", consume.Attempts),
+		))
+
+	start := time.Now()
+	return spanCtx, func() {
+		state := delivery.State().String()
+		span.SetAttributes(attribute.String("rmq.state", state))
+		span.End()
+
+		attributes := metric.WithAttributes(systemAttribute,
+			attribute.String("messaging.destination.name", consume.Queue),
+			attribute.String("rmq.state", state))
+		instrumentation.consumed.Add(ctx, 1, attributes)
+		instrumentation.duration.Record(ctx, time.Since(start).Seconds(), attributes)
+	}
+}
@@ -0,0 +1,40 @@
+package otelrmq
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ryanleary/rmq"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/trace"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestPropagation(t *testing.T) {
+	instrumentation, err := New(tracenoop.NewTracerProvider(), metricnoop.NewMeterProvider())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parent := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1, 2, 3},
+		SpanID:     trace.SpanID{4, 5, 6},
+		TraceFlags: trace.FlagsSampled,
+	})
+	headers := map[string]string{}
+	instrumentation.Inject(trace.ContextWithSpanContext(context.Background(), parent), headers)
+	if headers[rmq.HeaderTraceParent] == "" {
+		t.Fatalf("expected trace context in headers, got %v", headers)
+	}
+
+	delivery := rmq.NewTestDeliveryString("d1")
+	for key, value := range headers {
+		delivery.WithHeader(key, value)
+	}
+	ctx, end := instrumentation.StartConsume(context.Background(), delivery, rmq.ConsumeSpan{Queue: "q1", Consumer: "c1"})
+	if traceID := trace.SpanContextFromContext(ctx).TraceID(); traceID != parent.TraceID() {
+		t.Errorf("expected consumer span in trace %s, got %s", parent.TraceID(), traceID)
+	}
+	delivery.Ack()
+	end()
+}
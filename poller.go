@@ -0,0 +1,197 @@
+package rmq
+
+import (
+	"sync"
+	"time"
+
+	"gopkg.in/redis.v5"
+)
+
+// sharedPoller fetches deliveries for all consuming queues of a connection in
+// one goroutine, see connection.SetSharedPoller(). Each poll moves at most one
+// delivery per queue from ready to unacked, sharing one round trip. Queues
+// whose prefetch buffer is full are skipped until their consumers catch up
+type sharedPoller struct {
+	interval    time.Duration
+	redisClient redis.Cmdable
+	clock       func() Clock    // the connection's clock, see connection.SetClock()
+	done        <-chan struct{} // stops the poller, nil for never
+
+	mutex   sync.Mutex
+	queues  []*redisQueue
+	started bool
+}
+
+func newSharedPoller(interval time.Duration, redisClient redis.Cmdable, clock func() Clock, done <-chan struct{}) *sharedPoller {
+	return &sharedPoller{
+		interval:    interval,
+		redisClient: redisClient,
+		clock:       clock,
+		done:        done,
+	}
+}
+
+// add makes the poller fetch for the consuming queue, starting the poller on
+// first use. Queues get removed once they stopped consuming
+func (poller *sharedPoller) add(queue *redisQueue) {
+	poller.mutex.Lock()
+	defer poller.mutex.Unlock()
+	poller.queues = append(poller.queues, queue)
+	if !poller.started {
+		poller.started = true
+		go poller.run()
+	}
+}
+
+// consuming returns the queues which are still consuming and forgets the
+// others
+func (poller *sharedPoller) consuming() []*redisQueue {
+	poller.mutex.Lock()
+	defer poller.mutex.Unlock()
+	consuming := poller.queues[:0]
+	for _, queue := range poller.queues {
+		if !queue.consumingStopped {
+			consuming = append(consuming, queue)
+		}
+	}
+	poller.queues = consuming
+	return append([]*redisQueue(nil), consuming...)
+}
+
+func (poller *sharedPoller) run() {
+	backoff := time.Duration(0)
+	for {
+		wantMore, err := poller.poll()
+		switch {
+		case err != nil:
+			backoff = nextConsumeBackoff(backoff, poller.interval)
+			poller.clock().Sleep(backoff)
+		case !wantMore:
+			backoff = 0
+			poller.clock().Sleep(poller.interval)
+		default:
+			backoff = 0
+		}
+
+		select {
+		case <-poller.done:
+			return
+		default:
+		}
+	}
+}
+
+// poll fetches one delivery for each consuming queue with free prefetch
+// capacity, returns true if any queue got one and might get more right away.
+// Errors are passed to the queues' OnConsumeError hooks, the error of the
+// round trip is returned to back off
+func (poller *sharedPoller) poll() (wantMore bool, err error) {
+	var pipelined []*redisQueue
+	for _, queue := range poller.consuming() {
+		if queue.prefetchLimit-len(queue.deliveryChan) <= 0 {
+			continue // prefetch buffer full
+		}
+		if queue.fetchStream != nil {
+			more, err := queue.fetch() // reads a batch in one round trip anyway
+			if err != nil {
+				queue.consumeFailed(err)
+			}
+			wantMore = wantMore || more
+			continue
+		}
+		pipelined = append(pipelined, queue)
+	}
+	if len(pipelined) == 0 {
+		return wantMore, nil
+	}
+
+	reads := make([]func() (*wrapDelivery, error), len(pipelined))
+	_, err = poller.redisClient.Pipelined(func(pipe *redis.Pipeline) error {
+		for i, queue := range pipelined {
+			reads[i] = queue.pipePop(pipe)
+		}
+		return nil
+	})
+	err = pipelineErr(err) // redis.Nil if some queues were empty
+
+	for i, queue := range pipelined {
+		delivery, popErr := reads[i]()
+		if popErr != nil {
+			queue.consumeFailed(popErr)
+			continue
+		}
+		if delivery != nil {
+			queue.deliver(delivery)
+			wantMore = true
+		}
+	}
+	return wantMore, err
+}
+
+// pipePop adds the command moving one delivery from ready to unacked to pipe,
+// like consumeBatch(1) does. The returned function reads the moved delivery
+// from the command's result once the pipeline ran, nil if ready was empty
+func (queue *redisQueue) pipePop(pipe *redis.Pipeline) func() (*wrapDelivery, error) {
+	if queue.visibility > 0 {
+		deadline := visibilityScore(queue.clock.Now().Add(queue.visibility))
+		keys := []string{queue.readyKey, queue.unackedKey, queue.inflightKey}
+		result := consumeInflightScript.pick(queue.positional).eval(queue.redisClient, pipe, keys, deadline)
+		return func() (*wrapDelivery, error) {
+			if err := redisErr(result); err != nil {
+				return nil, err
+			}
+			wire, _ := result.Val().(string)
+			delivery := queue.deliveryOrNil(wire)
+			if delivery != nil {
+				delivery.track(deadline)
+			}
+			return delivery, nil
+		}
+	}
+
+	if queue.positional {
+		result := popScript.pick(true).eval(queue.redisClient, pipe, []string{queue.readyKey, queue.unackedKey}, 1)
+		return func() (*wrapDelivery, error) {
+			if err := redisErr(result); err != nil {
+				return nil, err
+			}
+			popped := stringValues(result.Val())
+			if len(popped) == 0 {
+				return nil, nil
+			}
+			return queue.deliveryOrNil(popped[0]), nil
+		}
+	}
+
+	result := pipe.RPopLPush(queue.readyKey, queue.unackedKey)
+	return func() (*wrapDelivery, error) {
+		if err := redisErr(result); err != nil {
+			return nil, err
+		}
+		return queue.deliveryOrNil(result.Val()), nil
+	}
+}
+
+// deliveryOrNil returns the delivery of a popped wire, nil if nothing was
+// popped
+func (queue *redisQueue) deliveryOrNil(wire string) *wrapDelivery {
+	if wire == "" {
+		return nil
+	}
+	return queue.newDelivery([]byte(wire))
+}
+
+// SetSharedPoller makes all queues opened on this connection afterwards fetch
+// their deliveries through one shared poller instead of a goroutine each,
+// which saves most of the polling of mostly idle queues: Each poll fetches one
+// delivery for every consuming queue in one round trip, repeating right away
+// while any queue got one and otherwise after pollDuration. The poll
+// durations passed to StartConsuming are ignored then, prefetch limits still
+// apply. Zero disables the shared poller again, which is the default
+func (connection *RedisConnection) SetSharedPoller(pollDuration time.Duration) {
+	if pollDuration <= 0 {
+		connection.poller = nil
+		return
+	}
+	connection.poller = newSharedPoller(pollDuration, connection.redisClient, connection.getClock, connection.done())
+}
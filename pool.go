@@ -0,0 +1,96 @@
+package rmq
+
+import (
+	"time"
+
+	"gopkg.in/redis.v5"
+)
+
+// ConnectionOptions tune the Redis client built by OpenConnectionWithOptions()
+// and OpenClusterConnectionWithOptions(). Zero values keep the client's
+// defaults. The client keeps no minimum of idle connections, it opens them on
+// demand and closes them after IdleTimeout
+type ConnectionOptions struct {
+	Password     string
+	MaxRetries   int           // retries of failed commands, zero for none
+	PoolSize     int           // connections per Redis node, the client defaults to 10
+	PoolTimeout  time.Duration // how long to wait for a free connection before failing with a pool timeout
+	IdleTimeout  time.Duration // after which idle connections get closed
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+func (options ConnectionOptions) client(address string, db int) *redis.Options {
+	return &redis.Options{
+		Addr:         address,
+		DB:           db,
+		Password:     options.Password,
+		MaxRetries:   options.MaxRetries,
+		PoolSize:     options.PoolSize,
+		PoolTimeout:  options.PoolTimeout,
+		IdleTimeout:  options.IdleTimeout,
+		DialTimeout:  options.DialTimeout,
+		ReadTimeout:  options.ReadTimeout,
+		WriteTimeout: options.WriteTimeout,
+	}
+}
+
+func (options ConnectionOptions) cluster(addresses []string) *redis.ClusterOptions {
+	return &redis.ClusterOptions{
+		Addrs:        addresses,
+		Password:     options.Password,
+		PoolSize:     options.PoolSize,
+		PoolTimeout:  options.PoolTimeout,
+		IdleTimeout:  options.IdleTimeout,
+		DialTimeout:  options.DialTimeout,
+		ReadTimeout:  options.ReadTimeout,
+		WriteTimeout: options.WriteTimeout,
+	}
+}
+
+// OpenConnectionWithOptions is like OpenConnection(), building the Redis
+// client with the given options
+func OpenConnectionWithOptions(tag, address string, db int, options ConnectionOptions) *RedisConnection {
+	return OpenConnectionWithRedisCmdable(tag, redis.NewClient(options.client(address, db)))
+}
+
+// OpenClusterConnectionWithOptions is like OpenClusterConnection(), building
+// the Redis Cluster client with the given options. MaxRetries doesn't apply to
+// cluster clients, they retry redirects instead
+func OpenClusterConnectionWithOptions(tag string, addresses []string, options ConnectionOptions) *RedisConnection {
+	return OpenConnectionWithRedisCmdable(tag, redis.NewClusterClient(options.cluster(addresses)))
+}
+
+// PoolStats are the connection pool statistics of a Redis client, summed over
+// all nodes for cluster clients
+type PoolStats struct {
+	Hits       int64 // times a free connection was found in the pool
+	Misses     int64 // times a new connection had to be opened or waited for
+	Timeouts   int64 // times waiting for a free connection timed out
+	TotalConns int64 // connections in the pool
+	IdleConns  int64 // free connections in the pool
+}
+
+func newPoolStats(stats *redis.PoolStats) PoolStats {
+	return PoolStats{
+		Hits:       int64(stats.Hits),
+		Misses:     int64(stats.Requests) - int64(stats.Hits),
+		Timeouts:   int64(stats.Timeouts),
+		TotalConns: int64(stats.TotalConns),
+		IdleConns:  int64(stats.FreeConns),
+	}
+}
+
+// PoolStats returns the pool statistics of the connection's Redis client.
+// Returns false if the client doesn't have a pool, like a custom
+// redis.Cmdable passed to OpenConnectionWithRedisCmdable()
+func (connection *RedisConnection) PoolStats() (PoolStats, bool) {
+	pooled, ok := connection.redisClient.(interface {
+		PoolStats() *redis.PoolStats
+	})
+	if !ok {
+		return PoolStats{}, false
+	}
+	return newPoolStats(pooled.PoolStats()), true
+}
@@ -0,0 +1,32 @@
+package rmq
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/redis.v5"
+)
+
+func TestConnectionOptions(t *testing.T) {
+	options := ConnectionOptions{PoolSize: 50, PoolTimeout: time.Second, ReadTimeout: 2 * time.Second, MaxRetries: 3}
+	client := options.client("localhost:6379", 2)
+	if client.Addr != "localhost:6379" || client.DB != 2 || client.PoolSize != 50 || client.PoolTimeout != time.Second || client.ReadTimeout != 2*time.Second || client.MaxRetries != 3 {
+		t.Errorf("client options %+v", client)
+	}
+	cluster := options.cluster([]string{"a:7000", "b:7000"})
+	if len(cluster.Addrs) != 2 || cluster.PoolSize != 50 || cluster.ReadTimeout != 2*time.Second {
+		t.Errorf("cluster options %+v", cluster)
+	}
+}
+
+func TestNewPoolStats(t *testing.T) {
+	stats := newPoolStats(&redis.PoolStats{Requests: 10, Hits: 7, Timeouts: 1, TotalConns: 4, FreeConns: 3})
+	if stats != (PoolStats{Hits: 7, Misses: 3, Timeouts: 1, TotalConns: 4, IdleConns: 3}) {
+		t.Errorf("pool stats %+v", stats)
+	}
+
+	wrapped := struct{ redis.Cmdable }{redis.NewClient(&redis.Options{Addr: "localhost:6379"})} // hides PoolStats()
+	if _, ok := OpenInspectorWithRedisCmdable(wrapped).PoolStats(); ok {
+		t.Errorf("wrapped client reported pool stats")
+	}
+}
@@ -0,0 +1,58 @@
+package rmq
+
+import "strings"
+
+// quarantine is a filter set with queue.SetQuarantineFilter()
+type quarantine struct {
+	filter   func(payload []byte) bool
+	readyKey string // ready key of the quarantine queue
+	name     string // name of the quarantine queue
+}
+
+// SetQuarantineFilter makes the queue move deliveries whose payload matches
+// filter straight to the ready list of the quarantine queue instead of handing
+// them to consumers. Quarantined deliveries are counted in the queue's
+// Quarantined stat. The filter must not modify the payload. Can be called at
+// any time to swap the filter while consuming, pass a nil filter to remove it
+func (queue *redisQueue) SetQuarantineFilter(filter func(payload []byte) bool, quarantineQueue string) {
+	if filter == nil {
+		queue.quarantine.Store((*quarantine)(nil))
+		return
+	}
+
+	queue.quarantine.Store(&quarantine{
+		filter:   filter,
+		readyKey: strings.Replace(queueReadyTemplate, phQueue, quarantineQueue, 1),
+		name:     quarantineQueue,
+	})
+}
+
+// quarantined moves the delivery to the quarantine queue and returns true if
+// it matches the quarantine filter
+func (queue *redisQueue) quarantined(delivery *wrapDelivery) bool {
+	current, _ := queue.quarantine.Load().(*quarantine)
+	if current == nil || !current.filter(delivery.payload) {
+		return false
+	}
+
+	// log.Printf("rmq queue quarantined delivery %s %s", queue, delivery)
+	delivery.setState(Pushed)
+	redisErrIsNil(queue.redisClient.SAdd(queuesKey, current.name))
+	if err := delivery.moveWire(current.readyKey, delivery.wire); err != nil {
+		// log.Printf("rmq queue failed to quarantine delivery %s %s", queue, err)
+		return true
+	}
+	redisErrIsNil(queue.redisClient.Incr(queue.quarantinedKey))
+	return true
+}
+
+// QuarantinedCount returns the number of deliveries moved to the quarantine
+// queue by the quarantine filter
+func (queue *redisQueue) QuarantinedCount() int {
+	result := queue.redisClient.Get(queue.quarantinedKey)
+	if redisErrIsNil(result) {
+		return 0
+	}
+	count, _ := result.Int64()
+	return int(count)
+}
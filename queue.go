@@ -1,9 +1,14 @@
 package rmq
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/adjust/uniuri"
@@ -14,18 +19,178 @@ const (
 	connectionsKey                   = "rmq::connections"                                           // Set of connection names
 	connectionHeartbeatTemplate      = "rmq::connection::{connection}::heartbeat"                   // expires after {connection} died
 	connectionQueuesTemplate         = "rmq::connection::{connection}::queues"                      // Set of queues consumers of {connection} are consuming
+	connectionStaleTemplate          = "rmq::connection::{connection}::stale"                       // Unix time in ms the cleaner first saw {connection} without heartbeat
+	connectionCleaningTemplate       = "rmq::connection::{connection}::cleaning"                    // Token of the cleaner currently cleaning {connection}, expires
+	connectionProtectedTemplate      = "rmq::connection::{connection}::protected"                   // Exists if cleaners must not clean {connection}
 	connectionQueueConsumersTemplate = "rmq::connection::{connection}::queue::{{queue}}::consumers" // Set of all consumers from {connection} consuming from {queue}
 	connectionQueueUnackedTemplate   = "rmq::connection::{connection}::queue::{{queue}}::unacked"   // List of deliveries consumers of {connection} are currently consuming
-
-	queuesKey             = "rmq::queues"                     // Set of all open queues
-	queueReadyTemplate    = "rmq::queue::{{queue}}::ready"    // List of deliveries in that {queue} (right is first and oldest, left is last and youngest)
-	queueRejectedTemplate = "rmq::queue::{{queue}}::rejected" // List of rejected deliveries from that {queue}
+	connectionQueueInflightTemplate  = "rmq::connection::{connection}::queue::{{queue}}::inflight"  // Sorted set of unacked deliveries scored by their visibility deadline
+	connectionQueueStatsTemplate     = "rmq::connection::{connection}::queue::{{queue}}::stats"     // Hash of consumers from {connection} consuming from {queue} to their JSON encoded ConsumerStat
+	connectionQueueLatencyTemplate   = "rmq::connection::{connection}::queue::{{queue}}::latency"   // Hash of latency bucket indexes to the number of deliveries from {queue} consumed by {connection} with that latency
+
+	queuesKey                   = "rmq::queues"                             // Set of all open queues
+	pushQueuesKey               = "rmq::queues::push"                       // Hash of queue names to the names of their push queues
+	queuesActivityKey           = "rmq::queues::activity"                   // Hash of queue names to the Unix time in ms they were last opened or published to
+	streamQueuesKey             = "rmq::queues::streams"                    // Set of queues opened as stream queues, see connection.OpenStreamQueue()
+	queueReadyTemplate          = "rmq::queue::{{queue}}::ready"            // List of deliveries in that {queue} (right is first and oldest, left is last and youngest)
+	queueRejectedTemplate       = "rmq::queue::{{queue}}::rejected"         // List of rejected deliveries from that {queue}
+	queueReasonsTemplate        = "rmq::queue::{{queue}}::reasons"          // Hash of rejected delivery payloads to their rejection reasons
+	queueAttemptsTemplate       = "rmq::queue::{{queue}}::attempts"         // Hash of delivery payloads to the number of times they were redelivered
+	queueChecksumTemplate       = "rmq::queue::{{queue}}::checksum"         // Number of deliveries from that {queue} rejected for a checksum mismatch
+	queueDelayedTemplate        = "rmq::queue::{{queue}}::delayed"          // Sorted set of deliveries waiting to be retried scored by when they are due
+	queueQuarantinedTemplate    = "rmq::queue::{{queue}}::quarantined"      // Number of deliveries from that {queue} moved to its quarantine queue
+	queueHistoryTemplate        = "rmq::queue::{{queue}}::history"          // Sorted set of recorded stats of {queue} scored by Unix time in ms
+	queueCountersTemplate       = "rmq::queue::{{queue}}::counters"         // Hash of cumulative counts of published, acked, rejected and pushed deliveries of {queue}
+	queueStreamTemplate         = "rmq::queue::{{queue}}::stream"           // Stream of ready and unacked deliveries of the stream queue {queue}, read by the consumer group streamGroup
+	queueRejectedStreamTemplate = "rmq::queue::{{queue}}::rejected::stream" // Stream of rejected deliveries of the stream queue {queue}
+	statsRecorderKey            = "rmq::stats::recorder"                    // Exists while some process recorded stats within the recording interval
 
 	phConnection = "{connection}" // connection name
 	phQueue      = "{queue}"      // queue name
 	phConsumer   = "{consumer}"   // consumer name (consisting of tag and token)
 
 	defaultBatchTimeout = time.Second
+	maxPushDepth        = 10 // max number of times a delivery can be pushed along a chain of push queues
+	maxReapInterval     = time.Second
+	maxConsumeBackoff   = 10 * time.Second // max sleep of the consume loop after Redis errors
+	reapBatchSize       = 100
+	returnBatchSize     = 1000 // max number of rejected deliveries returned per script call
+	returnThrottleSteps = 10   // number of batches per second used by ReturnAllRejectedThrottled
+	rejectedScanSize    = 1000 // number of rejected deliveries read per LRANGE when searching
+	idLength            = 16
+	activityInterval    = time.Minute // how often publishing to a queue updates its activity time
+)
+
+// ErrConsumersActive is returned by queue.ReturnAllUnacked() if the queue is
+// still consuming or its consumers are still busy with deliveries and by
+// queue.Destroy() if live connections have consumers on the queue
+var ErrConsumersActive = errors.New("rmq queue consumers still active, stop consuming first")
+
+var (
+	// consumeInflightScript moves a delivery from ready to unacked and tracks
+	// its visibility deadline
+	consumeInflightScript = newListScript("consumeInflight", `
+local payload = pop(KEYS[1], KEYS[2])
+if payload then
+	redis.call('ZADD', KEYS[3], ARGV[1], payload)
+end
+return payload
+`)
+
+	// reapScript returns up to ARGV[2] unacked deliveries whose visibility
+	// deadline passed ARGV[1] back to ready and bumps their attempts
+	reapScript = newScript("reap", `
+local expired = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+local returned = 0
+for _, payload in ipairs(expired) do
+	redis.call('ZREM', KEYS[1], payload)
+	if redis.call('LREM', KEYS[2], 1, payload) == 1 then
+		redis.call('LPUSH', KEYS[3], payload)
+		redis.call('HINCRBY', KEYS[4], payload, 1)
+		returned = returned + 1
+	end
+end
+return returned
+`)
+
+	// returnRejectedScript moves up to ARGV[1] rejected deliveries back to
+	// ready, removes their rejection reasons, bumps their attempts and returns
+	// how many it moved
+	returnRejectedScript = newScript("returnRejected", `
+local returned = 0
+for i = 1, tonumber(ARGV[1]) do
+	local payload = redis.call('RPOPLPUSH', KEYS[1], KEYS[2])
+	if not payload then
+		break
+	end
+	redis.call('HDEL', KEYS[3], payload)
+	redis.call('HINCRBY', KEYS[4], payload, 1)
+	returned = returned + 1
+end
+return returned
+`)
+
+	// drainScript moves up to ARGV[1] ready deliveries (oldest first) to
+	// another ready list and returns how many it moved
+	drainScript = newScript("drain", `
+local moved = 0
+for i = 1, tonumber(ARGV[1]) do
+	if not redis.call('RPOPLPUSH', KEYS[1], KEYS[2]) then
+		break
+	end
+	moved = moved + 1
+end
+return moved
+`)
+
+	// returnUnackedScript moves up to ARGV[1] unacked deliveries back to ready,
+	// removes their visibility deadlines, counts their redelivery attempts and
+	// returns how many it moved
+	returnUnackedScript = newScript("returnUnacked", `
+local returned = 0
+for i = 1, tonumber(ARGV[1]) do
+	local payload = redis.call('RPOPLPUSH', KEYS[1], KEYS[2])
+	if not payload then
+		break
+	end
+	redis.call('ZREM', KEYS[3], payload)
+	redis.call('HINCRBY', KEYS[4], payload, 1)
+	returned = returned + 1
+end
+return returned
+`)
+
+	// returnRejectedMessageScript moves one rejected delivery back to ready,
+	// removes its rejection reason and bumps its attempts. Returns 0 if the
+	// delivery isn't rejected anymore
+	returnRejectedMessageScript = newScript("returnRejectedMessage", `
+if redis.call('LREM', KEYS[1], 1, ARGV[1]) == 0 then
+	return 0
+end
+redis.call('LPUSH', KEYS[2], ARGV[1])
+redis.call('HDEL', KEYS[3], ARGV[1])
+redis.call('HINCRBY', KEYS[4], ARGV[1], 1)
+return 1
+`)
+
+	// trimRejectedScript drops all but the newest ARGV[1] rejected deliveries
+	// along with their rejection reasons and returns how many it dropped
+	trimRejectedScript = newScript("trimRejected", `
+local maxLength = tonumber(ARGV[1])
+local dropped = redis.call('LRANGE', KEYS[1], maxLength, -1)
+if #dropped == 0 then
+	return 0
+end
+if maxLength == 0 then
+	redis.call('DEL', KEYS[1])
+else
+	redis.call('LTRIM', KEYS[1], 0, maxLength - 1)
+end
+for _, payload in ipairs(dropped) do
+	redis.call('HDEL', KEYS[2], payload)
+end
+return #dropped
+`)
+
+	// purgeScript renames the list at KEYS[1] to the temporary KEYS[2] and
+	// deletes it along with the attempts of its entries in the hash at KEYS[3]
+	// and all further keys. Returns the length of the list
+	purgeScript = newScript("purge", `
+local length = redis.call('LLEN', KEYS[1])
+if length > 0 then
+	redis.call('RENAME', KEYS[1], KEYS[2])
+	if redis.call('HLEN', KEYS[3]) > 0 then
+		for _, payload in ipairs(redis.call('LRANGE', KEYS[2], 0, -1)) do
+			redis.call('HDEL', KEYS[3], payload)
+		end
+	end
+	redis.call('DEL', KEYS[2])
+end
+if #KEYS > 3 then
+	redis.call('DEL', unpack(KEYS, 4))
+end
+return length
+`)
 )
 
 // Queue interface defines the primary methods for interacting with data inserting
@@ -33,16 +198,70 @@ const (
 type Queue interface {
 	Publish(payload string) bool
 	PublishBytes(payload []byte) bool
-	SetPushQueue(pushQueue Queue)
+	PublishWithHeaders(payload string, headers map[string]string) bool
+	PublishWithContext(ctx context.Context, payload string) bool
+	SetPushQueue(pushQueue Queue) error
+	PushQueueName() string
+	PushChain() []string
+	SetDeadLetterQueue(deadQueue Queue)
 	StartConsuming(prefetchLimit int, pollDuration time.Duration) bool
+	StartConsumingErr(prefetchLimit int, pollDuration time.Duration) error
 	StopConsuming() bool
+	StopConsumingErr() error
 	AddConsumer(tag string, consumer Consumer) (name string, stopper chan<- int)
+	AddConsumerFunc(tag string, consumerFunc ConsumerFunc) (name string, stopper chan<- int)
+	AddContextConsumer(tag string, consumer ConsumerWithContext) (name string, stopper chan<- int)
 	AddBatchConsumer(tag string, batchSize int, consumer BatchConsumer) string
 	AddBatchConsumerWithTimeout(tag string, batchSize int, timeout time.Duration, consumer BatchConsumer) string
+	AckMany(deliveries []Delivery) (acked int, failed []Delivery, err error)
+	SetVisibilityTimeout(timeout time.Duration)
+	SetPerDeliveryTimeout(timeout time.Duration)
+	SetHooks(hooks Hooks)
+	SetChecksums(enabled bool)
+	SetRetryPolicy(policy *RetryPolicy)
+	SetAckCoalescing(interval time.Duration)
+	FlushAcks() error
+	SetQuarantineFilter(filter func(payload []byte) bool, quarantineQueue string)
+	ReadyCount() int
+	UnackedCount() int
+	DelayedCount() int
+	GetConsumers() []string
+	ConsumeOnce() int
 	PurgeReady() bool
+	PurgeReadyErr() (removed int64, err error)
 	PurgeRejected() bool
+	PurgeRejectedErr() (removed int64, err error)
+	PurgeUnacked() (removed int64, err error)
+	TrimRejected(maxLength int64) (dropped int64, err error)
+	DeleteRejected(payload []byte) (removed int64, err error)
+	DeleteRejectedByID(id string) (removed int64, err error)
+	SetRejectedMaxLength(maxLength int64)
 	ReturnRejected(count int) int
+	ReturnRejectedErr(max int) (returned int, err error)
+	GetRejectedWithReasons(count int) []RejectedDelivery
+	ListRejected(offset, limit int) []RejectedDelivery
+	GetRejected(count int) []string
+	PeekUnacked(count int) []string
+	PeekReady(offset, count int) []string
+	DrainTo(destinationQueue string, max int) (moved int, err error)
+	Destroy() (PurgeCounts, error)
+	Export(w io.Writer, lists ...string) (n int, err error)
+	DedupeReady() (removed int64, err error)
+	DedupeReadyPayloads() (removed int64, err error)
+	Import(r io.Reader) (n int, err error)
+	ForceDestroy() (PurgeCounts, error)
+	OldestUnackedAge() (age time.Duration, ok bool)
+	GetRejectedBytes(count int) [][]byte
+	RejectedCount() int
+	WatchRejected(threshold int64, interval time.Duration, fn func(count int64))
+	ReturnAllUnacked() (returned int, err error)
+	ForceReturnAllUnacked() (returned int, err error)
 	ReturnAllRejected() int
+	ReturnRejectedMessage(payload []byte) (bool, error)
+	ReturnRejectedMessageByID(id string) (bool, error)
+	ReturnAllRejectedThrottled(ctx context.Context, perSecond int) (returned int, err error)
+	Counters() QueueCounters
+	ResetCounters() (QueueCounters, error)
 	Close() bool
 }
 
@@ -53,25 +272,82 @@ type redisQueue struct {
 	consumersKey     string // key to set of consumers using this connection
 	readyKey         string // key to list of ready deliveries
 	rejectedKey      string // key to list of rejected deliveries
+	reasonsKey       string // key to hash of rejection reasons
 	unackedKey       string // key to list of currently consuming deliveries
+	inflightKey      string // key to sorted set of visibility deadlines of unacked deliveries
+	statsKey         string // key to hash of consumer stats
+	latencyKey       string // key to hash of latency histogram buckets
+	attemptsKey      string // key to hash of redelivery attempts
+	checksumKey      string // key to number of checksum mismatches
+	delayedKey       string // key to sorted set of deliveries waiting to be retried
+	quarantinedKey   string // key to number of quarantined deliveries
+	historyKey       string // key to sorted set of recorded stats
+	countersKey      string // key to hash of cumulative counters
 	pushKey          string // key to list of pushed deliveries
+	pushQueueName    string
+	deadKey          string // key to list of dead lettered deliveries
 	redisClient      redis.Cmdable
+	backend          backend       // stores the deliveries, see connection.backend
+	positional       bool          // whether to use LMOVE and LPOS, see connection.ServerInfo()
 	deliveryChan     chan Delivery // nil for publish channels, not nil for consuming channels
 	prefetchLimit    int           // max number of prefetched deliveries number of unacked can go up to prefetchLimit + numConsumers
 	pollDuration     time.Duration
+	visibility       time.Duration // time after which unsettled deliveries get redelivered, zero to disable
+	deliveryTimeout  time.Duration // deadline of contexts passed to context consumers, zero to disable
+	hooks            Hooks
+	tracer           Tracer          // nil to disable tracing
+	checksums        bool            // publish payloads with a checksum
+	rejectedMax      int64           // max length of the rejected list enforced on reject, zero to disable
+	retry            *RetryPolicy    // nil to move rejected deliveries to the rejected list
+	quarantine       atomic.Value    // *quarantine, nil if there's no quarantine filter
+	lastActivity     int64           // Unix time in ms the activity time was last updated, accessed atomically
+	consumingCtx     context.Context // cancelled on StopConsuming
+	stopConsuming    context.CancelFunc
 	consumingStopped bool
+	activeConsumers  int32           // number of consumers currently consuming a delivery or batch
+	connectionDone   <-chan struct{} // closed once the connection is stopped
+	watchersStopped  chan struct{}   // closed on StopConsuming, nil until a watcher is started
+	consumerCounters sync.Map        // consumer name to its *consumerCounters
+	latency          latencyHistogram
+	cumulative       *queueCounters // nil if counters are disabled
+	clock            Clock
+	synchronous      bool                  // consume only on ConsumeOnce(), see connection.SetSynchronous()
+	syncConsumers    syncConsumers         // consumers of a synchronous queue
+	poller           *sharedPoller         // fetches for the queue, nil if it fetches on its own, see connection.SetSharedPoller()
+	fetchStream      func() (bool, error)  // reads deliveries of stream queues, nil for list queues, see streamQueue.fetch()
+	unackedStream    func() (int64, error) // counts the pending entries of stream queues, nil for list queues
+	consuming        *consumingQueues      // the connection's, see connection.StopAllConsuming()
+	sharedDelivery   atomic.Value          // *deliveryShared, nil until built, see shared()
+	pooling          bool                  // whether settled deliveries get recycled, see connection.SetDeliveryPooling()
+	acks             *ackCoalescer         // nil if acks aren't coalesced, see SetAckCoalescing()
 }
 
-func newQueue(name, connectionName, queuesKey string, redisClient redis.Cmdable) *redisQueue {
+func newQueue(name, connectionName, queuesKey, deadKey string, redisClient redis.Cmdable) *redisQueue {
 	consumersKey := strings.Replace(connectionQueueConsumersTemplate, phConnection, connectionName, 1)
 	consumersKey = strings.Replace(consumersKey, phQueue, name, 1)
 
 	readyKey := strings.Replace(queueReadyTemplate, phQueue, name, 1)
 	rejectedKey := strings.Replace(queueRejectedTemplate, phQueue, name, 1)
+	reasonsKey := strings.Replace(queueReasonsTemplate, phQueue, name, 1)
+	attemptsKey := strings.Replace(queueAttemptsTemplate, phQueue, name, 1)
+	checksumKey := strings.Replace(queueChecksumTemplate, phQueue, name, 1)
+	delayedKey := strings.Replace(queueDelayedTemplate, phQueue, name, 1)
+	quarantinedKey := strings.Replace(queueQuarantinedTemplate, phQueue, name, 1)
+	historyKey := strings.Replace(queueHistoryTemplate, phQueue, name, 1)
+	countersKey := strings.Replace(queueCountersTemplate, phQueue, name, 1)
 
 	unackedKey := strings.Replace(connectionQueueUnackedTemplate, phConnection, connectionName, 1)
 	unackedKey = strings.Replace(unackedKey, phQueue, name, 1)
 
+	inflightKey := strings.Replace(connectionQueueInflightTemplate, phConnection, connectionName, 1)
+	inflightKey = strings.Replace(inflightKey, phQueue, name, 1)
+
+	statsKey := strings.Replace(connectionQueueStatsTemplate, phConnection, connectionName, 1)
+	statsKey = strings.Replace(statsKey, phQueue, name, 1)
+
+	latencyKey := strings.Replace(connectionQueueLatencyTemplate, phConnection, connectionName, 1)
+	latencyKey = strings.Replace(latencyKey, phQueue, name, 1)
+
 	queue := &redisQueue{
 		name:           name,
 		connectionName: connectionName,
@@ -79,8 +355,21 @@ func newQueue(name, connectionName, queuesKey string, redisClient redis.Cmdable)
 		consumersKey:   consumersKey,
 		readyKey:       readyKey,
 		rejectedKey:    rejectedKey,
+		reasonsKey:     reasonsKey,
 		unackedKey:     unackedKey,
+		inflightKey:    inflightKey,
+		statsKey:       statsKey,
+		latencyKey:     latencyKey,
+		attemptsKey:    attemptsKey,
+		checksumKey:    checksumKey,
+		delayedKey:     delayedKey,
+		quarantinedKey: quarantinedKey,
+		historyKey:     historyKey,
+		countersKey:    countersKey,
+		deadKey:        deadKey,
 		redisClient:    redisClient,
+		backend:        newRedisBackend(redisClient),
+		clock:          systemClock{},
 	}
 	return queue
 }
@@ -89,10 +378,98 @@ func (queue *redisQueue) String() string {
 	return fmt.Sprintf("[%s conn:%s]", queue.name, queue.connectionName)
 }
 
+// SetVisibilityTimeout makes unsettled deliveries eligible for redelivery once
+// they've been unacked for longer than timeout, even while the consuming
+// connection is still alive. Long running consumers can push their deadline
+// out with delivery.Extend(). Must be called before StartConsuming!
+func (queue *redisQueue) SetVisibilityTimeout(timeout time.Duration) {
+	queue.visibility = timeout
+	queue.resetShared()
+}
+
+// SetPerDeliveryTimeout sets the deadline of the context passed to consumers
+// added via AddContextConsumer. Deliveries are not settled when it expires,
+// but the OnDeadlineExceeded hook gets called.
+func (queue *redisQueue) SetPerDeliveryTimeout(timeout time.Duration) {
+	queue.deliveryTimeout = timeout
+}
+
+// SetHooks sets the callbacks the queue invokes, see Hooks
+func (queue *redisQueue) SetHooks(hooks Hooks) {
+	queue.hooks = hooks
+	queue.resetShared()
+}
+
+// SetChecksums makes the queue publish payloads along with a checksum.
+// Deliveries whose payload doesn't match their checksum when consumed get
+// rejected with ErrChecksumMismatch as reason instead of being consumed.
+// Consumers verify checksums regardless of this setting.
+func (queue *redisQueue) SetChecksums(enabled bool) {
+	queue.checksums = enabled
+}
+
+// SetRetryPolicy makes rejected deliveries of this queue get retried after a
+// delay according to policy instead of being moved to the rejected list.
+// Deliveries which exhausted their retries are moved to the dead letter queue
+// (or the rejected list if there's none). While consuming, due deliveries are
+// moved back to ready, other processes consuming the queue do so as well.
+// Must be called before StartConsuming!
+func (queue *redisQueue) SetRetryPolicy(policy *RetryPolicy) {
+	queue.retry = policy
+	queue.resetShared()
+}
+
 // Publish adds a delivery with the given payload to the queue
 func (queue *redisQueue) Publish(payload string) bool {
 	// debug(fmt.Sprintf("publish %s %s", payload, queue)) // COMMENTOUT
-	return !redisErrIsNil(queue.redisClient.LPush(queue.readyKey, payload))
+	if queue.checksums {
+		return queue.PublishWithHeaders(payload, nil)
+	}
+	queue.touch()
+	backendErr(queue.backend.push(queue.readyKey, payload))
+	queue.cumulative.add(counterPublished)
+	return true
+}
+
+// touch updates the activity time of the queue used by the cleaner to prune
+// unused queues, at most once per activityInterval
+func (queue *redisQueue) touch() {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	last := atomic.LoadInt64(&queue.lastActivity)
+	if now-last < int64(activityInterval/time.Millisecond) || !atomic.CompareAndSwapInt64(&queue.lastActivity, last, now) {
+		return
+	}
+	redisErrIsNil(queue.redisClient.HSet(queuesActivityKey, queue.name, now))
+}
+
+// PublishWithHeaders adds a delivery with the given payload and headers to the
+// queue. Headers are kept when the delivery gets rejected, pushed or dead
+// lettered, see delivery.Headers(). A unique id is stored in the HeaderID
+// header unless it's set already, the publishing time in HeaderPublishedAt
+func (queue *redisQueue) PublishWithHeaders(payload string, headers map[string]string) bool {
+	queue.touch()
+	backendErr(queue.backend.push(queue.readyKey, string(queue.wrap(payload, headers))))
+	queue.cumulative.add(counterPublished)
+	return true
+}
+
+// wrap returns the envelope of a payload published with headers, see
+// PublishWithHeaders()
+func (queue *redisQueue) wrap(payload string, headers map[string]string) []byte {
+	wrappedHeaders := make(map[string]string, len(headers)+2)
+	for key, value := range headers {
+		wrappedHeaders[key] = value
+	}
+	if wrappedHeaders[HeaderID] == "" {
+		wrappedHeaders[HeaderID] = uniuri.NewLen(idLength)
+	}
+	wrappedHeaders[HeaderPublishedAt] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	wrapped := &envelope{Payload: []byte(payload), Headers: wrappedHeaders}
+	if queue.checksums {
+		wrapped.Checksum = checksum(wrapped.Payload)
+	}
+	return wrapped.encode()
 }
 
 // PublishBytes just casts the bytes and calls Publish
@@ -100,37 +477,219 @@ func (queue *redisQueue) PublishBytes(payload []byte) bool {
 	return queue.Publish(string(payload))
 }
 
-// PurgeReady removes all ready deliveries from the queue and returns the number of purged deliveries
-func (queue *redisQueue) PurgeReady() bool {
-	result := queue.redisClient.Del(queue.readyKey)
-	if redisErrIsNil(result) {
-		return false
+// PublishWithContext adds a delivery with the given payload to the queue,
+// along with the trace context of ctx if the queue has a tracer
+func (queue *redisQueue) PublishWithContext(ctx context.Context, payload string) bool {
+	if queue.tracer == nil {
+		return queue.Publish(payload)
 	}
-	return result.Val() > 0
+
+	headers := map[string]string{}
+	queue.tracer.Inject(ctx, headers)
+	return queue.PublishWithHeaders(payload, headers)
+}
+
+// PurgeReady removes all ready deliveries from the queue and returns true if there were any
+func (queue *redisQueue) PurgeReady() bool {
+	return purgeResult(queue.PurgeReadyErr())
 }
 
-// PurgeRejected removes all rejected deliveries from the queue and returns the number of purged deliveries
+// PurgeReadyErr is like PurgeReady, but returns the number of purged
+// deliveries and Redis errors instead of panicking
+func (queue *redisQueue) PurgeReadyErr() (removed int64, err error) {
+	return queue.purge(queue.readyKey)
+}
+
+// PurgeRejected removes all rejected deliveries from the queue and returns true if there were any
 func (queue *redisQueue) PurgeRejected() bool {
-	result := queue.redisClient.Del(queue.rejectedKey)
-	if redisErrIsNil(result) {
-		return false
+	return purgeResult(queue.PurgeRejectedErr())
+}
+
+// PurgeRejectedErr is like PurgeRejected, but returns the number of purged
+// deliveries and Redis errors instead of panicking
+func (queue *redisQueue) PurgeRejectedErr() (removed int64, err error) {
+	return queue.purge(queue.rejectedKey, queue.reasonsKey)
+}
+
+// TrimRejected drops all but the newest maxLength rejected deliveries along
+// with their rejection reasons and returns the number of dropped deliveries.
+// The OnRejectedTrimmed hook gets called if any were dropped
+func (queue *redisQueue) TrimRejected(maxLength int64) (dropped int64, err error) {
+	if maxLength < 0 {
+		return 0, fmt.Errorf("rmq queue invalid rejected max length %d %s", maxLength, queue)
+	}
+
+	result := trimRejectedScript.run(queue.redisClient, []string{queue.rejectedKey, queue.reasonsKey}, maxLength)
+	if err := redisErr(result); err != nil {
+		return 0, err
 	}
-	return result.Val() > 0
+	dropped, _ = result.Val().(int64)
+	reportTrimmed(queue.hooks, queue.name, dropped)
+	return dropped, nil
+}
+
+// ReturnRejectedMessage moves one rejected delivery with the given payload
+// back to ready, like ReturnRejected it removes its rejection reason and bumps
+// its attempts. Returns false if there's no such rejected delivery
+func (queue *redisQueue) ReturnRejectedMessage(payload []byte) (bool, error) {
+	return queue.returnRejectedMessage(matchPayload(payload))
+}
+
+// ReturnRejectedMessageByID is like ReturnRejectedMessage, but for the
+// rejected delivery with the given id, see HeaderID
+func (queue *redisQueue) ReturnRejectedMessageByID(id string) (bool, error) {
+	return queue.returnRejectedMessage(matchID(id))
+}
+
+func (queue *redisQueue) returnRejectedMessage(match func(wire string) bool) (bool, error) {
+	wires, err := queue.findRejected(match)
+	if err != nil {
+		return false, err
+	}
+
+	keys := []string{queue.rejectedKey, queue.readyKey, queue.reasonsKey, queue.attemptsKey}
+	for _, wire := range wires {
+		result := returnRejectedMessageScript.run(queue.redisClient, keys, wire)
+		if err := redisErr(result); err != nil {
+			return false, err
+		}
+		if result.Val() == int64(1) {
+			return true, nil
+		}
+		// removed meanwhile, try the next match
+	}
+	return false, nil
+}
+
+// DeleteRejected removes all rejected deliveries with the given payload along
+// with their rejection reasons and returns the number of removed deliveries
+func (queue *redisQueue) DeleteRejected(payload []byte) (removed int64, err error) {
+	return queue.deleteRejected(matchPayload(payload))
+}
+
+// DeleteRejectedByID removes the rejected deliveries with the given id (see
+// HeaderID) along with their rejection reasons and returns the number of
+// removed deliveries
+func (queue *redisQueue) DeleteRejectedByID(id string) (removed int64, err error) {
+	return queue.deleteRejected(matchID(id))
+}
+
+// deleteRejected removes all rejected deliveries matching match
+func (queue *redisQueue) deleteRejected(match func(wire string) bool) (int64, error) {
+	wires, err := queue.findRejected(match)
+	if err != nil || len(wires) == 0 {
+		return 0, err
+	}
+
+	results, err := queue.redisClient.Pipelined(func(pipe *redis.Pipeline) error {
+		for _, wire := range wires {
+			pipe.LRem(queue.rejectedKey, 0, wire)
+		}
+		pipe.HDel(queue.reasonsKey, wires...)
+		return nil
+	})
+	if err := pipelineErr(err); err != nil {
+		return 0, err
+	}
+
+	removed := int64(0)
+	for i := 0; i < len(wires) && i < len(results); i++ {
+		if result, ok := results[i].(*redis.IntCmd); ok {
+			removed += result.Val()
+		}
+	}
+	return removed, nil
+}
+
+// findRejected returns the distinct wire payloads of the rejected deliveries
+// matching match, reading the rejected list page by page
+func (queue *redisQueue) findRejected(match func(wire string) bool) ([]string, error) {
+	found := []string{}
+	seen := map[string]bool{}
+	for start := int64(0); ; start += rejectedScanSize {
+		wires, err := queue.backend.scan(queue.rejectedKey, start, start+rejectedScanSize-1)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, wire := range wires {
+			if !seen[wire] && match(wire) {
+				seen[wire] = true
+				found = append(found, wire)
+			}
+		}
+
+		if len(wires) < rejectedScanSize {
+			return found, nil
+		}
+	}
+}
+
+// SetRejectedMaxLength makes deliveries of this queue trim the rejected list
+// to maxLength whenever they get rejected, dropping the oldest rejected
+// deliveries. Zero disables trimming.
+func (queue *redisQueue) SetRejectedMaxLength(maxLength int64) {
+	queue.rejectedMax = maxLength
+	queue.resetShared()
+}
+
+// PurgeUnacked removes all unacked deliveries of this connection from the
+// queue and returns the number of purged deliveries.
+//
+// WARNING: The purged deliveries are lost for good, they can't be settled
+// anymore and won't be returned by the cleaner. Only call this while no
+// consumer of this connection is consuming the queue, for example in test
+// teardowns or admin tools after the consuming process is gone and its
+// deliveries are known to be unwanted. Use the cleaner to return them instead.
+func (queue *redisQueue) PurgeUnacked() (removed int64, err error) {
+	return queue.purge(queue.unackedKey, queue.inflightKey)
+}
+
+// purge deletes the list at key along with the attempts of its entries and the
+// other keys and returns the length of the list. The list is atomically renamed to a temporary key and
+// deleted within one script, so deliveries added concurrently end up in a new
+// list and are kept, while the returned count is exactly what was deleted.
+// Nothing is left behind if the client fails halfway
+func (queue *redisQueue) purge(key string, otherKeys ...string) (int64, error) {
+	purgingKey := key + "::purging::" + uniuri.NewLen(6) // same hash slot as key
+	keys := append([]string{key, purgingKey, queue.attemptsKey}, otherKeys...)
+	result := purgeScript.run(queue.redisClient, keys)
+	if err := redisErr(result); err != nil {
+		return 0, err
+	}
+	removed, _ := result.Val().(int64)
+	return removed, nil
+}
+
+// purgeResult converts the result of a purge to the result of the bool
+// variants, panicking on Redis errors
+func purgeResult(removed int64, err error) bool {
+	if err != nil {
+		log.Panicf("rmq redis error is not nil %s", err)
+	}
+	return removed > 0
 }
 
 // Close purges and removes the queue from the list of queues
 func (queue *redisQueue) Close() bool {
 	queue.PurgeRejected()
 	queue.PurgeReady()
-	result := queue.redisClient.SRem(queuesKey, queue.name)
-	if redisErrIsNil(result) {
-		return false
-	}
-	return result.Val() > 0
+	_, err := queue.backend.del(queue.checksumKey, queue.delayedKey, queue.quarantinedKey)
+	backendErr(err)
+	redisErrIsNil(queue.redisClient.HDel(queuesActivityKey, queue.name))
+	redisErrIsNil(queue.redisClient.HDel(pushQueuesKey, queue.name))
+	removed, err := queue.backend.removeMember(queuesKey, queue.name)
+	backendErr(err)
+	return removed
 }
 
 func (queue *redisQueue) ReadyCount() int {
-	result := queue.redisClient.LLen(queue.readyKey)
+	return queue.count(queue.readyKey)
+}
+
+// DelayedCount returns the number of deliveries waiting to be retried
+func (queue *redisQueue) DelayedCount() int {
+	result := queue.redisClient.ZCard(queue.delayedKey)
 	if redisErrIsNil(result) {
 		return 0
 	}
@@ -138,115 +697,539 @@ func (queue *redisQueue) ReadyCount() int {
 }
 
 func (queue *redisQueue) UnackedCount() int {
-	result := queue.redisClient.LLen(queue.unackedKey)
+	return queue.count(queue.unackedKey)
+}
+
+// ChecksumMismatchCount returns the number of deliveries rejected because of
+// a checksum mismatch
+func (queue *redisQueue) ChecksumMismatchCount() int {
+	result := queue.redisClient.Get(queue.checksumKey)
 	if redisErrIsNil(result) {
 		return 0
 	}
-	return int(result.Val())
+	count, _ := result.Int64()
+	return int(count)
 }
 
 func (queue *redisQueue) RejectedCount() int {
-	result := queue.redisClient.LLen(queue.rejectedKey)
-	if redisErrIsNil(result) {
-		return 0
-	}
-	return int(result.Val())
+	return queue.count(queue.rejectedKey)
 }
 
-// ReturnAllUnacked moves all unacked deliveries back to the ready
-// queue and deletes the unacked key afterwards, returns number of returned
-// deliveries
-func (queue *redisQueue) ReturnAllUnacked() int {
-	result := queue.redisClient.LLen(queue.unackedKey)
-	if redisErrIsNil(result) {
-		return 0
+// count returns the length of the list at key, panicking on backend errors
+func (queue *redisQueue) count(key string) int {
+	count, err := queue.backend.count(key)
+	backendErr(err)
+	return int(count)
+}
+
+// ReturnAllUnacked moves all unacked deliveries of this queue's connection
+// back to ready and returns the number of returned deliveries. Other
+// consumers could then get deliveries which are still being worked on, so
+// ErrConsumersActive is returned if this queue didn't stop consuming yet or
+// any of its consumers are still busy. See ForceReturnAllUnacked
+func (queue *redisQueue) ReturnAllUnacked() (returned int, err error) {
+	if queue.consumersActive() {
+		return 0, ErrConsumersActive
 	}
+	return queue.ForceReturnAllUnacked()
+}
+
+// ForceReturnAllUnacked is like ReturnAllUnacked, but returns the unacked
+// deliveries even if this queue's consumers are still active. Each delivery is
+// moved atomically, but deliveries currently being consumed may get consumed
+// twice
+func (queue *redisQueue) ForceReturnAllUnacked() (returned int, err error) {
+	return queue.returnAllUnacked(nil)
+}
+
+// returnAllUnacked returns all unacked deliveries in batches, calling progress
+// (if not nil) after each batch with the number of deliveries returned so far
+func (queue *redisQueue) returnAllUnacked(progress func(returned int)) (returned int, err error) {
+	keys := []string{queue.unackedKey, queue.readyKey, queue.inflightKey, queue.attemptsKey}
+	for {
+		result := returnUnackedScript.run(queue.redisClient, keys, returnBatchSize)
+		if err := redisErr(result); err != nil {
+			return returned, err
+		}
+		moved, _ := result.Val().(int64)
+		returned += int(moved)
+		// debug(fmt.Sprintf("rmq queue returned unacked deliveries %s %d", queue, moved)) // COMMENTOUT
+		if progress != nil && moved > 0 {
+			progress(returned)
+		}
 
-	unackedCount := int(result.Val())
-	for i := 0; i < unackedCount; i++ {
-		if redisErrIsNil(queue.redisClient.RPopLPush(queue.unackedKey, queue.readyKey)) {
-			return i
+		if moved < returnBatchSize {
+			return returned, nil
 		}
-		// debug(fmt.Sprintf("rmq queue returned unacked delivery %s %s", result.Val(), queue.readyKey)) // COMMENTOUT
 	}
+}
 
-	return unackedCount
+// consumersActive returns true if the queue is consuming or any of its
+// consumers still consume deliveries
+func (queue *redisQueue) consumersActive() bool {
+	if queue.deliveryChan == nil {
+		return false // never consumed
+	}
+	return !queue.consumingStopped || len(queue.deliveryChan) > 0 || atomic.LoadInt32(&queue.activeConsumers) > 0
 }
 
 // ReturnAllRejected moves all rejected deliveries back to the ready
 // list and returns the number of returned deliveries
 func (queue *redisQueue) ReturnAllRejected() int {
-	result := queue.redisClient.LLen(queue.rejectedKey)
-	if redisErrIsNil(result) {
-		return 0
+	return queue.ReturnRejected(queue.RejectedCount())
+}
+
+// ReturnAllRejectedThrottled moves rejected deliveries back to ready at a
+// rate of about perSecond deliveries until the rejected list is empty or ctx
+// is done. Deliveries are moved in batches, the OnReturnProgress hook is
+// called after each batch. Returns ctx.Err() if ctx is done first
+func (queue *redisQueue) ReturnAllRejectedThrottled(ctx context.Context, perSecond int) (returned int, err error) {
+	if perSecond <= 0 {
+		return 0, fmt.Errorf("rmq queue invalid return rate %d %s", perSecond, queue)
+	}
+
+	batchSize := perSecond / returnThrottleSteps
+	if batchSize < 1 {
+		batchSize = 1
 	}
+	ticker := time.NewTicker(time.Duration(batchSize) * time.Second / time.Duration(perSecond))
+	defer ticker.Stop()
 
-	rejectedCount := int(result.Val())
-	return queue.ReturnRejected(rejectedCount)
+	for {
+		moved, err := queue.ReturnRejectedErr(batchSize)
+		returned += moved
+		if err != nil {
+			return returned, err
+		}
+		if hook := queue.hooks.OnReturnProgress; hook != nil && moved > 0 {
+			hook(returned)
+		}
+		if moved < batchSize {
+			return returned, nil // rejected list is empty
+		}
+
+		select {
+		case <-ctx.Done():
+			return returned, ctx.Err()
+		case <-ticker.C:
+		}
+	}
 }
 
 // ReturnRejected tries to return count rejected deliveries back to
-// the ready list and returns the number of returned deliveries
+// the ready list and returns the number of returned deliveries.
+// The rejection reasons of returned deliveries are removed and their
+// attempts bumped, like deliveries returned any other way
 func (queue *redisQueue) ReturnRejected(count int) int {
-	if count == 0 {
-		return 0
+	returned, err := queue.ReturnRejectedErr(count)
+	if err != nil {
+		log.Panicf("rmq redis error is not nil %s", err)
 	}
+	return returned
+}
 
-	for i := 0; i < count; i++ {
-		result := queue.redisClient.RPopLPush(queue.rejectedKey, queue.readyKey)
-		if redisErrIsNil(result) {
-			return i
+// ReturnRejectedErr is like ReturnRejected, but returns Redis errors instead
+// of panicking. The oldest rejected deliveries are returned first, each one
+// atomically along with removing its reason. Call it repeatedly with a small
+// max to drain a large rejected list gradually
+func (queue *redisQueue) ReturnRejectedErr(max int) (returned int, err error) {
+	keys := []string{queue.rejectedKey, queue.readyKey, queue.reasonsKey, queue.attemptsKey}
+	for returned < max {
+		batchSize := max - returned
+		if batchSize > returnBatchSize {
+			batchSize = returnBatchSize
+		}
+
+		result := returnRejectedScript.run(queue.redisClient, keys, batchSize)
+		if err := redisErr(result); err != nil {
+			return returned, err
+		}
+		moved, _ := result.Val().(int64)
+		returned += int(moved)
+		// debug(fmt.Sprintf("rmq queue returned rejected deliveries %s %d", queue, moved)) // COMMENTOUT
+
+		if int(moved) < batchSize {
+			break // rejected list is empty
 		}
-		// debug(fmt.Sprintf("rmq queue returned rejected delivery %s %s", result.Val(), queue.readyKey)) // COMMENTOUT
+	}
+	return returned, nil
+}
+
+// DrainTo moves up to max ready deliveries (oldest first) to the ready list
+// of the queue with the given name, e.g. after renaming a queue. Each
+// delivery is moved atomically, so it's safe while publishers and consumers
+// are active. If max <= 0 it moves as many deliveries as were ready when it
+// was called. Both queues must be in the same hash slot on Redis Cluster
+func (queue *redisQueue) DrainTo(destinationQueue string, max int) (moved int, err error) {
+	if max <= 0 {
+		ready, err := queue.backend.count(queue.readyKey)
+		if err != nil {
+			return 0, err
+		}
+		max = int(ready)
+	}
+	if max == 0 {
+		return 0, nil
+	}
+	if _, err := queue.backend.addMember(queuesKey, destinationQueue); err != nil {
+		return 0, err
 	}
 
-	return count
+	keys := []string{queue.readyKey, strings.Replace(queueReadyTemplate, phQueue, destinationQueue, 1)}
+	for moved < max {
+		batchSize := max - moved
+		if batchSize > returnBatchSize {
+			batchSize = returnBatchSize
+		}
+
+		result := drainScript.run(queue.redisClient, keys, batchSize)
+		if err := redisErr(result); err != nil {
+			return moved, err
+		}
+		batchMoved, _ := result.Val().(int64)
+		moved += int(batchMoved)
+
+		if int(batchMoved) < batchSize {
+			break // ready list is empty
+		}
+	}
+	return moved, nil
+}
+
+// GetRejectedWithReasons returns up to count rejected deliveries (newest
+// first) without removing them, along with their rejection reason, time and
+// the number of redelivery attempts
+func (queue *redisQueue) GetRejectedWithReasons(count int) []RejectedDelivery {
+	return queue.ListRejected(0, count)
+}
+
+// ListRejected is like GetRejectedWithReasons, but returns up to limit
+// rejected deliveries starting at offset, counted from the newest one.
+// Use it to page through large rejected lists
+func (queue *redisQueue) ListRejected(offset, limit int) []RejectedDelivery {
+	if offset < 0 || limit <= 0 {
+		return []RejectedDelivery{}
+	}
+
+	payloads, err := queue.backend.scan(queue.rejectedKey, int64(offset), int64(offset+limit-1))
+	backendErr(err)
+	if len(payloads) == 0 {
+		return []RejectedDelivery{}
+	}
+
+	reasons := queue.redisClient.HMGet(queue.reasonsKey, payloads...)
+	attempts := queue.redisClient.HMGet(queue.attemptsKey, payloads...)
+	redisErrIsNil(reasons)
+	redisErrIsNil(attempts)
+
+	rejected := make([]RejectedDelivery, len(payloads))
+	for i, wire := range payloads {
+		rejected[i] = newRejectedDelivery(wire, reasons.Val()[i], attempts.Val()[i])
+	}
+	return rejected
+}
+
+// GetRejected returns the payloads of up to count rejected deliveries (newest
+// first) without removing them. It's read only, so it can be used to inspect
+// queues consumed by other processes
+func (queue *redisQueue) GetRejected(count int) []string {
+	if count <= 0 {
+		return []string{}
+	}
+
+	payloads, err := queue.backend.scan(queue.rejectedKey, 0, int64(count-1))
+	backendErr(err)
+	for i, wire := range payloads {
+		payloads[i] = decodePayload(wire)
+	}
+	return payloads
+}
+
+// PeekReady returns up to count entries of the ready list in the order they
+// will be consumed, skipping the first offset ones. Entries are returned as
+// stored, use DecodeEntry() to get their payload and headers. It's read only,
+// but entries may get consumed by the time the result is used, so don't rely
+// on them still being in the queue
+func (queue *redisQueue) PeekReady(offset, count int) []string {
+	if offset < 0 || count <= 0 {
+		return []string{}
+	}
+
+	// the oldest entry is on the right
+	entries, err := queue.backend.scan(queue.readyKey, int64(-offset-count), int64(-offset-1))
+	backendErr(err)
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries
+}
+
+// PeekUnacked returns the payloads of up to count deliveries (newest first)
+// currently unacked by this queue's connection, without modifying them
+func (queue *redisQueue) PeekUnacked(count int) []string {
+	if count <= 0 {
+		return []string{}
+	}
+
+	payloads, err := queue.backend.scan(queue.unackedKey, 0, int64(count-1))
+	backendErr(err)
+	for i, wire := range payloads {
+		payloads[i] = decodePayload(wire)
+	}
+	return payloads
+}
+
+// OldestUnackedAge returns how long ago the oldest delivery unacked by this
+// queue's connection was published. Returns false if there are no unacked
+// deliveries or the oldest one wasn't published with headers
+func (queue *redisQueue) OldestUnackedAge() (age time.Duration, ok bool) {
+	result := queue.redisClient.LIndex(queue.unackedKey, -1)
+	if redisErrIsNil(result) {
+		return 0, false
+	}
+
+	published, ok := publishedAt(result.Val())
+	if !ok {
+		return 0, false
+	}
+	return time.Since(published), true
+}
+
+// GetRejectedBytes is like GetRejected, but returns the payloads as bytes
+func (queue *redisQueue) GetRejectedBytes(count int) [][]byte {
+	payloads := queue.GetRejected(count)
+	bytes := make([][]byte, len(payloads))
+	for i, payload := range payloads {
+		bytes[i] = []byte(payload)
+	}
+	return bytes
 }
 
 // CloseInConnection closes the queue in the associated connection by removing all related keys
 func (queue *redisQueue) CloseInConnection() {
-	redisErrIsNil(queue.redisClient.Del(queue.unackedKey))
-	redisErrIsNil(queue.redisClient.Del(queue.consumersKey))
-	redisErrIsNil(queue.redisClient.SRem(queue.queuesKey, queue.name))
+	if _, err := queue.closeInConnection(); err != nil {
+		log.Panicf("rmq redis error is not nil %s", err)
+	}
+}
+
+// closeInConnection is like CloseInConnection, but returns the number of
+// deleted keys and Redis errors instead of panicking
+func (queue *redisQueue) closeInConnection() (int, error) {
+	deleted, err := queue.deleteConnectionKeys()
+	if err != nil {
+		return deleted, err
+	}
+	if _, err := queue.backend.removeMember(queue.queuesKey, queue.name); err != nil {
+		return deleted, err
+	}
+	return deleted, nil
+}
+
+// deleteConnectionKeys deletes the keys of the queue in the associated
+// connection and returns how many it deleted. The queue stays in the set of
+// queues of the connection
+func (queue *redisQueue) deleteConnectionKeys() (int, error) {
+	deleted, err := queue.backend.del(queue.unackedKey, queue.inflightKey, queue.consumersKey, queue.statsKey, queue.latencyKey)
+	return int(deleted), err
 }
 
-func (queue *redisQueue) SetPushQueue(pushQueue Queue) {
+// SetPushQueue sets the queue deliveries get moved to by delivery.Push(),
+// replacing the previous one. Pass nil to remove the push queue. The push
+// queues of all queues are stored in Redis, so that an error can be returned
+// if this would introduce a cycle, even if the other queues of the chain were
+// configured by different processes
+func (queue *redisQueue) SetPushQueue(pushQueue Queue) error {
+	if pushQueue == nil {
+		if redisErrIsNil(queue.redisClient.HDel(pushQueuesKey, queue.name)) {
+			return fmt.Errorf("rmq queue failed to remove push queue %s", queue)
+		}
+		queue.pushKey = ""
+		queue.pushQueueName = ""
+		queue.resetShared()
+		return nil
+	}
+
 	redisPushQueue, ok := pushQueue.(*redisQueue)
 	if !ok {
-		return
+		return fmt.Errorf("rmq queue push queue must be a Redis queue %s %s", queue, pushQueue)
+	}
+
+	chain := append([]string{queue.name}, redisPushQueue.PushChain()...)
+	for _, name := range chain[1:] {
+		if name == queue.name {
+			return fmt.Errorf("rmq queue push queue would introduce a cycle %s", strings.Join(chain, " -> "))
+		}
+	}
+
+	if redisErrIsNil(queue.redisClient.HSet(pushQueuesKey, queue.name, redisPushQueue.name)) {
+		return fmt.Errorf("rmq queue failed to set push queue %s %s", queue, redisPushQueue.name)
 	}
 
 	queue.pushKey = redisPushQueue.readyKey
+	queue.pushQueueName = redisPushQueue.name
+	queue.resetShared()
+	return nil
+}
+
+// PushQueueName returns the name of the push queue set on this queue, empty
+// if there's none
+func (queue *redisQueue) PushQueueName() string {
+	return queue.pushQueueName
+}
+
+// PushChain returns the names of the queues deliveries pushed from this queue
+// pass through, starting with this queue. The chain ends when a queue has no
+// push queue, doesn't exist anymore (so push queues stored by destroyed or
+// pruned queues are ignored), repeats a queue or gets longer than the max
+// push depth
+func (queue *redisQueue) PushChain() []string {
+	chain := []string{queue.name}
+	seen := map[string]bool{queue.name: true}
+	for len(chain) <= maxPushDepth {
+		result := queue.redisClient.HGet(pushQueuesKey, chain[len(chain)-1])
+		if redisErrIsNil(result) {
+			break
+		}
+
+		name := result.Val()
+		chain = append(chain, name)
+		if seen[name] {
+			break
+		}
+		seen[name] = true
+
+		exists, err := queue.backend.isMember(queuesKey, name)
+		backendErr(err)
+		if !exists {
+			break
+		}
+	}
+	return chain
+}
+
+// SetDeadLetterQueue sets the queue dead lettered deliveries get moved to by
+// delivery.Dead(), overriding the connection's dead letter queue
+func (queue *redisQueue) SetDeadLetterQueue(deadQueue Queue) {
+	redisDeadQueue, ok := deadQueue.(*redisQueue)
+	if !ok {
+		return
+	}
+
+	queue.deadKey = redisDeadQueue.readyKey
+	queue.resetShared()
 }
 
 // StartConsuming starts consuming into a channel of size prefetchLimit
 // must be called before consumers can be added!
 // pollDuration is the duration the queue sleeps before checking for new deliveries
 func (queue *redisQueue) StartConsuming(prefetchLimit int, pollDuration time.Duration) bool {
+	err := queue.StartConsumingErr(prefetchLimit, pollDuration)
+	var redisErr *RedisError
+	if errors.As(err, &redisErr) {
+		log.Panicf("rmq queue failed to start consuming %s %s", queue, err)
+	}
+	return err == nil
+}
+
+// StartConsumingErr is like StartConsuming, but returns ErrAlreadyConsuming
+// if the queue is consuming already, ErrNotConnected if its connection was
+// stopped and Redis errors instead of panicking
+func (queue *redisQueue) StartConsumingErr(prefetchLimit int, pollDuration time.Duration) error {
 	if queue.deliveryChan != nil {
-		return false // already consuming
+		return ErrAlreadyConsuming
+	}
+	select {
+	case <-queue.connectionDone:
+		return ErrNotConnected
+	default:
 	}
 
 	// add queue to list of queues consumed on this connection
-	if redisErrIsNil(queue.redisClient.SAdd(queue.queuesKey, queue.name)) {
-		log.Panicf("rmq queue failed to start consuming %s", queue)
+	if _, err := queue.backend.addMember(queue.queuesKey, queue.name); err != nil {
+		return err
 	}
 
 	queue.prefetchLimit = prefetchLimit
 	queue.pollDuration = pollDuration
 	queue.deliveryChan = make(chan Delivery, prefetchLimit)
+	queue.consumingCtx, queue.stopConsuming = context.WithCancel(context.Background())
+	if queue.consuming != nil {
+		queue.consuming.add(queue)
+	}
 	// log.Printf("rmq queue started consuming %s %d %s", queue, prefetchLimit, pollDuration)
-	go queue.consume()
-	return true
+	if queue.synchronous {
+		return nil // ConsumeOnce() does the work
+	}
+	if queue.poller != nil {
+		queue.poller.add(queue)
+	} else {
+		go queue.consume()
+	}
+	if queue.visibility > 0 {
+		go queue.reap()
+	}
+	if queue.retry != nil {
+		go queue.promote()
+	}
+	go queue.publishConsumerStats()
+	return nil
 }
 
 func (queue *redisQueue) StopConsuming() bool {
+	return queue.StopConsumingErr() == nil
+}
+
+// StopConsumingErr is like StopConsuming, but returns ErrNotConsuming if the
+// queue wasn't consuming or was stopped already
+func (queue *redisQueue) StopConsumingErr() error {
 	if queue.deliveryChan == nil || queue.consumingStopped {
-		return false // not consuming or already stopped
+		return ErrNotConsuming
 	}
 
 	queue.consumingStopped = true
-	return true
+	queue.stopConsuming()
+	if queue.watchersStopped != nil {
+		close(queue.watchersStopped)
+	}
+	return nil
+}
+
+// WatchRejected calls fn when the rejected list of the queue reached
+// threshold, checking every interval. fn isn't called again before the
+// rejected list dropped below half the threshold. The watcher stops when the
+// queue stops consuming or its connection is stopped. Must be called before
+// StopConsuming!
+func (queue *redisQueue) WatchRejected(threshold int64, interval time.Duration, fn func(count int64)) {
+	if queue.watchersStopped == nil {
+		queue.watchersStopped = make(chan struct{})
+	}
+	go queue.watchRejected(&rejectedWatch{threshold: threshold}, interval, func() (int64, error) {
+		return queue.backend.count(queue.rejectedKey)
+	}, fn)
+}
+
+// watchRejected checks the rejected count returned by count every interval
+func (queue *redisQueue) watchRejected(watch *rejectedWatch, interval time.Duration, count func() (int64, error), fn func(count int64)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-queue.watchersStopped:
+			return
+		case <-queue.connectionDone:
+			return
+		case <-ticker.C:
+		}
+
+		rejected, err := count()
+		if err != nil {
+			continue // try again next interval
+		}
+		if watch.check(rejected) {
+			fn(rejected)
+		}
+	}
 }
 
 // AddConsumer adds a consumer to the queue
@@ -255,10 +1238,25 @@ func (queue *redisQueue) StopConsuming() bool {
 func (queue *redisQueue) AddConsumer(tag string, consumer Consumer) (name string, stopper chan<- int) {
 	name = queue.addConsumer(tag)
 	stopChan := make(chan int, 1)
+	if queue.synchronous {
+		queue.syncConsumers.add(&syncConsumer{name: name, consumer: consumer, stopper: stopChan})
+		return name, stopChan
+	}
 	go queue.consumerConsume(consumer, name, stopChan)
 	return name, stopChan
 }
 
+// AddConsumerFunc is similar to AddConsumer, but for a function
+func (queue *redisQueue) AddConsumerFunc(tag string, consumerFunc ConsumerFunc) (name string, stopper chan<- int) {
+	return queue.AddConsumer(tag, consumerFunc)
+}
+
+// AddContextConsumer is similar to AddConsumer, but passes each delivery along
+// with a context derived from the queue's consuming context
+func (queue *redisQueue) AddContextConsumer(tag string, consumer ConsumerWithContext) (name string, stopper chan<- int) {
+	return queue.AddConsumer(tag, &contextConsumer{queue: queue, consumer: consumer})
+}
+
 // AddBatchConsumer is similar to AddConsumer, but for batches of deliveries
 func (queue *redisQueue) AddBatchConsumer(tag string, batchSize int, consumer BatchConsumer) string {
 	return queue.AddBatchConsumerWithTimeout(tag, batchSize, defaultBatchTimeout, consumer)
@@ -266,24 +1264,73 @@ func (queue *redisQueue) AddBatchConsumer(tag string, batchSize int, consumer Ba
 
 func (queue *redisQueue) AddBatchConsumerWithTimeout(tag string, batchSize int, timeout time.Duration, consumer BatchConsumer) string {
 	name := queue.addConsumer(tag)
-	go queue.consumerBatchConsume(batchSize, timeout, consumer)
+	if queue.synchronous {
+		queue.syncConsumers.add(&syncConsumer{name: name, batch: consumer, batchSize: batchSize})
+		return name
+	}
+	go queue.consumerBatchConsume(name, batchSize, timeout, consumer)
 	return name
 }
 
-func (queue *redisQueue) GetConsumers() []string {
-	result := queue.redisClient.SMembers(queue.consumersKey)
-	if redisErrIsNil(result) {
-		return []string{}
+// ConsumeOnce is the driver of synchronous queues, see
+// connection.SetSynchronous(): It returns expired and promotes due deliveries
+// like the background goroutines would, fetches up to the prefetch limit of
+// ready deliveries and hands them to the consumers in turn and in the calling
+// goroutine. Returns how many deliveries the consumers got, deliveries stay
+// prefetched if there are no consumers. Returns 0 for other queues and before
+// StartConsuming or after StopConsuming
+func (queue *redisQueue) ConsumeOnce() int {
+	if !queue.synchronous || queue.deliveryChan == nil || queue.consumingStopped {
+		return 0
 	}
-	return result.Val()
+
+	if queue.visibility > 0 {
+		for queue.reapBatch() == reapBatchSize {
+			// keep going while there might be more expired deliveries
+		}
+	}
+	if queue.retry != nil {
+		for queue.promoteBatch() == reapBatchSize {
+			// keep going while there might be more due deliveries
+		}
+	}
+	if _, err := queue.fetch(); err != nil {
+		queue.consumeFailed(err)
+	}
+
+	consumed := queue.syncConsumers.dispatch(queue.deliveryChan, func(name string) {
+		queue.RemoveConsumer(name)
+	}, func(consumer *syncConsumer, deliveries []Delivery) {
+		if consumer.batch != nil {
+			queue.consumeDeliveryBatch(consumer.batch, queue.counters(consumer.name), deliveries)
+		} else {
+			queue.consumeDelivery(consumer.consumer, consumer.name, deliveries[0])
+		}
+		queue.recycle(deliveries...)
+	})
+	queue.publishConsumerStatsOnce()
+	queue.publishLatency(queue.clock.Now())
+	return consumed
+}
+
+// AckMany acknowledges all given deliveries in one round trip per unacked
+// list. Deliveries which couldn't be acked are returned in failed, err is only
+// set if Redis returned an error.
+func (queue *redisQueue) AckMany(deliveries []Delivery) (acked int, failed []Delivery, err error) {
+	return ackMany(deliveries)
+}
+
+func (queue *redisQueue) GetConsumers() []string {
+	consumers, err := queue.backend.members(queue.consumersKey)
+	backendErr(err)
+	return consumers
 }
 
 func (queue *redisQueue) RemoveConsumer(name string) bool {
-	result := queue.redisClient.SRem(queue.consumersKey, name)
-	if redisErrIsNil(result) {
-		return false
-	}
-	return result.Val() > 0
+	queue.removeConsumerCounters(name)
+	removed, err := queue.backend.removeMember(queue.consumersKey, name)
+	backendErr(err)
+	return removed
 }
 
 func (queue *redisQueue) addConsumer(tag string) string {
@@ -294,29 +1341,37 @@ func (queue *redisQueue) addConsumer(tag string) string {
 	name := fmt.Sprintf("%s-%s", tag, uniuri.NewLen(6))
 
 	// add consumer to list of consumers of this queue
-	if redisErrIsNil(queue.redisClient.SAdd(queue.consumersKey, name)) {
-		log.Panicf("rmq queue failed to add consumer %s %s", queue, tag)
+	if _, err := queue.backend.addMember(queue.consumersKey, name); err != nil {
+		log.Panicf("rmq queue failed to add consumer %s %s %s", queue, tag, err)
 	}
 
+	queue.consumerCounters.Store(name, &consumerCounters{})
 	// log.Printf("rmq queue added consumer %s %s", queue, name)
 	return name
 }
 
 func (queue *redisQueue) RemoveAllConsumers() int {
-	result := queue.redisClient.Del(queue.consumersKey)
-	if redisErrIsNil(result) {
-		return 0
-	}
-	return int(result.Val())
+	deleted, err := queue.backend.del(queue.consumersKey)
+	backendErr(err)
+	return int(deleted)
 }
 
+// consume fetches deliveries until the queue stops consuming. After Redis
+// errors it backs off exponentially, starting at the poll duration
 func (queue *redisQueue) consume() {
+	backoff := time.Duration(0)
 	for {
-		batchSize := queue.batchSize()
-		wantMore := queue.consumeBatch(batchSize)
-
-		if !wantMore {
-			time.Sleep(queue.pollDuration)
+		wantMore, err := queue.fetch()
+		switch {
+		case err != nil:
+			queue.consumeFailed(err)
+			backoff = nextConsumeBackoff(backoff, queue.pollDuration)
+			queue.clock.Sleep(backoff)
+		case !wantMore:
+			backoff = 0
+			queue.clock.Sleep(queue.pollDuration)
+		default:
+			backoff = 0
 		}
 
 		if queue.consumingStopped {
@@ -326,50 +1381,253 @@ func (queue *redisQueue) consume() {
 	}
 }
 
-func (queue *redisQueue) batchSize() int {
+// reap periodically returns deliveries whose visibility deadline passed
+func (queue *redisQueue) reap() {
+	interval := queue.visibility / 2
+	if interval > maxReapInterval {
+		interval = maxReapInterval
+	}
+
+	for {
+		queue.clock.Sleep(interval)
+
+		if queue.consumingStopped {
+			return
+		}
+
+		for queue.reapBatch() == reapBatchSize {
+			// keep going while there might be more expired deliveries
+		}
+	}
+}
+
+// promote periodically moves delayed deliveries which are due back to ready
+func (queue *redisQueue) promote() {
+	interval := queue.retry.promoteInterval()
+	for {
+		queue.clock.Sleep(interval)
+
+		if queue.consumingStopped {
+			return
+		}
+
+		for queue.promoteBatch() == reapBatchSize {
+			// keep going while there might be more due deliveries
+		}
+	}
+}
+
+// promoteBatch moves up to reapBatchSize due deliveries back to ready and
+// returns the number of moved deliveries
+func (queue *redisQueue) promoteBatch() int {
+	keys := []string{queue.delayedKey, queue.readyKey}
+	result := promoteScript.run(queue.redisClient, keys, visibilityScore(queue.clock.Now()), reapBatchSize)
+	if result.Err() != nil {
+		return 0 // try again next interval
+	}
+	promoted, _ := result.Val().(int64)
+	return int(promoted)
+}
+
+// reapBatch returns up to reapBatchSize expired deliveries back to ready and
+// returns the number of returned deliveries
+func (queue *redisQueue) reapBatch() int {
+	keys := []string{queue.inflightKey, queue.unackedKey, queue.readyKey, queue.attemptsKey}
+	result := reapScript.run(queue.redisClient, keys, visibilityScore(queue.clock.Now()), reapBatchSize)
+	if result.Err() != nil {
+		return 0 // try again next interval
+	}
+	returned, _ := result.Val().(int64)
+	return int(returned)
+}
+
+// consumeFailed calls the OnConsumeError hook
+func (queue *redisQueue) consumeFailed(err error) {
+	if hook := queue.hooks.OnConsumeError; hook != nil {
+		hook(queue.name, err)
+	}
+}
+
+// nextConsumeBackoff returns the sleep of the consume loop after another
+// Redis error
+func nextConsumeBackoff(backoff, pollDuration time.Duration) time.Duration {
+	switch {
+	case backoff == 0 && pollDuration > 0:
+		backoff = pollDuration
+	case backoff == 0:
+		backoff = time.Millisecond
+	default:
+		backoff *= 2
+	}
+	if backoff > maxConsumeBackoff {
+		backoff = maxConsumeBackoff
+	}
+	return backoff
+}
+
+// fetch reads the next batch of deliveries into the delivery channel, returns
+// true if there might be more
+func (queue *redisQueue) fetch() (bool, error) {
+	if queue.fetchStream != nil {
+		return queue.fetchStream()
+	}
+	batchSize, err := queue.batchSize()
+	if err != nil {
+		return false, err
+	}
+	return queue.consumeBatch(batchSize)
+}
+
+func (queue *redisQueue) batchSize() (int, error) {
 	prefetchCount := len(queue.deliveryChan)
 	prefetchLimit := queue.prefetchLimit - prefetchCount
 	// TODO: ignore ready count here and just return prefetchLimit?
-	if readyCount := queue.ReadyCount(); readyCount < prefetchLimit {
-		return readyCount
+	readyCount, err := queue.backend.count(queue.readyKey)
+	if err != nil {
+		return 0, err
 	}
-	return prefetchLimit
+	if int(readyCount) < prefetchLimit {
+		return int(readyCount), nil
+	}
+	return prefetchLimit, nil
 }
 
-// consumeBatch tries to read batchSize deliveries, returns true if any and all were consumed
-func (queue *redisQueue) consumeBatch(batchSize int) bool {
+// consumeBatch tries to read batchSize deliveries, returns true if any and all
+// were consumed. Deliveries fetched before a Redis error are still delivered
+func (queue *redisQueue) consumeBatch(batchSize int) (bool, error) {
 	if batchSize == 0 {
-		return false
+		return false, nil
+	}
+
+	var wires [][]byte
+	var err error
+	var deadline float64
+	if queue.visibility > 0 {
+		wires, deadline, err = queue.consumeInflight(batchSize)
+	} else {
+		wires, err = queue.backend.popToUnacked(queue.readyKey, queue.unackedKey, batchSize)
 	}
 
+	for _, wire := range wires {
+		delivery := queue.newDelivery(wire)
+		delivery.track(deadline)
+		queue.deliver(delivery)
+		// debug(fmt.Sprintf("consume %d/%d %s %s", i, batchSize, wire, queue)) // COMMENTOUT
+	}
+
+	// debug(fmt.Sprintf("rmq queue consumed batch %s %d", queue, batchSize)) // COMMENTOUT
+	return err == nil, err
+}
+
+// consumeInflight moves up to batchSize deliveries from ready to unacked like
+// backend.popToUnacked() and tracks their visibility deadlines. Returns the
+// deadline, which the deliveries hold on to, see delivery.track()
+func (queue *redisQueue) consumeInflight(batchSize int) ([][]byte, float64, error) {
+	keys := []string{queue.readyKey, queue.unackedKey, queue.inflightKey}
+	deadline := visibilityScore(queue.clock.Now().Add(queue.visibility))
+	script := consumeInflightScript.pick(queue.positional)
 	reqs, err := queue.redisClient.Pipelined(func(pipe *redis.Pipeline) error {
 		for i := 0; i < batchSize; i++ {
-			pipe.RPopLPush(queue.readyKey, queue.unackedKey)
+			script.eval(queue.redisClient, pipe, keys, deadline)
 		}
 		return nil
 	})
+	err = pipelineErr(err) // redis.Nil if some deliveries weren't ready anymore
 
-	if err != nil && err != redis.Nil {
-		// TODO: Not sure what to do here just yet
-		log.Panic("Unexpected error occurred.", err)
+	wires := make([][]byte, 0, len(reqs))
+	for _, result := range reqs {
+		cmd, ok := result.(*redis.Cmd)
+		if !ok || cmd.Err() != nil {
+			continue
+		}
+		if payload, ok := cmd.Val().(string); ok && len(payload) > 0 {
+			wires = append(wires, []byte(payload))
+		}
 	}
+	return wires, deadline, err
+}
 
-	for _, result := range reqs {
-		switch result := result.(type) {
-		case *redis.StringCmd:
-			data, cmdErr := result.Bytes()
-			if cmdErr != nil && cmdErr != redis.Nil || len(data) == 0 {
-				continue
-			}
-			queue.deliveryChan <- newDelivery(data, queue.unackedKey, queue.rejectedKey, queue.pushKey, queue.redisClient)
-		default:
-			return false
+func (queue *redisQueue) newDelivery(wire []byte) *wrapDelivery {
+	var delivery *wrapDelivery
+	if queue.pooling {
+		delivery = deliveryPool.Get().(*wrapDelivery)
+	} else {
+		delivery = &wrapDelivery{}
+	}
+	delivery.init(wire, queue.shared())
+	return delivery
+}
+
+// shared returns what the queue's deliveries have in common. It's built on
+// first use and again after a setter changed it, see resetShared()
+func (queue *redisQueue) shared() *deliveryShared {
+	if shared, _ := queue.sharedDelivery.Load().(*deliveryShared); shared != nil {
+		return shared
+	}
+
+	shared := &deliveryShared{
+		unackedKey:  queue.unackedKey,
+		rejectedKey: queue.rejectedKey,
+		pushKey:     queue.pushKey,
+		redisClient: queue.redisClient,
+		backend:     queue.backend,
+		hooks:       queue.hooks,
+		queueName:   queue.name,
+		connection:  queue.connectionName,
+		deadKey:     queue.deadKey,
+		positional:  queue.positional,
+		reasonsKey:  queue.reasonsKey,
+		attemptsKey: queue.attemptsKey,
+		rejectedMax: queue.rejectedMax,
+		counters:    queue.cumulative,
+		acks:        queue.acks,
+		clock:       queue.clock,
+	}
+	if queue.retry != nil {
+		shared.retry = queue.retry
+		shared.delayedKey = queue.delayedKey
+	}
+	if queue.visibility > 0 {
+		shared.inflightKey = queue.inflightKey
+	}
+	queue.sharedDelivery.Store(shared)
+	return shared
+}
+
+// resetShared makes deliveries consumed afterwards pick up changed settings.
+// Deliveries consumed before keep the settings they were consumed with
+func (queue *redisQueue) resetShared() {
+	queue.sharedDelivery.Store((*deliveryShared)(nil))
+}
+
+// recycle returns the deliveries settled by their consumer to the delivery
+// pool if the queue pools deliveries. Unsettled deliveries, WithHeader copies
+// and deliveries whose ack might still be buffered are left to the garbage
+// collector
+func (queue *redisQueue) recycle(deliveries ...Delivery) {
+	if !queue.pooling || queue.acks != nil {
+		return
+	}
+	for _, delivery := range deliveries {
+		if wrapped, ok := delivery.(*wrapDelivery); ok && wrapped.state == &wrapped.own && wrapped.State() != Unacked {
+			wrapped.recycle()
 		}
-		// debug(fmt.Sprintf("consume %d/%d %s %s", i, batchSize, result.Val(), queue)) // COMMENTOUT
 	}
+}
 
-	// debug(fmt.Sprintf("rmq queue consumed batch %s %d", queue, batchSize)) // COMMENTOUT
-	return true
+// deliver passes the delivery on to the consumers, unless its checksum doesn't
+// match, in which case it gets rejected
+func (queue *redisQueue) deliver(delivery *wrapDelivery) {
+	if !delivery.corrupt {
+		if !queue.quarantined(delivery) {
+			queue.deliveryChan <- delivery
+		}
+		return
+	}
+
+	// log.Printf("rmq queue rejected corrupt delivery %s %s", queue, delivery)
+	delivery.RejectWithReason(ErrChecksumMismatch.Error())
+	redisErrIsNil(queue.redisClient.Incr(queue.checksumKey))
 }
 
 func (queue *redisQueue) consumerConsume(consumer Consumer, name string, stopper chan int) {
@@ -378,7 +1636,8 @@ func (queue *redisQueue) consumerConsume(consumer Consumer, name string, stopper
 		select {
 		case delivery := <-queue.deliveryChan:
 			// debug(fmt.Sprintf("consumer consume %s %s", delivery, consumer)) // COMMENTOUT
-			consumer.Consume(delivery)
+			queue.consumeDelivery(consumer, name, delivery)
+			queue.recycle(delivery)
 		case <-stopper:
 			// debug(fmt.Sprintf("consumer stopped %s", consumer)) // COMMENTOUT
 			return
@@ -386,7 +1645,94 @@ func (queue *redisQueue) consumerConsume(consumer Consumer, name string, stopper
 	}
 }
 
-func (queue *redisQueue) consumerBatchConsume(batchSize int, timeout time.Duration, consumer BatchConsumer) {
+// consumeDelivery passes the delivery to the consumer, within a consumer span
+// if the queue has a tracer
+func (queue *redisQueue) consumeDelivery(consumer Consumer, name string, delivery Delivery) {
+	if wrapped, ok := unwrapDelivery(delivery); ok {
+		wrapped.consumer = name
+	}
+	atomic.AddInt32(&queue.activeConsumers, 1)
+	defer atomic.AddInt32(&queue.activeConsumers, -1)
+	queue.observeLatency(delivery)
+	counters := queue.counters(name)
+	counters.start()
+	defer counters.done(delivery)
+
+	ctx := queue.consumingCtx
+	if queue.tracer != nil {
+		var end func()
+		ctx, end = queue.tracer.StartConsume(ctx, delivery, queue.consumeSpan(name, delivery))
+		defer end()
+	}
+
+	if contextConsumer, ok := consumer.(*contextConsumer); ok {
+		queue.consumeWithContext(ctx, contextConsumer.consumer, delivery)
+	} else {
+		consumer.Consume(delivery)
+	}
+
+	queue.checkSettled(delivery)
+}
+
+// checkSettled calls the OnUnsettled hook if a consumer returned without
+// settling the delivery
+func (queue *redisQueue) checkSettled(delivery Delivery) {
+	if hook := queue.hooks.OnUnsettled; hook != nil && delivery.State() == Unacked {
+		hook(delivery)
+	}
+}
+
+// consumeSpan describes the consumer span of a delivery
+func (queue *redisQueue) consumeSpan(consumerName string, delivery Delivery) ConsumeSpan {
+	span := ConsumeSpan{
+		Queue:       queue.name,
+		Consumer:    consumerName,
+		PayloadSize: len(delivery.PayloadBytes()),
+	}
+
+	// attempts get bumped by the reaper and by returning unacked or rejected
+	// deliveries, so they're tracked even without visibility timeout
+	if wrapped, ok := delivery.(*wrapDelivery); ok {
+		result := queue.redisClient.HGet(queue.attemptsKey, string(wrapped.wire))
+		if !redisErrIsNil(result) {
+			attempts, _ := result.Int64()
+			span.Attempts = int(attempts)
+		}
+	}
+	return span
+}
+
+// consumeWithContext passes the delivery to the consumer with a context derived
+// from parent which expires after the per delivery timeout
+func (queue *redisQueue) consumeWithContext(parent context.Context, consumer ConsumerWithContext, delivery Delivery) {
+	if queue.deliveryTimeout <= 0 {
+		consumer.Consume(parent, delivery)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(parent, queue.deliveryTimeout)
+	defer cancel()
+
+	if hook := queue.hooks.OnDeadlineExceeded; hook != nil {
+		timer := queue.clock.AfterFunc(queue.deliveryTimeout, func() { hook(delivery) })
+		defer timer.Stop()
+	}
+
+	consumer.Consume(ctx, delivery)
+}
+
+// contextConsumer adapts a ConsumerWithContext to be added like a Consumer
+type contextConsumer struct {
+	queue    *redisQueue
+	consumer ConsumerWithContext
+}
+
+func (consumer *contextConsumer) Consume(delivery Delivery) {
+	consumer.queue.consumeWithContext(consumer.queue.consumingCtx, consumer.consumer, delivery)
+}
+
+func (queue *redisQueue) consumerBatchConsume(name string, batchSize int, timeout time.Duration, consumer BatchConsumer) {
+	counters := queue.counters(name)
 	batch := []Delivery{}
 	timer := time.NewTimer(timeout)
 	stopTimer(timer) // timer not active yet
@@ -419,13 +1765,29 @@ func (queue *redisQueue) consumerBatchConsume(batchSize int, timeout time.Durati
 		}
 
 		// debug(fmt.Sprintf("batch consume consume %d", len(batch))) // COMMENTOUT
-		consumer.Consume(batch)
+		queue.consumeDeliveryBatch(consumer, counters, batch)
+		queue.recycle(batch...)
 
 		batch = batch[:0] // reset batch
 		stopTimer(timer)  // stop and drain the timer if it fired in between
 	}
 }
 
+// consumeDeliveryBatch passes the batch to the consumer
+func (queue *redisQueue) consumeDeliveryBatch(consumer BatchConsumer, counters *consumerCounters, batch []Delivery) {
+	for _, delivery := range batch {
+		queue.observeLatency(delivery)
+	}
+	atomic.AddInt32(&queue.activeConsumers, 1)
+	counters.start()
+	consumer.Consume(batch)
+	counters.done(batch...)
+	atomic.AddInt32(&queue.activeConsumers, -1)
+	for _, delivery := range batch {
+		queue.checkSettled(delivery)
+	}
+}
+
 func stopTimer(timer *time.Timer) {
 	if timer.Stop() {
 		return
@@ -437,6 +1799,11 @@ func stopTimer(timer *time.Timer) {
 	}
 }
 
+// visibilityScore returns the sorted set score of a visibility deadline
+func visibilityScore(deadline time.Time) float64 {
+	return float64(deadline.UnixNano() / int64(time.Millisecond))
+}
+
 // redisErrIsNil returns false if there is no error, true if the result error is nil and panics if there's another error
 func redisErrIsNil(result redis.Cmder) bool {
 	switch result.Err() {
@@ -450,6 +1817,14 @@ func redisErrIsNil(result redis.Cmder) bool {
 	}
 }
 
+// redisErr returns the result error unless there is none or it's redis.Nil
+func redisErr(result redis.Cmder) error {
+	if err := result.Err(); err != nil && err != redis.Nil {
+		return newRedisError(result, err)
+	}
+	return nil
+}
+
 func debug(message string) {
 	log.Printf("rmq debug: %s", message) // COMMENTOUT
 }
@@ -0,0 +1,93 @@
+package rmq
+
+import (
+	"html/template"
+	"io"
+	"unicode/utf8"
+)
+
+// detailPayloadLength is the length payloads on the queue detail page get
+// truncated to
+const detailPayloadLength = 200
+
+// QueueDetailTemplate renders QueueDetail as the queue detail page. It uses
+// the "style" template of OverviewTemplate
+var QueueDetailTemplate = template.Must(template.Must(OverviewTemplate.Clone()).New("queue").Parse(`<!DOCTYPE html>
+<html><head><title>queue {{.Name}}</title>
+{{template "style"}}
+</head><body>
+<h1>{{.Name}}</h1>
+<table>
+<tr><td>ready</td><td>{{.Stat.ReadyCount}}</td></tr>
+<tr><td>rejected</td><td>{{.Stat.RejectedCount}}</td></tr>
+<tr><td>scheduled</td><td>{{.Stat.ScheduledCount}}{{if .Stat.NextDueIn}} next in {{.Stat.NextDueIn}}{{end}}</td></tr>
+<tr><td>unacked</td><td>{{.Stat.UnackedCount}}</td></tr>
+<tr><td>push queues</td><td>{{range $i, $name := .PushChain}}{{if $i}} → {{end}}{{$name}}{{else}}none{{end}}</td></tr>
+</table>
+<h2>connections</h2>
+<table>
+<tr><th>connection</th><th>unacked</th><th>consumers</th></tr>
+{{range .Connections}}<tr class="connection {{.Stat.Health}}"><td>{{.Name}} {{template "health" .Stat}}</td><td>{{.Stat.UnackedCount}}</td><td>{{range $i, $consumer := .Consumers}}{{if $i}}, {{end}}{{$consumer.Name}}{{end}}</td></tr>
+{{end}}</table>
+<h2>first {{len .Ready}} ready</h2>
+<table>
+{{range .Ready}}<tr><td>{{.}}</td></tr>
+{{end}}</table>
+<h2>first {{len .Rejected}} rejected</h2>
+<table>
+<tr><th>payload</th><th>reason</th><th>rejected at</th><th>attempts</th></tr>
+{{range .Rejected}}<tr><td>{{.Payload}}</td><td>{{.Reason}}</td><td>{{if not .RejectedAt.IsZero}}{{.RejectedAt.Format "2006-01-02T15:04:05Z07:00"}}{{end}}</td><td>{{.Attempts}}</td></tr>
+{{end}}</table>
+</body></html>`))
+
+// QueueDetail is what QueueDetailTemplate gets executed with, see
+// connection.QueueDetail(). Payloads are truncated
+type QueueDetail struct {
+	Name        string
+	Stat        QueueStat
+	Connections []HtmlConnectionStat // consuming the queue, sorted by name
+	Ready       []string             // payloads of the first ready deliveries in the order they will be consumed
+	Rejected    []RejectedDelivery   // newest first
+	PushChain   []string             // queues deliveries pushed from this queue pass through, empty if it has no push queue
+}
+
+// QueueDetail returns the stats of the queue along with the payloads of up
+// to count ready and rejected deliveries. Payloads can be sensitive, so make
+// sure only authorized users get to see them
+func (connection *RedisConnection) QueueDetail(name string, count int) QueueDetail {
+	stats := connection.CollectStats([]string{name})
+	queue := connection.openQueue(name)
+	detail := QueueDetail{
+		Name:      name,
+		Stat:      stats.QueueStats[name],
+		PushChain: queue.PushChain()[1:],
+		Rejected:  queue.ListRejected(0, count),
+	}
+	if data := stats.htmlData(HtmlOptions{}); len(data.Queues) == 1 {
+		detail.Connections = data.Queues[0].Connections
+	}
+	for _, entry := range queue.PeekReady(0, count) {
+		detail.Ready = append(detail.Ready, truncatePayload(decodePayload(entry), detailPayloadLength))
+	}
+	for i := range detail.Rejected {
+		detail.Rejected[i].Payload = truncatePayload(detail.Rejected[i].Payload, detailPayloadLength)
+	}
+	return detail
+}
+
+// RenderHtml writes the queue detail page rendered by QueueDetailTemplate to w
+func (detail QueueDetail) RenderHtml(w io.Writer) error {
+	return QueueDetailTemplate.ExecuteTemplate(w, "queue", detail)
+}
+
+// truncatePayload shortens payload to at most length bytes without splitting
+// runes, marking truncated payloads with an ellipsis
+func truncatePayload(payload string, length int) string {
+	if len(payload) <= length {
+		return payload
+	}
+	for length > 0 && !utf8.RuneStart(payload[length]) {
+		length--
+	}
+	return payload[:length] + "…"
+}
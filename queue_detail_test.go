@@ -0,0 +1,42 @@
+package rmq
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestQueueDetailRenderHtml(t *testing.T) {
+	detail := QueueDetail{
+		Name:      "q1",
+		Stat:      NewQueueStat(1, 1),
+		Ready:     []string{"<script>alert(1)</script>"},
+		Rejected:  []RejectedDelivery{{Payload: "d2", Reason: "timeout"}},
+		PushChain: []string{"q2", "q3"},
+	}
+	var buffer bytes.Buffer
+	if err := detail.RenderHtml(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	html := buffer.String()
+	for _, expected := range []string{"&lt;script&gt;alert(1)&lt;/script&gt;", "<td>d2</td><td>timeout</td>", "q2 → q3", "<style>"} {
+		if !strings.Contains(html, expected) {
+			t.Errorf("expected %q in html\n%s", expected, html)
+		}
+	}
+}
+
+func TestTruncatePayload(t *testing.T) {
+	for _, test := range []struct {
+		payload  string
+		expected string
+	}{
+		{"short", "short"},
+		{"too long", "too l…"},
+		{"abcdä", "abcd…"}, // doesn't split ä
+	} {
+		if truncated := truncatePayload(test.payload, 5); truncated != test.expected {
+			t.Errorf("truncatePayload(%q) = %q, expected %q", test.payload, truncated, test.expected)
+		}
+	}
+}
@@ -1,11 +1,17 @@
 package rmq
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	. "github.com/adjust/gocheck"
+	"gopkg.in/redis.v5"
 )
 
 const delayMs = 3
@@ -17,21 +23,21 @@ func TestQueueSuite(t *testing.T) {
 type QueueSuite struct{}
 
 func (suite *QueueSuite) TestConnections(c *C) {
-	flushConn := OpenConnection("conns-flush", "localhost:6379", 1)
+	flushConn := OpenConnection("conns-flush", testRedisAddr, 1)
 	flushConn.flushDb()
 	flushConn.StopHeartbeat()
 
-	connection := OpenConnection("conns-conn", "localhost:6379", 1)
+	connection := OpenConnection("conns-conn", testRedisAddr, 1)
 	c.Assert(connection, NotNil)
 	c.Assert(NewCleaner(connection).Clean(), IsNil)
 
 	c.Check(connection.GetConnections(), HasLen, 1, Commentf("cleaner %s", connection.Name)) // cleaner connection remains
 
-	conn1 := OpenConnection("conns-conn1", "localhost:6379", 1)
+	conn1 := OpenConnection("conns-conn1", testRedisAddr, 1)
 	c.Check(connection.GetConnections(), HasLen, 2)
 	c.Check(connection.hijackConnection("nope").Check(), Equals, false)
 	c.Check(conn1.Check(), Equals, true)
-	conn2 := OpenConnection("conns-conn2", "localhost:6379", 1)
+	conn2 := OpenConnection("conns-conn2", testRedisAddr, 1)
 	c.Check(connection.GetConnections(), HasLen, 3)
 	c.Check(conn1.Check(), Equals, true)
 	c.Check(conn2.Check(), Equals, true)
@@ -51,7 +57,7 @@ func (suite *QueueSuite) TestConnections(c *C) {
 }
 
 func (suite *QueueSuite) TestConnectionQueues(c *C) {
-	connection := OpenConnection("conn-q-conn", "localhost:6379", 1)
+	connection := OpenConnection("conn-q-conn", testRedisAddr, 1)
 	c.Assert(connection, NotNil)
 
 	connection.CloseAllQueues()
@@ -89,7 +95,7 @@ func (suite *QueueSuite) TestConnectionQueues(c *C) {
 }
 
 func (suite *QueueSuite) TestQueue(c *C) {
-	connection := OpenConnection("queue-conn", "localhost:6379", 1)
+	connection := OpenConnection("queue-conn", testRedisAddr, 1)
 	c.Assert(connection, NotNil)
 
 	queue := connection.OpenQueue("queue-q").(*redisQueue)
@@ -104,6 +110,15 @@ func (suite *QueueSuite) TestQueue(c *C) {
 	c.Check(queue.ReadyCount(), Equals, 0)
 	c.Check(queue.PurgeReady(), Equals, false)
 
+	c.Check(queue.Publish("queue-d3"), Equals, true)
+	c.Check(queue.Publish("queue-d4"), Equals, true)
+	removed, err := queue.PurgeReadyErr()
+	c.Check(err, IsNil)
+	c.Check(removed, Equals, int64(2))
+	removed, err = queue.PurgeReadyErr()
+	c.Check(err, IsNil)
+	c.Check(removed, Equals, int64(0))
+
 	queue.RemoveAllConsumers()
 	c.Check(queue.GetConsumers(), HasLen, 0)
 	c.Check(connection.GetConsumingQueues(), HasLen, 0)
@@ -126,7 +141,7 @@ func (suite *QueueSuite) TestQueue(c *C) {
 }
 
 func (suite *QueueSuite) TestConsumer(c *C) {
-	connection := OpenConnection("cons-conn", "localhost:6379", 1)
+	connection := OpenConnection("cons-conn", testRedisAddr, 1)
 	c.Assert(connection, NotNil)
 
 	queue := connection.OpenQueue("cons-q").(*redisQueue)
@@ -187,13 +202,16 @@ func (suite *QueueSuite) TestConsumer(c *C) {
 	c.Check(queue.PurgeRejected(), Equals, true)
 	c.Check(queue.RejectedCount(), Equals, 0)
 	c.Check(queue.PurgeRejected(), Equals, false)
+	removed, err := queue.PurgeRejectedErr()
+	c.Check(err, IsNil)
+	c.Check(removed, Equals, int64(0))
 
 	queue.StopConsuming()
 	connection.StopHeartbeat()
 }
 
 func (suite *QueueSuite) TestMulti(c *C) {
-	connection := OpenConnection("multi-conn", "localhost:6379", 1)
+	connection := OpenConnection("multi-conn", testRedisAddr, 1)
 	queue := connection.OpenQueue("multi-q").(*redisQueue)
 	queue.PurgeReady()
 
@@ -242,7 +260,7 @@ func (suite *QueueSuite) TestMulti(c *C) {
 }
 
 func (suite *QueueSuite) TestStop(c *C) {
-	connection := OpenConnection("stop-conn", "localhost:6379", 1)
+	connection := OpenConnection("stop-conn", testRedisAddr, 1)
 	queue := connection.OpenQueue("stop-q").(*redisQueue)
 	queue.PurgeRejected()
 	queue.PurgeReady()
@@ -264,8 +282,96 @@ func (suite *QueueSuite) TestStop(c *C) {
 	c.Check(consumer.LastDelivery.Payload(), Equals, "stop-d1")
 }
 
+type ctxConsumer struct {
+	errs chan error
+}
+
+func (consumer *ctxConsumer) Consume(ctx context.Context, delivery Delivery) {
+	<-ctx.Done()
+	consumer.errs <- ctx.Err()
+}
+
+func (suite *QueueSuite) TestContextConsumer(c *C) {
+	connection := OpenConnection("ctx-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("ctx-q").(*redisQueue)
+	queue.PurgeRejected()
+	queue.PurgeReady()
+
+	exceeded := make(chan Delivery, 1)
+	queue.SetPerDeliveryTimeout(5 * time.Millisecond)
+	queue.SetHooks(Hooks{OnDeadlineExceeded: func(delivery Delivery) { exceeded <- delivery }})
+
+	consumer := &ctxConsumer{errs: make(chan error, 1)}
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddContextConsumer("ctx-cons", consumer)
+
+	c.Check(queue.Publish("ctx-d1"), Equals, true)
+	c.Check(<-consumer.errs, Equals, context.DeadlineExceeded)
+	c.Check((<-exceeded).Payload(), Equals, "ctx-d1")
+	c.Check(queue.UnackedCount(), Equals, 1) // not settled by the deadline
+
+	queue.SetPerDeliveryTimeout(0)
+	c.Check(queue.Publish("ctx-d2"), Equals, true)
+	time.Sleep(delayMs * time.Millisecond)
+	queue.StopConsuming()
+	c.Check(<-consumer.errs, Equals, context.Canceled)
+
+	connection.StopHeartbeat()
+}
+
+type traceKey struct{}
+
+// testTracer stores the trace id of the publishing context in the traceparent
+// header and passes it on to the consumer's context
+type testTracer struct {
+	spans chan ConsumeSpan
+}
+
+func (tracer *testTracer) Inject(ctx context.Context, headers map[string]string) {
+	if traceID, ok := ctx.Value(traceKey{}).(string); ok {
+		headers[HeaderTraceParent] = traceID
+	}
+}
+
+func (tracer *testTracer) StartConsume(ctx context.Context, delivery Delivery, span ConsumeSpan) (context.Context, func()) {
+	traceID, _ := delivery.Header(HeaderTraceParent)
+	return context.WithValue(ctx, traceKey{}, traceID), func() { tracer.spans <- span }
+}
+
+type traceConsumer struct {
+	traceIDs chan string
+}
+
+func (consumer *traceConsumer) Consume(ctx context.Context, delivery Delivery) {
+	traceID, _ := ctx.Value(traceKey{}).(string)
+	consumer.traceIDs <- traceID
+	delivery.Ack()
+}
+
+func (suite *QueueSuite) TestTracer(c *C) {
+	connection := OpenConnection("trace-conn", testRedisAddr, 1)
+	tracer := &testTracer{spans: make(chan ConsumeSpan, 1)}
+	connection.SetTracer(tracer)
+	queue := connection.OpenQueue("trace-q").(*redisQueue)
+	queue.PurgeRejected()
+	queue.PurgeReady()
+
+	consumer := &traceConsumer{traceIDs: make(chan string, 1)}
+	queue.StartConsuming(10, time.Millisecond)
+	name, _ := queue.AddContextConsumer("trace-cons", consumer)
+
+	ctx := context.WithValue(context.Background(), traceKey{}, "00-trace-span-01")
+	c.Check(queue.PublishWithContext(ctx, "trace-d1"), Equals, true)
+	c.Check(<-consumer.traceIDs, Equals, "00-trace-span-01")
+	c.Check(<-tracer.spans, DeepEquals, ConsumeSpan{Queue: "trace-q", Consumer: name, PayloadSize: len("trace-d1")})
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
 func (suite *QueueSuite) TestBatch(c *C) {
-	connection := OpenConnection("batch-conn", "localhost:6379", 1)
+	connection := OpenConnection("batch-conn", testRedisAddr, 1)
 	queue := connection.OpenQueue("batch-q").(*redisQueue)
 	queue.PurgeRejected()
 	queue.PurgeReady()
@@ -313,8 +419,300 @@ func (suite *QueueSuite) TestBatch(c *C) {
 	c.Check(queue.RejectedCount(), Equals, 3)
 }
 
+func (suite *QueueSuite) TestAckMany(c *C) {
+	connection := OpenConnection("ackmany-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("ackmany-q").(*redisQueue)
+	queue.PurgeRejected()
+	queue.PurgeReady()
+
+	for i := 0; i < 5; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("ackmany-d%d", i)), Equals, true)
+	}
+
+	consumer := NewTestConsumer("ackmany-cons")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("ackmany-cons", consumer)
+	time.Sleep(delayMs * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 5)
+	c.Check(queue.UnackedCount(), Equals, 5)
+
+	c.Check(consumer.LastDeliveries[1].Ack(), Equals, true) // already acked, skipped without touching Redis
+
+	acked, failed, err := queue.AckMany(consumer.LastDeliveries)
+	c.Check(err, IsNil)
+	c.Check(acked, Equals, 4)
+	c.Assert(failed, HasLen, 1)
+	c.Check(failed[0].Payload(), Equals, "ackmany-d1")
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestAckManyVisibility(c *C) {
+	connection := OpenConnection("ackmany-vis-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("ackmany-vis-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.ResetCounters()
+	queue.SetVisibilityTimeout(time.Minute)
+
+	for i := 0; i < 3; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("ackmany-vis-d%d", i)), Equals, true)
+	}
+	queue.redisClient.HIncrBy(queue.attemptsKey, "ackmany-vis-d0", 1)
+
+	consumer := NewTestConsumer("ackmany-vis-cons")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("ackmany-vis-cons", consumer)
+	time.Sleep(delayMs * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 3)
+	c.Check(queue.redisClient.ZCard(queue.inflightKey).Val(), Equals, int64(3))
+
+	acked, failed, err := queue.AckMany(consumer.LastDeliveries)
+	c.Check(err, IsNil)
+	c.Check(acked, Equals, 3)
+	c.Check(failed, HasLen, 0)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.redisClient.ZCard(queue.inflightKey).Val(), Equals, int64(0)) // not reaped later
+	c.Check(queue.redisClient.HExists(queue.attemptsKey, "ackmany-vis-d0").Val(), Equals, false)
+	c.Check(queue.Counters().Acked, Equals, int64(3))
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPurgeReadyErr(c *C) {
+	connection := OpenConnection("purge-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("purge-q").(*redisQueue)
+	queue.PurgeReady()
+
+	removed, err := queue.PurgeReadyErr()
+	c.Check(err, IsNil)
+	c.Check(removed, Equals, int64(0))
+
+	for i := 0; i < 3; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("purge-d%d", i)), Equals, true)
+	}
+	queue.redisClient.HIncrBy(queue.attemptsKey, "purge-d1", 1)
+	removed, err = queue.PurgeReadyErr()
+	c.Check(err, IsNil)
+	c.Check(removed, Equals, int64(3))
+	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(queue.redisClient.HLen(queue.attemptsKey).Val(), Equals, int64(0))
+	c.Check(queue.redisClient.Keys(queue.readyKey+"::purging::*").Val(), HasLen, 0)
+
+	c.Check(queue.Publish("purge-d3"), Equals, true)
+	c.Check(queue.ReadyCount(), Equals, 1)
+
+	connection.StopHeartbeat()
+	queue.PurgeReady()
+}
+
+func (suite *QueueSuite) TestPurgeUnacked(c *C) {
+	connection := OpenConnection("purge-unacked-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("purge-unacked-q").(*redisQueue)
+	queue.PurgeReady()
+
+	c.Check(queue.Publish("purge-unacked-d1"), Equals, true)
+	c.Check(queue.Publish("purge-unacked-d2"), Equals, true)
+
+	consumer := NewTestConsumer("purge-unacked-cons")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("purge-unacked-cons", consumer)
+	time.Sleep(delayMs * time.Millisecond)
+	queue.StopConsuming()
+	c.Check(queue.UnackedCount(), Equals, 2)
+
+	removed, err := queue.PurgeUnacked()
+	c.Check(err, IsNil)
+	c.Check(removed, Equals, int64(2))
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPeekUnacked(c *C) {
+	connection := OpenConnection("peek-unacked-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("peek-unacked-q").(*redisQueue)
+	queue.PurgeReady()
+
+	c.Check(queue.Publish("peek-unacked-d1"), Equals, true)
+	c.Check(queue.PublishWithHeaders("peek-unacked-d2", nil), Equals, true)
+
+	consumer := NewTestConsumer("peek-unacked-cons")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("peek-unacked-cons", consumer)
+	time.Sleep(delayMs * time.Millisecond)
+
+	c.Check(queue.PeekUnacked(1), DeepEquals, []string{"peek-unacked-d2"})
+	c.Check(queue.PeekUnacked(5), DeepEquals, []string{"peek-unacked-d2", "peek-unacked-d1"})
+	c.Check(queue.UnackedCount(), Equals, 2)
+
+	inspector := OpenConnection("peek-unacked-inspector", testRedisAddr, 1)
+	snapshot := inspector.InspectConnection(connection.Name).UnackedSnapshot()
+	c.Check(snapshot, DeepEquals, map[string][]string{"peek-unacked-q": {"peek-unacked-d2", "peek-unacked-d1"}})
+
+	_, ok := queue.OldestUnackedAge()
+	c.Check(ok, Equals, false) // oldest was published without headers
+	c.Check(consumer.LastDeliveries[0].Ack(), Equals, true)
+	age, ok := queue.OldestUnackedAge()
+	c.Check(ok, Equals, true)
+	c.Check(age > 0 && age < time.Second, Equals, true)
+
+	queue.StopConsuming()
+	for _, delivery := range consumer.LastDeliveries {
+		delivery.Ack()
+	}
+	inspector.StopHeartbeat()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestReturnAllUnacked(c *C) {
+	connection := OpenConnection("return-unacked-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("return-unacked-q").(*redisQueue)
+	queue.PurgeReady()
+
+	for i := 0; i < 3; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("return-unacked-d%d", i)), Equals, true)
+	}
+
+	consumer := NewTestConsumer("return-unacked-cons")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("return-unacked-cons", consumer)
+	time.Sleep(delayMs * time.Millisecond)
+	c.Check(queue.UnackedCount(), Equals, 3)
+
+	returned, err := queue.ReturnAllUnacked()
+	c.Check(err, Equals, ErrConsumersActive)
+	c.Check(returned, Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 3)
+
+	queue.StopConsuming()
+	time.Sleep(delayMs * time.Millisecond)
+	returned, err = queue.ReturnAllUnacked()
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 3)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 3)
+	c.Check(queue.redisClient.HGet(queue.attemptsKey, "return-unacked-d0").Val(), Equals, "1")
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestSettleErr(c *C) {
+	connection := OpenConnection("settle-err-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("settle-err-q").(*redisQueue)
+	queue.PurgeRejected()
+	queue.PurgeReady()
+
+	for i := 0; i < 3; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("settle-err-d%d", i)), Equals, true)
+	}
+
+	consumer := NewTestConsumer("settle-err-cons")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("settle-err-cons", consumer)
+	time.Sleep(delayMs * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 3)
+
+	c.Check(consumer.LastDeliveries[0].AckErr(), IsNil)
+	c.Check(consumer.LastDeliveries[0].AckErr(), Equals, ErrAlreadySettled)
+	c.Check(consumer.LastDeliveries[0].RejectErr(), Equals, ErrAlreadySettled)
+	c.Check(consumer.LastDeliveries[1].RejectErr(), IsNil)
+	c.Check(consumer.LastDeliveries[2].PushErr(), IsNil) // no push queue, rejected
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 2)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestUnsettledHook(c *C) {
+	connection := OpenConnection("unsettled-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("unsettled-q").(*redisQueue)
+	queue.PurgeRejected()
+	queue.PurgeReady()
+
+	unsettled := make(chan Delivery, 2)
+	queue.SetHooks(Hooks{OnUnsettled: func(delivery Delivery) { unsettled <- delivery }})
+
+	consumer := NewTestConsumer("unsettled-cons")
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("unsettled-cons", consumer)
+
+	c.Check(queue.Publish("unsettled-d1"), Equals, true)
+	time.Sleep(delayMs * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 1)
+	c.Check(consumer.LastDelivery.State(), Equals, Acked)
+
+	consumer.AutoAck = false
+	c.Check(queue.Publish("unsettled-d2"), Equals, true)
+	c.Check((<-unsettled).Payload(), Equals, "unsettled-d2")
+	c.Check(consumer.LastDelivery.State(), Equals, Unacked)
+	c.Check(consumer.LastDelivery.Push(), Equals, true) // no push queue
+	c.Check(consumer.LastDelivery.State(), Equals, Rejected)
+	c.Check(unsettled, HasLen, 0)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestVisibilityTimeout(c *C) {
+	connection := OpenConnection("visibility-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("visibility-q").(*redisQueue)
+	queue.PurgeRejected()
+	queue.PurgeReady()
+	queue.SetVisibilityTimeout(20 * time.Millisecond)
+
+	consumer := NewTestConsumer("visibility-cons")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("visibility-cons", consumer)
+
+	c.Check(queue.Publish("visibility-d1"), Equals, true)
+	c.Check(queue.Publish("visibility-d2"), Equals, true)
+	c.Assert(consumer.WaitForDeliveries(2, time.Second), Equals, true)
+	deliveries := consumer.Deliveries()
+	c.Check(deliveries[1].Extend(50*time.Millisecond), Equals, true)
+	c.Check(queue.UnackedCount(), Equals, 2)
+
+	c.Check(deliveries[0].Ack(), Equals, true)
+	time.Sleep(30 * time.Millisecond)
+	c.Check(queue.UnackedCount(), Equals, 1) // extended, not redelivered yet
+	c.Check(consumer.Deliveries(), HasLen, 2)
+
+	c.Assert(consumer.WaitForDeliveries(3, time.Second), Equals, true) // redelivered
+	redelivered := consumer.Last()
+	c.Check(redelivered.Extend(time.Second), Equals, true) // so it doesn't time out again
+	c.Check(redelivered.Payload(), Equals, "visibility-d2")
+	stale := deliveries[1]
+	c.Check(stale.Ack(), Equals, false) // doesn't ack the redelivered copy
+	c.Check(stale.Extend(time.Second), Equals, false)
+	c.Check(stale.RejectWithReason("stale"), Equals, false)
+	c.Check(queue.UnackedCount(), Equals, 1)
+	c.Check(queue.redisClient.HGet(queue.attemptsKey, "visibility-d2").Val(), Equals, "1")
+
+	c.Check(redelivered.RejectWithReason("too slow"), Equals, true)
+	c.Check(redelivered.Extend(time.Second), Equals, false)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 1)
+	c.Check(queue.redisClient.HExists(queue.attemptsKey, "visibility-d2").Val(), Equals, false)
+	rejected := queue.GetRejectedWithReasons(1)
+	c.Assert(rejected, HasLen, 1)
+	c.Check(rejected[0].Attempts, Equals, 1) // moved into the rejection
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
 func (suite *QueueSuite) TestReturnRejected(c *C) {
-	connection := OpenConnection("return-conn", "localhost:6379", 1)
+	connection := OpenConnection("return-conn", testRedisAddr, 1)
 	queue := connection.OpenQueue("return-q").(*redisQueue)
 	queue.PurgeReady()
 
@@ -366,77 +764,856 @@ func (suite *QueueSuite) TestReturnRejected(c *C) {
 	c.Check(queue.RejectedCount(), Equals, 0)
 }
 
-func (suite *QueueSuite) TestPushQueue(c *C) {
-	connection := OpenConnection("push", "localhost:6379", 1)
-	queue1 := connection.OpenQueue("queue1").(*redisQueue)
-	queue2 := connection.OpenQueue("queue2").(*redisQueue)
-	queue1.SetPushQueue(queue2)
-	c.Check(queue1.pushKey, Equals, queue2.readyKey)
-
-	consumer1 := NewTestConsumer("push-cons")
-	consumer1.AutoAck = false
-	consumer1.AutoFinish = false
-	queue1.StartConsuming(10, time.Millisecond)
-	queue1.AddConsumer("push-cons", consumer1)
+func (suite *QueueSuite) TestReturnRejectedErr(c *C) {
+	connection := OpenConnection("return-err-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("return-err-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
 
-	consumer2 := NewTestConsumer("push-cons")
-	consumer2.AutoAck = false
-	consumer2.AutoFinish = false
-	queue2.StartConsuming(10, time.Millisecond)
-	queue2.AddConsumer("push-cons", consumer2)
+	for i := 0; i < 3; i++ {
+		c.Check(queue.redisClient.LPush(queue.rejectedKey, fmt.Sprintf("return-err-d%d", i)).Err(), IsNil)
+	}
 
-	queue1.Publish("d1")
-	time.Sleep(delayMs * time.Millisecond)
-	c.Check(queue1.UnackedCount(), Equals, 1)
-	c.Assert(consumer1.LastDeliveries, HasLen, 1)
+	returned, err := queue.ReturnRejectedErr(1)
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 1)
+	c.Check(queue.ReadyCount(), Equals, 1)
+	c.Check(queue.RejectedCount(), Equals, 2)
 
-	c.Check(consumer1.LastDelivery.Push(), Equals, true)
-	time.Sleep(delayMs * time.Millisecond)
-	c.Check(queue1.UnackedCount(), Equals, 0)
-	c.Check(queue2.UnackedCount(), Equals, 1)
+	returned, err = queue.ReturnRejectedErr(5)
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 2)
+	c.Check(queue.ReadyCount(), Equals, 3)
+	c.Check(queue.RejectedCount(), Equals, 0)
+	c.Check(queue.redisClient.HGet(queue.attemptsKey, "return-err-d2").Val(), Equals, "1") // bumped like any requeue
 
-	c.Assert(consumer2.LastDeliveries, HasLen, 1)
-	c.Check(consumer2.LastDelivery.Push(), Equals, true)
-	time.Sleep(delayMs * time.Millisecond)
-	c.Check(queue2.RejectedCount(), Equals, 1)
+	returned, err = queue.ReturnRejectedErr(5)
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 0)
+	c.Check(queue.ReturnAllRejected(), Equals, 0)
+	queue.PurgeReady()
 }
 
-func (suite *QueueSuite) TestConsuming(c *C) {
-	connection := OpenConnection("consume", "localhost:6379", 1)
-	queue := connection.OpenQueue("consume-q").(*redisQueue)
+func (suite *QueueSuite) TestReturnAllRejectedThrottled(c *C) {
+	connection := OpenConnection("throttle-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("throttle-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	for i := 0; i < 30; i++ {
+		queue.redisClient.LPush(queue.rejectedKey, fmt.Sprintf("throttle-d%d", i))
+	}
 
-	c.Check(queue.StopConsuming(), Equals, false)
+	progress := []int{}
+	queue.SetHooks(Hooks{OnReturnProgress: func(returned int) { progress = append(progress, returned) }})
 
-	queue.StartConsuming(10, time.Millisecond)
-	c.Check(queue.StopConsuming(), Equals, true)
-	c.Check(queue.StopConsuming(), Equals, false)
+	start := time.Now()
+	returned, err := queue.ReturnAllRejectedThrottled(context.Background(), 200)
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 30)
+	c.Check(time.Since(start) >= 100*time.Millisecond, Equals, true) // 20 per 100ms
+	c.Check(progress, DeepEquals, []int{20, 30})
+	c.Check(queue.ReadyCount(), Equals, 30)
+	c.Check(queue.RejectedCount(), Equals, 0)
+
+	for i := 0; i < 30; i++ {
+		queue.redisClient.LPush(queue.rejectedKey, fmt.Sprintf("throttle-d%d", i))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	returned, err = queue.ReturnAllRejectedThrottled(ctx, 200)
+	c.Check(err, Equals, context.Canceled)
+	c.Check(returned, Equals, 20)
+	c.Check(queue.RejectedCount(), Equals, 10)
+
+	_, err = queue.ReturnAllRejectedThrottled(context.Background(), 0)
+	c.Check(err, NotNil)
+	connection.StopHeartbeat()
 }
 
-func (suite *QueueSuite) BenchmarkQueue(c *C) {
-	// open queue
-	connection := OpenConnection("bench-conn", "localhost:6379", 1)
-	queueName := fmt.Sprintf("bench-q%d", c.N)
-	queue := connection.OpenQueue(queueName).(*redisQueue)
+func (suite *QueueSuite) TestTrimRejected(c *C) {
+	connection := OpenConnection("trim-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("trim-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
 
-	// add some consumers
-	numConsumers := 10
-	var consumers []*TestConsumer
-	for i := 0; i < numConsumers; i++ {
-		consumer := NewTestConsumer("bench-A")
-		// consumer.SleepDuration = time.Microsecond
-		consumers = append(consumers, consumer)
-		queue.StartConsuming(10, time.Millisecond)
-		queue.AddConsumer("bench-cons", consumer)
-	}
+	trimmed := int64(0)
+	queue.SetHooks(Hooks{OnRejectedTrimmed: func(queueName string, dropped int64) { trimmed += dropped }})
 
-	// publish deliveries
-	for i := 0; i < c.N; i++ {
-		c.Check(queue.Publish("bench-d"), Equals, true)
+	for i := 0; i < 5; i++ {
+		queue.redisClient.LPush(queue.rejectedKey, fmt.Sprintf("trim-d%d", i))
+	}
+	dropped, err := queue.TrimRejected(3)
+	c.Check(err, IsNil)
+	c.Check(dropped, Equals, int64(2))
+	c.Check(trimmed, Equals, int64(2))
+	c.Check(queue.GetRejected(5), DeepEquals, []string{"trim-d4", "trim-d3", "trim-d2"})
+	dropped, err = queue.TrimRejected(3)
+	c.Check(err, IsNil)
+	c.Check(dropped, Equals, int64(0))
+
+	queue.SetRejectedMaxLength(3)
+	for i := 5; i < 7; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("trim-d%d", i)), Equals, true)
 	}
+	consumer := NewTestConsumer("trim-cons")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("trim-cons", consumer)
+	time.Sleep(delayMs * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 2)
+	c.Check(consumer.LastDeliveries[0].Reject(), Equals, true)
+	c.Check(consumer.LastDeliveries[1].RejectWithReason("bad"), Equals, true)
+	c.Check(trimmed, Equals, int64(4))
+	c.Check(queue.GetRejected(5), DeepEquals, []string{"trim-d6", "trim-d5", "trim-d4"})
 
-	// wait until all are consumed
-	for {
-		ready := queue.ReadyCount()
+	queue.StopConsuming()
+	dropped, err = queue.TrimRejected(0)
+	c.Check(err, IsNil)
+	c.Check(dropped, Equals, int64(3))
+	c.Check(queue.RejectedCount(), Equals, 0)
+	c.Check(queue.redisClient.HLen(queue.reasonsKey).Val(), Equals, int64(0))
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestDeleteRejected(c *C) {
+	connection := OpenConnection("delete-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("delete-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+
+	queue.redisClient.LPush(queue.rejectedKey, "delete-poison", "delete-d1", "delete-poison")
+	poison := &envelope{Payload: []byte("delete-poison"), Headers: map[string]string{HeaderID: "delete-id1"}}
+	other := &envelope{Payload: []byte("delete-d2"), Headers: map[string]string{HeaderID: "delete-id2"}}
+	queue.redisClient.LPush(queue.rejectedKey, poison.encode(), other.encode())
+	queue.redisClient.HSet(queue.reasonsKey, "delete-poison", "{}")
+
+	removed, err := queue.DeleteRejected([]byte("delete-poison"))
+	c.Check(err, IsNil)
+	c.Check(removed, Equals, int64(3))
+	c.Check(queue.GetRejected(10), DeepEquals, []string{"delete-d2", "delete-d1"})
+	c.Check(queue.redisClient.HLen(queue.reasonsKey).Val(), Equals, int64(0))
+
+	removed, err = queue.DeleteRejectedByID("delete-id2")
+	c.Check(err, IsNil)
+	c.Check(removed, Equals, int64(1))
+	removed, err = queue.DeleteRejectedByID("delete-id2")
+	c.Check(err, IsNil)
+	c.Check(removed, Equals, int64(0))
+	c.Check(queue.GetRejected(10), DeepEquals, []string{"delete-d1"})
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestReturnRejectedMessage(c *C) {
+	connection := OpenConnection("return-msg-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("return-msg-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	queue.redisClient.Del(queue.attemptsKey)
+
+	customer := &envelope{Payload: []byte("return-msg-customer"), Headers: map[string]string{HeaderID: "return-msg-id"}}
+	queue.redisClient.LPush(queue.rejectedKey, "return-msg-d1", customer.encode(), "return-msg-d2")
+	queue.redisClient.HSet(queue.reasonsKey, "return-msg-d1", "{}")
+
+	returned, err := queue.ReturnRejectedMessage([]byte("return-msg-d1"))
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, true)
+	c.Check(queue.ReadyCount(), Equals, 1)
+	c.Check(queue.redisClient.HGet(queue.attemptsKey, "return-msg-d1").Val(), Equals, "1")
+	c.Check(queue.redisClient.HExists(queue.reasonsKey, "return-msg-d1").Val(), Equals, false)
+
+	returned, err = queue.ReturnRejectedMessage([]byte("return-msg-d1"))
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, false)
+
+	returned, err = queue.ReturnRejectedMessageByID("return-msg-id")
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, true)
+	c.Check(queue.ReadyCount(), Equals, 2)
+	c.Check(queue.GetRejected(10), DeepEquals, []string{"return-msg-d2"})
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestWatchRejected(c *C) {
+	connection := OpenConnection("watch-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("watch-q").(*redisQueue)
+	queue.PurgeRejected()
+
+	counts := make(chan int64, 10)
+	queue.WatchRejected(3, time.Millisecond, func(count int64) { counts <- count })
+	queueCounts := make(chan string, 10)
+	connection.WatchRejected(3, time.Millisecond, func(queueName string, count int64) {
+		if queueName == "watch-q" {
+			queueCounts <- queueName
+		}
+	})
+
+	queue.redisClient.LPush(queue.rejectedKey, "watch-d1", "watch-d2", "watch-d3")
+	c.Check(<-counts, Equals, int64(3))
+	c.Check(<-queueCounts, Equals, "watch-q")
+	time.Sleep(delayMs * time.Millisecond)
+	c.Check(counts, HasLen, 0) // not again while above threshold
+	c.Check(queueCounts, HasLen, 0)
+
+	queue.StartConsuming(10, time.Millisecond)
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+	queue.PurgeRejected()
+}
+
+func (suite *QueueSuite) TestRetryPolicy(c *C) {
+	connection := OpenConnection("retry-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("retry-q").(*redisQueue)
+	deadQueue := connection.OpenQueue("retry-dead-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	deadQueue.PurgeReady()
+	queue.SetDeadLetterQueue(deadQueue)
+	queue.SetRetryPolicy(&RetryPolicy{InitialDelay: 2 * time.Millisecond, Multiplier: 2, MaxAttempts: 2})
+
+	c.Check(queue.Publish("retry-d1"), Equals, true)
+	consumer := NewTestConsumer("retry-cons")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("retry-cons", consumer)
+
+	for retries := 0; retries <= 2; retries++ {
+		c.Assert(consumer.WaitForDeliveries(retries+1, time.Second), Equals, true)
+		delivery := consumer.Last()
+		c.Check(delivery.Payload(), Equals, "retry-d1")
+		if retries > 0 {
+			c.Check(delivery.Headers()[HeaderRetryCount], Equals, fmt.Sprint(retries))
+		}
+		c.Check(delivery.Reject(), Equals, true)
+		if retries < 2 {
+			c.Check(delivery.State(), Equals, Delayed)
+		} else {
+			c.Check(delivery.State(), Equals, Dead)
+		}
+	}
+
+	c.Check(consumer.Deliveries(), HasLen, 3)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.DelayedCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 0)
+	c.Check(deadQueue.ReadyCount(), Equals, 1)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+	deadQueue.PurgeReady()
+}
+
+func (suite *QueueSuite) TestQuarantineFilter(c *C) {
+	connection := OpenConnection("quarantine-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("quarantine-q").(*redisQueue)
+	quarantineQueue := connection.OpenQueue("quarantine-bad-q").(*redisQueue)
+	queue.PurgeReady()
+	quarantineQueue.PurgeReady()
+	queue.redisClient.Del(queue.quarantinedKey)
+
+	queue.SetQuarantineFilter(func(payload []byte) bool {
+		return bytes.HasPrefix(payload, []byte("bad"))
+	}, "quarantine-bad-q")
+	c.Check(queue.Publish("bad-d1"), Equals, true)
+	c.Check(queue.Publish("good-d1"), Equals, true)
+
+	consumer := NewTestConsumer("quarantine-cons")
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("quarantine-cons", consumer)
+	time.Sleep(delayMs * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 1)
+	c.Check(consumer.LastDelivery.Payload(), Equals, "good-d1")
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(quarantineQueue.ReadyCount(), Equals, 1)
+	c.Check(queue.QuarantinedCount(), Equals, 1)
+
+	queue.SetQuarantineFilter(nil, "")
+	c.Check(queue.Publish("bad-d2"), Equals, true)
+	time.Sleep(delayMs * time.Millisecond)
+	c.Check(consumer.LastDeliveries, HasLen, 2)
+	c.Check(quarantineQueue.ReadyCount(), Equals, 1)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+	quarantineQueue.PurgeReady()
+}
+
+func (suite *QueueSuite) TestPeekReady(c *C) {
+	connection := OpenConnection("peek-ready-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("peek-ready-q").(*redisQueue)
+	queue.PurgeReady()
+
+	c.Check(queue.PeekReady(0, 10), HasLen, 0)
+	c.Check(queue.Publish("peek-ready-d1"), Equals, true)
+	c.Check(queue.PublishWithHeaders("peek-ready-d2", map[string]string{"tenant": "a"}), Equals, true)
+	c.Check(queue.Publish("peek-ready-d3"), Equals, true)
+
+	entries := queue.PeekReady(0, 2)
+	c.Assert(entries, HasLen, 2)
+	c.Check(entries[0], Equals, "peek-ready-d1")
+	payload, headers := DecodeEntry(entries[1])
+	c.Check(payload, Equals, "peek-ready-d2")
+	c.Check(headers["tenant"], Equals, "a")
+	c.Check(queue.PeekReady(2, 10), DeepEquals, []string{"peek-ready-d3"})
+	c.Check(queue.PeekReady(3, 10), HasLen, 0)
+	c.Check(queue.ReadyCount(), Equals, 3)
+
+	inspector := OpenInspector(testRedisAddr, 1)
+	c.Check(inspector.PeekReady("peek-ready-q", 2, 1), DeepEquals, []string{"peek-ready-d3"})
+
+	connection.StopHeartbeat()
+	queue.PurgeReady()
+}
+
+func (suite *QueueSuite) TestDrainTo(c *C) {
+	connection := OpenConnection("drain-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("drain-q").(*redisQueue)
+	destination := connection.OpenQueue("drain-new-q").(*redisQueue)
+	queue.PurgeReady()
+	destination.PurgeReady()
+	connection.redisClient.SRem(queuesKey, "drain-new-q")
+
+	for i := 0; i < 5; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("drain-d%d", i)), Equals, true)
+	}
+
+	moved, err := queue.DrainTo("drain-new-q", 2)
+	c.Check(err, IsNil)
+	c.Check(moved, Equals, 2)
+	c.Check(destination.PeekReady(0, 10), DeepEquals, []string{"drain-d0", "drain-d1"})
+	c.Check(connection.redisClient.SIsMember(queuesKey, "drain-new-q").Val(), Equals, true)
+
+	moved, err = queue.DrainTo("drain-new-q", 0)
+	c.Check(err, IsNil)
+	c.Check(moved, Equals, 3)
+	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(destination.ReadyCount(), Equals, 5)
+
+	moved, err = queue.DrainTo("drain-new-q", 0)
+	c.Check(err, IsNil)
+	c.Check(moved, Equals, 0)
+
+	connection.StopHeartbeat()
+	destination.PurgeReady()
+}
+
+func (suite *QueueSuite) TestDestroy(c *C) {
+	connection := OpenConnection("destroy-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("destroy-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+
+	for i := 0; i < 4; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("destroy-d%d", i)), Equals, true)
+	}
+	release := make(chan struct{})
+	defer close(release)
+	consumer := NewTestConsumer("destroy-cons")
+	consumer.Behavior = func(int, Delivery) { <-release } // blocks on the first delivery
+	queue.StartConsuming(2, time.Millisecond)
+	queue.AddConsumer("destroy-cons", consumer)
+	c.Assert(consumer.WaitForDeliveries(1, time.Second), Equals, true)
+	// one delivery being consumed and two prefetched
+	c.Assert(eventually(func() bool { return queue.ReadyCount() == 1 }), Equals, true)
+	c.Check(consumer.Deliveries(), HasLen, 1)
+	c.Check(queue.UnackedCount(), Equals, 3)
+	c.Check(consumer.Last().Reject(), Equals, true)
+
+	_, err := queue.Destroy()
+	c.Check(err, Equals, ErrConsumersActive)
+	c.Check(queue.ReadyCount(), Equals, 1)
+
+	queue.StopConsuming()
+	queue.RemoveAllConsumers()
+	counts, err := queue.Destroy()
+	c.Check(err, IsNil)
+	c.Check(counts, Equals, PurgeCounts{Ready: 1, Rejected: 1, Unacked: 2, Connections: 1})
+	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 0)
+	c.Check(connection.redisClient.SIsMember(queuesKey, "destroy-q").Val(), Equals, false)
+	c.Check(connection.redisClient.SIsMember(connection.queuesKey, "destroy-q").Val(), Equals, false)
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestExportImport(c *C) {
+	connection := OpenConnection("export-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("export-q").(*redisQueue)
+	restored := connection.OpenQueue("export-restored-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	restored.PurgeReady()
+	restored.PurgeRejected()
+
+	c.Check(queue.Publish("export-d1"), Equals, true)
+	c.Check(queue.PublishBytes([]byte("export-\x00\xff")), Equals, true)
+	c.Check(queue.PublishWithHeaders("export-d3", map[string]string{"tenant": "a"}), Equals, true)
+	queue.redisClient.LPush(queue.rejectedKey, "export-r1")
+
+	buffer := &bytes.Buffer{}
+	n, err := queue.Export(buffer, ExportReady, ExportRejected)
+	c.Check(err, IsNil)
+	c.Check(n, Equals, 4)
+	c.Check(bytes.Count(buffer.Bytes(), []byte("\n")), Equals, 4)
+	c.Check(queue.ReadyCount(), Equals, 3)
+
+	_, err = queue.Export(buffer, "unknown")
+	c.Check(err, NotNil)
+
+	n, err = restored.Import(bytes.NewReader(buffer.Bytes()))
+	c.Check(err, IsNil)
+	c.Check(n, Equals, 4)
+	c.Check(restored.PeekReady(0, 10), DeepEquals, queue.PeekReady(0, 10))
+	c.Check(restored.GetRejected(10), DeepEquals, []string{"export-r1"})
+
+	_, err = restored.Import(strings.NewReader("not json\n"))
+	c.Check(err, NotNil)
+
+	connection.StopHeartbeat()
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	restored.PurgeReady()
+	restored.PurgeRejected()
+}
+
+func (suite *QueueSuite) TestCopyQueue(c *C) {
+	connection := OpenConnection("copy-queue-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("copy-queue-q").(*redisQueue)
+	staging := connection.openQueue("copy-queue-staging-q")
+	queue.PurgeReady()
+	staging.PurgeReady()
+
+	c.Check(queue.Publish("copy-queue-d1"), Equals, true)
+	c.Check(queue.PublishWithHeaders("copy-queue-d2", map[string]string{"tenant": "a"}), Equals, true)
+
+	copied, err := connection.CopyQueue("copy-queue-q", "copy-queue-staging-q")
+	c.Check(err, IsNil)
+	c.Check(copied, Equals, int64(2))
+	c.Check(staging.PeekReady(0, 10), DeepEquals, queue.PeekReady(0, 10))
+	c.Check(queue.ReadyCount(), Equals, 2)
+	c.Check(connection.redisClient.SIsMember(queuesKey, "copy-queue-staging-q").Val(), Equals, true)
+
+	_, err = connection.CopyQueue("copy-queue-q", "copy-queue-staging-q")
+	c.Check(err, Equals, ErrQueueNotEmpty)
+	copied, err = connection.ForceCopyQueue("copy-queue-q", "copy-queue-staging-q")
+	c.Check(err, IsNil)
+	c.Check(copied, Equals, int64(2))
+	c.Check(staging.ReadyCount(), Equals, 2)
+
+	connection.StopHeartbeat()
+	queue.PurgeReady()
+	staging.PurgeReady()
+}
+
+func (suite *QueueSuite) TestDedupeReady(c *C) {
+	connection := OpenConnection("dedupe-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("dedupe-q").(*redisQueue)
+	queue.PurgeReady()
+
+	for _, payload := range []string{"dedupe-a", "dedupe-b", "dedupe-a", "dedupe-c", "dedupe-b", "dedupe-a"} {
+		c.Check(queue.Publish(payload), Equals, true)
+	}
+	removed, err := queue.DedupeReady()
+	c.Check(err, IsNil)
+	c.Check(removed, Equals, int64(3))
+	c.Check(queue.PeekReady(0, 10), DeepEquals, []string{"dedupe-a", "dedupe-b", "dedupe-c"})
+
+	// envelopes of the same payload differ by their id
+	c.Check(queue.PublishWithHeaders("dedupe-d", nil), Equals, true)
+	c.Check(queue.PublishWithHeaders("dedupe-d", nil), Equals, true)
+	removed, err = queue.DedupeReady()
+	c.Check(err, IsNil)
+	c.Check(removed, Equals, int64(0))
+	removed, err = queue.DedupeReadyPayloads()
+	c.Check(err, IsNil)
+	c.Check(removed, Equals, int64(1))
+	c.Check(queue.ReadyCount(), Equals, 4)
+	c.Check(queue.redisClient.Keys(queue.readyKey+"::*").Val(), HasLen, 0)
+
+	connection.StopHeartbeat()
+	queue.PurgeReady()
+}
+
+func (suite *QueueSuite) TestRejectWithReason(c *C) {
+	connection := OpenConnection("reason-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("reason-q").(*redisQueue)
+	queue.PurgeRejected()
+	queue.PurgeReady()
+
+	for i := 0; i < 3; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("reason-d%d", i)), Equals, true)
+	}
+
+	consumer := NewTestConsumer("reason-cons")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	name, _ := queue.AddConsumer("reason-cons", consumer)
+	time.Sleep(delayMs * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 3)
+
+	before := time.Now()
+	c.Check(consumer.LastDeliveries[0].RejectWithReason("bad input"), Equals, true)
+	c.Check(consumer.LastDeliveries[1].Reject(), Equals, true)
+	c.Check(consumer.LastDeliveries[2].RejectWithError(fmt.Errorf("timeout")), Equals, true)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 3)
+
+	rejected := queue.GetRejectedWithReasons(10)
+	c.Assert(rejected, HasLen, 3)
+	c.Check(rejected[0].Payload, Equals, "reason-d2")
+	c.Check(rejected[0].Reason, Equals, "timeout")
+	c.Check(rejected[0].RejectedAt.Before(before), Equals, false)
+	c.Check(rejected[1].Payload, Equals, "reason-d1")
+	c.Check(rejected[1].Reason, Equals, "")
+	c.Check(rejected[1].RejectedAt.IsZero(), Equals, true)
+	c.Check(rejected[2].Payload, Equals, "reason-d0")
+	c.Check(rejected[2].Reason, Equals, "bad input")
+	c.Check(rejected[2].Connection, Equals, connection.Name)
+	c.Check(rejected[2].Consumer, Equals, name)
+	c.Check(queue.GetRejectedWithReasons(1), HasLen, 1)
+
+	page := queue.ListRejected(1, 5)
+	c.Assert(page, HasLen, 2)
+	c.Check(page[0].Payload, Equals, "reason-d1")
+	c.Check(page[1].Payload, Equals, "reason-d0")
+	c.Check(queue.ListRejected(3, 5), HasLen, 0)
+	c.Check(queue.GetRejected(2), DeepEquals, []string{"reason-d2", "reason-d1"})
+	c.Check(queue.GetRejectedBytes(1), DeepEquals, [][]byte{[]byte("reason-d2")})
+	c.Check(queue.GetRejected(0), HasLen, 0)
+
+	queue.StopConsuming()
+	c.Check(queue.ReturnAllRejected(), Equals, 3)
+	c.Check(queue.redisClient.HLen(queue.reasonsKey).Val(), Equals, int64(0))
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestChecksums(c *C) {
+	connection := OpenConnection("checksum-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("checksum-q").(*redisQueue)
+	queue.Close()
+	queue.SetChecksums(true)
+
+	c.Check(queue.Publish("checksum-d0"), Equals, true)
+	c.Check(queue.Publish("checksum-d1"), Equals, true)
+
+	// corrupt the newest delivery like a bad restore would
+	corrupt := &envelope{Payload: []byte("checksum-dX"), Checksum: checksum([]byte("checksum-d1"))}
+	c.Check(queue.redisClient.LSet(queue.readyKey, 0, corrupt.encode()).Err(), IsNil)
+
+	consumer := NewTestConsumer("checksum-cons")
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("checksum-cons", consumer)
+	time.Sleep(delayMs * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 1)
+	c.Check(consumer.LastDelivery.Payload(), Equals, "checksum-d0")
+
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 1)
+	c.Check(queue.ChecksumMismatchCount(), Equals, 1)
+	rejected := queue.GetRejectedWithReasons(1)
+	c.Assert(rejected, HasLen, 1)
+	c.Check(rejected[0].Payload, Equals, "checksum-dX")
+	c.Check(rejected[0].Reason, Equals, ErrChecksumMismatch.Error())
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPushQueue(c *C) {
+	connection := OpenConnection("push", testRedisAddr, 1)
+	queue1 := connection.OpenQueue("queue1").(*redisQueue)
+	queue2 := connection.OpenQueue("queue2").(*redisQueue)
+	queue1.SetPushQueue(queue2)
+	c.Check(queue1.pushKey, Equals, queue2.readyKey)
+
+	consumer1 := NewTestConsumer("push-cons")
+	consumer1.AutoAck = false
+	consumer1.AutoFinish = false
+	queue1.StartConsuming(10, time.Millisecond)
+	queue1.AddConsumer("push-cons", consumer1)
+
+	consumer2 := NewTestConsumer("push-cons")
+	consumer2.AutoAck = false
+	consumer2.AutoFinish = false
+	queue2.StartConsuming(10, time.Millisecond)
+	queue2.AddConsumer("push-cons", consumer2)
+
+	queue1.Publish("d1")
+	time.Sleep(delayMs * time.Millisecond)
+	c.Check(queue1.UnackedCount(), Equals, 1)
+	c.Assert(consumer1.LastDeliveries, HasLen, 1)
+
+	c.Check(consumer1.LastDelivery.Push(), Equals, true)
+	time.Sleep(delayMs * time.Millisecond)
+	c.Check(queue1.UnackedCount(), Equals, 0)
+	c.Check(queue2.UnackedCount(), Equals, 1)
+
+	c.Assert(consumer2.LastDeliveries, HasLen, 1)
+	c.Check(consumer2.LastDelivery.Push(), Equals, true)
+	time.Sleep(delayMs * time.Millisecond)
+	c.Check(queue2.RejectedCount(), Equals, 1)
+}
+
+func (suite *QueueSuite) TestPushQueueCycle(c *C) {
+	connection := OpenConnection("push-cycle", testRedisAddr, 1)
+	queue1 := connection.OpenQueue("push-cycle-q1").(*redisQueue)
+	queue2 := connection.OpenQueue("push-cycle-q2").(*redisQueue)
+	queue3 := connection.OpenQueue("push-cycle-q3").(*redisQueue)
+	connection.redisClient.Del(pushQueuesKey)
+
+	c.Check(queue1.SetPushQueue(queue2), IsNil)
+	c.Check(queue2.SetPushQueue(queue3), IsNil)
+	c.Check(queue1.PushQueueName(), Equals, "push-cycle-q2")
+	c.Check(queue1.PushChain(), DeepEquals, []string{"push-cycle-q1", "push-cycle-q2", "push-cycle-q3"})
+	c.Check(queue3.PushChain(), DeepEquals, []string{"push-cycle-q3"})
+
+	c.Check(queue3.SetPushQueue(queue1), ErrorMatches, "rmq queue push queue would introduce a cycle .*")
+	c.Check(queue3.SetPushQueue(queue3), NotNil)
+	c.Check(queue3.PushQueueName(), Equals, "")
+	c.Check(queue3.PushChain(), DeepEquals, []string{"push-cycle-q3"})
+	c.Check(queue3.SetPushQueue(NewTestQueue("push-cycle-test")), NotNil)
+
+	// removed push queues and push queues of queues which don't exist anymore
+	// don't count as cycles
+	c.Check(queue2.SetPushQueue(nil), IsNil)
+	c.Check(queue2.PushQueueName(), Equals, "")
+	c.Check(queue1.PushChain(), DeepEquals, []string{"push-cycle-q1", "push-cycle-q2"})
+	c.Check(queue2.SetPushQueue(queue3), IsNil)
+	connection.redisClient.HSet(pushQueuesKey, "push-cycle-q3", "push-cycle-gone")
+	connection.redisClient.HSet(pushQueuesKey, "push-cycle-gone", "push-cycle-q1")
+	c.Check(queue1.PushChain(), DeepEquals, []string{"push-cycle-q1", "push-cycle-q2", "push-cycle-q3", "push-cycle-gone"})
+	c.Check(queue1.SetPushQueue(queue2), IsNil)
+	connection.redisClient.HDel(pushQueuesKey, "push-cycle-q3", "push-cycle-gone")
+
+	// chains configured elsewhere can only be caught while pushing
+	connection.redisClient.HSet(pushQueuesKey, "push-cycle-q3", "push-cycle-q1")
+	queue1.PurgeReady()
+	queue1.PurgeRejected()
+	queue2.PurgeReady()
+	deep := &envelope{Payload: []byte("push-cycle-d1"), Headers: map[string]string{HeaderPushCount: fmt.Sprint(maxPushDepth)}}
+	queue1.PublishBytes(deep.encode())
+
+	consumer := NewTestConsumer("push-cycle-cons")
+	consumer.AutoAck = false
+	queue1.StartConsuming(10, time.Millisecond)
+	queue1.AddConsumer("push-cycle-cons", consumer)
+	time.Sleep(delayMs * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 1)
+	c.Check(consumer.LastDelivery.Push(), Equals, false)
+	c.Check(queue1.RejectedCount(), Equals, 1)
+	c.Check(queue2.ReadyCount(), Equals, 0)
+
+	queue1.StopConsuming()
+	connection.redisClient.Del(pushQueuesKey)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPushQueueHeaders(c *C) {
+	connection := OpenConnection("push-headers", testRedisAddr, 1)
+	queue1 := connection.OpenQueue("push-headers-q1").(*redisQueue)
+	queue2 := connection.OpenQueue("push-headers-q2").(*redisQueue)
+	queue3 := connection.OpenQueue("push-headers-q3").(*redisQueue)
+	connection.redisClient.Del(pushQueuesKey)
+	for _, queue := range []*redisQueue{queue1, queue2, queue3} {
+		queue.PurgeReady()
+		queue.PurgeRejected()
+	}
+	c.Check(queue1.SetPushQueue(queue2), IsNil)
+	c.Check(queue2.SetPushQueue(queue3), IsNil)
+
+	consumers := []*TestConsumer{}
+	for _, queue := range []*redisQueue{queue1, queue2, queue3} {
+		consumer := NewTestConsumer("push-headers-cons")
+		consumer.AutoAck = false
+		queue.StartConsuming(10, time.Millisecond)
+		queue.AddConsumer("push-headers-cons", consumer)
+		consumers = append(consumers, consumer)
+	}
+
+	c.Check(queue1.PublishWithHeaders("push-headers-d1", map[string]string{"trace": "abc"}), Equals, true)
+	time.Sleep(delayMs * time.Millisecond)
+	c.Assert(consumers[0].LastDeliveries, HasLen, 1)
+	stamped := consumers[0].LastDelivery.WithHeader("worker", "host-1")
+	c.Check(stamped.Push(), Equals, true)
+
+	time.Sleep(delayMs * time.Millisecond)
+	c.Assert(consumers[1].LastDeliveries, HasLen, 1)
+	c.Check(consumers[1].LastDelivery.Push(), Equals, true)
+
+	time.Sleep(delayMs * time.Millisecond)
+	c.Assert(consumers[2].LastDeliveries, HasLen, 1)
+	delivery := consumers[2].LastDelivery
+	c.Check(delivery.Payload(), Equals, "push-headers-d1")
+	id, _ := delivery.Header(HeaderID)
+	c.Check(id, HasLen, idLength)
+	publishedAt, _ := delivery.Header(HeaderPublishedAt)
+	c.Check(delivery.Headers(), DeepEquals, map[string]string{"trace": "abc", HeaderPushCount: "2", HeaderID: id, HeaderPublishedAt: publishedAt})
+	_, ok := delivery.Header("worker")
+	c.Check(ok, Equals, false)
+
+	c.Check(delivery.Reject(), Equals, true)
+	rejected := queue3.GetRejectedWithReasons(1)
+	c.Assert(rejected, HasLen, 1)
+	c.Check(rejected[0].Payload, Equals, "push-headers-d1")
+	c.Check(rejected[0].ID, Equals, id)
+	c.Check(queue3.GetRejected(1), DeepEquals, []string{"push-headers-d1"})
+
+	for _, queue := range []*redisQueue{queue1, queue2, queue3} {
+		queue.StopConsuming()
+	}
+	connection.redisClient.Del(pushQueuesKey)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestCopyTo(c *C) {
+	connection := OpenConnection("copy-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("copy-q").(*redisQueue)
+	mirror := connection.openQueue("copy-mirror-q")
+	queue.PurgeReady()
+	mirror.PurgeReady()
+	connection.redisClient.SRem(queuesKey, "copy-mirror-q")
+
+	copies := make(chan string, 1)
+	queue.SetHooks(Hooks{OnCopy: func(delivery Delivery, queueName string) { copies <- queueName }})
+
+	consumer := NewTestConsumer("copy-cons")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("copy-cons", consumer)
+
+	c.Check(queue.PublishWithHeaders("copy-d1", map[string]string{"trace": "abc"}), Equals, true)
+	time.Sleep(delayMs * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 1)
+	c.Check(consumer.LastDelivery.CopyTo("copy-mirror-q"), IsNil)
+	c.Check(<-copies, Equals, "copy-mirror-q")
+	c.Check(queue.UnackedCount(), Equals, 1)
+	c.Check(mirror.ReadyCount(), Equals, 1)
+	c.Check(connection.redisClient.SIsMember(queuesKey, "copy-mirror-q").Val(), Equals, true)
+
+	wire := connection.redisClient.LIndex(mirror.readyKey, 0).Val()
+	copied := queue.newDelivery([]byte(wire))
+	c.Check(copied.Payload(), Equals, "copy-d1")
+	id, _ := consumer.LastDelivery.Header(HeaderID)
+	publishedAt, _ := consumer.LastDelivery.Header(HeaderPublishedAt)
+	c.Check(copied.Headers(), DeepEquals, map[string]string{"trace": "abc", HeaderCopyOf: "copy-q", HeaderID: id, HeaderPublishedAt: publishedAt})
+
+	c.Check(consumer.LastDelivery.Ack(), Equals, true)
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestDeadLetterQueue(c *C) {
+	connection := OpenConnection("dead", testRedisAddr, 1)
+	queue := connection.OpenQueue("dead-q").(*redisQueue)
+	pushQueue := connection.OpenQueue("dead-push-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	queue.SetPushQueue(pushQueue)
+
+	consumer := NewTestConsumer("dead-cons")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("dead-cons", consumer)
+
+	queue.Publish("dead-d1")
+	time.Sleep(delayMs * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 1)
+	c.Check(consumer.LastDelivery.Dead(), Equals, ErrNoDeadLetterQueue)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 1)
+
+	deadQueue := connection.OpenQueue("dead-dlq").(*redisQueue)
+	deadQueue.PurgeReady()
+	queue.SetDeadLetterQueue(deadQueue)
+	queue.Publish("dead-d2")
+	time.Sleep(delayMs * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 2)
+	c.Check(consumer.LastDelivery.Dead(), IsNil)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 1)
+	c.Check(pushQueue.ReadyCount(), Equals, 0)
+	c.Check(deadQueue.ReadyCount(), Equals, 1)
+
+	deadConsumer := NewTestConsumer("dead-dlq-cons")
+	deadQueue.StartConsuming(10, time.Millisecond)
+	deadQueue.AddConsumer("dead-dlq-cons", deadConsumer)
+	time.Sleep(delayMs * time.Millisecond)
+	c.Assert(deadConsumer.LastDeliveries, HasLen, 1)
+	c.Check(deadConsumer.LastDelivery.Payload(), Equals, "dead-d2")
+	c.Check(deadConsumer.LastDelivery.Headers()[HeaderOriginQueue], Equals, "dead-q")
+
+	queue.StopConsuming()
+	deadQueue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestConsuming(c *C) {
+	connection := OpenConnection("consume", testRedisAddr, 1)
+	queue := connection.OpenQueue("consume-q").(*redisQueue)
+
+	c.Check(queue.StopConsuming(), Equals, false)
+
+	queue.StartConsuming(10, time.Millisecond)
+	c.Check(queue.StopConsuming(), Equals, true)
+	c.Check(queue.StopConsuming(), Equals, false)
+}
+
+func (suite *QueueSuite) BenchmarkReject(c *C) {
+	connection := OpenConnection("bench-reject-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("bench-reject-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+
+	for i := 0; i < c.N; i++ {
+		queue.Publish("bench-reject-d")
+	}
+
+	consumer := NewTestConsumer("bench-reject-cons")
+	consumer.AutoAck = false
+	queue.StartConsuming(c.N, time.Millisecond)
+	queue.AddConsumer("bench-reject-cons", consumer)
+	for len(consumer.LastDeliveries) < c.N {
+		time.Sleep(delayMs * time.Millisecond)
+	}
+
+	c.ResetTimer()
+	for _, delivery := range consumer.LastDeliveries {
+		delivery.Reject()
+	}
+	c.StopTimer()
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) BenchmarkQueue(c *C) {
+	// open queue
+	connection := OpenConnection("bench-conn", testRedisAddr, 1)
+	queueName := fmt.Sprintf("bench-q%d", c.N)
+	queue := connection.OpenQueue(queueName).(*redisQueue)
+
+	// add some consumers
+	numConsumers := 10
+	var consumers []*TestConsumer
+	for i := 0; i < numConsumers; i++ {
+		consumer := NewTestConsumer("bench-A")
+		// consumer.SleepDuration = time.Microsecond
+		consumers = append(consumers, consumer)
+		queue.StartConsuming(10, time.Millisecond)
+		queue.AddConsumer("bench-cons", consumer)
+	}
+
+	// publish deliveries
+	for i := 0; i < c.N; i++ {
+		c.Check(queue.Publish("bench-d"), Equals, true)
+	}
+
+	// wait until all are consumed
+	for {
+		ready := queue.ReadyCount()
 		unacked := queue.UnackedCount()
 		fmt.Printf("%d unacked %d %d\n", c.N, ready, unacked)
 		if ready == 0 && unacked == 0 {
@@ -455,3 +1632,449 @@ func (suite *QueueSuite) BenchmarkQueue(c *C) {
 
 	connection.StopHeartbeat()
 }
+
+func (suite *QueueSuite) TestConsumerStats(c *C) {
+	connection := OpenConnection("consumer-stats-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("consumer-stats-q").(*redisQueue)
+	queue.PurgeReady()
+
+	queue.StartConsuming(10, time.Millisecond)
+	name, _ := queue.AddConsumer("consumer-stats-cons", NewTestConsumer("consumer-stats-A"))
+	queue.Publish("consumer-stats-d1")
+	queue.Publish("consumer-stats-d2")
+	time.Sleep(delayMs * time.Millisecond)
+
+	queue.publishConsumerStatsOnce()
+	stats := connection.CollectStats([]string{"consumer-stats-q"})
+	connectionStat := stats.QueueStats["consumer-stats-q"].ConnectionStats[connection.Name]
+	c.Check(connectionStat.ConsumerStats, DeepEquals, map[string]ConsumerStat{
+		name: {Processed: 2, Acked: 2},
+	})
+
+	queue.RemoveConsumer(name)
+	c.Check(queue.getConsumerStats(), HasLen, 0)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestClock(c *C) {
+	connection := OpenConnection("clock-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("clock-q").(*redisQueue)
+	c.Check(queue.clock, Equals, Clock(systemClock{}))
+
+	clock := &frozenClock{now: time.Now().Add(-time.Hour)}
+	connection.SetClock(clock)
+	queue = connection.OpenQueue("clock-q").(*redisQueue)
+	c.Check(queue.clock, Equals, Clock(clock))
+	delivery := queue.newDelivery([]byte("clock-d"))
+	c.Check(delivery.clock, Equals, Clock(clock))
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestConsumeOnce(c *C) {
+	connection := OpenConnection("sync-conn", testRedisAddr, 1)
+	connection.SetSynchronous(true)
+	queue := connection.OpenQueue("sync-q")
+	queue.PurgeReady()
+	c.Check(queue.ConsumeOnce(), Equals, 0) // not consuming
+
+	queue.StartConsuming(2, time.Millisecond)
+	consumer := NewTestConsumer("sync-A")
+	_, stopper := queue.AddConsumer("sync-cons", consumer)
+	batchConsumer := &recordingBatchConsumer{}
+	queue.AddBatchConsumer("sync-batch", 2, batchConsumer)
+	for i := 0; i < 5; i++ {
+		queue.Publish(fmt.Sprintf("sync-d%d", i))
+	}
+	c.Check(queue.ReadyCount(), Equals, 5)
+
+	// nothing happens in the background
+	time.Sleep(delayMs * time.Millisecond)
+	c.Check(queue.ReadyCount(), Equals, 5)
+	c.Check(consumer.Deliveries(), HasLen, 0)
+
+	c.Check(queue.ConsumeOnce(), Equals, 2) // the prefetch limit
+	c.Check(consumer.Deliveries(), HasLen, 1)
+	c.Check(consumer.Last().Payload(), Equals, "sync-d0")
+	c.Check(batchConsumer.lastBatch, HasLen, 1)
+	c.Check(queue.ReadyCount(), Equals, 3)
+	c.Check(queue.Counters().Acked, Equals, int64(1))
+
+	stopper <- 1
+	c.Check(queue.ConsumeOnce(), Equals, 2)
+	c.Check(batchConsumer.lastBatch, HasLen, 2)
+	c.Check(consumer.Deliveries(), HasLen, 1)
+	c.Check(queue.GetConsumers(), HasLen, 1)
+
+	queue.StopConsuming()
+	c.Check(queue.ConsumeOnce(), Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 1)
+	connection.StopHeartbeat()
+}
+
+// recordingBatchConsumer records the last batch without blocking
+type recordingBatchConsumer struct {
+	lastBatch Deliveries
+}
+
+func (consumer *recordingBatchConsumer) Consume(batch Deliveries) {
+	consumer.lastBatch = batch
+}
+
+// frozenClock is a Clock whose Now() doesn't move
+type frozenClock struct {
+	systemClock
+	now time.Time
+}
+
+func (clock *frozenClock) Now() time.Time {
+	return clock.now
+}
+
+func (suite *QueueSuite) TestCounters(c *C) {
+	connection := OpenConnection("counters-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("counters-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	connection.redisClient.Del(queue.countersKey)
+
+	queue.StartConsuming(10, time.Millisecond)
+	consumer := NewTestConsumer("counters-A")
+	consumer.AutoAck = false
+	queue.AddConsumer("counters-cons", consumer)
+	queue.Publish("counters-d1")
+	queue.Publish("counters-d2")
+	queue.Publish("counters-d3")
+	time.Sleep(delayMs * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 3)
+	consumer.LastDeliveries[0].Ack()
+	consumer.LastDeliveries[1].Reject()
+	consumer.LastDeliveries[2].Push() // rejected, the queue has no push queue
+
+	expected := QueueCounters{Published: 3, Acked: 1, Rejected: 2}
+	c.Check(queue.Counters(), Equals, expected) // pending
+	queue.cumulative.flushPending()
+	c.Check(queue.cumulative.pendingCounts(), Equals, QueueCounters{})
+	c.Check(queue.Counters(), Equals, expected)
+	stats := connection.CollectStats([]string{"counters-q"})
+	c.Check(stats.QueueStats["counters-q"].Counters, Equals, expected)
+
+	connection.SetCounters(false)
+	uncounted := connection.OpenQueue("counters-q").(*redisQueue)
+	c.Check(uncounted.cumulative, IsNil)
+	uncounted.Publish("counters-d4")
+	c.Check(uncounted.Counters(), Equals, expected)
+
+	queue.Publish("counters-d5") // pending
+	previous, err := queue.ResetCounters()
+	c.Check(err, IsNil)
+	expected.Published++
+	c.Check(previous, Equals, expected)
+	c.Check(queue.Counters(), Equals, QueueCounters{})
+
+	queue.Publish("counters-d6")
+	queue.cumulative.flushPending()
+	all, err := connection.ResetAllCounters("counters-")
+	c.Check(err, IsNil)
+	c.Check(all["counters-q"], Equals, QueueCounters{Published: 1})
+	c.Check(queue.Counters(), Equals, QueueCounters{})
+
+	// queues opened again share the counters
+	connection.SetCounters(true)
+	reopened := connection.OpenQueue("counters-q").(*redisQueue)
+	c.Check(reopened.cumulative, Equals, queue.cumulative)
+
+	queue.SetDeadLetterQueue(connection.OpenQueue("counters-dead-q"))
+	queue.Publish("counters-d7")
+	time.Sleep(delayMs * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 7)
+	c.Check(consumer.LastDelivery.Dead(), IsNil)
+	c.Check(queue.Counters(), Equals, QueueCounters{Published: 1, Dead: 1})
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func TestNextConsumeBackoff(t *testing.T) {
+	backoff := time.Duration(0)
+	for _, expected := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond} {
+		if backoff = nextConsumeBackoff(backoff, 100*time.Millisecond); backoff != expected {
+			t.Errorf("expected backoff %s, got %s", expected, backoff)
+		}
+	}
+	if backoff = nextConsumeBackoff(8*time.Second, 100*time.Millisecond); backoff != maxConsumeBackoff {
+		t.Errorf("expected max backoff, got %s", backoff)
+	}
+	if backoff = nextConsumeBackoff(0, 0); backoff != time.Millisecond {
+		t.Errorf("expected 1ms backoff without poll duration, got %s", backoff)
+	}
+}
+
+func (suite *QueueSuite) TestPositionalCommands(c *C) {
+	for _, positional := range []bool{false, true} {
+		comment := Commentf("positional %t", positional)
+		connection := OpenConnection("positional-conn", testRedisAddr, 1)
+		connection.setPositional(positional)
+		queue := connection.OpenQueue("positional-q").(*redisQueue)
+		c.Check(queue.positional, Equals, positional, comment)
+		queue.PurgeReady()
+		queue.PurgeRejected()
+		queue.PublishBytes([]byte("positional-dup"))
+		queue.PublishBytes([]byte("positional-mid"))
+		queue.PublishBytes([]byte("positional-dup"))
+
+		queue.StartConsuming(3, time.Millisecond)
+		consumer := NewTestConsumer("positional-A")
+		consumer.AutoAck = false
+		queue.AddConsumer("positional-cons", consumer)
+		time.Sleep(delayMs * time.Millisecond)
+		c.Assert(consumer.Deliveries(), HasLen, 3, comment)
+
+		c.Check(consumer.Deliveries()[0].Ack(), Equals, true, comment)
+		if positional {
+			// the duplicate consumed first got removed
+			c.Check(queue.PeekUnacked(3), DeepEquals, []string{"positional-dup", "positional-mid"}, comment)
+		} else {
+			c.Check(queue.PeekUnacked(3), DeepEquals, []string{"positional-mid", "positional-dup"}, comment)
+		}
+		c.Check(consumer.Deliveries()[1].Reject(), Equals, true, comment)
+		c.Check(queue.RejectedCount(), Equals, 1, comment)
+		c.Check(consumer.Deliveries()[2].Ack(), Equals, true, comment)
+		c.Check(queue.UnackedCount(), Equals, 0, comment)
+
+		queue.StopConsuming()
+		connection.StopHeartbeat()
+	}
+}
+
+func (suite *QueueSuite) TestScriptRegistry(c *C) {
+	redisClient := redis.NewClient(&redis.Options{Addr: testRedisAddr, DB: 1})
+	connection := OpenConnectionWithRedisCmdable("scripts-conn", redisClient)
+	c.Check(scriptsOf(redisClient), Equals, scriptsOf(redisClient))
+	queue := connection.OpenQueue("scripts-q").(*redisQueue)
+	var mutex sync.Mutex
+	ran := []string{}
+	connection.SetScriptHook(func(name string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		ran = append(ran, name)
+	})
+
+	c.Check(connection.backend.push(queue.unackedKey, "scripts-d1", "scripts-d2"), IsNil)
+	c.Check(queue.newDelivery([]byte("scripts-d1")).Ack(), Equals, true) // loads the script
+	c.Check(scriptsOf(redisClient).isLoaded(removeUnackedScript.pick(queue.positional)), Equals, true)
+	c.Check(redisClient.ScriptFlush().Err(), IsNil)                      // like after a restart
+	c.Check(queue.newDelivery([]byte("scripts-d2")).Ack(), Equals, true) // falls back to EVAL
+
+	mutex.Lock()
+	c.Check(ran, DeepEquals, []string{"removeUnacked", "removeUnacked"})
+	mutex.Unlock()
+	connection.SetScriptHook(nil)
+
+	script := removeUnackedScript.pick(queue.positional)
+	c.Check(script.Load(redisClient).Val(), Equals, script.hash)
+	connection.StopHeartbeat()
+	c.Check(scriptsOf(redisClient), IsNil) // dropped with the last connection
+}
+
+func (suite *QueueSuite) TestSharedPoller(c *C) {
+	connection := OpenConnection("shared-conn", testRedisAddr, 1)
+	connection.SetSharedPoller(time.Millisecond)
+	queue1 := connection.OpenQueue("shared-q1")
+	queue2 := connection.OpenQueue("shared-q2")
+	queue1.PurgeReady()
+	queue2.PurgeReady()
+	for i := 0; i < 4; i++ {
+		queue1.Publish(fmt.Sprintf("shared-d%d", i))
+	}
+	queue2.Publish("shared-e0")
+
+	// the first consumer keeps its deliveries, the prefetch limit leaves one
+	// more in the buffer
+	queue1.StartConsuming(1, time.Hour)
+	queue2.StartConsuming(1, time.Hour)
+	consumer1 := NewTestConsumer("shared-A")
+	consumer1.AutoFinish = false
+	queue1.AddConsumer("shared-cons1", consumer1)
+	consumer2 := NewTestConsumer("shared-B")
+	queue2.AddConsumer("shared-cons2", consumer2)
+	time.Sleep(delayMs * time.Millisecond)
+	c.Check(consumer1.Deliveries(), HasLen, 1)
+	c.Check(consumer2.Deliveries(), HasLen, 1)
+	c.Check(queue1.ReadyCount(), Equals, 2)
+
+	queue1.StopConsuming()
+	consumer1.Finish()
+	queue2.Publish("shared-e1")
+	time.Sleep(delayMs * time.Millisecond)
+	c.Check(consumer2.Deliveries(), HasLen, 2)
+	c.Check(consumer2.Last().Payload(), Equals, "shared-e1")
+
+	queue2.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestAckCoalescing(c *C) {
+	connection := OpenConnection("coalesce-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("coalesce-q")
+	queue.PurgeReady()
+	var mutex sync.Mutex
+	failed := map[string]error{}
+	queue.SetHooks(Hooks{OnAckFailed: func(delivery Delivery, err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		failed[delivery.Payload()] = err
+	}})
+	queue.SetAckCoalescing(time.Hour) // flushed by hand only
+	for i := 0; i < 3; i++ {
+		queue.Publish(fmt.Sprintf("coalesce-d%d", i))
+	}
+
+	queue.StartConsuming(10, time.Millisecond)
+	consumer := NewTestConsumer("coalesce-A")
+	consumer.AutoAck = false
+	queue.AddConsumer("coalesce-cons", consumer)
+	c.Assert(consumer.WaitForDeliveries(3, time.Second), Equals, true)
+	for _, delivery := range consumer.Deliveries() {
+		c.Check(delivery.Ack(), Equals, true)
+		c.Check(delivery.State(), Equals, Acked)
+	}
+	c.Check(queue.UnackedCount(), Equals, 3) // still buffered
+	c.Check(queue.FlushAcks(), IsNil)
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	// acks of deliveries which aren't unacked anymore fail on flush
+	queue.Publish("coalesce-gone")
+	c.Assert(consumer.WaitForDeliveries(4, time.Second), Equals, true)
+	_, err := queue.PurgeUnacked()
+	c.Check(err, IsNil)
+	gone := consumer.Last()
+	c.Check(gone.Ack(), Equals, true)
+	c.Check(queue.FlushAcks(), IsNil)
+	c.Check(gone.State(), Equals, Unacked)
+	mutex.Lock()
+	c.Check(failed, DeepEquals, map[string]error{"coalesce-gone": ErrDeliveryNotFound})
+	mutex.Unlock()
+
+	// without coalescing acks are removed right away again
+	queue.SetAckCoalescing(0)
+	queue.Publish("coalesce-direct")
+	c.Assert(consumer.WaitForDeliveries(5, time.Second), Equals, true)
+	c.Check(consumer.Last().Ack(), Equals, true)
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestStopAllConsuming(c *C) {
+	connection := OpenConnection("shutdown-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("shutdown-q")
+	queue.PurgeReady()
+	for i := 0; i < 3; i++ {
+		queue.Publish(fmt.Sprintf("shutdown-d%d", i))
+	}
+	queue.StartConsuming(5, time.Millisecond)
+	consumer := NewTestConsumer("shutdown-A")
+	consumer.AutoAck = false
+	consumer.AutoFinish = false
+	queue.AddConsumer("shutdown-cons", consumer)
+	c.Assert(consumer.WaitForDeliveries(1, time.Second), Equals, true)
+	time.Sleep(delayMs * time.Millisecond) // prefetches the others
+
+	ctx, cancel := context.WithTimeout(context.Background(), delayMs*time.Millisecond)
+	defer cancel()
+	report, err := connection.StopAllConsuming(ctx)
+	c.Check(errors.Is(err, context.DeadlineExceeded), Equals, true)
+	c.Check(report.Returned, Equals, 2)
+	c.Check(report.Consuming, Equals, 1)
+	c.Check(report.Unacked, DeepEquals, map[string]int{"shutdown-q": 1})
+	c.Check(queue.ReadyCount(), Equals, 2)
+	c.Check(connection.Check(), Equals, false)
+	c.Check(hasConnection(connection), Equals, true) // left for the cleaner
+	consumer.Finish()
+
+	connection = OpenConnection("shutdown-conn2", testRedisAddr, 1)
+	queue = connection.OpenQueue("shutdown-q")
+	queue.StartConsuming(5, time.Millisecond)
+	queue.AddConsumer("shutdown-cons2", NewTestConsumer("shutdown-B"))
+	time.Sleep(delayMs * time.Millisecond)
+	report, err = connection.StopAllConsuming(context.Background())
+	c.Check(err, IsNil)
+	c.Check(report.Unacked, HasLen, 0)
+	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(hasConnection(connection), Equals, false)
+}
+
+// eventually returns whether condition became true within a second
+func eventually(condition func() bool) bool {
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+func hasConnection(connection *RedisConnection) bool {
+	for _, name := range connection.GetConnections() {
+		if name == connection.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func (suite *QueueSuite) TestRunner(c *C) {
+	connection := OpenConnection("runner-conn", testRedisAddr, 1)
+	consumer := NewTestConsumer("runner-A")
+	ctx, cancel := context.WithCancel(context.Background())
+	setup := func(connection Connection) error {
+		queue := connection.OpenQueue("runner-q")
+		queue.PurgeReady()
+		queue.StartConsuming(5, time.Millisecond)
+		queue.AddConsumer("runner-cons", consumer)
+		queue.Publish("runner-d1")
+		return nil
+	}
+
+	done := make(chan error)
+	go func() { done <- Runner{GracePeriod: time.Second}.Run(ctx, connection, setup) }()
+	c.Check(consumer.WaitForDeliveries(1, time.Second), Equals, true)
+	cancel()
+	c.Check(<-done, IsNil)
+	c.Check(hasConnection(connection), Equals, false)
+
+	// a failing setup still shuts the connection down
+	connection = OpenConnection("runner-conn2", testRedisAddr, 1)
+	setupErr := errors.New("runner-setup-failed")
+	err := Runner{}.Run(context.Background(), connection, func(Connection) error { return setupErr })
+	c.Check(errors.Is(err, setupErr), Equals, true)
+	c.Check(connection.Check(), Equals, false)
+}
+
+func (suite *QueueSuite) TestConsumingErrors(c *C) {
+	connection := OpenConnection("errors-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("errors-q")
+	c.Check(queue.StopConsumingErr(), Equals, ErrNotConsuming)
+	c.Check(queue.StartConsumingErr(10, time.Millisecond), IsNil)
+	c.Check(queue.StartConsumingErr(10, time.Millisecond), Equals, ErrAlreadyConsuming)
+	c.Check(queue.StopConsumingErr(), IsNil)
+	c.Check(queue.StopConsumingErr(), Equals, ErrNotConsuming)
+
+	connection.StopHeartbeat()
+	other := connection.OpenQueue("errors-other")
+	c.Check(other.StartConsumingErr(10, time.Millisecond), Equals, ErrNotConnected)
+
+	connection.redisClient.Set("errors-string", "x", 0)
+	_, err := connection.backend.count("errors-string")
+	var redisErr *RedisError
+	c.Assert(errors.As(err, &redisErr), Equals, true)
+	c.Check(redisErr.Command, Equals, "LLEN")
+	c.Check(redisErr.Key, Equals, "errors-string")
+	c.Check(IsRetryable(err), Equals, false)
+	connection.redisClient.Del("errors-string")
+}
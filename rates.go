@@ -0,0 +1,120 @@
+package rmq
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// QueueRate holds per second rates of a queue between two stats snapshots
+type QueueRate struct {
+	Publish       float64 `json:"publish"`        // deliveries added to ready, estimated from ready changes and consumed deliveries
+	Consume       float64 `json:"consume"`        // deliveries processed by consumers
+	Reject        float64 `json:"reject"`         // deliveries rejected by consumers
+	BacklogGrowth float64 `json:"backlog_growth"` // change of the ready count, negative while draining
+}
+
+// StatsRates are the rates of queues by queue name
+type StatsRates map[string]QueueRate
+
+// DiffFrom returns the rates of all queues in both stats and previous, which
+// was collected elapsed before stats. Consume and reject rates are based on
+// consumer stats, so they count consumers which appeared in between but not
+// ones which disappeared
+func (stats Stats) DiffFrom(previous Stats, elapsed time.Duration) StatsRates {
+	rates := StatsRates{}
+	seconds := elapsed.Seconds()
+	if seconds <= 0 {
+		return rates
+	}
+
+	for queueName, queueStat := range stats.QueueStats {
+		previousStat, ok := previous.QueueStats[queueName]
+		if !ok {
+			continue
+		}
+
+		consumed, rejected := consumedSince(queueStat, previousStat)
+		readyDelta := float64(queueStat.ReadyCount - previousStat.ReadyCount)
+		published := readyDelta + float64(consumed)
+		if published < 0 {
+			published = 0 // ready deliveries were purged or moved
+		}
+		rates[queueName] = QueueRate{
+			Publish:       published / seconds,
+			Consume:       float64(consumed) / seconds,
+			Reject:        float64(rejected) / seconds,
+			BacklogGrowth: readyDelta / seconds,
+		}
+	}
+	return rates
+}
+
+// consumedSince returns how many deliveries the consumers of the queue
+// processed and rejected since previous
+func consumedSince(queueStat, previous QueueStat) (consumed, rejected int64) {
+	for connectionName, connectionStat := range queueStat.ConnectionStats {
+		previousConsumers := previous.ConnectionStats[connectionName].ConsumerStats
+		for consumerName, consumerStat := range connectionStat.ConsumerStats {
+			previousStat := previousConsumers[consumerName] // zero for new consumers
+			if consumerStat.Processed >= previousStat.Processed {
+				consumed += consumerStat.Processed - previousStat.Processed
+			}
+			if consumerStat.Rejected >= previousStat.Rejected {
+				rejected += consumerStat.Rejected - previousStat.Rejected
+			}
+		}
+	}
+	return consumed, rejected
+}
+
+// RateTracker collects stats and computes rates since its previous collection
+type RateTracker struct {
+	connection Connection
+
+	mutex       sync.Mutex
+	previous    Stats
+	collectedAt time.Time // zero before the first collection
+}
+
+// NewRateTracker returns a tracker collecting stats from the connection
+func NewRateTracker(connection Connection) *RateTracker {
+	return &RateTracker{connection: connection}
+}
+
+// CollectStats collects the stats of the given queues and returns them along
+// with their rates since the previous call. Rates are nil on the first call
+func (tracker *RateTracker) CollectStats(queueList []string) (Stats, StatsRates) {
+	return tracker.record(tracker.connection.CollectStats(queueList))
+}
+
+// CollectStatsCtx is like CollectStats, but bounded by ctx like
+// connection.CollectStatsCtx(). Incomplete stats get no rates and aren't
+// used for the rates of the next call
+func (tracker *RateTracker) CollectStatsCtx(ctx context.Context, queueList []string) (Stats, StatsRates, error) {
+	stats, err := tracker.connection.CollectStatsCtx(ctx, queueList)
+	if err != nil {
+		return stats, nil, err
+	}
+	stats, rates := tracker.record(stats)
+	return stats, rates, nil
+}
+
+// record computes the rates of stats since the previous collection and
+// remembers them for the next one
+func (tracker *RateTracker) record(stats Stats) (Stats, StatsRates) {
+	now := time.Now()
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	var rates StatsRates
+	if !tracker.collectedAt.IsZero() {
+		rates = stats.DiffFrom(tracker.previous, now.Sub(tracker.collectedAt))
+	}
+	// copy the queue stats so callers can modify the returned stats
+	tracker.previous, tracker.collectedAt = Stats{QueueStats: QueueStats{}}, now
+	for queueName, queueStat := range stats.QueueStats {
+		tracker.previous.QueueStats[queueName] = queueStat
+	}
+	return stats, rates
+}
@@ -0,0 +1,40 @@
+package rmq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatsDiffFrom(t *testing.T) {
+	consumerStats := func(processed, rejected int64) map[string]ConsumerStat {
+		return map[string]ConsumerStat{"cons": {Processed: processed, Rejected: rejected}}
+	}
+
+	previous := NewStats()
+	previousStat := NewQueueStat(100, 0)
+	previousStat.ConnectionStats["conn1"] = ConnectionStat{ConsumerStats: consumerStats(10, 1)}
+	previousStat.ConnectionStats["gone"] = ConnectionStat{ConsumerStats: consumerStats(50, 5)}
+	previous.QueueStats["q1"] = previousStat
+	previous.QueueStats["removed"] = NewQueueStat(5, 0)
+
+	stats := NewStats()
+	queueStat := NewQueueStat(80, 3)
+	queueStat.ConnectionStats["conn1"] = ConnectionStat{ConsumerStats: consumerStats(40, 3)}
+	queueStat.ConnectionStats["new"] = ConnectionStat{ConsumerStats: consumerStats(10, 0)}
+	stats.QueueStats["q1"] = queueStat
+	stats.QueueStats["added"] = NewQueueStat(5, 0)
+
+	rates := stats.DiffFrom(previous, 10*time.Second)
+	if len(rates) != 1 {
+		t.Fatalf("expected rates of queues in both stats only, got %v", rates)
+	}
+	// 40 consumed, ready went down by 20, so 20 were published
+	expected := QueueRate{Publish: 2, Consume: 4, Reject: 0.2, BacklogGrowth: -2}
+	if rates["q1"] != expected {
+		t.Errorf("expected %+v, got %+v", expected, rates["q1"])
+	}
+
+	if rates := stats.DiffFrom(previous, 0); len(rates) != 0 {
+		t.Errorf("expected no rates without elapsed time, got %v", rates)
+	}
+}
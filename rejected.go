@@ -0,0 +1,63 @@
+package rmq
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// RejectedDelivery is a delivery in the rejected list of a queue along with
+// the reason it was rejected for. Reason, RejectedAt, Connection and Consumer
+// are empty if the delivery was rejected without a reason.
+type RejectedDelivery struct {
+	Payload    string
+	ID         string // see HeaderID, empty if the delivery has no envelope
+	Reason     string
+	RejectedAt time.Time
+	Attempts   int    // number of times the delivery was redelivered before it got rejected with a reason
+	Connection string // name of the connection which rejected the delivery
+	Consumer   string // name of the consumer which rejected the delivery, if known
+}
+
+// rejection is the value stored in the reasons hash of a queue
+type rejection struct {
+	Reason     string    `json:"reason"`
+	RejectedAt time.Time `json:"rejected_at"`
+	Connection string    `json:"connection,omitempty"`
+	Consumer   string    `json:"consumer,omitempty"`
+	Attempts   int       `json:"attempts,omitempty"` // moved from the attempts hash on rejection
+}
+
+// newRejectedDelivery builds a RejectedDelivery from a wire payload and the
+// raw values of the reasons and attempts hashes (nil if not present)
+func newRejectedDelivery(wire string, rawRejection, rawAttempts interface{}) RejectedDelivery {
+	rejected := RejectedDelivery{Payload: wire}
+	if decoded, ok := decodeEnvelope([]byte(wire)); ok {
+		rejected.Payload = string(decoded.Payload)
+		rejected.ID = decoded.Headers[HeaderID]
+	}
+
+	if value, ok := rawRejection.(string); ok {
+		var r rejection
+		if err := json.Unmarshal([]byte(value), &r); err == nil {
+			rejected.Reason = r.Reason
+			rejected.RejectedAt = r.RejectedAt
+			rejected.Connection = r.Connection
+			rejected.Consumer = r.Consumer
+			rejected.Attempts = r.Attempts
+		}
+	}
+
+	if value, ok := rawAttempts.(string); ok {
+		rejected.Attempts, _ = strconv.Atoi(value)
+	}
+
+	return rejected
+}
+
+func errorReason(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,59 @@
+package rmq
+
+import (
+	"math"
+	"time"
+)
+
+// promoteScript moves up to ARGV[2] delayed deliveries which are due at
+// ARGV[1] to ready and returns how many it moved. Being a script it's safe to
+// run from any number of processes at once
+var promoteScript = newScript("promote", `
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, payload in ipairs(due) do
+	redis.call('ZREM', KEYS[1], payload)
+	redis.call('LPUSH', KEYS[2], payload)
+end
+return #due
+`)
+
+// RetryPolicy makes rejected deliveries get retried after a delay instead of
+// being moved to the rejected list, see queue.SetRetryPolicy()
+type RetryPolicy struct {
+	InitialDelay time.Duration // delay before the first retry
+	Multiplier   float64       // factor the delay grows by with each retry, values below 1 are treated as 1
+	MaxDelay     time.Duration // upper bound of the delay, zero for none
+	MaxAttempts  int           // number of retries after which deliveries get dead lettered, zero for no limit
+}
+
+// delay returns the delay before the retry after the given number of retries
+func (policy *RetryPolicy) delay(retries int) time.Duration {
+	multiplier := policy.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	delay := float64(policy.InitialDelay) * math.Pow(multiplier, float64(retries))
+	if policy.MaxDelay > 0 && delay > float64(policy.MaxDelay) {
+		return policy.MaxDelay
+	}
+	return time.Duration(delay)
+}
+
+// exhausted returns true if a delivery which was retried the given number of
+// times shouldn't be retried again
+func (policy *RetryPolicy) exhausted(retries int) bool {
+	return policy.MaxAttempts > 0 && retries >= policy.MaxAttempts
+}
+
+// promoteInterval returns how often due retries are moved back to ready
+func (policy *RetryPolicy) promoteInterval() time.Duration {
+	interval := policy.InitialDelay / 2
+	if interval > maxReapInterval {
+		return maxReapInterval
+	}
+	if interval < time.Millisecond {
+		return time.Millisecond
+	}
+	return interval
+}
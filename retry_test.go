@@ -0,0 +1,26 @@
+package rmq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := &RetryPolicy{InitialDelay: time.Second, Multiplier: 2, MaxDelay: 5 * time.Second, MaxAttempts: 4}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}
+	for retries, delay := range expected {
+		if got := policy.delay(retries); got != delay {
+			t.Errorf("delay(%d) = %s, expected %s", retries, got, delay)
+		}
+	}
+
+	if policy.exhausted(3) || !policy.exhausted(4) {
+		t.Error("policy should be exhausted after 4 retries")
+	}
+	if (&RetryPolicy{InitialDelay: time.Second}).delay(3) != time.Second {
+		t.Error("delay should not grow without multiplier")
+	}
+	if (&RetryPolicy{}).exhausted(100) {
+		t.Error("policy without max attempts should never be exhausted")
+	}
+}
@@ -0,0 +1,163 @@
+// Package rmqprom exports rmq queue stats as Prometheus metrics
+package rmqprom
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ryanleary/rmq"
+)
+
+const (
+	defaultTimeout       = 5 * time.Second
+	defaultCacheInterval = 10 * time.Second
+)
+
+var errTimeout = errors.New("rmq stats collection timed out")
+
+var (
+	readyDesc = prometheus.NewDesc("rmq_ready_messages",
+		"Number of ready deliveries in the queue.", []string{"queue"}, nil)
+	rejectedDesc = prometheus.NewDesc("rmq_rejected_messages",
+		"Number of rejected deliveries in the queue.", []string{"queue"}, nil)
+	unackedDesc = prometheus.NewDesc("rmq_unacked_messages",
+		"Number of unacked deliveries of the queue in the connection.", []string{"queue", "connection"}, nil)
+	consumersDesc = prometheus.NewDesc("rmq_consumers",
+		"Number of consumers of the queue in the connection.", []string{"queue", "connection"}, nil)
+	aliveDesc = prometheus.NewDesc("rmq_connection_alive",
+		"1 if the connection has a heartbeat, 0 otherwise.", []string{"connection"}, nil)
+	scrapeErrorDesc = prometheus.NewDesc("rmq_scrape_error",
+		"1 if the last collection of rmq stats failed or timed out, 0 otherwise.", nil, nil)
+)
+
+// Collector is a prometheus.Collector which collects the stats of all open
+// queues of a connection on scrape. Stats are cached for the cache interval
+// and collecting them is given up after the timeout, so a slow Redis can't
+// hang scrapes
+type Collector struct {
+	connection    rmq.Connection
+	timeout       time.Duration
+	cacheInterval time.Duration
+
+	mutex       sync.Mutex
+	stats       rmq.Stats
+	collectedAt time.Time     // zero if stats were never collected successfully
+	err         error         // of the last collection
+	done        chan struct{} // closed when the running collection is done, nil if none is running
+}
+
+// NewCollector returns a collector of the stats of the given connection
+func NewCollector(connection rmq.Connection) *Collector {
+	return &Collector{
+		connection:    connection,
+		timeout:       defaultTimeout,
+		cacheInterval: defaultCacheInterval,
+	}
+}
+
+// SetTimeout sets how long a scrape waits for stats to be collected before
+// reporting a scrape error. A collection which times out keeps running in
+// the background and is used by later scrapes once it's done
+func (collector *Collector) SetTimeout(timeout time.Duration) {
+	collector.timeout = timeout
+}
+
+// SetCacheInterval sets how long collected stats are reused by scrapes
+// before they get collected again
+func (collector *Collector) SetCacheInterval(cacheInterval time.Duration) {
+	collector.cacheInterval = cacheInterval
+}
+
+// Describe implements prometheus.Collector
+func (collector *Collector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- readyDesc
+	descs <- rejectedDesc
+	descs <- unackedDesc
+	descs <- consumersDesc
+	descs <- aliveDesc
+	descs <- scrapeErrorDesc
+}
+
+// Collect implements prometheus.Collector
+func (collector *Collector) Collect(metrics chan<- prometheus.Metric) {
+	stats, err := collector.currentStats()
+	if err != nil {
+		metrics <- prometheus.MustNewConstMetric(scrapeErrorDesc, prometheus.GaugeValue, 1)
+		return
+	}
+	metrics <- prometheus.MustNewConstMetric(scrapeErrorDesc, prometheus.GaugeValue, 0)
+
+	for queueName, queueStat := range stats.QueueStats {
+		metrics <- prometheus.MustNewConstMetric(readyDesc, prometheus.GaugeValue, float64(queueStat.ReadyCount), queueName)
+		metrics <- prometheus.MustNewConstMetric(rejectedDesc, prometheus.GaugeValue, float64(queueStat.RejectedCount), queueName)
+		for connectionName, connectionStat := range queueStat.ConnectionStats {
+			metrics <- prometheus.MustNewConstMetric(unackedDesc, prometheus.GaugeValue, float64(connectionStat.UnackedCount), queueName, connectionName)
+			metrics <- prometheus.MustNewConstMetric(consumersDesc, prometheus.GaugeValue, float64(len(connectionStat.Consumers)), queueName, connectionName)
+		}
+	}
+	for connectionName, active := range stats.Connections() {
+		alive := 0.0
+		if active {
+			alive = 1
+		}
+		metrics <- prometheus.MustNewConstMetric(aliveDesc, prometheus.GaugeValue, alive, connectionName)
+	}
+}
+
+// currentStats returns the cached stats if they are recent enough. Otherwise
+// it waits up to the timeout for a collection, starting one unless one is
+// running already
+func (collector *Collector) currentStats() (rmq.Stats, error) {
+	collector.mutex.Lock()
+	if !collector.collectedAt.IsZero() && time.Since(collector.collectedAt) < collector.cacheInterval {
+		defer collector.mutex.Unlock()
+		return collector.stats, nil
+	}
+	if collector.done == nil {
+		collector.done = make(chan struct{})
+		go collector.collect(collector.done)
+	}
+	done := collector.done
+	collector.mutex.Unlock()
+
+	timer := time.NewTimer(collector.timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		return rmq.Stats{}, errTimeout
+	}
+
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	return collector.stats, collector.err
+}
+
+// collect collects stats, stores the result and closes done
+func (collector *Collector) collect(done chan struct{}) {
+	stats, err := collectStats(collector.connection)
+
+	collector.mutex.Lock()
+	collector.err = err
+	if err == nil {
+		collector.stats = stats
+		collector.collectedAt = time.Now()
+	}
+	collector.done = nil
+	collector.mutex.Unlock()
+	close(done)
+}
+
+// collectStats collects the stats of all open queues of the connection,
+// returning the panics rmq raises on Redis errors as errors
+func collectStats(connection rmq.Connection) (stats rmq.Stats, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("rmq stats collection failed: %v", r)
+		}
+	}()
+	return connection.CollectStats(connection.GetOpenQueues()), nil
+}
@@ -0,0 +1,86 @@
+package rmqprom
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ryanleary/rmq"
+)
+
+type statsConnection struct {
+	rmq.TestConnection
+	collect func() rmq.Stats
+	calls   int
+}
+
+func (connection *statsConnection) CollectStats(queueList []string) rmq.Stats {
+	connection.calls++
+	return connection.collect()
+}
+
+func collectMetrics(collector *Collector) map[*prometheus.Desc]int {
+	metrics := make(chan prometheus.Metric, 100)
+	collector.Collect(metrics)
+	close(metrics)
+
+	counts := map[*prometheus.Desc]int{}
+	for metric := range metrics {
+		counts[metric.Desc()]++
+	}
+	return counts
+}
+
+func TestCollect(t *testing.T) {
+	connection := &statsConnection{TestConnection: rmq.NewTestConnection(), collect: func() rmq.Stats {
+		stats := rmq.NewStats()
+		queueStat := rmq.NewQueueStat(2, 1)
+		queueStat.ConnectionStats["conn1"] = rmq.ConnectionStat{Active: true, UnackedCount: 3, Consumers: []string{"c1"}}
+		stats.QueueStats["q1"] = queueStat
+		return stats
+	}}
+	collector := NewCollector(connection)
+
+	counts := collectMetrics(collector)
+	expected := map[*prometheus.Desc]int{
+		scrapeErrorDesc: 1, readyDesc: 1, rejectedDesc: 1, unackedDesc: 1, consumersDesc: 1, aliveDesc: 1,
+	}
+	for desc, count := range expected {
+		if counts[desc] != count {
+			t.Errorf("expected %d metrics of %v, got %d", count, desc, counts[desc])
+		}
+	}
+
+	collectMetrics(collector)
+	if connection.calls != 1 {
+		t.Errorf("expected cached stats, collected %d times", connection.calls)
+	}
+}
+
+func TestCollectError(t *testing.T) {
+	release := make(chan struct{})
+	slow := &statsConnection{TestConnection: rmq.NewTestConnection(), collect: func() rmq.Stats {
+		<-release
+		return rmq.NewStats()
+	}}
+	collector := NewCollector(slow)
+	collector.SetTimeout(10 * time.Millisecond)
+
+	start := time.Now()
+	counts := collectMetrics(collector)
+	if time.Since(start) > time.Second {
+		t.Errorf("collect didn't time out")
+	}
+	if counts[scrapeErrorDesc] != 1 || len(counts) != 1 {
+		t.Errorf("expected only a scrape error, got %v", counts)
+	}
+	close(release)
+
+	failing := &statsConnection{TestConnection: rmq.NewTestConnection(), collect: func() rmq.Stats {
+		panic("redis down")
+	}}
+	counts = collectMetrics(NewCollector(failing))
+	if counts[scrapeErrorDesc] != 1 || len(counts) != 1 {
+		t.Errorf("expected only a scrape error, got %v", counts)
+	}
+}
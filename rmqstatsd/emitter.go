@@ -0,0 +1,158 @@
+// Package rmqstatsd emits rmq queue stats as StatsD gauges
+package rmqstatsd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ryanleary/rmq"
+)
+
+const (
+	defaultMetricPrefix = "rmq."
+	maxPacketSize       = 1432 // fits into an Ethernet frame with IP and UDP headers
+)
+
+// Emitter collects the stats of queues every interval and sends their ready,
+// rejected and unacked counts and the consumer counts of their connections as
+// StatsD gauges. Tags are sent in the DogStatsD format
+type Emitter struct {
+	connection   rmq.Connection
+	address      string
+	interval     time.Duration
+	queues       []string // nil to emit all open queues
+	queuePrefix  string
+	metricPrefix string
+	tags         []string
+	errors       int64 // accessed atomically
+}
+
+// NewEmitter returns an emitter sending the stats of all open queues of the
+// connection to the StatsD server at address (host:port) every interval
+func NewEmitter(connection rmq.Connection, address string, interval time.Duration) *Emitter {
+	return &Emitter{
+		connection:   connection,
+		address:      address,
+		interval:     interval,
+		metricPrefix: defaultMetricPrefix,
+	}
+}
+
+// SetQueues sets the queues to emit instead of all open queues
+func (emitter *Emitter) SetQueues(queues []string) {
+	emitter.queues = queues
+}
+
+// SetQueuePrefix only emits queues whose names start with prefix
+func (emitter *Emitter) SetQueuePrefix(prefix string) {
+	emitter.queuePrefix = prefix
+}
+
+// SetMetricPrefix sets the prefix of the metric names, "rmq." by default
+func (emitter *Emitter) SetMetricPrefix(prefix string) {
+	emitter.metricPrefix = prefix
+}
+
+// SetTags sets tags like "env:prod" sent along with every metric
+func (emitter *Emitter) SetTags(tags ...string) {
+	emitter.tags = tags
+}
+
+// Errors returns the number of failed stats collections and sends so far.
+// They aren't logged, so a missing StatsD server doesn't flood the log
+func (emitter *Emitter) Errors() int64 {
+	return atomic.LoadInt64(&emitter.errors)
+}
+
+// Run emits stats every interval until ctx is done. It only returns an error
+// if the address can't be resolved
+func (emitter *Emitter) Run(ctx context.Context) error {
+	conn, err := net.Dial("udp", emitter.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ticker := time.NewTicker(emitter.interval)
+	defer ticker.Stop()
+	for {
+		emitter.emit(conn)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// emit collects the stats and sends them in as few packets as possible
+func (emitter *Emitter) emit(conn net.Conn) {
+	stats, err := emitter.collectStats()
+	if err != nil {
+		atomic.AddInt64(&emitter.errors, 1)
+		return
+	}
+
+	var packet bytes.Buffer
+	send := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		if _, err := conn.Write(packet.Bytes()); err != nil {
+			atomic.AddInt64(&emitter.errors, 1)
+		}
+		packet.Reset()
+	}
+	for _, line := range emitter.lines(stats) {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > maxPacketSize {
+			send()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	send()
+}
+
+// lines returns the gauge lines of the stats
+func (emitter *Emitter) lines(stats rmq.Stats) []string {
+	var lines []string
+	gauge := func(name string, value int, tags ...string) {
+		tags = append(tags, emitter.tags...)
+		lines = append(lines, fmt.Sprintf("%s%s:%d|g|#%s", emitter.metricPrefix, name, value, strings.Join(tags, ",")))
+	}
+	for queueName, queueStat := range stats.QueueStats {
+		if !strings.HasPrefix(queueName, emitter.queuePrefix) {
+			continue
+		}
+		queueTag := "queue:" + queueName
+		gauge("queue.ready", queueStat.ReadyCount, queueTag)
+		gauge("queue.rejected", queueStat.RejectedCount, queueTag)
+		gauge("queue.unacked", queueStat.UnackedCount(), queueTag)
+		for connectionName, connectionStat := range queueStat.ConnectionStats {
+			gauge("connection.consumers", len(connectionStat.Consumers), queueTag, "connection:"+connectionName)
+		}
+	}
+	return lines
+}
+
+// collectStats collects the stats of the emitted queues, returning the panics
+// rmq raises on Redis errors as errors
+func (emitter *Emitter) collectStats() (stats rmq.Stats, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("rmq stats collection failed: %v", r)
+		}
+	}()
+	queues := emitter.queues
+	if queues == nil {
+		queues = emitter.connection.GetOpenQueues()
+	}
+	return emitter.connection.CollectStats(queues), nil
+}
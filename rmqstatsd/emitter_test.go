@@ -0,0 +1,72 @@
+package rmqstatsd
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ryanleary/rmq"
+)
+
+type statsConnection struct {
+	rmq.TestConnection
+}
+
+func (connection *statsConnection) GetOpenQueues() []string {
+	return []string{"q1", "other"}
+}
+
+func (connection *statsConnection) CollectStats(queueList []string) rmq.Stats {
+	stats := rmq.NewStats()
+	for _, queueName := range queueList {
+		queueStat := rmq.NewQueueStat(2, 1)
+		queueStat.ConnectionStats["conn1"] = rmq.ConnectionStat{UnackedCount: 3, Consumers: []string{"c1", "c2"}}
+		stats.QueueStats[queueName] = queueStat
+	}
+	return stats
+}
+
+func TestEmitter(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	emitter := NewEmitter(&statsConnection{rmq.NewTestConnection()}, server.LocalAddr().String(), time.Hour)
+	emitter.SetQueuePrefix("q")
+	emitter.SetMetricPrefix("test.")
+	emitter.SetTags("env:test")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- emitter.Run(ctx) }()
+
+	buffer := make([]byte, maxPacketSize)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := server.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(buffer[:n]), "\n")
+	sort.Strings(lines)
+	expected := []string{
+		"test.connection.consumers:2|g|#queue:q1,connection:conn1,env:test",
+		"test.queue.ready:2|g|#queue:q1,env:test",
+		"test.queue.rejected:1|g|#queue:q1,env:test",
+		"test.queue.unacked:3|g|#queue:q1,env:test",
+	}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("expected Run to return nil on cancel, got %v", err)
+	}
+	if emitter.Errors() != 0 {
+		t.Errorf("expected no errors, got %d", emitter.Errors())
+	}
+}
@@ -0,0 +1,172 @@
+package rmqtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ryanleary/rmq"
+)
+
+const (
+	maxPeek          = 1000 // max number of payloads of a queue the assertions look at
+	maxListed        = 10   // max number of payloads listed in failure messages
+	maxListedLength  = 200  // max length of payloads listed in failure messages
+	truncationSuffix = "…"
+)
+
+// Matcher matches published payloads, see AssertPublished()
+type Matcher interface {
+	Match(payload string) bool
+	String() string // describes the matched payloads in failure messages
+}
+
+type funcMatcher struct {
+	description string
+	match       func(payload string) bool
+}
+
+func (matcher funcMatcher) Match(payload string) bool {
+	return matcher.match(payload)
+}
+
+func (matcher funcMatcher) String() string {
+	return matcher.description
+}
+
+// MatchFunc returns a matcher of the payloads for which match returns true
+func MatchFunc(description string, match func(payload string) bool) Matcher {
+	return funcMatcher{description: description, match: match}
+}
+
+// Exact returns a matcher of the given payload
+func Exact(payload string) Matcher {
+	return MatchFunc(fmt.Sprintf("payload %q", payload), func(published string) bool {
+		return published == payload
+	})
+}
+
+// Contains returns a matcher of payloads containing substring
+func Contains(substring string) Matcher {
+	return MatchFunc(fmt.Sprintf("payload containing %q", substring), func(published string) bool {
+		return strings.Contains(published, substring)
+	})
+}
+
+// JSONSubset returns a matcher of JSON payloads containing the given JSON:
+// Objects match if they have all fields of subset with matching values,
+// arrays if they have the same length and matching elements, other values if
+// they are equal. It panics if subset isn't valid JSON
+func JSONSubset(subset string) Matcher {
+	var expected interface{}
+	if err := json.Unmarshal([]byte(subset), &expected); err != nil {
+		panic(fmt.Sprintf("rmqtest: invalid JSON subset %q: %s", subset, err))
+	}
+	return MatchFunc(fmt.Sprintf("JSON payload containing %s", subset), func(published string) bool {
+		var actual interface{}
+		if err := json.Unmarshal([]byte(published), &actual); err != nil {
+			return false
+		}
+		return jsonContains(actual, expected)
+	})
+}
+
+func jsonContains(actual, expected interface{}) bool {
+	switch expected := expected.(type) {
+	case map[string]interface{}:
+		actual, ok := actual.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for key, value := range expected {
+			if actualValue, ok := actual[key]; !ok || !jsonContains(actualValue, value) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		actual, ok := actual.([]interface{})
+		if !ok || len(actual) != len(expected) {
+			return false
+		}
+		for i := range expected {
+			if !jsonContains(actual[i], expected[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(actual, expected)
+}
+
+// AssertPublished fails the test unless a payload published to the queue
+// matches. For a rmq.TestQueue these are all payloads published since its
+// last Reset(), for other queues the ready ones. Returns true if one matched
+func AssertPublished(t testing.TB, queue rmq.Queue, matcher Matcher) bool {
+	t.Helper()
+	payloads := Published(queue)
+	for _, payload := range payloads {
+		if matcher.Match(payload) {
+			return true
+		}
+	}
+	t.Errorf("rmqtest: no %s published to %s, got %s", matcher, queue, listPayloads(payloads))
+	return false
+}
+
+// AssertPublishedJSON is like AssertPublished, matching payloads which can be
+// unmarshalled into a T for which match returns true
+func AssertPublishedJSON[T any](t testing.TB, queue rmq.Queue, match func(v T) bool) bool {
+	t.Helper()
+	var zero T
+	matcher := MatchFunc(fmt.Sprintf("matching %T payload", zero), func(payload string) bool {
+		var v T
+		if err := json.Unmarshal([]byte(payload), &v); err != nil {
+			return false
+		}
+		return match(v)
+	})
+	return AssertPublished(t, queue, matcher)
+}
+
+// AssertNothingPublished fails the test if any payload was published to the
+// queue, see AssertPublished(). Returns true if none was
+func AssertNothingPublished(t testing.TB, queue rmq.Queue) bool {
+	t.Helper()
+	if payloads := Published(queue); len(payloads) > 0 {
+		t.Errorf("rmqtest: expected nothing published to %s, got %s", queue, listPayloads(payloads))
+		return false
+	}
+	return true
+}
+
+// Published returns the payloads the assertions check, see AssertPublished()
+func Published(queue rmq.Queue) []string {
+	if testQueue, ok := queue.(*rmq.TestQueue); ok {
+		return testQueue.LastDeliveries
+	}
+	return queue.PeekReady(0, maxPeek)
+}
+
+// listPayloads formats up to maxListed payloads, truncated to
+// maxListedLength, for failure messages
+func listPayloads(payloads []string) string {
+	if len(payloads) == 0 {
+		return "no payloads"
+	}
+
+	listed := make([]string, 0, maxListed+1)
+	for i, payload := range payloads {
+		if i == maxListed {
+			listed = append(listed, fmt.Sprintf("and %d more", len(payloads)-maxListed))
+			break
+		}
+		if len(payload) > maxListedLength {
+			payload = payload[:maxListedLength] + truncationSuffix
+		}
+		listed = append(listed, fmt.Sprintf("%q", payload))
+	}
+	return fmt.Sprintf("%d payloads: %s", len(payloads), strings.Join(listed, ", "))
+}
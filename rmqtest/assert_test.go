@@ -0,0 +1,75 @@
+package rmqtest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ryanleary/rmq"
+)
+
+// recorder records the failures of assertions instead of failing the test
+type recorder struct {
+	testing.TB
+	failures []string
+}
+
+func (recorder *recorder) Helper() {}
+
+func (recorder *recorder) Errorf(format string, args ...interface{}) {
+	recorder.failures = append(recorder.failures, fmt.Sprintf(format, args...))
+}
+
+type event struct {
+	Kind string `json:"kind"`
+	ID   int    `json:"id"`
+}
+
+func TestAssertPublished(t *testing.T) {
+	queue := rmq.NewTestQueue("events")
+	queue.Publish(`{"kind":"created","id":1,"tags":["a","b"]}`)
+	queue.Publish("plain")
+
+	r := &recorder{TB: t}
+	if !AssertPublished(r, queue, Exact("plain")) ||
+		!AssertPublished(r, queue, Contains("lai")) ||
+		!AssertPublished(r, queue, JSONSubset(`{"kind":"created","tags":["a","b"]}`)) ||
+		!AssertPublishedJSON(r, queue, func(e event) bool { return e.ID == 1 }) {
+		t.Errorf("expected assertions to pass, got %v", r.failures)
+	}
+
+	if AssertPublished(r, queue, JSONSubset(`{"tags":["a"]}`)) {
+		t.Error("expected arrays of different lengths not to match")
+	}
+	if AssertPublishedJSON(r, queue, func(e event) bool { return e.ID == 2 }) {
+		t.Error("expected no event with id 2")
+	}
+	if AssertNothingPublished(r, queue) {
+		t.Error("expected payloads")
+	}
+	if len(r.failures) != 3 {
+		t.Fatalf("expected 3 failures, got %v", r.failures)
+	}
+	if !strings.Contains(r.failures[0], `2 payloads: "{\"kind\":\"created\"`) || !strings.Contains(r.failures[0], `"plain"`) {
+		t.Errorf("expected failure to list the payloads, got %s", r.failures[0])
+	}
+
+	queue.Reset()
+	if !AssertNothingPublished(r, queue) {
+		t.Errorf("expected nothing published, got %v", r.failures)
+	}
+}
+
+func TestListPayloads(t *testing.T) {
+	payloads := []string{strings.Repeat("x", maxListedLength+1)}
+	for i := 0; i < maxListed; i++ {
+		payloads = append(payloads, "p")
+	}
+	listed := listPayloads(payloads)
+	if !strings.Contains(listed, strings.Repeat("x", maxListedLength)+truncationSuffix) {
+		t.Errorf("expected truncated payload, got %s", listed)
+	}
+	if !strings.HasSuffix(listed, "and 1 more") {
+		t.Errorf("expected remaining payloads to be counted, got %s", listed)
+	}
+}
@@ -0,0 +1,188 @@
+// Package rmqtest contains helpers for tests of code using rmq
+package rmqtest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ryanleary/rmq"
+)
+
+// FakeClock is an rmq.Clock which only moves when Advance() is called, set
+// it with connection.SetClock(). Sleeps, timers and tickers fire once the
+// clock was advanced past their time
+type FakeClock struct {
+	mutex   sync.Mutex
+	waiting *sync.Cond // broadcast whenever a waiter is added, see BlockUntil()
+	now     time.Time
+	waiters []*waiter
+}
+
+var _ rmq.Clock = (*FakeClock)(nil)
+
+// waiter is a pending sleep, timer or ticker of a FakeClock
+type waiter struct {
+	at       time.Time
+	ch       chan time.Time // nil for AfterFunc
+	fn       func()
+	interval time.Duration // zero unless it's a ticker
+}
+
+// NewFakeClock returns a clock starting at now
+func NewFakeClock(now time.Time) *FakeClock {
+	clock := &FakeClock{now: now}
+	clock.waiting = sync.NewCond(&clock.mutex)
+	return clock
+}
+
+func (clock *FakeClock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return clock.now
+}
+
+// Sleep blocks until the clock got advanced by d
+func (clock *FakeClock) Sleep(d time.Duration) {
+	<-clock.After(d)
+}
+
+func (clock *FakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	clock.add(&waiter{ch: ch}, d)
+	return ch
+}
+
+func (clock *FakeClock) AfterFunc(d time.Duration, f func()) rmq.Timer {
+	w := &waiter{fn: f}
+	clock.add(w, d)
+	return &fakeTimer{clock: clock, waiter: w}
+}
+
+// NewTicker returns a ticker which ticks each time the clock got advanced by
+// another d. Like time.Ticker it drops ticks if they aren't received
+func (clock *FakeClock) NewTicker(d time.Duration) rmq.Ticker {
+	if d <= 0 {
+		panic("rmqtest: non-positive interval for FakeClock.NewTicker")
+	}
+	w := &waiter{ch: make(chan time.Time, 1), interval: d}
+	clock.add(w, d)
+	return &fakeTicker{clock: clock, waiter: w}
+}
+
+// Advance moves the clock forward by d and fires all sleeps, timers and
+// tickers due until then in order
+func (clock *FakeClock) Advance(d time.Duration) {
+	clock.mutex.Lock()
+	end := clock.now.Add(d)
+	for {
+		w := clock.nextDue(end)
+		if w == nil {
+			break
+		}
+		clock.now = w.at
+		if w.interval > 0 {
+			w.at = w.at.Add(w.interval)
+		} else {
+			clock.remove(w)
+		}
+		clock.fire(w)
+	}
+	clock.now = end
+	clock.mutex.Unlock()
+}
+
+// BlockUntil blocks until at least n sleeps, timers or tickers are waiting
+// for the clock, so a test can advance it once the code under test sleeps
+func (clock *FakeClock) BlockUntil(n int) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	for len(clock.waiters) < n {
+		clock.waiting.Wait()
+	}
+}
+
+// Waiters returns the number of sleeps, timers and tickers waiting for the
+// clock
+func (clock *FakeClock) Waiters() int {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return len(clock.waiters)
+}
+
+// add registers the waiter to fire after d, right away if d isn't positive
+func (clock *FakeClock) add(w *waiter, d time.Duration) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	w.at = clock.now.Add(d)
+	if d <= 0 && w.interval == 0 {
+		clock.fire(w)
+		return
+	}
+	clock.waiters = append(clock.waiters, w)
+	clock.waiting.Broadcast()
+}
+
+// nextDue returns the earliest waiter due at end, nil if there's none. The
+// caller must hold the mutex
+func (clock *FakeClock) nextDue(end time.Time) *waiter {
+	sort.SliceStable(clock.waiters, func(i, j int) bool {
+		return clock.waiters[i].at.Before(clock.waiters[j].at)
+	})
+	if len(clock.waiters) == 0 || clock.waiters[0].at.After(end) {
+		return nil
+	}
+	return clock.waiters[0]
+}
+
+// remove removes the waiter and returns true if it was waiting. The caller
+// must hold the mutex
+func (clock *FakeClock) remove(w *waiter) bool {
+	for i, other := range clock.waiters {
+		if other == w {
+			clock.waiters = append(clock.waiters[:i], clock.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// fire sends the current time to the waiter or calls its function in a new
+// goroutine like time.AfterFunc does. The caller must hold the mutex
+func (clock *FakeClock) fire(w *waiter) {
+	if w.fn != nil {
+		go w.fn()
+		return
+	}
+	select {
+	case w.ch <- clock.now:
+	default: // the previous tick wasn't received yet
+	}
+}
+
+type fakeTimer struct {
+	clock  *FakeClock
+	waiter *waiter
+}
+
+// Stop stops the timer and returns true if it didn't fire yet
+func (timer *fakeTimer) Stop() bool {
+	timer.clock.mutex.Lock()
+	defer timer.clock.mutex.Unlock()
+	return timer.clock.remove(timer.waiter)
+}
+
+type fakeTicker struct {
+	clock  *FakeClock
+	waiter *waiter
+}
+
+func (ticker *fakeTicker) C() <-chan time.Time {
+	return ticker.waiter.ch
+}
+
+func (ticker *fakeTicker) Stop() {
+	ticker.clock.mutex.Lock()
+	defer ticker.clock.mutex.Unlock()
+	ticker.clock.remove(ticker.waiter)
+}
@@ -0,0 +1,57 @@
+package rmqtest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	clock := NewFakeClock(start)
+
+	slept := make(chan time.Time)
+	go func() {
+		clock.Sleep(time.Second)
+		slept <- clock.Now()
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(500 * time.Millisecond)
+	select {
+	case <-slept:
+		t.Fatal("expected sleep to continue")
+	default:
+	}
+	clock.Advance(500 * time.Millisecond)
+	if now := <-slept; !now.Equal(start.Add(time.Second)) {
+		t.Errorf("unexpected time after sleep %s", now)
+	}
+
+	ticker := clock.NewTicker(time.Minute)
+	fired := make(chan struct{}, 1)
+	timer := clock.AfterFunc(90*time.Second, func() { fired <- struct{}{} })
+	clock.Advance(time.Minute)
+	if tick := <-ticker.C(); !tick.Equal(start.Add(time.Second + time.Minute)) {
+		t.Errorf("unexpected tick %s", tick)
+	}
+	clock.Advance(time.Minute)
+	<-fired
+	if timer.Stop() {
+		t.Error("expected fired timer not to stop")
+	}
+	<-ticker.C()
+	ticker.Stop()
+	if waiters := clock.Waiters(); waiters != 0 {
+		t.Errorf("expected no waiters, got %d", waiters)
+	}
+
+	stopped := clock.AfterFunc(time.Second, func() { t.Error("expected stopped timer not to fire") })
+	if !stopped.Stop() {
+		t.Error("expected timer to stop")
+	}
+	clock.Advance(time.Second)
+	select {
+	case <-clock.After(0):
+	default:
+		t.Error("expected After(0) to fire right away")
+	}
+}
@@ -0,0 +1,409 @@
+package rmqtest
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/redis.v5"
+)
+
+// ErrInjected is the error returned by commands failed by a FaultyClient,
+// unless another error was given
+var ErrInjected = errors.New("rmqtest: injected redis error")
+
+// FaultyClient is a redis.Cmdable delegating to another client, which tests
+// can tell to fail commands, to slow them down or to be down for a while. Pass
+// it to rmq.OpenConnectionWithRedisCmdable(). Commands are named by their
+// lower case Redis name like "lpush", a Pipelined() call counts as one
+// "pipeline" command and scripts run as "evalsha" (and "eval" if the script
+// wasn't loaded yet). Commands of the wrapped client which aren't used by rmq
+// aren't affected. It's safe for concurrent use
+type FaultyClient struct {
+	redis.Cmdable
+
+	mutex     sync.Mutex
+	failing   map[string]error // by command name
+	every     int              // fail every nth command, zero to disable
+	everyErr  error
+	latency   time.Duration
+	down      bool
+	downUntil time.Time // zero if down until Up() is called
+	calls     map[string]int
+	total     int
+}
+
+// NewFaultyClient returns a client delegating to client without any faults
+func NewFaultyClient(client redis.Cmdable) *FaultyClient {
+	return &FaultyClient{
+		Cmdable: client,
+		failing: map[string]error{},
+		calls:   map[string]int{},
+	}
+}
+
+// Fail makes all further calls of the command fail with err, ErrInjected if
+// err is nil, until Heal() is called
+func (client *FaultyClient) Fail(command string, err error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.failing[strings.ToLower(command)] = orInjected(err)
+}
+
+// FailEvery fails every nth command with err, ErrInjected if err is nil.
+// Pass 0 to stop
+func (client *FaultyClient) FailEvery(n int, err error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.every = n
+	client.everyErr = orInjected(err)
+}
+
+// SetLatency delays each command by latency
+func (client *FaultyClient) SetLatency(latency time.Duration) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.latency = latency
+}
+
+// Down fails all commands with ErrInjected for the duration, until Up() is
+// called if duration isn't positive
+func (client *FaultyClient) Down(duration time.Duration) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.down = true
+	client.downUntil = time.Time{}
+	if duration > 0 {
+		client.downUntil = time.Now().Add(duration)
+	}
+}
+
+// Up ends a Down() window early
+func (client *FaultyClient) Up() {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.down = false
+}
+
+// Heal removes all faults and the latency
+func (client *FaultyClient) Heal() {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.failing = map[string]error{}
+	client.every = 0
+	client.latency = 0
+	client.down = false
+}
+
+// Calls returns how often the command was called, failed calls included
+func (client *FaultyClient) Calls(command string) int {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.calls[strings.ToLower(command)]
+}
+
+// fault counts a call of the command, sleeps for the latency and returns the
+// error the call should fail with, nil if it should be delegated
+func (client *FaultyClient) fault(command string) error {
+	client.mutex.Lock()
+	client.calls[command]++
+	client.total++
+	latency := client.latency
+	err := client.failing[command]
+	if client.down && !client.downUntil.IsZero() && !time.Now().Before(client.downUntil) {
+		client.down = false
+	}
+	if client.down {
+		err = ErrInjected
+	}
+	if err == nil && client.every > 0 && client.total%client.every == 0 {
+		err = client.everyErr
+	}
+	client.mutex.Unlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	return err
+}
+
+func orInjected(err error) error {
+	if err == nil {
+		return ErrInjected
+	}
+	return err
+}
+
+func (client *FaultyClient) Pipelined(fn func(*redis.Pipeline) error) ([]redis.Cmder, error) {
+	if err := client.fault("pipeline"); err != nil {
+		return nil, err
+	}
+	return client.Cmdable.Pipelined(fn)
+}
+
+func (client *FaultyClient) Del(keys ...string) *redis.IntCmd {
+	if err := client.fault("del"); err != nil {
+		return redis.NewIntResult(0, err)
+	}
+	return client.Cmdable.Del(keys...)
+}
+
+func (client *FaultyClient) Exists(key string) *redis.BoolCmd {
+	if err := client.fault("exists"); err != nil {
+		return redis.NewBoolResult(false, err)
+	}
+	return client.Cmdable.Exists(key)
+}
+
+func (client *FaultyClient) Expire(key string, expiration time.Duration) *redis.BoolCmd {
+	if err := client.fault("expire"); err != nil {
+		return redis.NewBoolResult(false, err)
+	}
+	return client.Cmdable.Expire(key, expiration)
+}
+
+func (client *FaultyClient) Keys(pattern string) *redis.StringSliceCmd {
+	if err := client.fault("keys"); err != nil {
+		return redis.NewStringSliceResult(nil, err)
+	}
+	return client.Cmdable.Keys(pattern)
+}
+
+func (client *FaultyClient) TTL(key string) *redis.DurationCmd {
+	if err := client.fault("ttl"); err != nil {
+		return redis.NewDurationResult(0, err)
+	}
+	return client.Cmdable.TTL(key)
+}
+
+func (client *FaultyClient) Get(key string) *redis.StringCmd {
+	if err := client.fault("get"); err != nil {
+		return redis.NewStringResult("", err)
+	}
+	return client.Cmdable.Get(key)
+}
+
+func (client *FaultyClient) Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
+	if err := client.fault("set"); err != nil {
+		return redis.NewStatusResult("", err)
+	}
+	return client.Cmdable.Set(key, value, expiration)
+}
+
+func (client *FaultyClient) SetNX(key string, value interface{}, expiration time.Duration) *redis.BoolCmd {
+	if err := client.fault("setnx"); err != nil {
+		return redis.NewBoolResult(false, err)
+	}
+	return client.Cmdable.SetNX(key, value, expiration)
+}
+
+func (client *FaultyClient) Incr(key string) *redis.IntCmd {
+	if err := client.fault("incr"); err != nil {
+		return redis.NewIntResult(0, err)
+	}
+	return client.Cmdable.Incr(key)
+}
+
+func (client *FaultyClient) HDel(key string, fields ...string) *redis.IntCmd {
+	if err := client.fault("hdel"); err != nil {
+		return redis.NewIntResult(0, err)
+	}
+	return client.Cmdable.HDel(key, fields...)
+}
+
+func (client *FaultyClient) HExists(key, field string) *redis.BoolCmd {
+	if err := client.fault("hexists"); err != nil {
+		return redis.NewBoolResult(false, err)
+	}
+	return client.Cmdable.HExists(key, field)
+}
+
+func (client *FaultyClient) HGet(key, field string) *redis.StringCmd {
+	if err := client.fault("hget"); err != nil {
+		return redis.NewStringResult("", err)
+	}
+	return client.Cmdable.HGet(key, field)
+}
+
+func (client *FaultyClient) HGetAll(key string) *redis.StringStringMapCmd {
+	if err := client.fault("hgetall"); err != nil {
+		return redis.NewStringStringMapResult(nil, err)
+	}
+	return client.Cmdable.HGetAll(key)
+}
+
+func (client *FaultyClient) HIncrBy(key, field string, incr int64) *redis.IntCmd {
+	if err := client.fault("hincrby"); err != nil {
+		return redis.NewIntResult(0, err)
+	}
+	return client.Cmdable.HIncrBy(key, field, incr)
+}
+
+func (client *FaultyClient) HLen(key string) *redis.IntCmd {
+	if err := client.fault("hlen"); err != nil {
+		return redis.NewIntResult(0, err)
+	}
+	return client.Cmdable.HLen(key)
+}
+
+func (client *FaultyClient) HMGet(key string, fields ...string) *redis.SliceCmd {
+	if err := client.fault("hmget"); err != nil {
+		return redis.NewSliceResult(nil, err)
+	}
+	return client.Cmdable.HMGet(key, fields...)
+}
+
+func (client *FaultyClient) HSet(key, field string, value interface{}) *redis.BoolCmd {
+	if err := client.fault("hset"); err != nil {
+		return redis.NewBoolResult(false, err)
+	}
+	return client.Cmdable.HSet(key, field, value)
+}
+
+func (client *FaultyClient) HSetNX(key, field string, value interface{}) *redis.BoolCmd {
+	if err := client.fault("hsetnx"); err != nil {
+		return redis.NewBoolResult(false, err)
+	}
+	return client.Cmdable.HSetNX(key, field, value)
+}
+
+func (client *FaultyClient) LIndex(key string, index int64) *redis.StringCmd {
+	if err := client.fault("lindex"); err != nil {
+		return redis.NewStringResult("", err)
+	}
+	return client.Cmdable.LIndex(key, index)
+}
+
+func (client *FaultyClient) LLen(key string) *redis.IntCmd {
+	if err := client.fault("llen"); err != nil {
+		return redis.NewIntResult(0, err)
+	}
+	return client.Cmdable.LLen(key)
+}
+
+func (client *FaultyClient) LPush(key string, values ...interface{}) *redis.IntCmd {
+	if err := client.fault("lpush"); err != nil {
+		return redis.NewIntResult(0, err)
+	}
+	return client.Cmdable.LPush(key, values...)
+}
+
+func (client *FaultyClient) LRange(key string, start, stop int64) *redis.StringSliceCmd {
+	if err := client.fault("lrange"); err != nil {
+		return redis.NewStringSliceResult(nil, err)
+	}
+	return client.Cmdable.LRange(key, start, stop)
+}
+
+func (client *FaultyClient) LRem(key string, count int64, value interface{}) *redis.IntCmd {
+	if err := client.fault("lrem"); err != nil {
+		return redis.NewIntResult(0, err)
+	}
+	return client.Cmdable.LRem(key, count, value)
+}
+
+func (client *FaultyClient) LSet(key string, index int64, value interface{}) *redis.StatusCmd {
+	if err := client.fault("lset"); err != nil {
+		return redis.NewStatusResult("", err)
+	}
+	return client.Cmdable.LSet(key, index, value)
+}
+
+func (client *FaultyClient) RPopLPush(source, destination string) *redis.StringCmd {
+	if err := client.fault("rpoplpush"); err != nil {
+		return redis.NewStringResult("", err)
+	}
+	return client.Cmdable.RPopLPush(source, destination)
+}
+
+func (client *FaultyClient) RPush(key string, values ...interface{}) *redis.IntCmd {
+	if err := client.fault("rpush"); err != nil {
+		return redis.NewIntResult(0, err)
+	}
+	return client.Cmdable.RPush(key, values...)
+}
+
+func (client *FaultyClient) SAdd(key string, members ...interface{}) *redis.IntCmd {
+	if err := client.fault("sadd"); err != nil {
+		return redis.NewIntResult(0, err)
+	}
+	return client.Cmdable.SAdd(key, members...)
+}
+
+func (client *FaultyClient) SCard(key string) *redis.IntCmd {
+	if err := client.fault("scard"); err != nil {
+		return redis.NewIntResult(0, err)
+	}
+	return client.Cmdable.SCard(key)
+}
+
+func (client *FaultyClient) SIsMember(key string, member interface{}) *redis.BoolCmd {
+	if err := client.fault("sismember"); err != nil {
+		return redis.NewBoolResult(false, err)
+	}
+	return client.Cmdable.SIsMember(key, member)
+}
+
+func (client *FaultyClient) SMembers(key string) *redis.StringSliceCmd {
+	if err := client.fault("smembers"); err != nil {
+		return redis.NewStringSliceResult(nil, err)
+	}
+	return client.Cmdable.SMembers(key)
+}
+
+func (client *FaultyClient) SRem(key string, members ...interface{}) *redis.IntCmd {
+	if err := client.fault("srem"); err != nil {
+		return redis.NewIntResult(0, err)
+	}
+	return client.Cmdable.SRem(key, members...)
+}
+
+func (client *FaultyClient) ZAdd(key string, members ...redis.Z) *redis.IntCmd {
+	if err := client.fault("zadd"); err != nil {
+		return redis.NewIntResult(0, err)
+	}
+	return client.Cmdable.ZAdd(key, members...)
+}
+
+func (client *FaultyClient) ZCard(key string) *redis.IntCmd {
+	if err := client.fault("zcard"); err != nil {
+		return redis.NewIntResult(0, err)
+	}
+	return client.Cmdable.ZCard(key)
+}
+
+func (client *FaultyClient) ZRangeWithScores(key string, start, stop int64) *redis.ZSliceCmd {
+	if err := client.fault("zrange"); err != nil {
+		return redis.NewZSliceCmdResult(nil, err)
+	}
+	return client.Cmdable.ZRangeWithScores(key, start, stop)
+}
+
+func (client *FaultyClient) ZRangeByScore(key string, opt redis.ZRangeBy) *redis.StringSliceCmd {
+	if err := client.fault("zrangebyscore"); err != nil {
+		return redis.NewStringSliceResult(nil, err)
+	}
+	return client.Cmdable.ZRangeByScore(key, opt)
+}
+
+func (client *FaultyClient) ZRem(key string, members ...interface{}) *redis.IntCmd {
+	if err := client.fault("zrem"); err != nil {
+		return redis.NewIntResult(0, err)
+	}
+	return client.Cmdable.ZRem(key, members...)
+}
+
+func (client *FaultyClient) Eval(script string, keys []string, args ...interface{}) *redis.Cmd {
+	if err := client.fault("eval"); err != nil {
+		return redis.NewCmdResult(nil, err)
+	}
+	return client.Cmdable.Eval(script, keys, args...)
+}
+
+func (client *FaultyClient) EvalSha(sha1 string, keys []string, args ...interface{}) *redis.Cmd {
+	if err := client.fault("evalsha"); err != nil {
+		return redis.NewCmdResult(nil, err)
+	}
+	return client.Cmdable.EvalSha(sha1, keys, args...)
+}
@@ -0,0 +1,139 @@
+package rmqtest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ryanleary/rmq"
+	"gopkg.in/redis.v5"
+)
+
+func TestFaultyClient(t *testing.T) {
+	server := StartMiniredis(t)
+	client := NewFaultyClient(redis.NewClient(&redis.Options{Addr: server.Addr()}))
+
+	if err := client.Set("faulty-k", "v", 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	failure := errors.New("get failed")
+	client.Fail("GET", failure)
+	if err := client.Get("faulty-k").Err(); err != failure {
+		t.Errorf("expected get to fail, got %v", err)
+	}
+	if err := client.Exists("faulty-k").Err(); err != nil {
+		t.Errorf("expected exists to work, got %v", err)
+	}
+	if calls := client.Calls("get"); calls != 1 {
+		t.Errorf("expected 1 get call, got %d", calls)
+	}
+
+	client.Heal()
+	client.FailEvery(2, nil)
+	failed := 0
+	for i := 0; i < 4; i++ {
+		if client.Get("faulty-k").Err() == ErrInjected {
+			failed++
+		}
+	}
+	if failed != 2 {
+		t.Errorf("expected every 2nd call to fail, %d of 4 failed", failed)
+	}
+
+	client.Heal()
+	client.Down(20 * time.Millisecond)
+	if _, err := client.Pipelined(func(pipe *redis.Pipeline) error { return nil }); err != ErrInjected {
+		t.Errorf("expected pipeline to fail while down, got %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if err := client.Get("faulty-k").Err(); err != nil {
+		t.Errorf("expected client to be up again, got %v", err)
+	}
+}
+
+func TestFaultyConsumeBackoff(t *testing.T) {
+	server := StartMiniredis(t)
+	client := NewFaultyClient(redis.NewClient(&redis.Options{Addr: server.Addr()}))
+	connection := rmq.OpenConnectionWithRedisCmdable("faulty-conn", client)
+	t.Cleanup(func() { connection.StopHeartbeat() })
+
+	var mutex sync.Mutex
+	var consumeErrors []time.Time
+	queue := connection.OpenQueue("faulty-q")
+	queue.SetHooks(rmq.Hooks{OnConsumeError: func(queueName string, err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		consumeErrors = append(consumeErrors, time.Now())
+	}})
+	if err := queue.StartConsumingErr(10, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	consumer := rmq.NewTestConsumer("faulty-A")
+	consumer.AutoAck = false
+	queue.AddConsumer("faulty-cons", consumer)
+
+	client.Down(0)
+	time.Sleep(100 * time.Millisecond)
+	client.Up()
+
+	mutex.Lock()
+	errorTimes := append([]time.Time(nil), consumeErrors...)
+	mutex.Unlock()
+	// 1, 2, 4, 8, 16ms... instead of a failing call each millisecond
+	if len(errorTimes) < 3 || len(errorTimes) > 12 {
+		t.Fatalf("expected the consume loop to back off, got %d errors", len(errorTimes))
+	}
+	first := errorTimes[1].Sub(errorTimes[0])
+	last := errorTimes[len(errorTimes)-1].Sub(errorTimes[len(errorTimes)-2])
+	if last < 4*time.Millisecond || last <= first {
+		t.Errorf("expected growing delays between failed fetches, first %s, last %s", first, last)
+	}
+
+	queue.Publish("faulty-d")
+	if !consumer.WaitForDeliveries(1, time.Second) {
+		t.Fatal("expected the consume loop to recover")
+	}
+	if !consumer.Last().Ack() {
+		t.Error("expected the delivery to be acked")
+	}
+
+	// wait for the consumer, it's removed before miniredis is closed
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := connection.StopAllConsuming(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFaultyHeartbeatRecovery(t *testing.T) {
+	server := StartMiniredis(t)
+	client := NewFaultyClient(redis.NewClient(&redis.Options{Addr: server.Addr()}))
+	connection := rmq.OpenConnectionWithRedisCmdable("faulty-conn", client)
+	t.Cleanup(func() { connection.StopHeartbeat() })
+
+	// wait for the first update of the heartbeat loop, which would otherwise
+	// set the key again right after it expired
+	for client.Calls("set") < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	client.Down(0)
+	if connection.Check() {
+		t.Error("expected the check to fail while Redis is down")
+	}
+	server.FastForward(2 * time.Minute) // the heartbeat expires
+	client.Up()
+	if connection.Check() {
+		t.Error("expected the heartbeat to be expired")
+	}
+
+	// the heartbeat survived the failed updates and sets the key again
+	deadline := time.Now().Add(3 * time.Second)
+	for !connection.Check() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the heartbeat to recover")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
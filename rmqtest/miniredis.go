@@ -0,0 +1,32 @@
+package rmqtest
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis"
+	"github.com/ryanleary/rmq"
+)
+
+// StartMiniredis starts a miniredis server which is closed once the test
+// finished. Unlike a real Redis it only expires keys when the test calls
+// FastForward() on it
+func StartMiniredis(t testing.TB) *miniredis.Miniredis {
+	t.Helper()
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("rmqtest failed to start miniredis: %s", err)
+	}
+	t.Cleanup(server.Close)
+	return server
+}
+
+// OpenTestConnection opens a connection to a miniredis server of its own, so
+// tests using it are isolated from each other and can run in parallel. The
+// heartbeat is stopped once the test finished
+func OpenTestConnection(t testing.TB) *rmq.RedisConnection {
+	t.Helper()
+	server := StartMiniredis(t)
+	connection := rmq.OpenConnection(t.Name(), server.Addr(), 0)
+	t.Cleanup(func() { connection.StopHeartbeat() })
+	return connection
+}
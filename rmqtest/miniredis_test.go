@@ -0,0 +1,14 @@
+package rmqtest
+
+import "testing"
+
+func TestOpenTestConnection(t *testing.T) {
+	connection := OpenTestConnection(t)
+	queue := connection.OpenQueue("rmqtest-q")
+	if !queue.Publish("rmqtest-d") {
+		t.Fatal("failed to publish")
+	}
+	if payloads := queue.PeekReady(0, 10); len(payloads) != 1 || payloads[0] != "rmqtest-d" {
+		t.Errorf("unexpected ready payloads %v", payloads)
+	}
+}
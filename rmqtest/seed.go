@@ -0,0 +1,65 @@
+package rmqtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/ryanleary/rmq"
+)
+
+// importRecord is a record of the format written by queue.Export() and read
+// by queue.Import()
+type importRecord struct {
+	Version int    `json:"v"`
+	List    string `json:"list"`
+	Entry   []byte `json:"entry"`
+}
+
+// Seed publishes the payloads to the queue in the given order and fails the
+// test right away if publishing fails
+func Seed(t testing.TB, queue rmq.Queue, payloads ...string) {
+	t.Helper()
+	for i, payload := range payloads {
+		if !queue.Publish(payload) {
+			t.Fatalf("rmqtest failed to seed payload %d to %s", i, queue)
+		}
+	}
+}
+
+// SeedJSON is like Seed for the values marshalled to JSON
+func SeedJSON[T any](t testing.TB, queue rmq.Queue, values []T) {
+	t.Helper()
+	payloads := make([]string, len(values))
+	for i, value := range values {
+		bytes, err := json.Marshal(value)
+		if err != nil {
+			t.Fatalf("rmqtest failed to marshal value %d: %s", i, err)
+		}
+		payloads[i] = string(bytes)
+	}
+	Seed(t, queue, payloads...)
+}
+
+// SeedRejected adds the payloads to the rejected deliveries of the queue
+// without reasons, the last one is the newest. It imports them with
+// queue.Import(), so it works for Redis, memory and test queues alike
+func SeedRejected(t testing.TB, queue rmq.Queue, payloads ...string) {
+	t.Helper()
+	buffer := &bytes.Buffer{}
+	encoder := json.NewEncoder(buffer)
+	for _, payload := range payloads {
+		record := importRecord{Version: 1, List: rmq.ExportRejected, Entry: []byte(payload)}
+		if err := encoder.Encode(record); err != nil {
+			t.Fatalf("rmqtest failed to encode rejected payload: %s", err)
+		}
+	}
+
+	imported, err := queue.Import(buffer)
+	if err != nil {
+		t.Fatalf("rmqtest failed to seed rejected payloads to %s: %s", queue, err)
+	}
+	if imported != len(payloads) {
+		t.Fatalf("rmqtest seeded %d of %d rejected payloads to %s", imported, len(payloads), queue)
+	}
+}
@@ -0,0 +1,34 @@
+package rmqtest
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ryanleary/rmq"
+)
+
+func TestSeed(t *testing.T) {
+	testSeed(t, rmq.NewTestQueue("seed-test"))
+	testSeed(t, rmq.NewMemoryConnection().OpenQueue("seed-memory"))
+}
+
+func TestSeedMiniredis(t *testing.T) {
+	testSeed(t, OpenTestConnection(t).OpenQueue("seed-redis"))
+}
+
+func testSeed(t *testing.T, queue rmq.Queue) {
+	Seed(t, queue, "s1", "s2")
+	SeedJSON(t, queue, []event{{Kind: "created", ID: 1}})
+	SeedRejected(t, queue, "r1", "r2")
+
+	expectedReady := []string{"s1", "s2", `{"kind":"created","id":1}`}
+	if ready := queue.PeekReady(0, 10); !reflect.DeepEqual(ready, expectedReady) {
+		t.Errorf("%s: expected ready %v, got %v", queue, expectedReady, ready)
+	}
+	if rejected := queue.GetRejected(10); !reflect.DeepEqual(rejected, []string{"r2", "r1"}) {
+		t.Errorf("%s: expected rejected [r2 r1], got %v", queue, rejected)
+	}
+	if count := queue.RejectedCount(); count != 2 {
+		t.Errorf("%s: expected 2 rejected, got %d", queue, count)
+	}
+}
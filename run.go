@@ -0,0 +1,82 @@
+package rmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// defaultGracePeriod is how long a Runner waits for consumers when shutting
+// down by default
+const defaultGracePeriod = 30 * time.Second
+
+// Runner runs a worker until its context is done, see Runner.Run(). The zero
+// value waits for consumers for 30s and doesn't catch signals
+type Runner struct {
+	// GracePeriod is how long to wait for running Consume() calls when
+	// shutting down, see connection.StopAllConsuming(). Zero for 30s
+	GracePeriod time.Duration
+
+	// Signals shut the worker down as well, like os.Interrupt and
+	// syscall.SIGTERM. Leave it empty if the caller handles signals itself,
+	// by cancelling the context
+	Signals []os.Signal
+}
+
+// ShutdownError is returned by Runner.Run() if the shutdown failed or left
+// deliveries unacked, which the cleaner returns once the connection's
+// heartbeat expired
+type ShutdownError struct {
+	Report ShutdownReport
+	Err    error // the error of connection.StopAllConsuming(), nil if it only left deliveries unacked
+}
+
+func (err *ShutdownError) Error() string {
+	unacked := 0
+	for _, count := range err.Report.Unacked {
+		unacked += count
+	}
+	if err.Err == nil {
+		return fmt.Sprintf("rmq shutdown left %d deliveries unacked", unacked)
+	}
+	return fmt.Sprintf("rmq shutdown left %d deliveries unacked: %s", unacked, err.Err)
+}
+
+func (err *ShutdownError) Unwrap() error {
+	return err.Err
+}
+
+// Run calls setup to open queues and add consumers on the connection, then
+// blocks until ctx is done or, if the runner has signals, one of them
+// arrives. Then it shuts the connection down with StopAllConsuming(), giving
+// consumers the grace period to finish. Returns nil once the connection shut
+// down cleanly, so it can run in an errgroup.Group. Otherwise the error of
+// setup and a *ShutdownError describing what the shutdown left behind are
+// returned
+func (runner Runner) Run(ctx context.Context, connection *RedisConnection, setup func(Connection) error) error {
+	if len(runner.Signals) > 0 {
+		var stop context.CancelFunc
+		ctx, stop = signal.NotifyContext(ctx, runner.Signals...)
+		defer stop()
+	}
+
+	setupErr := setup(connection)
+	if setupErr == nil {
+		<-ctx.Done()
+	}
+
+	gracePeriod := runner.GracePeriod
+	if gracePeriod <= 0 {
+		gracePeriod = defaultGracePeriod
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	report, err := connection.StopAllConsuming(shutdownCtx)
+	if err != nil || len(report.Unacked) > 0 {
+		return errors.Join(setupErr, &ShutdownError{Report: report, Err: err})
+	}
+	return setupErr
+}
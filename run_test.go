@@ -0,0 +1,20 @@
+package rmq
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestShutdownError(t *testing.T) {
+	err := error(&ShutdownError{Report: ShutdownReport{Unacked: map[string]int{"a": 2, "b": 1}}})
+	if err.Error() != "rmq shutdown left 3 deliveries unacked" {
+		t.Error("unexpected message", err)
+	}
+
+	err = errors.Join(errors.New("setup failed"), &ShutdownError{Err: context.DeadlineExceeded})
+	var shutdownErr *ShutdownError
+	if !errors.As(err, &shutdownErr) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("shutdown error should be inspectable", err)
+	}
+}
@@ -0,0 +1,168 @@
+package rmq
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"gopkg.in/redis.v5"
+)
+
+// luaScript is a Lua script run through the script registry of the Redis
+// client running it, see scriptRegistry
+type luaScript struct {
+	*redis.Script
+	name string // passed to the script hook, see connection.SetScriptHook()
+	hash string // SHA1 of the source, as run by EVALSHA
+}
+
+func newScript(name, src string) *luaScript {
+	hash := sha1.Sum([]byte(src))
+	return &luaScript{Script: redis.NewScript(src), name: name, hash: hex.EncodeToString(hash[:])}
+}
+
+// run runs the script with EVALSHA, see scriptRegistry.run(). Clients without
+// an open connection have no registry, they run it with EVALSHA falling back
+// to EVAL without loading it
+func (script *luaScript) run(client redis.Cmdable, keys []string, args ...interface{}) *redis.Cmd {
+	if registry := scriptsOf(client); registry != nil {
+		return registry.run(client, script, keys, args...)
+	}
+	return script.Run(client, keys, args...)
+}
+
+// eval adds the script to the pipeline of client, see scriptRegistry.eval()
+func (script *luaScript) eval(client redis.Cmdable, pipe *redis.Pipeline, keys []string, args ...interface{}) *redis.Cmd {
+	if registry := scriptsOf(client); registry != nil {
+		return registry.eval(pipe, script, keys, args...)
+	}
+	return script.Eval(pipe, keys, args...)
+}
+
+// scriptRegistry keeps track of the scripts loaded into Redis. Script caches
+// belong to the server, so there's one registry per Redis client, shared by
+// all connections using it. It's dropped once the last of them stopped
+type scriptRegistry struct {
+	mutex       sync.Mutex
+	loaded      map[string]bool   // hashes of scripts loaded with SCRIPT LOAD
+	hook        func(name string) // nil if not set
+	connections int               // open connections using the registry, guarded by registriesMutex
+}
+
+var (
+	registriesMutex sync.Mutex
+	registries      = map[redis.Cmdable]*scriptRegistry{} // by Redis client
+)
+
+// scriptsOf returns the script registry of the client, nil if no connection
+// using it is open
+func scriptsOf(client redis.Cmdable) *scriptRegistry {
+	registriesMutex.Lock()
+	defer registriesMutex.Unlock()
+	return registries[client]
+}
+
+// retainScripts returns the script registry of the client for a connection
+// opened on it, creating it for the first one
+func retainScripts(client redis.Cmdable) *scriptRegistry {
+	registriesMutex.Lock()
+	defer registriesMutex.Unlock()
+	registry, ok := registries[client]
+	if !ok {
+		registry = &scriptRegistry{loaded: map[string]bool{}}
+		registries[client] = registry
+	}
+	registry.connections++
+	return registry
+}
+
+// releaseScripts drops the script registry of the client once the last
+// connection retaining it stopped
+func releaseScripts(client redis.Cmdable) {
+	registriesMutex.Lock()
+	defer registriesMutex.Unlock()
+	registry, ok := registries[client]
+	if !ok {
+		return
+	}
+	registry.connections--
+	if registry.connections <= 0 {
+		delete(registries, client)
+	}
+}
+
+// run loads the script with SCRIPT LOAD on first use and runs it with
+// EVALSHA. If Redis lost the script (e.g. after a restart) it's run with EVAL,
+// which loads it again. Cluster clients skip SCRIPT LOAD, which would only
+// reach one node, each node loads the script on its first NOSCRIPT instead
+func (registry *scriptRegistry) run(client redis.Cmdable, script *luaScript, keys []string, args ...interface{}) *redis.Cmd {
+	registry.ran(script)
+	if !registry.isLoaded(script) {
+		if _, cluster := client.(*redis.ClusterClient); !cluster && script.Load(client).Err() == nil {
+			registry.setLoaded(script)
+		}
+	}
+
+	result := script.EvalSha(client, keys, args...)
+	if err := result.Err(); err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT ") {
+		return script.Eval(client, keys, args...)
+	}
+	return result
+}
+
+// eval adds the script to pipe with EVAL. A NOSCRIPT error couldn't be
+// retried without running the rest of the pipeline again, so pipelines keep
+// sending the script
+func (registry *scriptRegistry) eval(pipe *redis.Pipeline, script *luaScript, keys []string, args ...interface{}) *redis.Cmd {
+	registry.ran(script)
+	return script.Eval(pipe, keys, args...)
+}
+
+func (registry *scriptRegistry) isLoaded(script *luaScript) bool {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	return registry.loaded[script.hash]
+}
+
+func (registry *scriptRegistry) setLoaded(script *luaScript) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.loaded[script.hash] = true
+}
+
+// ran calls the hook, if any
+func (registry *scriptRegistry) ran(script *luaScript) {
+	registry.mutex.Lock()
+	hook := registry.hook
+	registry.mutex.Unlock()
+	if hook != nil {
+		hook(script.name)
+	}
+}
+
+func (registry *scriptRegistry) setHook(hook func(name string)) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.hook = hook
+}
+
+// SetScriptHook sets a function called with the name of each Lua script run
+// on the connection's Redis client, e.g. "removeUnacked", so tests can assert
+// which scripts ran. Connections sharing a Redis client share the hook, it's
+// dropped once they all stopped. Inspectors don't run the hook unless another
+// connection on their client is open. Pass nil to remove it
+func (connection *RedisConnection) SetScriptHook(hook func(name string)) {
+	if registry := scriptsOf(connection.redisClient); registry != nil {
+		registry.setHook(hook)
+	}
+}
+
+// releaseScripts releases the script registry retained by the connection
+// once it stopped. Inspectors and hijacked connections retain none
+func (connection *RedisConnection) releaseScripts() {
+	if atomic.CompareAndSwapInt32(&connection.scriptsRetained, 1, 0) {
+		releaseScripts(connection.redisClient)
+	}
+}
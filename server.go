@@ -0,0 +1,148 @@
+package rmq
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ServerInfo describes the Redis server of a connection, see
+// connection.ServerInfo()
+type ServerInfo struct {
+	Version string // like "7.2.4", empty if the server didn't report it
+	Major   int
+	Minor   int
+	Patch   int
+}
+
+// AtLeast returns true if the server version is major.minor or later
+func (info ServerInfo) AtLeast(major, minor int) bool {
+	return info.Major > major || info.Major == major && info.Minor >= minor
+}
+
+// positional returns true if the server supports LMOVE and LPOS, which were
+// added in Redis 6.2
+func (info ServerInfo) positional() bool {
+	return info.AtLeast(6, 2)
+}
+
+// parseServerInfo parses the reply of INFO SERVER
+func parseServerInfo(reply string) ServerInfo {
+	info := ServerInfo{}
+	for _, line := range strings.Split(reply, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "redis_version:") {
+			continue
+		}
+		info.Version = strings.TrimPrefix(line, "redis_version:")
+		parts := strings.SplitN(info.Version, ".", 3)
+		numbers := []*int{&info.Major, &info.Minor, &info.Patch}
+		for i, part := range parts {
+			*numbers[i], _ = strconv.Atoi(part)
+		}
+		break
+	}
+	return info
+}
+
+// The list scripts below come in two variants, see listScript. Both define
+// pop(src, dst), which moves the tail of src to the head of dst and returns
+// it, and remove(key, value), which removes one occurrence of value from key
+// and returns 1, 0 if there's none
+const (
+	legacyListLua = `
+local function pop(src, dst)
+	return redis.call('RPOPLPUSH', src, dst)
+end
+local function remove(key, value)
+	return redis.call('LREM', key, 1, value)
+end
+`
+
+	// LREM by value removes the newest occurrence of a duplicate payload,
+	// LPOS finds the oldest one (the one consumed first), which gets replaced
+	// by a tombstone to be removed by position
+	positionalListLua = `
+local function pop(src, dst)
+	return redis.call('LMOVE', src, dst, 'RIGHT', 'LEFT')
+end
+local function remove(key, value)
+	local position = redis.call('LPOS', key, value, 'RANK', -1)
+	if not position then
+		return 0
+	end
+	redis.call('LSET', key, position, 'rmq::removed')
+	return redis.call('LREM', key, -1, 'rmq::removed')
+end
+`
+)
+
+// listScript is a script moving deliveries between lists, in a legacy
+// variant built on RPOPLPUSH and LREM by value and a positional variant built
+// on LMOVE and LPOS for servers which support them
+type listScript struct {
+	legacy     *luaScript
+	positional *luaScript
+}
+
+func newListScript(name, src string) listScript {
+	return listScript{
+		legacy:     newScript(name, legacyListLua+src),
+		positional: newScript(name, positionalListLua+src),
+	}
+}
+
+// pick returns the variant to run
+func (script listScript) pick(positional bool) *luaScript {
+	if positional {
+		return script.positional
+	}
+	return script.legacy
+}
+
+var (
+	// popScript moves up to ARGV[1] deliveries from the tail of KEYS[1] to the
+	// head of KEYS[2] and returns them, oldest first
+	popScript = newListScript("pop", `
+local popped = {}
+for i = 1, tonumber(ARGV[1]) do
+	local payload = pop(KEYS[1], KEYS[2])
+	if not payload then
+		break
+	end
+	popped[#popped + 1] = payload
+end
+return popped
+`)
+
+	// removeScript removes one occurrence of ARGV[1] from KEYS[1]
+	removeScript = newListScript("remove", `
+return remove(KEYS[1], ARGV[1])
+`)
+)
+
+// ServerInfo returns the version of the connection's Redis server. Queues
+// opened on the connection use LMOVE and LPOS instead of RPOPLPUSH and LREM
+// by value if the server was Redis 6.2 or later when the connection was
+// opened, which makes acking duplicate payloads remove the oldest one
+func (connection *RedisConnection) ServerInfo() (ServerInfo, error) {
+	result := connection.redisClient.Info("server")
+	if err := redisErr(result); err != nil {
+		return ServerInfo{}, err
+	}
+	return parseServerInfo(result.Val()), nil
+}
+
+// detectServer switches the connection to the positional list commands if
+// the server supports them. If the version can't be detected the legacy
+// commands are used
+func (connection *RedisConnection) detectServer() {
+	info, err := connection.ServerInfo()
+	connection.setPositional(err == nil && info.positional())
+}
+
+// setPositional sets whether queues opened afterwards use LMOVE and LPOS,
+// regardless of the server version in tests
+func (connection *RedisConnection) setPositional(positional bool) {
+	connection.positional = positional
+	connection.backend = redisBackend{client: connection.redisClient, positional: positional}
+}
@@ -0,0 +1,21 @@
+package rmq
+
+import "testing"
+
+func TestParseServerInfo(t *testing.T) {
+	info := parseServerInfo("# Server\r\nredis_version:6.2.14\r\nredis_mode:standalone\r\n")
+	if info.Version != "6.2.14" || info.Major != 6 || info.Minor != 2 || info.Patch != 14 {
+		t.Errorf("parsed %+v", info)
+	}
+	if !info.AtLeast(6, 2) || info.AtLeast(6, 3) || !info.AtLeast(5, 9) || info.AtLeast(7, 0) {
+		t.Errorf("wrong AtLeast for %+v", info)
+	}
+
+	info = parseServerInfo("# Server\r\n")
+	if info.Version != "" || info.positional() {
+		t.Errorf("parsed %+v from a reply without version", info)
+	}
+	if !parseServerInfo("redis_version:7.0.0\n").positional() {
+		t.Errorf("7.0 isn't positional")
+	}
+}
@@ -0,0 +1,170 @@
+package rmq
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/redis.v5"
+)
+
+// shutdownPollInterval is how often StopAllConsuming() checks whether the
+// consumers finished
+const shutdownPollInterval = 10 * time.Millisecond
+
+// ShutdownReport describes what connection.StopAllConsuming() left behind
+type ShutdownReport struct {
+	Returned  int            // prefetched deliveries no consumer started, moved back to ready
+	Consuming int            // consumers still consuming when the context expired
+	Unacked   map[string]int // deliveries left unacked, by queue name, the cleaner returns them
+}
+
+// consumingQueues are the queues which started consuming on a connection
+type consumingQueues struct {
+	mutex  sync.Mutex
+	queues []*redisQueue
+}
+
+func (consuming *consumingQueues) add(queue *redisQueue) {
+	consuming.mutex.Lock()
+	defer consuming.mutex.Unlock()
+	consuming.queues = append(consuming.queues, queue)
+}
+
+func (consuming *consumingQueues) all() []*redisQueue {
+	consuming.mutex.Lock()
+	defer consuming.mutex.Unlock()
+	return append([]*redisQueue(nil), consuming.queues...)
+}
+
+// StopAllConsuming shuts the connection down gracefully. It stops all queues
+// which started consuming on this connection, moves their prefetched
+// deliveries back to ready and waits until their consumers returned or ctx is
+// done. Then it flushes buffered acks, stops the heartbeat and closes the
+// connection. Deliveries still unacked after that are reported, the
+// connection stays visible to cleaners then so they return them once its
+// heartbeat expired. All errors are joined into the returned error, which
+// wraps ctx.Err() if consumers were still consuming
+func (connection *RedisConnection) StopAllConsuming(ctx context.Context) (ShutdownReport, error) {
+	report := ShutdownReport{Unacked: map[string]int{}}
+	var errs []error
+
+	queues := connection.consuming.all()
+	drain := func() {
+		for _, queue := range queues {
+			returned, err := queue.drain()
+			report.Returned += returned
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	for _, queue := range queues {
+		queue.StopConsuming()
+	}
+	drain()
+	report.Consuming = waitForConsumers(ctx, queues)
+	if report.Consuming > 0 {
+		errs = append(errs, ctx.Err())
+	}
+	drain() // fetched while stopping
+
+	for _, queue := range queues {
+		if err := queue.FlushAcks(); err != nil {
+			errs = append(errs, err)
+		}
+		unacked, err := queue.unackedCount()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if unacked > 0 {
+			report.Unacked[queue.name] += int(unacked)
+		}
+	}
+
+	if err := connection.stopHeartbeat(); err != nil {
+		errs = append(errs, err)
+	}
+	if len(report.Unacked) == 0 && len(errs) == 0 {
+		if err := connection.close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return report, errors.Join(errs...)
+}
+
+// unackedCount returns the number of deliveries unacked by the queue's
+// connection
+func (queue *redisQueue) unackedCount() (int64, error) {
+	if queue.unackedStream != nil {
+		return queue.unackedStream()
+	}
+	return queue.backend.count(queue.unackedKey)
+}
+
+// waitForConsumers waits until no consumer of the queues is consuming or ctx
+// is done and returns the number of consumers still consuming
+func waitForConsumers(ctx context.Context, queues []*redisQueue) int {
+	for {
+		consuming := 0
+		for _, queue := range queues {
+			consuming += int(atomic.LoadInt32(&queue.activeConsumers))
+		}
+		if consuming == 0 {
+			return 0
+		}
+
+		select {
+		case <-ctx.Done():
+			return consuming
+		case <-time.After(shutdownPollInterval):
+		}
+	}
+}
+
+// drain takes the prefetched deliveries no consumer started out of the
+// delivery channel and moves them back to ready, returns how many were moved.
+// Deliveries of stream queues stay pending, see cleaner.SetStreamMinIdle()
+func (queue *redisQueue) drain() (returned int, err error) {
+	for {
+		select {
+		case delivery := <-queue.deliveryChan:
+			wrapped, ok := delivery.(*wrapDelivery)
+			if !ok {
+				continue
+			}
+			if moveErr := wrapped.unconsume(queue.readyKey); moveErr != nil {
+				err = moveErr
+				continue
+			}
+			returned++
+		default:
+			return returned, err
+		}
+	}
+}
+
+// unconsume moves the delivery back to the consuming end of ready, for
+// prefetched deliveries which were never passed to a consumer
+func (delivery *wrapDelivery) unconsume(readyKey string) error {
+	results, err := delivery.redisClient.Pipelined(func(pipe *redis.Pipeline) error {
+		pipe.RPush(readyKey, delivery.wire)
+		delivery.removeUnacked(pipe)
+		return nil
+	})
+	return delivery.moveResult(readyKey, results, err)
+}
+
+// close removes the connection from the set of connections, like Close()
+// but returning errors
+func (connection *RedisConnection) close() error {
+	if _, err := connection.backend.del(strings.Replace(connectionProtectedTemplate, phConnection, connection.Name, 1)); err != nil {
+		return err
+	}
+	_, err := connection.backend.removeMember(connectionsKey, connection.Name)
+	return err
+}
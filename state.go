@@ -18,4 +18,10 @@ const (
 	// Pushed messages are messages that have been sent to a different queue
 	// by the consumer.
 	Pushed
+	// Dead messages are messages that have been moved to the dead letter queue
+	// by the consumer.
+	Dead
+	// Delayed messages are messages that have been rejected by the consumer
+	// and scheduled to be retried later, see queue.SetRetryPolicy().
+	Delayed
 )
@@ -1,14 +1,54 @@
 package rmq
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"sort"
+	"time"
+
+	"gopkg.in/redis.v5"
+)
+
+// HeartbeatWarningTTL is the heartbeat TTL below which connections are
+// considered stale. Healthy connections renew their heartbeat every second
+const HeartbeatWarningTTL = heartbeatDuration - 10*time.Second
+
+// Connection health as returned by ConnectionStat.Health()
+const (
+	HealthAlive = "alive" // heartbeat renewed recently
+	HealthStale = "stale" // heartbeat wasn't renewed for a while, the connection might be about to die
+	HealthDead  = "dead"  // no heartbeat, waiting to be cleaned
 )
 
+// heartbeatHealth returns the health of a connection given whether it has a
+// heartbeat and the heartbeat's TTL, zero if unknown
+func heartbeatHealth(active bool, ttl time.Duration) string {
+	switch {
+	case !active:
+		return HealthDead
+	case ttl > 0 && ttl < HeartbeatWarningTTL:
+		return HealthStale
+	default:
+		return HealthAlive
+	}
+}
+
 type ConnectionStat struct {
-	Active       bool     `json:"active"`
-	UnackedCount int      `json:"unacked"`
-	Consumers    []string `json:"consumers"`
+	Active             bool                    `json:"active"`
+	HeartbeatTTL       time.Duration           `json:"heartbeat_ttl"` // zero if the connection has no heartbeat
+	UnackedCount       int                     `json:"unacked"`
+	Consumers          []string                `json:"consumers"`
+	OldestUnackedAge   time.Duration           `json:"oldest_unacked_age"`
+	OldestUnackedKnown bool                    `json:"oldest_unacked_known"` // false if there's no unacked delivery with a publishing time
+	ConsumerStats      map[string]ConsumerStat `json:"consumer_stats"`       // by consumer name, as last published by the connection
+}
+
+// Health returns HealthAlive, HealthStale or HealthDead depending on the
+// heartbeat of the connection
+func (stat ConnectionStat) Health() string {
+	return heartbeatHealth(stat.Active, stat.HeartbeatTTL)
 }
 
 func (stat ConnectionStat) String() string {
@@ -18,12 +58,100 @@ func (stat ConnectionStat) String() string {
 	)
 }
 
+// MarshalJSON encodes the stat with its consumers sorted and a consumer count
+func (stat ConnectionStat) MarshalJSON() ([]byte, error) {
+	consumers := append([]string{}, stat.Consumers...)
+	sort.Strings(consumers)
+	consumerStats := stat.ConsumerStats
+	if consumerStats == nil {
+		consumerStats = map[string]ConsumerStat{}
+	}
+	return json.Marshal(struct {
+		Active             bool                    `json:"active"`
+		HeartbeatTTL       time.Duration           `json:"heartbeat_ttl"`
+		Health             string                  `json:"health"`
+		UnackedCount       int                     `json:"unacked"`
+		ConsumerCount      int                     `json:"consumer_count"`
+		Consumers          []string                `json:"consumers"`
+		OldestUnackedAge   time.Duration           `json:"oldest_unacked_age"`
+		OldestUnackedKnown bool                    `json:"oldest_unacked_known"`
+		ConsumerStats      map[string]ConsumerStat `json:"consumer_stats"`
+	}{
+		Active:             stat.Active,
+		HeartbeatTTL:       stat.HeartbeatTTL,
+		Health:             stat.Health(),
+		UnackedCount:       stat.UnackedCount,
+		ConsumerCount:      len(consumers),
+		Consumers:          consumers,
+		OldestUnackedAge:   stat.OldestUnackedAge,
+		OldestUnackedKnown: stat.OldestUnackedKnown,
+		ConsumerStats:      consumerStats,
+	})
+}
+
 type ConnectionStats map[string]ConnectionStat
 
+// String lists the stats sorted by connection name
+func (stats ConnectionStats) String() string {
+	var buffer bytes.Buffer
+	buffer.WriteString("map[")
+	for i, name := range stats.sortedNames() {
+		if i > 0 {
+			buffer.WriteString(" ")
+		}
+		fmt.Fprintf(&buffer, "%s:%s", name, stats[name])
+	}
+	buffer.WriteString("]")
+	return buffer.String()
+}
+
 type QueueStat struct {
-	ReadyCount      int             `json:"ready"`
-	RejectedCount   int             `json:"rejected"`
-	ConnectionStats ConnectionStats `json:"connections"`
+	ReadyCount       int             `json:"ready"`
+	RejectedCount    int             `json:"rejected"`
+	ChecksumMismatch int             `json:"checksum_mismatch"`
+	Quarantined      int             `json:"quarantined"`
+	ScheduledCount   int             `json:"scheduled"`   // deliveries in the delayed set, waiting to be retried
+	NextDueIn        time.Duration   `json:"next_due_in"` // until the earliest scheduled delivery is due, zero if there are none or it's overdue
+	Counters         QueueCounters   `json:"counters"`    // cumulative counts, see queue.Counters()
+	ConnectionStats  ConnectionStats `json:"connections"`
+	Latency          *LatencyStat    `json:"latency,omitempty"` // of all connections, nil if there's no latency data
+	Stream           bool            `json:"stream,omitempty"`  // whether it's a stream queue, see connection.OpenStreamQueue()
+}
+
+// MarshalJSON encodes the stat along with its unacked and consumer totals.
+// Connections are keyed by name
+func (stat QueueStat) MarshalJSON() ([]byte, error) {
+	connectionStats := stat.ConnectionStats
+	if connectionStats == nil {
+		connectionStats = ConnectionStats{}
+	}
+	return json.Marshal(struct {
+		ReadyCount       int             `json:"ready"`
+		RejectedCount    int             `json:"rejected"`
+		UnackedCount     int             `json:"unacked"`
+		ConsumerCount    int             `json:"consumer_count"`
+		ChecksumMismatch int             `json:"checksum_mismatch"`
+		Quarantined      int             `json:"quarantined"`
+		ScheduledCount   int             `json:"scheduled"`
+		NextDueIn        time.Duration   `json:"next_due_in"`
+		Counters         QueueCounters   `json:"counters"`
+		ConnectionStats  ConnectionStats `json:"connections"`
+		Latency          *LatencyStat    `json:"latency,omitempty"`
+		Stream           bool            `json:"stream,omitempty"`
+	}{
+		ReadyCount:       stat.ReadyCount,
+		RejectedCount:    stat.RejectedCount,
+		UnackedCount:     stat.UnackedCount(),
+		ConsumerCount:    stat.ConsumerCount(),
+		ChecksumMismatch: stat.ChecksumMismatch,
+		Quarantined:      stat.Quarantined,
+		ScheduledCount:   stat.ScheduledCount,
+		NextDueIn:        stat.NextDueIn,
+		Counters:         stat.Counters,
+		ConnectionStats:  connectionStats,
+		Latency:          stat.Latency,
+		Stream:           stat.Stream,
+	})
 }
 
 func NewQueueStat(readyCount, rejectedCount int) QueueStat {
@@ -35,7 +163,7 @@ func NewQueueStat(readyCount, rejectedCount int) QueueStat {
 }
 
 func (stat QueueStat) String() string {
-	return fmt.Sprintf("[ready:%d rejected:%d conn:%s",
+	return fmt.Sprintf("[ready:%d rejected:%d conn:%s]",
 		stat.ReadyCount,
 		stat.RejectedCount,
 		stat.ConnectionStats,
@@ -65,51 +193,414 @@ func (stat QueueStat) ConnectionCount() int {
 type QueueStats map[string]QueueStat
 
 type Stats struct {
-	QueueStats       QueueStats      `json:"queues"`
-	otherConnections map[string]bool // non consuming connections, Active or not
+	QueueStats       QueueStats               `json:"queues"`
+	Incomplete       bool                     `json:"incomplete,omitempty"`       // true if collecting was given up, see CollectStatsCtx()
+	IdleConnections  int                      `json:"idle_connections,omitempty"` // number of connections dropped by WithoutIdleConnections()
+	otherConnections map[string]bool          // non consuming connections, Active or not
+	heartbeatTTLs    map[string]time.Duration // of all connections with a heartbeat
+}
+
+// String lists the queues and then the connections not consuming any of
+// them, one per line sorted by name
+func (stats Stats) String() string {
+	var buffer bytes.Buffer
+	for _, queueName := range stats.sortedQueueNames() {
+		fmt.Fprintf(&buffer, "queue %s %s\n", queueName, stats.QueueStats[queueName])
+	}
+	for _, connectionName := range stats.sortedConnectionNames() {
+		fmt.Fprintf(&buffer, "connection %s %s\n", connectionName, ActiveSign(stats.otherConnections[connectionName]))
+	}
+	if stats.IdleConnections > 0 {
+		fmt.Fprintf(&buffer, "%d idle connections\n", stats.IdleConnections)
+	}
+	return buffer.String()
+}
+
+// ConnectionHeartbeat is the heartbeat of a connection in encoded stats
+type ConnectionHeartbeat struct {
+	TTL    time.Duration `json:"ttl"`
+	Health string        `json:"health"`
+}
+
+// StatsJSONVersion is the version of the schema Stats are encoded in by
+// MarshalJSON. It gets bumped on incompatible changes
+const StatsJSONVersion = 1
+
+// MarshalJSON encodes the stats with a version field. Queues and connections
+// are keyed by name and encoded in sorted order, so the output is the same for
+// the same stats
+func (stats Stats) MarshalJSON() ([]byte, error) {
+	queueStats := stats.QueueStats
+	if queueStats == nil {
+		queueStats = QueueStats{}
+	}
+	return json.Marshal(struct {
+		Version         int                            `json:"version"`
+		Incomplete      bool                           `json:"incomplete,omitempty"`
+		IdleConnections int                            `json:"idle_connections,omitempty"`
+		QueueStats      QueueStats                     `json:"queues"`
+		Connections     map[string]bool                `json:"connections"`
+		Heartbeats      map[string]ConnectionHeartbeat `json:"heartbeats"`
+	}{
+		Version:         StatsJSONVersion,
+		Incomplete:      stats.Incomplete,
+		IdleConnections: stats.IdleConnections,
+		QueueStats:      queueStats,
+		Connections:     stats.Connections(),
+		Heartbeats:      stats.Heartbeats(),
+	})
+}
+
+// Heartbeats returns the heartbeat TTL and health of each connection by
+// connection name, including connections which don't consume any queue
+func (stats Stats) Heartbeats() map[string]ConnectionHeartbeat {
+	heartbeats := map[string]ConnectionHeartbeat{}
+	for name, active := range stats.Connections() {
+		ttl := stats.heartbeatTTLs[name]
+		heartbeats[name] = ConnectionHeartbeat{TTL: ttl, Health: heartbeatHealth(active, ttl)}
+	}
+	return heartbeats
+}
+
+// Connections returns whether each connection is alive by connection name,
+// including connections which don't consume any queue
+func (stats Stats) Connections() map[string]bool {
+	connections := map[string]bool{}
+	for name, active := range stats.otherConnections {
+		connections[name] = active
+	}
+	for _, queueStat := range stats.QueueStats {
+		for name, connectionStat := range queueStat.ConnectionStats {
+			connections[name] = connectionStat.Active
+		}
+	}
+	return connections
+}
+
+// WithoutIdleConnections returns a copy of the stats without idle
+// connections, which neither have consumers nor unacked deliveries, like
+// processes which only publish. Queues only list the connections doing
+// something for them and connections not consuming any queue are dropped.
+// IdleConnections counts the connections which aren't listed anymore
+func (stats Stats) WithoutIdleConnections() Stats {
+	filtered := Stats{
+		QueueStats:       make(QueueStats, len(stats.QueueStats)),
+		Incomplete:       stats.Incomplete,
+		otherConnections: map[string]bool{},
+		heartbeatTTLs:    stats.heartbeatTTLs,
+	}
+	for queueName, queueStat := range stats.QueueStats {
+		connectionStats := ConnectionStats{}
+		for connectionName, connectionStat := range queueStat.ConnectionStats {
+			if len(connectionStat.Consumers) > 0 || connectionStat.UnackedCount > 0 {
+				connectionStats[connectionName] = connectionStat
+			}
+		}
+		queueStat.ConnectionStats = connectionStats
+		filtered.QueueStats[queueName] = queueStat
+	}
+	filtered.IdleConnections = stats.IdleConnections + len(stats.Connections()) - len(filtered.Connections())
+	return filtered
 }
 
 func NewStats() Stats {
 	return Stats{
 		QueueStats:       QueueStats{},
 		otherConnections: map[string]bool{},
+		heartbeatTTLs:    map[string]time.Duration{},
 	}
 }
 
-func collectStats(queueList []string, mainConnection *RedisConnection) Stats {
-	stats := NewStats()
-	for _, queueName := range queueList {
-		queue := mainConnection.openQueue(queueName)
-		stats.QueueStats[queueName] = NewQueueStat(queue.ReadyCount(), queue.RejectedCount())
+// statsPipelineSize is the max number of commands collectStats sends in one
+// pipeline
+const statsPipelineSize = 1000
+
+// collectStats collects the stats of the given queues in a few pipelines:
+// one round of counts per queue, one of liveness and queues per connection and
+// one of consumer details per consuming connection and queue. Once ctx is
+// done it stops waiting for Redis and returns the stats collected so far,
+// marked as incomplete, along with the context's error
+func collectStats(ctx context.Context, queueList []string, mainConnection *RedisConnection) (stats Stats, err error) {
+	stats = NewStats()
+	redisClient := mainConnection.redisClient
+	defer func() {
+		stats.Incomplete = err != nil
+	}()
+
+	type queueCmds struct {
+		ready, rejected, scheduled *redis.IntCmd
+		checksum, quarantined      *redis.StringCmd
+		counters                   *redis.StringStringMapCmd
+		stream                     *redis.BoolCmd
+	}
+	queueResults := make([]queueCmds, len(queueList))
+	collected, err := pipelineChunked(ctx, redisClient, len(queueList), 7, func(pipe *redis.Pipeline, i int) {
+		queue := mainConnection.openQueue(queueList[i])
+		queueResults[i] = queueCmds{
+			ready:       pipe.LLen(queue.readyKey),
+			rejected:    pipe.LLen(queue.rejectedKey),
+			scheduled:   pipe.ZCard(queue.delayedKey),
+			checksum:    pipe.Get(queue.checksumKey),
+			quarantined: pipe.Get(queue.quarantinedKey),
+			counters:    pipe.HGetAll(queue.countersKey),
+			stream:      pipe.SIsMember(streamQueuesKey, queue.name),
+		}
+	})
+	var scheduledQueues []string // queues with scheduled deliveries
+	var streamQueues []string
+	for i, queueName := range queueList[:collected] {
+		results := queueResults[i]
+		queueStat := NewQueueStat(int(intResult(results.ready)), int(intResult(results.rejected)))
+		queueStat.ScheduledCount = int(intResult(results.scheduled))
+		queueStat.ChecksumMismatch = int(stringIntResult(results.checksum))
+		queueStat.Quarantined = int(stringIntResult(results.quarantined))
+		if !redisErrIsNil(results.counters) {
+			queueStat.Counters = newQueueCounters(results.counters.Val())
+		}
+		stats.QueueStats[queueName] = queueStat
+		if queueStat.ScheduledCount > 0 {
+			scheduledQueues = append(scheduledQueues, queueName)
+		}
+		if !redisErrIsNil(results.stream) && results.stream.Val() {
+			streamQueues = append(streamQueues, queueName)
+		}
 	}
 
-	connectionNames := mainConnection.GetConnections()
-	for _, connectionName := range connectionNames {
-		connection := mainConnection.hijackConnection(connectionName)
-		connectionActive := connection.Check()
+	if err != nil {
+		return stats, err
+	}
 
-		queueNames := connection.GetConsumingQueues()
+	countsResults := make([]*redis.Cmd, len(streamQueues))
+	collected, err = pipelineChunked(ctx, redisClient, len(streamQueues), 1, func(pipe *redis.Pipeline, i int) {
+		streamKey, rejectedStreamKey := streamQueueKeys(streamQueues[i])
+		countsResults[i] = streamCountsScript.eval(redisClient, pipe, []string{streamKey, rejectedStreamKey}, streamGroup)
+	})
+	streamUnacked := map[string]map[string]int64{} // pending entries by queue and connection name
+	for i, queueName := range streamQueues[:collected] {
+		queueStat := stats.QueueStats[queueName]
+		queueStat.Stream = true
+		if !redisErrIsNil(countsResults[i]) {
+			values, _ := countsResults[i].Val().([]interface{})
+			counts := parseStreamCounts(values)
+			queueStat.ReadyCount = int(counts.ready())
+			queueStat.RejectedCount = int(counts.rejected)
+			streamUnacked[queueName] = counts.unacked
+		}
+		stats.QueueStats[queueName] = queueStat
+	}
+
+	if err != nil {
+		return stats, err
+	}
+
+	nextDue := make([]*redis.ZSliceCmd, len(scheduledQueues))
+	collected, err = pipelineChunked(ctx, redisClient, len(scheduledQueues), 1, func(pipe *redis.Pipeline, i int) {
+		nextDue[i] = pipe.ZRangeWithScores(mainConnection.openQueue(scheduledQueues[i]).delayedKey, 0, 0)
+	})
+	now := visibilityScore(time.Now())
+	for i, queueName := range scheduledQueues[:collected] {
+		if redisErrIsNil(nextDue[i]) || len(nextDue[i].Val()) == 0 {
+			continue
+		}
+		if dueIn := nextDue[i].Val()[0].Score - now; dueIn > 0 {
+			queueStat := stats.QueueStats[queueName]
+			queueStat.NextDueIn = time.Duration(dueIn) * time.Millisecond
+			stats.QueueStats[queueName] = queueStat
+		}
+	}
+
+	if err != nil {
+		return stats, err
+	}
+
+	var connectionsResult *redis.StringSliceCmd
+	if _, err := pipelineChunked(ctx, redisClient, 1, 1, func(pipe *redis.Pipeline, i int) {
+		connectionsResult = pipe.SMembers(connectionsKey)
+	}); err != nil {
+		return stats, err
+	}
+	connectionNames := []string{}
+	if !redisErrIsNil(connectionsResult) {
+		connectionNames = connectionsResult.Val()
+	}
+	type connectionCmds struct {
+		heartbeat *redis.DurationCmd
+		queues    *redis.StringSliceCmd
+	}
+	connectionResults := make([]connectionCmds, len(connectionNames))
+	collected, err = pipelineChunked(ctx, redisClient, len(connectionNames), 2, func(pipe *redis.Pipeline, i int) {
+		connection := mainConnection.hijackConnection(connectionNames[i])
+		connectionResults[i] = connectionCmds{
+			heartbeat: pipe.TTL(connection.heartbeatKey),
+			queues:    pipe.SMembers(connection.queuesKey),
+		}
+	})
+
+	type consumingQueue struct {
+		connectionName string
+		active         bool
+		heartbeatTTL   time.Duration
+		queue          *redisQueue
+	}
+	var consuming []consumingQueue
+	for i, connectionName := range connectionNames[:collected] {
+		results := connectionResults[i]
+		connectionActive := !redisErrIsNil(results.heartbeat) && results.heartbeat.Val() > 0
+		var heartbeatTTL time.Duration
+		if connectionActive {
+			heartbeatTTL = results.heartbeat.Val()
+			stats.heartbeatTTLs[connectionName] = heartbeatTTL
+		}
+		var queueNames []string
+		if !redisErrIsNil(results.queues) {
+			queueNames = results.queues.Val()
+		}
 		if len(queueNames) == 0 {
 			stats.otherConnections[connectionName] = connectionActive
 			continue
 		}
 
+		connection := mainConnection.hijackConnection(connectionName)
 		for _, queueName := range queueNames {
-			queue := connection.openQueue(queueName)
-			Consumers := queue.GetConsumers()
-			openQueueStat, ok := stats.QueueStats[queueName]
-			if !ok {
+			if _, ok := stats.QueueStats[queueName]; !ok {
 				continue
 			}
-			openQueueStat.ConnectionStats[connectionName] = ConnectionStat{
-				Active:       connectionActive,
-				UnackedCount: queue.UnackedCount(),
-				Consumers:    Consumers,
+			consuming = append(consuming, consumingQueue{connectionName, connectionActive, heartbeatTTL, connection.openQueue(queueName)})
+		}
+	}
+
+	type consumingCmds struct {
+		consumers     *redis.StringSliceCmd
+		unacked       *redis.IntCmd
+		oldest        *redis.StringCmd
+		consumerStats *redis.StringStringMapCmd
+		latency       *redis.StringStringMapCmd
+	}
+	if err != nil {
+		return stats, err
+	}
+
+	consumingResults := make([]consumingCmds, len(consuming))
+	collected, err = pipelineChunked(ctx, redisClient, len(consuming), 5, func(pipe *redis.Pipeline, i int) {
+		queue := consuming[i].queue
+		consumingResults[i] = consumingCmds{
+			consumers:     pipe.SMembers(queue.consumersKey),
+			unacked:       pipe.LLen(queue.unackedKey),
+			oldest:        pipe.LIndex(queue.unackedKey, -1),
+			consumerStats: pipe.HGetAll(queue.statsKey),
+			latency:       pipe.HGetAll(queue.latencyKey),
+		}
+	})
+
+	latencies := map[string]*latencyCounts{}
+	for i, consumingQueue := range consuming[:collected] {
+		results := consumingResults[i]
+		queueName := consumingQueue.queue.name
+		consumers := []string{}
+		if !redisErrIsNil(results.consumers) {
+			consumers = results.consumers.Val()
+		}
+		var oldestUnackedAge time.Duration
+		oldestUnackedKnown := false
+		if !redisErrIsNil(results.oldest) {
+			if published, ok := publishedAt(results.oldest.Val()); ok {
+				oldestUnackedAge, oldestUnackedKnown = time.Since(published), true
 			}
 		}
+		consumerStats := map[string]ConsumerStat{}
+		if !redisErrIsNil(results.consumerStats) {
+			consumerStats = parseConsumerStats(results.consumerStats.Val())
+		}
+		if latencies[queueName] == nil {
+			latencies[queueName] = &latencyCounts{}
+		}
+		if !redisErrIsNil(results.latency) {
+			addLatencyFields(latencies[queueName], results.latency.Val())
+		}
+
+		unacked := intResult(results.unacked)
+		if stats.QueueStats[queueName].Stream {
+			unacked = streamUnacked[queueName][consumingQueue.connectionName]
+		}
+
+		stats.QueueStats[queueName].ConnectionStats[consumingQueue.connectionName] = ConnectionStat{
+			Active:             consumingQueue.active,
+			HeartbeatTTL:       consumingQueue.heartbeatTTL,
+			UnackedCount:       int(unacked),
+			Consumers:          consumers,
+			OldestUnackedAge:   oldestUnackedAge,
+			OldestUnackedKnown: oldestUnackedKnown,
+			ConsumerStats:      consumerStats,
+		}
 	}
 
-	return stats
+	for queueName, counts := range latencies {
+		queueStat := stats.QueueStats[queueName]
+		queueStat.Latency = newLatencyStat(*counts)
+		stats.QueueStats[queueName] = queueStat
+	}
+	return stats, err
+}
+
+// pipelineChunked calls queue for 0 <= i < n to add cmdsPerCall commands each
+// to pipelines of up to statsPipelineSize commands and executes them.
+// Command errors are left to the callers to check. If ctx is done before all
+// pipelines returned it returns the context's error and the number of calls
+// whose commands were executed, a pipeline still running in the background
+// may keep calling queue for later i
+func pipelineChunked(ctx context.Context, redisClient redis.Cmdable, n, cmdsPerCall int, queue func(pipe *redis.Pipeline, i int)) (executed int, err error) {
+	chunkSize := statsPipelineSize / cmdsPerCall
+	for start := 0; start < n; start += chunkSize {
+		if err := ctx.Err(); err != nil {
+			return start, err
+		}
+		end := start + chunkSize
+		if end > n {
+			end = n
+		}
+		pipeline := func() {
+			redisClient.Pipelined(func(pipe *redis.Pipeline) error {
+				for i := start; i < end; i++ {
+					queue(pipe, i)
+				}
+				return nil
+			})
+		}
+		if ctx.Done() == nil { // can't be cancelled, no need to wait in another goroutine
+			pipeline()
+			continue
+		}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			pipeline()
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return start, ctx.Err()
+		}
+	}
+	return n, nil
+}
+
+// intResult returns the value of the result, 0 on redis.Nil
+func intResult(result *redis.IntCmd) int64 {
+	if redisErrIsNil(result) {
+		return 0
+	}
+	return result.Val()
+}
+
+// stringIntResult returns the value of the result parsed as integer, 0 on
+// redis.Nil
+func stringIntResult(result *redis.StringCmd) int64 {
+	if redisErrIsNil(result) {
+		return 0
+	}
+	count, _ := result.Int64()
+	return count
 }
 
 func (stats ConnectionStats) sortedNames() []string {
@@ -0,0 +1,51 @@
+package rmq
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+)
+
+// CSVColumns are the columns written by stats.WriteCSV(), in order
+var CSVColumns = []string{"queue", "connection", "ready", "rejected", "unacked", "consumers", "connection_alive"}
+
+// WriteCSV writes a header row and one row per queue and consuming connection
+// to w, sorted by queue and connection name. Ready and rejected are the counts
+// of the queue and repeated for each of its connections, unacked and consumers
+// are those of the connection. Queues without consuming connections get a row
+// with empty connection and connection_alive
+func (stats Stats) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(CSVColumns); err != nil {
+		return err
+	}
+
+	for _, queueName := range stats.sortedQueueNames() {
+		queueStat := stats.QueueStats[queueName]
+		ready, rejected := strconv.Itoa(queueStat.ReadyCount), strconv.Itoa(queueStat.RejectedCount)
+		connectionNames := queueStat.ConnectionStats.sortedNames()
+		if len(connectionNames) == 0 {
+			if err := writer.Write([]string{queueName, "", ready, rejected, "0", "0", ""}); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, connectionName := range connectionNames {
+			connectionStat := queueStat.ConnectionStats[connectionName]
+			if err := writer.Write([]string{
+				queueName,
+				connectionName,
+				ready,
+				rejected,
+				strconv.Itoa(connectionStat.UnackedCount),
+				strconv.Itoa(len(connectionStat.Consumers)),
+				strconv.FormatBool(connectionStat.Active),
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
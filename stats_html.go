@@ -0,0 +1,220 @@
+package rmq
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OverviewTemplate renders HtmlData as the overview page. Replace it or its
+// "style" template to restyle the page
+var OverviewTemplate = template.Must(template.New("overview").Funcs(template.FuncMap{"fields": strings.Fields, "join": strings.Join}).Parse(`<!DOCTYPE html>
+<html><head><title>queue stats</title>
+{{if .Refresh}}<meta http-equiv="refresh" content="{{.Refresh}}">{{end}}
+{{template "style"}}
+</head><body>
+{{with .Health}}{{template "health-banner" .}}{{end}}
+{{if .Incomplete}}<p class="incomplete">stats are incomplete, collecting them timed out</p>
+{{end}}<table>
+<tr><th>queue</th><th>ready</th><th>rejected</th><th>scheduled</th><th>unacked</th><th>consumers</th><th>connections</th><th>latency p50/p95/p99</th>{{if .History}}<th>ready history</th>{{end}}{{if .Rates}}<th>published/s</th><th>consumed/s</th><th>rejected/s</th>{{end}}{{if .Actions}}<th></th>{{end}}</tr>
+{{range .Queues}}<tr class="queue"><td>{{if $.Actions}}<a href="queues/{{.Name}}">{{.Name}}</a>{{else}}{{.Name}}{{end}}</td><td>{{.Stat.ReadyCount}}</td><td>{{.Stat.RejectedCount}}</td><td>{{.Stat.ScheduledCount}}{{if .Stat.NextDueIn}} next in {{.Stat.NextDueIn}}{{end}}</td><td>{{.Stat.UnackedCount}}</td><td>{{.Stat.ConsumerCount}}</td><td>{{.Stat.ConnectionCount}}</td><td>{{with .Stat.Latency}}{{.P50}}/{{.P95}}/{{.P99}}{{end}}</td>{{if $.History}}<td>{{with .Sparkline}}<svg width="120" height="20"><polyline points="{{.}}" fill="none" stroke="#888"/></svg>{{end}}</td>{{end}}{{if $.Rates}}{{with .Rate}}<td>{{printf "%.1f" .Publish}}</td><td>{{printf "%.1f" .Consume}}</td><td>{{printf "%.1f" .Reject}}</td>{{else}}<td></td><td></td><td></td>{{end}}{{end}}{{if $.Actions}}<td>{{template "actions" .Name}}</td>{{end}}</tr>
+{{if not $.Condensed}}{{range .Connections}}<tr class="connection {{.Stat.Health}}"><td>{{.Name}} {{template "health" .Stat}}</td><td></td><td></td><td></td><td>{{.Stat.UnackedCount}}</td><td>{{len .Stat.Consumers}}</td><td></td><td></td></tr>
+{{range .Consumers}}<tr class="consumer"><td>{{.Name}} {{if .Stat.Busy}}busy{{else}}idle{{end}}</td><td colspan="7">processed {{.Stat.Processed}} acked {{.Stat.Acked}} rejected {{.Stat.Rejected}}</td></tr>
+{{end}}{{end}}{{end}}{{end}}
+{{if not .Condensed}}<tr><td colspan="8">other connections</td></tr>
+{{range .OtherConnections}}<tr class="connection {{.Health}}"><td>{{.Name}} {{template "health" .}}</td><td colspan="7"></td></tr>
+{{end}}{{end}}{{if .IdleConnections}}<tr class="connection"><td colspan="8">{{.IdleConnections}} idle connections</td></tr>
+{{end}}
+</table>
+{{if not .GeneratedAt.IsZero}}<p>generated at {{.GeneratedAt.Format "2006-01-02T15:04:05Z07:00"}}</p>{{end}}
+</body></html>
+{{define "actions"}}{{range $action := "purge-ready purge-rejected return-rejected reset-counters" | fields}}<form method="post" action="queues/{{$}}/{{$action}}" onsubmit="return confirm('{{$action}} {{$}}?')"><button>{{$action}}</button></form>{{end}}{{end}}
+{{define "health-banner"}}{{if .Healthy}}<p class="healthy">✓ healthy</p>{{else}}<ul class="unhealthy">
+{{- with .UnconsumedQueues}}
+<li>ready deliveries without live consumers: {{join . ", "}}</li>{{end}}
+{{- with .DeadConnections}}
+<li>dead connections waiting to be cleaned: {{join . ", "}}</li>{{end}}
+{{- with .RejectingQueues}}
+<li>many rejected deliveries: {{join . ", "}}</li>{{end}}
+{{- with .StuckQueues}}
+<li>ready count not decreasing: {{join . ", "}}</li>{{end}}
+</ul>{{end}}{{end}}
+{{define "health"}}{{if eq .Health "dead"}}✗ dead, pending clean{{else}}✓ {{.HeartbeatTTL}}{{if eq .Health "stale"}} stale{{end}}{{end}}{{end}}
+{{define "style"}}<style>
+body { font-family: monospace; }
+td { padding: 0 1em; text-align: right; }
+td:first-child { text-align: left; }
+tr.connection { color: #888; }
+tr.consumer { color: #aaa; }
+tr.stale td:first-child { color: #c80; }
+tr.dead td:first-child { color: #c00; }
+tr.consumer td:first-child { padding-left: 2em; }
+form { display: inline; }
+p.healthy { color: #080; }
+ul.unhealthy { color: #c00; }
+p.incomplete { color: #c80; }
+</style>{{end}}`))
+
+// HtmlOptions configure the overview page rendered by stats.RenderHtml()
+type HtmlOptions struct {
+	Condensed   bool                   // only list queues, not their connections
+	Refresh     int                    // reload the page every Refresh seconds, 0 to not reload
+	Sort        string                 // "ready", "rejected" or "unacked" to sort queues by count, by name otherwise
+	Descending  bool                   // sort queues in descending order
+	GeneratedAt time.Time              // shown on the page unless zero
+	Actions     bool                   // show buttons posting to queues/{name}/{action} and link queues/{name}, see example/handler.go
+	Rates       StatsRates             // show rates of queues, see RateTracker
+	History     map[string][]StatPoint // show ready counts over time by queue name, see connection.QueueHistory()
+	Health      *HealthReport          // show a banner with the health of all queues, see connection.HealthSummary()
+}
+
+// HtmlData is what OverviewTemplate gets executed with
+type HtmlData struct {
+	Condensed        bool
+	Refresh          int
+	GeneratedAt      time.Time
+	Actions          bool
+	Rates            StatsRates
+	History          map[string][]StatPoint
+	Health           *HealthReport
+	Incomplete       bool // see Stats.Incomplete
+	IdleConnections  int  // see Stats.IdleConnections
+	Queues           []HtmlQueue
+	OtherConnections []HtmlConnection // connections not consuming any queue
+}
+
+// HtmlQueue is a queue with its connections sorted by name
+type HtmlQueue struct {
+	Name        string
+	Stat        QueueStat
+	Rate        *QueueRate // nil if unknown
+	Sparkline   string     // points of an SVG polyline of the ready history, empty if unknown
+	Connections []HtmlConnectionStat
+}
+
+// HtmlConnectionStat is the stat of a connection consuming a queue with its
+// consumers sorted by name
+type HtmlConnectionStat struct {
+	Name      string
+	Stat      ConnectionStat
+	Consumers []HtmlConsumerStat
+}
+
+// HtmlConsumerStat is the stat of a consumer of a connection
+type HtmlConsumerStat struct {
+	Name string
+	Stat ConsumerStat
+}
+
+// HtmlConnection is a connection not consuming any queue
+type HtmlConnection struct {
+	Name         string
+	Active       bool
+	HeartbeatTTL time.Duration
+}
+
+// Health returns the health of the connection, see ConnectionStat.Health()
+func (connection HtmlConnection) Health() string {
+	return heartbeatHealth(connection.Active, connection.HeartbeatTTL)
+}
+
+// GetHtml renders the overview page with queues sorted by name. layout
+// "condensed" only lists queues, refresh is the reload interval in seconds
+func (stats Stats) GetHtml(layout, refresh string) string {
+	seconds, _ := strconv.Atoi(refresh)
+	var buffer bytes.Buffer
+	if err := stats.RenderHtml(&buffer, HtmlOptions{Condensed: layout == "condensed", Refresh: seconds}); err != nil {
+		return template.HTMLEscapeString(err.Error())
+	}
+	return buffer.String()
+}
+
+// RenderHtml writes the overview page rendered by OverviewTemplate to w
+func (stats Stats) RenderHtml(w io.Writer, options HtmlOptions) error {
+	return OverviewTemplate.Execute(w, stats.htmlData(options))
+}
+
+func (stats Stats) htmlData(options HtmlOptions) HtmlData {
+	data := HtmlData{Condensed: options.Condensed, Refresh: options.Refresh, GeneratedAt: options.GeneratedAt, Actions: options.Actions, Rates: options.Rates, History: options.History, Health: options.Health, Incomplete: stats.Incomplete, IdleConnections: stats.IdleConnections}
+	for _, queueName := range stats.sortedQueueNames() {
+		queueStat := stats.QueueStats[queueName]
+		queue := HtmlQueue{Name: queueName, Stat: queueStat}
+		if rate, ok := options.Rates[queueName]; ok {
+			queue.Rate = &rate
+		}
+		queue.Sparkline = sparkline(options.History[queueName], 120, 20)
+		for _, connectionName := range queueStat.ConnectionStats.sortedNames() {
+			connectionStat := queueStat.ConnectionStats[connectionName]
+			connection := HtmlConnectionStat{Name: connectionName, Stat: connectionStat}
+			consumerNames := make([]string, 0, len(connectionStat.ConsumerStats))
+			for consumerName := range connectionStat.ConsumerStats {
+				consumerNames = append(consumerNames, consumerName)
+			}
+			sort.Strings(consumerNames)
+			for _, consumerName := range consumerNames {
+				connection.Consumers = append(connection.Consumers, HtmlConsumerStat{
+					Name: consumerName,
+					Stat: connectionStat.ConsumerStats[consumerName],
+				})
+			}
+			queue.Connections = append(queue.Connections, connection)
+		}
+		data.Queues = append(data.Queues, queue)
+	}
+	for _, connectionName := range stats.sortedConnectionNames() {
+		data.OtherConnections = append(data.OtherConnections, HtmlConnection{
+			Name:         connectionName,
+			Active:       stats.otherConnections[connectionName],
+			HeartbeatTTL: stats.heartbeatTTLs[connectionName],
+		})
+	}
+
+	count := map[string]func(QueueStat) int{
+		"ready":    func(stat QueueStat) int { return stat.ReadyCount },
+		"rejected": func(stat QueueStat) int { return stat.RejectedCount },
+		"unacked":  func(stat QueueStat) int { return stat.UnackedCount() },
+	}[options.Sort]
+	sort.SliceStable(data.Queues, func(i, j int) bool {
+		a, b := data.Queues[i], data.Queues[j]
+		if options.Descending {
+			a, b = b, a
+		}
+		if count != nil {
+			return count(a.Stat) < count(b.Stat)
+		}
+		return a.Name < b.Name
+	})
+	return data
+}
+
+// sparkline returns the points of a polyline of the ready counts fitting into
+// width and height, empty if there are less than two points
+func sparkline(points []StatPoint, width, height int) string {
+	if len(points) < 2 {
+		return ""
+	}
+	start, end := points[0].Time, points[len(points)-1].Time
+	duration := end.Sub(start)
+	maxReady := 1
+	for _, point := range points {
+		if point.Ready > maxReady {
+			maxReady = point.Ready
+		}
+	}
+
+	coordinates := make([]string, 0, len(points))
+	for _, point := range points {
+		x := 0.0
+		if duration > 0 {
+			x = float64(width) * float64(point.Time.Sub(start)) / float64(duration)
+		}
+		y := float64(height) * (1 - float64(point.Ready)/float64(maxReady))
+		coordinates = append(coordinates, fmt.Sprintf("%.1f,%.1f", x, y))
+	}
+	return strings.Join(coordinates, " ")
+}
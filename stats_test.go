@@ -1,10 +1,19 @@
 package rmq
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	. "github.com/adjust/gocheck"
+	"gopkg.in/redis.v5"
 )
 
 func TestStatsSuite(t *testing.T) {
@@ -14,11 +23,11 @@ func TestStatsSuite(t *testing.T) {
 type StatsSuite struct{}
 
 func (suite *StatsSuite) TestStats(c *C) {
-	connection := OpenConnection("stats-conn", "localhost:6379", 1)
+	connection := OpenConnection("stats-conn", testRedisAddr, 1)
 	c.Assert(NewCleaner(connection).Clean(), IsNil)
 
-	conn1 := OpenConnection("stats-conn1", "localhost:6379", 1)
-	conn2 := OpenConnection("stats-conn2", "localhost:6379", 1)
+	conn1 := OpenConnection("stats-conn1", testRedisAddr, 1)
+	conn2 := OpenConnection("stats-conn2", testRedisAddr, 1)
 	q1 := conn2.OpenQueue("stats-q1").(*redisQueue)
 	q1.PurgeReady()
 	q1.Publish("stats-d1")
@@ -31,9 +40,10 @@ func (suite *StatsSuite) TestStats(c *C) {
 	q2.Publish("stats-d2")
 	q2.Publish("stats-d3")
 	q2.Publish("stats-d4")
-	time.Sleep(2 * time.Millisecond)
-	consumer.LastDeliveries[0].Ack()
-	consumer.LastDeliveries[1].Reject()
+	c.Assert(consumer.WaitForDeliveries(3, time.Second), Equals, true)
+	deliveries := consumer.Deliveries()
+	deliveries[0].Ack()
+	deliveries[1].Reject()
 	q2.AddConsumer("stats-cons2", NewTestConsumer("hand-B"))
 
 	stats := connection.CollectStats([]string{"stats-q1", "stats-q2"})
@@ -46,3 +56,276 @@ func (suite *StatsSuite) TestStats(c *C) {
 	conn1.StopHeartbeat()
 	conn2.StopHeartbeat()
 }
+
+func TestStatsMarshalJSON(t *testing.T) {
+	stats := NewStats()
+	queueStat := NewQueueStat(3, 1)
+	queueStat.Counters = QueueCounters{Published: 10, Acked: 5, Rejected: 1}
+	queueStat.ConnectionStats["conn-b"] = ConnectionStat{Active: true, UnackedCount: 2, Consumers: []string{"c2", "c1"},
+		ConsumerStats: map[string]ConsumerStat{"c2": {Processed: 3, Acked: 2, Rejected: 1, Busy: true}, "c1": {}}}
+	queueStat.ConnectionStats["conn-a"] = ConnectionStat{UnackedCount: 1}
+	stats.QueueStats["q1"] = queueStat
+	stats.otherConnections["conn-c"] = true
+	stats.heartbeatTTLs["conn-c"] = 30 * time.Second
+
+	expected := `{"version":1,"queues":{"q1":{"ready":3,"rejected":1,"unacked":3,"consumer_count":2,"checksum_mismatch":0,"quarantined":0,"scheduled":0,"next_due_in":0,` +
+		`"counters":{"published":10,"acked":5,"rejected":1,"pushed":0,"dead":0},"connections":{` +
+		`"conn-a":{"active":false,"heartbeat_ttl":0,"health":"dead","unacked":1,"consumer_count":0,"consumers":[],"oldest_unacked_age":0,"oldest_unacked_known":false,"consumer_stats":{}},` +
+		`"conn-b":{"active":true,"heartbeat_ttl":0,"health":"alive","unacked":2,"consumer_count":2,"consumers":["c1","c2"],"oldest_unacked_age":0,"oldest_unacked_known":false,` +
+		`"consumer_stats":{"c1":{"processed":0,"acked":0,"rejected":0,"busy":false},"c2":{"processed":3,"acked":2,"rejected":1,"busy":true}}}}}},` +
+		`"connections":{"conn-a":false,"conn-b":true,"conn-c":true},` +
+		`"heartbeats":{"conn-a":{"ttl":0,"health":"dead"},"conn-b":{"ttl":0,"health":"alive"},"conn-c":{"ttl":30000000000,"health":"stale"}}}`
+	for i := 0; i < 5; i++ {
+		bytes, err := json.Marshal(stats)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(bytes) != expected {
+			t.Fatalf("unexpected json\n%s\nexpected\n%s", bytes, expected)
+		}
+	}
+}
+
+func TestPipelineChunkedCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// a cancelled context must not reach Redis, so there's no need for a client
+	executed, err := pipelineChunked(ctx, nil, 3, 1, func(pipe *redis.Pipeline, i int) {
+		t.Fatalf("queued call %d", i)
+	})
+	if executed != 0 || err != context.Canceled {
+		t.Fatalf("unexpected result %d %v", executed, err)
+	}
+
+	stats := NewStats()
+	stats.Incomplete = true
+	bytes, err := json.Marshal(stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(bytes), `{"version":1,"incomplete":true,`) {
+		t.Fatalf("unexpected json %s", bytes)
+	}
+}
+
+func TestStatsWithoutIdleConnections(t *testing.T) {
+	stats := NewStats()
+	queueStat := NewQueueStat(3, 0)
+	queueStat.ConnectionStats["consumer"] = ConnectionStat{Active: true, Consumers: []string{"c1"}}
+	queueStat.ConnectionStats["unacked"] = ConnectionStat{Active: true, UnackedCount: 1}
+	queueStat.ConnectionStats["idle"] = ConnectionStat{Active: true}
+	stats.QueueStats["q1"] = queueStat
+	stats.otherConnections["publisher-1"] = true
+	stats.otherConnections["publisher-2"] = false
+
+	filtered := stats.WithoutIdleConnections()
+	if filtered.IdleConnections != 3 {
+		t.Fatalf("unexpected idle connections %d", filtered.IdleConnections)
+	}
+	if connections := filtered.Connections(); len(connections) != 2 || !connections["consumer"] || !connections["unacked"] {
+		t.Fatalf("unexpected connections %v", connections)
+	}
+	if !strings.HasSuffix(filtered.String(), "\n3 idle connections\n") {
+		t.Fatalf("unexpected string %q", filtered.String())
+	}
+	if len(stats.Connections()) != 5 || stats.IdleConnections != 0 {
+		t.Fatalf("original stats changed %v", stats.Connections())
+	}
+}
+
+func TestStatsHtmlSorting(t *testing.T) {
+	stats := NewStats()
+	for name, ready := range map[string]int{"q-b": 1, "q-a": 5, "q-c": 3} {
+		queueStat := NewQueueStat(ready, 0)
+		queueStat.ConnectionStats["conn-2"] = ConnectionStat{}
+		queueStat.ConnectionStats["conn-1"] = ConnectionStat{}
+		stats.QueueStats[name] = queueStat
+	}
+
+	for _, test := range []struct {
+		options  HtmlOptions
+		expected []string
+	}{
+		{HtmlOptions{}, []string{"q-a", "q-b", "q-c"}},
+		{HtmlOptions{Sort: "ready"}, []string{"q-b", "q-c", "q-a"}},
+		{HtmlOptions{Sort: "ready", Descending: true}, []string{"q-a", "q-c", "q-b"}},
+	} {
+		data := stats.htmlData(test.options)
+		for i, queue := range data.Queues {
+			if queue.Name != test.expected[i] {
+				t.Errorf("%+v: expected %s at %d, got %s", test.options, test.expected[i], i, queue.Name)
+			}
+			if queue.Connections[0].Name != "conn-1" {
+				t.Errorf("expected connections to be sorted, got %s first", queue.Connections[0].Name)
+			}
+		}
+	}
+
+	html := stats.GetHtml("", "5")
+	if !strings.Contains(html, `<meta http-equiv="refresh" content="5">`) {
+		t.Errorf("expected refresh in html\n%s", html)
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+// goldenStats returns stats with several queues and connections, so map
+// iteration order would show in unsorted output
+func goldenStats() Stats {
+	stats := NewStats()
+	for i, name := range []string{"q-c", "q-a", "q-d", "q-b"} {
+		queueStat := NewQueueStat(10*i, i)
+		queueStat.Counters = QueueCounters{Published: int64(100 * i), Acked: int64(90 * i)}
+		for j, connectionName := range []string{"conn-3", "conn-1", "conn-2"} {
+			queueStat.ConnectionStats[connectionName] = ConnectionStat{
+				Active:        j != 1,
+				HeartbeatTTL:  time.Duration(j*20) * time.Second,
+				UnackedCount:  i + j,
+				Consumers:     []string{"cons-b", "cons-a"},
+				ConsumerStats: map[string]ConsumerStat{"cons-b": {Processed: 2, Acked: 2}, "cons-a": {Processed: 1, Rejected: 1, Busy: true}},
+			}
+		}
+		stats.QueueStats[name] = queueStat
+	}
+	for i, connectionName := range []string{"idle-b", "idle-c", "idle-a"} {
+		stats.otherConnections[connectionName] = i != 2
+		if i != 2 {
+			stats.heartbeatTTLs[connectionName] = time.Minute
+		}
+	}
+	return stats
+}
+
+// checkGolden compares actual to the golden file testdata/name, run the tests
+// with -update to rewrite golden files after intended format changes
+func checkGolden(t *testing.T, name string, actual []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := ioutil.WriteFile(path, actual, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actual, expected) {
+		t.Errorf("%s doesn't match, got\n%s", path, actual)
+	}
+}
+
+func TestStatsGolden(t *testing.T) {
+	for i := 0; i < 5; i++ { // map iteration order differs between runs
+		stats := goldenStats()
+		checkGolden(t, "stats.txt", []byte(stats.String()))
+
+		jsonBytes, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkGolden(t, "stats.json", append(jsonBytes, '\n'))
+
+		var html bytes.Buffer
+		health := &HealthReport{StuckQueues: []string{"q-b", "q-d"}, DeadConnections: []string{"conn-1"}}
+		options := HtmlOptions{GeneratedAt: time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC), Health: health}
+		if err := stats.RenderHtml(&html, options); err != nil {
+			t.Fatal(err)
+		}
+		checkGolden(t, "stats.html", html.Bytes())
+		html.Reset()
+		options.Condensed = true
+		if err := stats.RenderHtml(&html, options); err != nil {
+			t.Fatal(err)
+		}
+		checkGolden(t, "stats_condensed.html", html.Bytes())
+	}
+}
+
+// BenchmarkCollectStats collects the stats of 500 queues consumed by 10
+// connections, run with -bench CollectStats against a local Redis
+func BenchmarkCollectStats(b *testing.B) {
+	connection := OpenConnection("stats-bench", testRedisAddr, 1)
+	defer connection.StopHeartbeat()
+
+	queueNames := make([]string, 500)
+	for i := range queueNames {
+		queueNames[i] = fmt.Sprintf("stats-bench-q%d", i)
+		connection.OpenQueue(queueNames[i]).Publish("stats-bench-d")
+	}
+	for c := 0; c < 10; c++ {
+		consumingConnection := OpenConnection(fmt.Sprintf("stats-bench-conn%d", c), testRedisAddr, 1)
+		defer consumingConnection.StopHeartbeat()
+		for _, queueName := range queueNames {
+			consumingConnection.redisClient.SAdd(consumingConnection.queuesKey, queueName)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		connection.CollectStats(queueNames)
+	}
+}
+
+func (suite *StatsSuite) TestQueueHistory(c *C) {
+	connection := OpenConnection("stats-history-conn", testRedisAddr, 1)
+	queue := connection.OpenQueue("stats-history-q").(*redisQueue)
+	queue.PurgeReady()
+	connection.redisClient.Del(queue.historyKey, statsRecorderKey)
+
+	queue.Publish("stats-history-d1")
+	connection.recordStats("recorder-1", time.Minute, time.Hour)
+	connection.recordStats("recorder-2", time.Minute, time.Hour) // within the interval
+	points := connection.QueueHistory("stats-history-q", time.Now().Add(-time.Minute))
+	c.Assert(points, HasLen, 1)
+	c.Check(points[0].Ready, Equals, 1)
+	c.Check(connection.QueueHistory("stats-history-q", time.Now().Add(time.Minute)), HasLen, 0)
+
+	histories, err := connection.QueueHistoriesCtx(context.Background(), []string{"stats-history-q", "stats-history-none-q"}, time.Now().Add(-time.Minute))
+	c.Check(err, IsNil)
+	c.Check(histories["stats-history-q"], DeepEquals, points)
+	c.Check(histories["stats-history-none-q"], HasLen, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	histories, err = connection.QueueHistoriesCtx(ctx, []string{"stats-history-q"}, time.Now().Add(-time.Minute))
+	c.Check(err, Equals, context.Canceled)
+	c.Check(histories, HasLen, 0)
+
+	connection.StopHeartbeat()
+}
+
+func TestSparkline(t *testing.T) {
+	start := time.Now()
+	points := []StatPoint{
+		{Time: start, Ready: 0},
+		{Time: start.Add(time.Minute), Ready: 10},
+		{Time: start.Add(2 * time.Minute), Ready: 5},
+	}
+	if line := sparkline(points, 100, 20); line != "0.0,20.0 50.0,0.0 100.0,10.0" {
+		t.Errorf("unexpected sparkline %s", line)
+	}
+	if line := sparkline(points[:1], 100, 20); line != "" {
+		t.Errorf("expected no sparkline for a single point, got %s", line)
+	}
+}
+
+func TestStatsWriteCSV(t *testing.T) {
+	stats := NewStats()
+	queueStat := NewQueueStat(3, 1)
+	queueStat.ConnectionStats["conn-b"] = ConnectionStat{Active: true, UnackedCount: 2, Consumers: []string{"c1", "c2"}}
+	queueStat.ConnectionStats["conn-a"] = ConnectionStat{UnackedCount: 1}
+	stats.QueueStats["orders,eu"] = queueStat
+	stats.QueueStats["idle"] = NewQueueStat(0, 0)
+
+	var buffer bytes.Buffer
+	if err := stats.WriteCSV(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	expected := "queue,connection,ready,rejected,unacked,consumers,connection_alive\n" +
+		"idle,,0,0,0,0,\n" +
+		"\"orders,eu\",conn-a,3,1,1,0,false\n" +
+		"\"orders,eu\",conn-b,3,1,2,2,true\n"
+	if buffer.String() != expected {
+		t.Errorf("unexpected csv\n%s\nexpected\n%s", buffer.String(), expected)
+	}
+}
@@ -0,0 +1,184 @@
+package rmq
+
+import (
+	"sync"
+	"time"
+)
+
+// StatsMetric is a queue count a StatsWatcher can watch
+type StatsMetric int
+
+const (
+	ReadyCount    StatsMetric = iota // QueueStat.ReadyCount
+	RejectedCount                    // QueueStat.RejectedCount
+	UnackedCount                     // QueueStat.UnackedCount() of all connections
+)
+
+func (metric StatsMetric) value(stat QueueStat) int {
+	switch metric {
+	case ReadyCount:
+		return stat.ReadyCount
+	case RejectedCount:
+		return stat.RejectedCount
+	default:
+		return stat.UnackedCount()
+	}
+}
+
+// thresholdWatch decides when a threshold callback should be called. The
+// threshold is exceeded once the value reaches it and recovers once the
+// value dropped below half of it, like rejectedWatch
+type thresholdWatch struct {
+	metric    StatsMetric
+	queue     string
+	threshold int
+	fn        func(queue string, value int, exceeded bool)
+	exceeded  bool
+}
+
+// check returns true if the callback should be called for the given value
+func (watch *thresholdWatch) check(value int) bool {
+	if watch.exceeded {
+		if value < watch.threshold/2 {
+			watch.exceeded = false
+			return true
+		}
+		return false
+	}
+	watch.exceeded = value >= watch.threshold
+	return watch.exceeded
+}
+
+// StatsWatcher collects stats every interval and calls registered callbacks
+// when queue counts cross their thresholds or connections die. All callbacks
+// share one stats collection per interval
+type StatsWatcher struct {
+	connection Connection
+	interval   time.Duration
+
+	mutex           sync.Mutex
+	queues          []string // queues with thresholds
+	thresholds      []*thresholdWatch
+	connectionDown  []func(connection string)
+	downConnections map[string]bool // connections callbacks were called for
+}
+
+// NewStatsWatcher returns a watcher collecting stats from the connection
+// every interval once started
+func NewStatsWatcher(connection Connection, interval time.Duration) *StatsWatcher {
+	return &StatsWatcher{
+		connection:      connection,
+		interval:        interval,
+		downConnections: map[string]bool{},
+	}
+}
+
+// OnThreshold calls fn with exceeded true when the metric of the queue
+// reaches threshold and with exceeded false once it drops below half the
+// threshold again, so fn isn't called on every check while the value hovers
+// around the threshold
+func (watcher *StatsWatcher) OnThreshold(metric StatsMetric, queue string, threshold int, fn func(queue string, value int, exceeded bool)) *StatsWatcher {
+	watcher.mutex.Lock()
+	defer watcher.mutex.Unlock()
+	watcher.thresholds = append(watcher.thresholds, &thresholdWatch{metric: metric, queue: queue, threshold: threshold, fn: fn})
+	for _, name := range watcher.queues {
+		if name == queue {
+			return watcher
+		}
+	}
+	watcher.queues = append(watcher.queues, queue)
+	return watcher
+}
+
+// OnConnectionDown calls fn once for each connection found without heartbeat.
+// Only connections consuming watched queues or no queue at all are checked.
+// fn is called again if a connection of the same name dies after it was
+// cleaned
+func (watcher *StatsWatcher) OnConnectionDown(fn func(connection string)) *StatsWatcher {
+	watcher.mutex.Lock()
+	defer watcher.mutex.Unlock()
+	watcher.connectionDown = append(watcher.connectionDown, fn)
+	return watcher
+}
+
+// Start starts watching in a goroutine. Failed collections are skipped. Call
+// the returned function to stop watching
+func (watcher *StatsWatcher) Start() (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(watcher.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if stats, ok := watcher.collect(); ok {
+				watcher.check(stats)
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// collect collects the stats of all watched queues, returning false if that
+// failed
+func (watcher *StatsWatcher) collect() (stats Stats, ok bool) {
+	defer func() {
+		if recover() != nil { // stats collection panics on Redis errors
+			ok = false
+		}
+	}()
+
+	watcher.mutex.Lock()
+	queues := append([]string{}, watcher.queues...)
+	watcher.mutex.Unlock()
+	return watcher.connection.CollectStats(queues), true
+}
+
+// check calls the callbacks of thresholds crossed and connections died since
+// the previous check
+func (watcher *StatsWatcher) check(stats Stats) {
+	var calls []func()
+
+	watcher.mutex.Lock()
+	for _, watch := range watcher.thresholds {
+		queueStat, ok := stats.QueueStats[watch.queue]
+		if !ok {
+			continue
+		}
+		value := watch.metric.value(queueStat)
+		if watch.check(value) {
+			watch, exceeded := watch, watch.exceeded
+			calls = append(calls, func() { watch.fn(watch.queue, value, exceeded) })
+		}
+	}
+
+	connections := stats.Connections()
+	for name, active := range connections {
+		if active || watcher.downConnections[name] {
+			continue
+		}
+		watcher.downConnections[name] = true
+		for _, fn := range watcher.connectionDown {
+			name, fn := name, fn
+			calls = append(calls, func() { fn(name) })
+		}
+	}
+	for name := range watcher.downConnections {
+		if _, ok := connections[name]; !ok {
+			delete(watcher.downConnections, name) // cleaned
+		}
+	}
+	watcher.mutex.Unlock()
+
+	// outside the lock so callbacks can register further callbacks
+	for _, call := range calls {
+		call()
+	}
+}
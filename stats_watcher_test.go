@@ -0,0 +1,43 @@
+package rmq
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestStatsWatcherCheck(t *testing.T) {
+	var calls []string
+	watcher := NewStatsWatcher(nil, 0).
+		OnThreshold(ReadyCount, "q1", 10, func(queue string, value int, exceeded bool) {
+			calls = append(calls, fmt.Sprintf("ready %s %d %t", queue, value, exceeded))
+		}).
+		OnThreshold(RejectedCount, "q1", 2, func(queue string, value int, exceeded bool) {
+			calls = append(calls, fmt.Sprintf("rejected %s %d %t", queue, value, exceeded))
+		}).
+		OnConnectionDown(func(connection string) {
+			calls = append(calls, "down "+connection)
+		})
+	if !reflect.DeepEqual(watcher.queues, []string{"q1"}) {
+		t.Errorf("expected q1 to be collected once, got %v", watcher.queues)
+	}
+
+	check := func(ready, rejected int, connections map[string]bool, expected ...string) {
+		t.Helper()
+		stats := NewStats()
+		stats.QueueStats["q1"] = NewQueueStat(ready, rejected)
+		stats.otherConnections = connections
+		calls = nil
+		watcher.check(stats)
+		if len(calls) != len(expected) || len(expected) > 0 && !reflect.DeepEqual(calls, expected) {
+			t.Errorf("ready %d rejected %d: expected calls %v, got %v", ready, rejected, expected, calls)
+		}
+	}
+
+	check(9, 0, map[string]bool{"c1": true})
+	check(10, 0, map[string]bool{"c1": true}, "ready q1 10 true")
+	check(12, 0, map[string]bool{"c1": false}, "down c1")
+	check(6, 0, map[string]bool{"c1": false}) // hysteresis
+	check(4, 3, nil, "ready q1 4 false", "rejected q1 3 true")
+	check(11, 0, map[string]bool{"c1": false}, "ready q1 11 true", "rejected q1 0 false", "down c1")
+}
@@ -0,0 +1,217 @@
+package rmq
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// streamDelivery is a delivery consumed from a streamQueue. It's an entry
+// pending for the consumer group, settling it acknowledges and deletes the
+// entry, rejecting it additionally adds it to the queue's rejected stream
+type streamDelivery struct {
+	*wrapDelivery
+	id    string // id of the stream entry
+	queue *streamQueue
+}
+
+func (delivery *streamDelivery) String() string {
+	return fmt.Sprintf("[%s %s %s]", delivery.payload, delivery.queue.streamKey, delivery.id)
+}
+
+// WithHeader returns a copy of the delivery with the given header set, see
+// wrapDelivery.WithHeader()
+func (delivery *streamDelivery) WithHeader(key, value string) Delivery {
+	copied := *delivery
+	copied.wrapDelivery = delivery.wrapDelivery.WithHeader(key, value).(*wrapDelivery)
+	return &copied
+}
+
+func (delivery *streamDelivery) Ack() bool {
+	return settleResult(delivery.AckErr())
+}
+
+// AckErr is like wrapDelivery.AckErr(), ErrDeliveryNotFound is returned if the
+// entry wasn't pending anymore, for example because the cleaner reclaimed it
+func (delivery *streamDelivery) AckErr() error {
+	if !delivery.settle(Acked) {
+		return ErrAlreadySettled
+	}
+	return delivery.settled(delivery.ack())
+}
+
+func (delivery *streamDelivery) ack() error {
+	result := streamAckScript.run(delivery.redisClient, []string{delivery.queue.streamKey}, streamGroup, delivery.id)
+	if err := redisErr(result); err != nil {
+		return err
+	}
+	if result.Val() != int64(1) {
+		return ErrDeliveryNotFound
+	}
+	delivery.counters.add(counterAcked)
+	return nil
+}
+
+func (delivery *streamDelivery) Reject() bool {
+	return settleResult(delivery.RejectErr())
+}
+
+func (delivery *streamDelivery) RejectErr() error {
+	if !delivery.settle(Rejected) {
+		return ErrAlreadySettled
+	}
+	return delivery.settled(delivery.reject(""))
+}
+
+// RejectWithReason rejects the delivery and stores the reason and time of the
+// rejection along with it in the rejected stream
+func (delivery *streamDelivery) RejectWithReason(reason string) bool {
+	if !delivery.settle(Rejected) {
+		return false
+	}
+	return settleResult(delivery.settled(delivery.reject(reason)))
+}
+
+func (delivery *streamDelivery) RejectWithError(err error) bool {
+	return delivery.RejectWithReason(errorReason(err))
+}
+
+// reject moves the entry to the rejected stream, storing the reason unless
+// it's empty
+func (delivery *streamDelivery) reject(reason string) error {
+	rejection := encodeRejection(reason, delivery.connection, delivery.consumer, delivery.clock.Now())
+	keys := []string{delivery.queue.streamKey, delivery.queue.rejectedStreamKey}
+	result := streamRejectScript.run(delivery.redisClient, keys, streamGroup, delivery.id, delivery.wire, rejection, delivery.rejectedMax)
+	if err := redisErr(result); err != nil {
+		return err
+	}
+	dropped, _ := result.Val().(int64)
+	if dropped < 0 {
+		return ErrDeliveryNotFound
+	}
+	delivery.counters.add(counterRejected)
+	reportTrimmed(delivery.hooks, delivery.queueName, dropped)
+	return nil
+}
+
+func (delivery *streamDelivery) Push() bool {
+	return settleResult(delivery.PushErr())
+}
+
+// PushErr is like wrapDelivery.PushErr(), pushing to the list or stream queue
+// set by queue.SetPushQueue()
+func (delivery *streamDelivery) PushErr() error {
+	if !delivery.settle(Pushed) {
+		return ErrAlreadySettled
+	}
+	return delivery.settled(delivery.push())
+}
+
+func (delivery *streamDelivery) push() error {
+	target := delivery.queue.pushTarget
+	if target == nil {
+		delivery.setState(Rejected)
+		return delivery.reject("")
+	}
+
+	pushCount, _ := strconv.Atoi(delivery.headers[HeaderPushCount])
+	if pushCount >= maxPushDepth {
+		delivery.setState(Rejected)
+		if err := delivery.reject(ErrPushChainTooDeep.Error()); err != nil {
+			return err
+		}
+		return ErrPushChainTooDeep
+	}
+
+	headers := delivery.copyHeaders()
+	headers[HeaderPushCount] = strconv.Itoa(pushCount + 1)
+	return delivery.count(counterPushed, delivery.moveTo(target, delivery.rewrap(headers)))
+}
+
+// Dead moves the delivery to the dead letter queue, see wrapDelivery.Dead()
+func (delivery *streamDelivery) Dead() error {
+	if !delivery.settle(Dead) {
+		return ErrAlreadySettled
+	}
+	return delivery.settled(delivery.dead())
+}
+
+func (delivery *streamDelivery) dead() error {
+	target := delivery.queue.deadTarget
+	if target == nil {
+		delivery.setState(Rejected)
+		if err := delivery.reject(""); err != nil {
+			return err
+		}
+		return ErrNoDeadLetterQueue
+	}
+
+	headers := delivery.copyHeaders()
+	headers[HeaderOriginQueue] = delivery.queueName
+	return delivery.count(counterDead, delivery.moveTo(target, delivery.rewrap(headers)))
+}
+
+// moveTo publishes wire to the target and then acknowledges the entry. Like
+// moves of list deliveries this isn't atomic, the error describes which half
+// failed
+func (delivery *streamDelivery) moveTo(target *streamTarget, wire []byte) error {
+	if err := target.publish(delivery.queue.redisQueue, wire); err != nil {
+		return err
+	}
+
+	result := streamAckScript.run(delivery.redisClient, []string{delivery.queue.streamKey}, streamGroup, delivery.id)
+	if err := redisErr(result); err != nil {
+		return fmt.Errorf("rmq delivery pushed to %s, but failed to acknowledge %s: %w", target.name, delivery, err)
+	}
+	return nil
+}
+
+// CopyTo publishes a copy of the delivery to the queue with the given name,
+// see wrapDelivery.CopyTo(). Copies to stream queues get added to their
+// stream
+func (delivery *streamDelivery) CopyTo(queueName string) error {
+	isStream, err := delivery.backend.isMember(streamQueuesKey, queueName)
+	if err != nil {
+		return err
+	}
+	if !isStream {
+		return delivery.wrapDelivery.CopyTo(queueName)
+	}
+
+	headers := delivery.copyHeaders()
+	headers[HeaderCopyOf] = delivery.queueName
+	streamKey, _ := streamQueueKeys(queueName)
+	target := &streamTarget{name: queueName, key: streamKey, stream: true}
+	if err := target.publish(delivery.queue.redisQueue, delivery.rewrap(headers)); err != nil {
+		return err
+	}
+
+	if hook := delivery.hooks.OnCopy; hook != nil {
+		hook(delivery, queueName)
+	}
+	return nil
+}
+
+// Extend resets the idle time of the entry, so the cleaner doesn't reclaim it
+// before it was idle for its min idle time again. Returns false if the entry
+// isn't pending for this connection anymore. The timeout is ignored, see
+// cleaner.SetStreamMinIdle()
+func (delivery *streamDelivery) Extend(timeout time.Duration) bool {
+	result := streamExtendScript.run(delivery.redisClient, []string{delivery.queue.streamKey}, streamGroup, delivery.connection, delivery.id)
+	if redisErrIsNil(result) {
+		return false
+	}
+	return result.Val() == int64(1)
+}
+
+// unwrapDelivery returns the wrapDelivery of a delivery consumed from a list
+// or stream queue
+func unwrapDelivery(delivery Delivery) (*wrapDelivery, bool) {
+	switch delivery := delivery.(type) {
+	case *wrapDelivery:
+		return delivery, true
+	case *streamDelivery:
+		return delivery.wrapDelivery, true
+	}
+	return nil, false
+}
@@ -0,0 +1,981 @@
+package rmq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"gopkg.in/redis.v5"
+)
+
+const (
+	streamGroup          = "rmq" // consumer group of all stream queues, its consumers are named after connections
+	streamScanSize       = 1000  // number of stream entries read per script call when paging
+	defaultStreamMinIdle = 10 * time.Minute
+)
+
+// ErrStreamUnsupported is returned by the methods of stream queues which only
+// list queues support, see connection.OpenStreamQueue()
+var ErrStreamUnsupported = errors.New("rmq operation not supported by stream queues")
+
+// streamFieldLua defines field(), which returns the value of a field of a
+// stream entry, empty if it's missing
+const streamFieldLua = `
+local function field(fields, name)
+	for i = 1, #fields, 2 do
+		if fields[i] == name then
+			return fields[i + 1]
+		end
+	end
+	return ''
+end
+`
+
+// lastDeliveredLua defines lastDelivered(), which returns the id of the last
+// entry of the stream KEYS[1] read by the group ARGV[1]. Entries after it are
+// ready, the ones before it which are still in the stream unacked
+const lastDeliveredLua = `
+local function lastDelivered()
+	local groups = redis.pcall('XINFO', 'GROUPS', KEYS[1])
+	if groups.err then
+		return '0-0'
+	end
+	for _, group in ipairs(groups) do
+		local name, last
+		for i = 1, #group, 2 do
+			if group[i] == 'name' then
+				name = group[i + 1]
+			elseif group[i] == 'last-delivered-id' then
+				last = group[i + 1]
+			end
+		end
+		if name == ARGV[1] then
+			return last
+		end
+	end
+	return '0-0'
+end
+`
+
+var (
+	// streamAddScript adds the wire payload ARGV[1] to the stream KEYS[1] and
+	// returns its id
+	streamAddScript = newScript("streamAdd", `
+return redis.call('XADD', KEYS[1], '*', 'payload', ARGV[1])
+`)
+
+	// streamReadScript reads up to ARGV[3] new entries of the stream KEYS[1] as
+	// the consumer ARGV[2] of the group ARGV[1], creating the group if needed.
+	// Returns their ids and payloads, alternating
+	streamReadScript = newScript("streamRead", streamFieldLua+`
+redis.pcall('XGROUP', 'CREATE', KEYS[1], ARGV[1], '0', 'MKSTREAM')
+local reply = redis.call('XREADGROUP', 'GROUP', ARGV[1], ARGV[2], 'COUNT', ARGV[3], 'STREAMS', KEYS[1], '>')
+local read = {}
+if not reply then
+	return read
+end
+for _, entry in ipairs(reply[1][2]) do
+	read[#read + 1] = entry[1]
+	read[#read + 1] = field(entry[2], 'payload')
+end
+return read
+`)
+
+	// streamAckScript acknowledges the entry ARGV[2] of the stream KEYS[1] for
+	// the group ARGV[1] and deletes it. Returns 0 if it wasn't pending
+	streamAckScript = newScript("streamAck", `
+local acked = redis.call('XACK', KEYS[1], ARGV[1], ARGV[2])
+if acked == 1 then
+	redis.call('XDEL', KEYS[1], ARGV[2])
+end
+return acked
+`)
+
+	// streamRejectScript acknowledges and deletes the entry ARGV[2] like
+	// streamAckScript and adds its wire payload ARGV[3] to the rejected stream
+	// KEYS[2] along with the JSON encoded rejection ARGV[4] (if not empty),
+	// trimming the rejected stream to ARGV[5] entries if that's positive.
+	// Returns the number of trimmed entries, -1 if the entry wasn't pending
+	streamRejectScript = newScript("streamReject", `
+if redis.call('XACK', KEYS[1], ARGV[1], ARGV[2]) == 0 then
+	return -1
+end
+redis.call('XDEL', KEYS[1], ARGV[2])
+local fields = {'payload', ARGV[3]}
+if ARGV[4] ~= '' then
+	fields[3] = 'rejection'
+	fields[4] = ARGV[4]
+end
+local maxLength = tonumber(ARGV[5])
+if maxLength <= 0 then
+	redis.call('XADD', KEYS[2], '*', unpack(fields))
+	return 0
+end
+local dropped = redis.call('XLEN', KEYS[2]) + 1 - maxLength
+redis.call('XADD', KEYS[2], 'MAXLEN', maxLength, '*', unpack(fields))
+return math.max(dropped, 0)
+`)
+
+	// streamExtendScript resets the idle time of the entry ARGV[3] pending for
+	// the consumer ARGV[2] of the group ARGV[1]. Returns 0 if it isn't pending
+	streamExtendScript = newScript("streamExtend", `
+return #redis.call('XCLAIM', KEYS[1], ARGV[1], ARGV[2], 0, ARGV[3], 'JUSTID')
+`)
+
+	// streamCountsScript returns the length of the stream KEYS[1], the number
+	// of its entries pending for the group ARGV[1] and the length of the
+	// rejected stream KEYS[2], followed by the names of the consumers with
+	// pending entries alternating with their numbers of pending entries
+	streamCountsScript = newScript("streamCounts", `
+local counts = {redis.call('XLEN', KEYS[1]), 0, redis.call('XLEN', KEYS[2])}
+local pending = redis.pcall('XPENDING', KEYS[1], ARGV[1])
+if pending.err then
+	return counts
+end
+counts[2] = pending[1]
+if pending[4] then
+	for _, consumer in ipairs(pending[4]) do
+		counts[#counts + 1] = consumer[1]
+		counts[#counts + 1] = tonumber(consumer[2])
+	end
+end
+return counts
+`)
+
+	// streamReadyScript returns the payloads of up to ARGV[2] ready entries of
+	// the stream KEYS[1], oldest first. If ARGV[3] is set it deletes them
+	streamReadyScript = newScript("streamReady", streamFieldLua+lastDeliveredLua+`
+local entries = redis.call('XRANGE', KEYS[1], '(' .. lastDelivered(), '+', 'COUNT', ARGV[2])
+local payloads = {}
+for _, entry in ipairs(entries) do
+	payloads[#payloads + 1] = field(entry[2], 'payload')
+	if ARGV[3] then
+		redis.call('XDEL', KEYS[1], entry[1])
+	end
+end
+return payloads
+`)
+
+	// streamPendingScript handles up to ARGV[3] entries of the stream KEYS[1]
+	// pending for the consumer ARGV[2] of the group ARGV[1]: Unless ARGV[4] is
+	// set they get acknowledged and deleted, with ARGV[4] set to 'return' they
+	// get added to the stream again first, so they're ready again. Returns
+	// their payloads, oldest first
+	streamPendingScript = newScript("streamPending", streamFieldLua+`
+local pending = redis.pcall('XPENDING', KEYS[1], ARGV[1], '-', '+', ARGV[3], ARGV[2])
+local payloads = {}
+if pending.err then
+	return payloads
+end
+for _, entry in ipairs(pending) do
+	local entries = redis.call('XRANGE', KEYS[1], entry[1], entry[1])
+	local payload = ''
+	if entries[1] then
+		payload = field(entries[1][2], 'payload')
+	end
+	payloads[#payloads + 1] = payload
+	if ARGV[4] ~= 'peek' then
+		if ARGV[4] == 'return' and entries[1] then
+			redis.call('XADD', KEYS[1], '*', 'payload', payload)
+		end
+		redis.call('XACK', KEYS[1], ARGV[1], entry[1])
+		redis.call('XDEL', KEYS[1], entry[1])
+	end
+end
+return payloads
+`)
+
+	// streamReclaimScript claims up to ARGV[4] entries of the stream KEYS[1]
+	// which were pending for the group ARGV[1] for at least ARGV[3] ms, starting
+	// at the id ARGV[5], as consumer ARGV[2] and adds them to the stream again,
+	// so they're ready again. Returns the number of reclaimed entries and the
+	// id to continue with, 0-0 once all pending entries were checked
+	streamReclaimScript = newScript("streamReclaim", streamFieldLua+`
+local reply = redis.pcall('XAUTOCLAIM', KEYS[1], ARGV[1], ARGV[2], ARGV[3], ARGV[5], 'COUNT', ARGV[4])
+if reply.err then
+	return {0, '0-0'}
+end
+local reclaimed = 0
+for _, entry in ipairs(reply[2]) do
+	if type(entry) == 'table' then
+		redis.call('XADD', KEYS[1], '*', 'payload', field(entry[2], 'payload'))
+		redis.call('XACK', KEYS[1], ARGV[1], entry[1])
+		redis.call('XDEL', KEYS[1], entry[1])
+		reclaimed = reclaimed + 1
+	end
+end
+return {reclaimed, reply[1]}
+`)
+
+	// streamRejectedScript returns up to ARGV[2] entries of the rejected stream
+	// KEYS[1], newest first, starting before the id ARGV[1] ('+' to start with
+	// the newest one). Returns their ids, payloads and rejections, alternating
+	streamRejectedScript = newScript("streamRejected", streamFieldLua+`
+local start = ARGV[1]
+if start ~= '+' then
+	start = '(' .. start
+end
+local rejected = {}
+for _, entry in ipairs(redis.call('XREVRANGE', KEYS[1], start, '-', 'COUNT', ARGV[2])) do
+	rejected[#rejected + 1] = entry[1]
+	rejected[#rejected + 1] = field(entry[2], 'payload')
+	rejected[#rejected + 1] = field(entry[2], 'rejection')
+end
+return rejected
+`)
+
+	// streamReturnRejectedScript moves the entries ARGV[1..n] of the rejected
+	// stream KEYS[1] to the stream KEYS[2], or its oldest ARGV[1] entries if
+	// that's a number. Returns the number of moved entries
+	streamReturnRejectedScript = newScript("streamReturnRejected", streamFieldLua+`
+local entries = {}
+if tonumber(ARGV[1]) then
+	entries = redis.call('XRANGE', KEYS[1], '-', '+', 'COUNT', ARGV[1])
+else
+	for _, id in ipairs(ARGV) do
+		local found = redis.call('XRANGE', KEYS[1], id, id)
+		if found[1] then
+			entries[#entries + 1] = found[1]
+		end
+	end
+end
+for _, entry in ipairs(entries) do
+	redis.call('XADD', KEYS[2], '*', 'payload', field(entry[2], 'payload'))
+	redis.call('XDEL', KEYS[1], entry[1])
+end
+return #entries
+`)
+
+	// streamTrimScript trims the stream KEYS[1] to its newest ARGV[1] entries,
+	// deleting it if that's 0. Returns the number of dropped entries
+	streamTrimScript = newScript("streamTrim", `
+local length = redis.call('XLEN', KEYS[1])
+local maxLength = tonumber(ARGV[1])
+if length <= maxLength then
+	return 0
+end
+if maxLength == 0 then
+	redis.call('DEL', KEYS[1])
+else
+	redis.call('XTRIM', KEYS[1], 'MAXLEN', maxLength)
+end
+return length - maxLength
+`)
+
+	// streamDeleteScript deletes the entries ARGV[1..n] of the stream KEYS[1]
+	// and returns how many it deleted
+	streamDeleteScript = newScript("streamDelete", `
+return redis.call('XDEL', KEYS[1], unpack(ARGV))
+`)
+)
+
+// streamQueue is a queue stored in a Redis stream instead of lists, see
+// connection.OpenStreamQueue(). It shares consumers, hooks, counters and
+// consumer stats with the list queue it embeds, only reading, settling and
+// inspecting deliveries is done on the streams
+type streamQueue struct {
+	*redisQueue
+	streamKey         string
+	rejectedStreamKey string
+	pushTarget        *streamTarget // nil if there's no push queue
+	deadTarget        *streamTarget // nil if there's no dead letter queue
+}
+
+// streamTarget is a queue stream deliveries get pushed or dead lettered to,
+// either a list queue or another stream queue
+type streamTarget struct {
+	name   string // name of the queue, only used in errors
+	key    string // ready list or stream
+	stream bool
+}
+
+// newStreamTarget returns the target of a list or stream queue, nil for other
+// queues
+func newStreamTarget(queue Queue) *streamTarget {
+	switch queue := queue.(type) {
+	case *streamQueue:
+		return &streamTarget{name: queue.name, key: queue.streamKey, stream: true}
+	case *redisQueue:
+		return &streamTarget{name: queue.name, key: queue.readyKey}
+	}
+	return nil
+}
+
+// publish adds wire to the target
+func (target *streamTarget) publish(queue *redisQueue, wire []byte) error {
+	if target.stream {
+		return redisErr(streamAddScript.run(queue.redisClient, []string{target.key}, wire))
+	}
+	return queue.backend.push(target.key, string(wire))
+}
+
+// openStreamQueue opens a stream queue without adding it to the sets of queues
+func (connection *RedisConnection) openStreamQueue(name string) *streamQueue {
+	queue := &streamQueue{redisQueue: connection.openQueue(name)}
+	queue.streamKey, queue.rejectedStreamKey = streamQueueKeys(name)
+	if connection.deadKey != "" {
+		// the connection only knows the dead letter queue's ready list
+		queue.deadTarget = &streamTarget{name: connection.deadKey, key: connection.deadKey}
+	}
+	queue.fetchStream = queue.fetch
+	queue.unackedStream = func() (int64, error) {
+		counts, err := queue.counts()
+		return counts.unacked[queue.connectionName], err
+	}
+	return queue
+}
+
+func (queue *streamQueue) String() string {
+	return fmt.Sprintf("[%s conn:%s stream]", queue.name, queue.connectionName)
+}
+
+// Publish adds a delivery with the given payload to the stream
+func (queue *streamQueue) Publish(payload string) bool {
+	if queue.checksums {
+		return queue.PublishWithHeaders(payload, nil)
+	}
+	return queue.publish([]byte(payload))
+}
+
+// PublishBytes just casts the bytes and calls Publish
+func (queue *streamQueue) PublishBytes(payload []byte) bool {
+	return queue.Publish(string(payload))
+}
+
+// PublishWithHeaders is like queue.PublishWithHeaders() of list queues
+func (queue *streamQueue) PublishWithHeaders(payload string, headers map[string]string) bool {
+	return queue.publish(queue.wrap(payload, headers))
+}
+
+// PublishWithContext is like queue.PublishWithContext() of list queues
+func (queue *streamQueue) PublishWithContext(ctx context.Context, payload string) bool {
+	if queue.tracer == nil {
+		return queue.Publish(payload)
+	}
+
+	headers := map[string]string{}
+	queue.tracer.Inject(ctx, headers)
+	return queue.PublishWithHeaders(payload, headers)
+}
+
+func (queue *streamQueue) publish(wire []byte) bool {
+	queue.touch()
+	if err := redisErr(streamAddScript.run(queue.redisClient, []string{queue.streamKey}, wire)); err != nil {
+		log.Panicf("rmq redis error is not nil %s", err)
+	}
+	queue.cumulative.add(counterPublished)
+	return true
+}
+
+// fetch reads up to the free prefetch capacity of new entries into the
+// delivery channel, returns true if it read as many as it could
+func (queue *streamQueue) fetch() (bool, error) {
+	batchSize := queue.prefetchLimit - len(queue.deliveryChan)
+	if batchSize <= 0 {
+		return false, nil
+	}
+
+	result := streamReadScript.run(queue.redisClient, []string{queue.streamKey}, streamGroup, queue.connectionName, batchSize)
+	if err := redisErr(result); err != nil {
+		return false, err
+	}
+	read, _ := result.Val().([]interface{})
+	for i := 0; i+1 < len(read); i += 2 {
+		id, _ := read[i].(string)
+		wire, _ := read[i+1].(string)
+		queue.deliver(queue.newStreamDelivery(id, []byte(wire)))
+	}
+	return len(read)/2 == batchSize, nil
+}
+
+func (queue *streamQueue) newStreamDelivery(id string, wire []byte) *streamDelivery {
+	return &streamDelivery{wrapDelivery: queue.newDelivery(wire), id: id, queue: queue}
+}
+
+// deliver passes the delivery on to the consumers, unless its checksum doesn't
+// match, in which case it gets rejected
+func (queue *streamQueue) deliver(delivery *streamDelivery) {
+	if !delivery.corrupt {
+		queue.deliveryChan <- delivery
+		return
+	}
+
+	delivery.RejectWithReason(ErrChecksumMismatch.Error())
+	redisErrIsNil(queue.redisClient.Incr(queue.checksumKey))
+}
+
+// SetPushQueue sets the queue deliveries get pushed to, a list or a stream
+// queue. Pass nil to remove the push queue. Unlike for list queues push
+// chains aren't tracked, only pushing to the queue itself is refused
+func (queue *streamQueue) SetPushQueue(pushQueue Queue) error {
+	if pushQueue == nil {
+		queue.pushTarget = nil
+		return nil
+	}
+
+	target := newStreamTarget(pushQueue)
+	if target == nil {
+		return fmt.Errorf("rmq queue push queue must be a Redis queue %s %s", queue, pushQueue)
+	}
+	if target.name == queue.name {
+		return fmt.Errorf("rmq queue push queue would introduce a cycle %s -> %s", queue.name, queue.name)
+	}
+	queue.pushTarget = target
+	return nil
+}
+
+func (queue *streamQueue) PushQueueName() string {
+	if queue.pushTarget == nil {
+		return ""
+	}
+	return queue.pushTarget.name
+}
+
+// PushChain returns the name of the queue followed by the one of its push
+// queue, if any
+func (queue *streamQueue) PushChain() []string {
+	if queue.pushTarget == nil {
+		return []string{queue.name}
+	}
+	return []string{queue.name, queue.pushTarget.name}
+}
+
+// SetDeadLetterQueue sets the list or stream queue dead lettered deliveries
+// get moved to, overriding the connection's dead letter queue
+func (queue *streamQueue) SetDeadLetterQueue(deadQueue Queue) {
+	if target := newStreamTarget(deadQueue); target != nil {
+		queue.deadTarget = target
+	}
+}
+
+// SetVisibilityTimeout does nothing, unsettled entries of stream queues get
+// reclaimed by the cleaner once they were idle for its min idle time, see
+// cleaner.SetStreamMinIdle()
+func (queue *streamQueue) SetVisibilityTimeout(timeout time.Duration) {}
+
+// SetRetryPolicy does nothing, stream queues don't retry rejected deliveries
+func (queue *streamQueue) SetRetryPolicy(policy *RetryPolicy) {}
+
+// SetQuarantineFilter does nothing, stream queues have no quarantine
+func (queue *streamQueue) SetQuarantineFilter(filter func(payload []byte) bool, quarantineQueue string) {
+}
+
+// AckMany acknowledges the deliveries one by one
+func (queue *streamQueue) AckMany(deliveries []Delivery) (acked int, failed []Delivery, err error) {
+	for _, delivery := range deliveries {
+		ackErr := delivery.AckErr()
+		switch ackErr {
+		case nil:
+			acked++
+			continue
+		case ErrDeliveryNotFound, ErrAlreadySettled:
+		default:
+			if err == nil {
+				err = ackErr
+			}
+		}
+		failed = append(failed, delivery)
+	}
+	return acked, failed, err
+}
+
+// streamCounts are the counts returned by streamCountsScript
+type streamCounts struct {
+	length   int64
+	pending  int64
+	rejected int64
+	unacked  map[string]int64 // pending entries by connection name
+}
+
+// ready returns the number of entries not read by any connection yet
+func (counts streamCounts) ready() int64 {
+	return counts.length - counts.pending
+}
+
+func (queue *streamQueue) counts() (streamCounts, error) {
+	result := streamCountsScript.run(queue.redisClient, []string{queue.streamKey, queue.rejectedStreamKey}, streamGroup)
+	if err := redisErr(result); err != nil {
+		return streamCounts{}, err
+	}
+	values, _ := result.Val().([]interface{})
+	return parseStreamCounts(values), nil
+}
+
+func parseStreamCounts(values []interface{}) streamCounts {
+	counts := streamCounts{unacked: map[string]int64{}}
+	if len(values) < 3 {
+		return counts
+	}
+	counts.length, _ = values[0].(int64)
+	counts.pending, _ = values[1].(int64)
+	counts.rejected, _ = values[2].(int64)
+	for i := 3; i+1 < len(values); i += 2 {
+		name, _ := values[i].(string)
+		counts.unacked[name], _ = values[i+1].(int64)
+	}
+	return counts
+}
+
+// mustCounts returns the counts of the queue, panicking on Redis errors
+func (queue *streamQueue) mustCounts() streamCounts {
+	counts, err := queue.counts()
+	if err != nil {
+		log.Panicf("rmq redis error is not nil %s", err)
+	}
+	return counts
+}
+
+// ReadyCount returns the number of entries not read by any connection yet
+func (queue *streamQueue) ReadyCount() int {
+	return int(queue.mustCounts().ready())
+}
+
+// UnackedCount returns the number of entries pending for this queue's
+// connection
+func (queue *streamQueue) UnackedCount() int {
+	return int(queue.mustCounts().unacked[queue.connectionName])
+}
+
+// DelayedCount returns 0, stream queues don't retry rejected deliveries
+func (queue *streamQueue) DelayedCount() int {
+	return 0
+}
+
+func (queue *streamQueue) RejectedCount() int {
+	return int(queue.mustCounts().rejected)
+}
+
+func (queue *streamQueue) PurgeReady() bool {
+	return purgeResult(queue.PurgeReadyErr())
+}
+
+// PurgeReadyErr removes all entries not read yet in batches and returns how
+// many it removed
+func (queue *streamQueue) PurgeReadyErr() (removed int64, err error) {
+	for {
+		result := streamReadyScript.run(queue.redisClient, []string{queue.streamKey}, streamGroup, streamScanSize, "purge")
+		if err := redisErr(result); err != nil {
+			return removed, err
+		}
+		purged, _ := result.Val().([]interface{})
+		removed += int64(len(purged))
+		if len(purged) < streamScanSize {
+			return removed, nil
+		}
+	}
+}
+
+func (queue *streamQueue) PurgeRejected() bool {
+	return purgeResult(queue.PurgeRejectedErr())
+}
+
+// PurgeRejectedErr removes all rejected entries and returns how many it
+// removed
+func (queue *streamQueue) PurgeRejectedErr() (removed int64, err error) {
+	return queue.TrimRejected(0)
+}
+
+// PurgeUnacked removes all entries pending for this queue's connection and
+// returns how many it removed. The same warning as for list queues applies,
+// see queue.PurgeUnacked()
+func (queue *streamQueue) PurgeUnacked() (removed int64, err error) {
+	purged, err := queue.handlePending("purge")
+	return int64(purged), err
+}
+
+// ReturnAllUnacked adds all entries pending for this queue's connection to the
+// stream again, so they're ready again, and returns how many it returned.
+// Returns ErrConsumersActive if the queue's consumers are still active
+func (queue *streamQueue) ReturnAllUnacked() (returned int, err error) {
+	if queue.consumersActive() {
+		return 0, ErrConsumersActive
+	}
+	return queue.ForceReturnAllUnacked()
+}
+
+// ForceReturnAllUnacked is like ReturnAllUnacked, but returns the pending
+// entries even if this queue's consumers are still active
+func (queue *streamQueue) ForceReturnAllUnacked() (returned int, err error) {
+	return queue.handlePending("return")
+}
+
+// handlePending runs streamPendingScript in the given mode until all entries
+// pending for this queue's connection were handled, returns their number
+func (queue *streamQueue) handlePending(mode string) (handled int, err error) {
+	for {
+		payloads, err := queue.pending(streamScanSize, mode)
+		handled += len(payloads)
+		if err != nil || len(payloads) < streamScanSize {
+			return handled, err
+		}
+	}
+}
+
+func (queue *streamQueue) pending(count int, mode string) ([]string, error) {
+	result := streamPendingScript.run(queue.redisClient, []string{queue.streamKey}, streamGroup, queue.connectionName, count, mode)
+	if err := redisErr(result); err != nil {
+		return nil, err
+	}
+	return stringValues(result.Val()), nil
+}
+
+// PeekUnacked returns the payloads of the oldest count entries pending for
+// this queue's connection, newest first
+func (queue *streamQueue) PeekUnacked(count int) []string {
+	if count <= 0 {
+		return []string{}
+	}
+
+	wires, err := queue.pending(count, "peek")
+	if err != nil {
+		log.Panicf("rmq redis error is not nil %s", err)
+	}
+	payloads := make([]string, len(wires))
+	for i, wire := range wires {
+		payloads[len(wires)-1-i] = decodePayload(wire)
+	}
+	return payloads
+}
+
+// PeekReady returns up to count entries not read yet in the order they will
+// be consumed, skipping the first offset ones, see queue.PeekReady()
+func (queue *streamQueue) PeekReady(offset, count int) []string {
+	if offset < 0 || count <= 0 {
+		return []string{}
+	}
+
+	result := streamReadyScript.run(queue.redisClient, []string{queue.streamKey}, streamGroup, offset+count)
+	if err := redisErr(result); err != nil {
+		log.Panicf("rmq redis error is not nil %s", err)
+	}
+	entries := stringValues(result.Val())
+	if len(entries) <= offset {
+		return []string{}
+	}
+	return entries[offset:]
+}
+
+// OldestUnackedAge returns false, ages of stream entries aren't tracked
+func (queue *streamQueue) OldestUnackedAge() (age time.Duration, ok bool) {
+	return 0, false
+}
+
+// TrimRejected drops all but the newest maxLength rejected entries and returns
+// how many it dropped
+func (queue *streamQueue) TrimRejected(maxLength int64) (dropped int64, err error) {
+	if maxLength < 0 {
+		maxLength = 0
+	}
+	result := streamTrimScript.run(queue.redisClient, []string{queue.rejectedStreamKey}, maxLength)
+	if err := redisErr(result); err != nil {
+		return 0, err
+	}
+	dropped, _ = result.Val().(int64)
+	return dropped, nil
+}
+
+// rejectedEntry is an entry of the rejected stream
+type rejectedEntry struct {
+	id        string
+	wire      string
+	rejection string // empty if rejected without a reason
+}
+
+// rejectedEntries returns up to count rejected entries, newest first, starting
+// before the entry with the given id, "+" to start with the newest one
+func (queue *streamQueue) rejectedEntries(before string, count int) ([]rejectedEntry, error) {
+	result := streamRejectedScript.run(queue.redisClient, []string{queue.rejectedStreamKey}, before, count)
+	if err := redisErr(result); err != nil {
+		return nil, err
+	}
+	values := stringValues(result.Val())
+	entries := make([]rejectedEntry, 0, len(values)/3)
+	for i := 0; i+2 < len(values); i += 3 {
+		entries = append(entries, rejectedEntry{id: values[i], wire: values[i+1], rejection: values[i+2]})
+	}
+	return entries, nil
+}
+
+// findRejected returns the ids of the rejected entries matching match, newest
+// first, reading the rejected stream page by page
+func (queue *streamQueue) findRejected(match func(wire string) bool) ([]string, error) {
+	found := []string{}
+	before := "+"
+	for {
+		entries, err := queue.rejectedEntries(before, streamScanSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if match(entry.wire) {
+				found = append(found, entry.id)
+			}
+		}
+		if len(entries) < streamScanSize {
+			return found, nil
+		}
+		before = entries[len(entries)-1].id
+	}
+}
+
+// ListRejected returns up to limit rejected deliveries, newest first, skipping
+// the first offset ones
+func (queue *streamQueue) ListRejected(offset, limit int) []RejectedDelivery {
+	if offset < 0 || limit <= 0 {
+		return []RejectedDelivery{}
+	}
+
+	entries, err := queue.rejectedEntries("+", offset+limit)
+	if err != nil {
+		log.Panicf("rmq redis error is not nil %s", err)
+	}
+	if len(entries) <= offset {
+		return []RejectedDelivery{}
+	}
+	rejected := make([]RejectedDelivery, 0, len(entries)-offset)
+	for _, entry := range entries[offset:] {
+		var rejection interface{}
+		if entry.rejection != "" {
+			rejection = entry.rejection
+		}
+		rejected = append(rejected, newRejectedDelivery(entry.wire, rejection, nil))
+	}
+	return rejected
+}
+
+func (queue *streamQueue) GetRejectedWithReasons(count int) []RejectedDelivery {
+	return queue.ListRejected(0, count)
+}
+
+// GetRejected returns the payloads of up to count rejected deliveries, newest
+// first
+func (queue *streamQueue) GetRejected(count int) []string {
+	rejected := queue.ListRejected(0, count)
+	payloads := make([]string, len(rejected))
+	for i, delivery := range rejected {
+		payloads[i] = delivery.Payload
+	}
+	return payloads
+}
+
+func (queue *streamQueue) GetRejectedBytes(count int) [][]byte {
+	payloads := queue.GetRejected(count)
+	bytes := make([][]byte, len(payloads))
+	for i, payload := range payloads {
+		bytes[i] = []byte(payload)
+	}
+	return bytes
+}
+
+func (queue *streamQueue) DeleteRejected(payload []byte) (removed int64, err error) {
+	return queue.deleteRejected(matchPayload(payload))
+}
+
+func (queue *streamQueue) DeleteRejectedByID(id string) (removed int64, err error) {
+	return queue.deleteRejected(matchID(id))
+}
+
+func (queue *streamQueue) deleteRejected(match func(wire string) bool) (removed int64, err error) {
+	ids, err := queue.findRejected(match)
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+	result := streamDeleteScript.run(queue.redisClient, []string{queue.rejectedStreamKey}, stringArgs(ids)...)
+	if err := redisErr(result); err != nil {
+		return 0, err
+	}
+	removed, _ = result.Val().(int64)
+	return removed, nil
+}
+
+func (queue *streamQueue) ReturnRejected(count int) int {
+	returned, err := queue.ReturnRejectedErr(count)
+	if err != nil {
+		log.Panicf("rmq redis error is not nil %s", err)
+	}
+	return returned
+}
+
+// ReturnRejectedErr moves up to max rejected entries (oldest first) back to
+// the stream and returns how many it moved
+func (queue *streamQueue) ReturnRejectedErr(max int) (returned int, err error) {
+	for returned < max {
+		batchSize := max - returned
+		if batchSize > returnBatchSize {
+			batchSize = returnBatchSize
+		}
+		moved, err := queue.returnRejected(batchSize)
+		returned += moved
+		if err != nil || moved < batchSize {
+			return returned, err
+		}
+	}
+	return returned, nil
+}
+
+// returnRejected runs streamReturnRejectedScript with the given arguments
+func (queue *streamQueue) returnRejected(args ...interface{}) (int, error) {
+	result := streamReturnRejectedScript.run(queue.redisClient, []string{queue.rejectedStreamKey, queue.streamKey}, args...)
+	if err := redisErr(result); err != nil {
+		return 0, err
+	}
+	moved, _ := result.Val().(int64)
+	return int(moved), nil
+}
+
+func (queue *streamQueue) ReturnAllRejected() int {
+	return queue.ReturnRejected(queue.RejectedCount())
+}
+
+// ReturnRejectedMessage moves one rejected entry with the given payload back
+// to the stream. Returns false if there's no such rejected entry
+func (queue *streamQueue) ReturnRejectedMessage(payload []byte) (bool, error) {
+	return queue.returnRejectedMessage(matchPayload(payload))
+}
+
+func (queue *streamQueue) ReturnRejectedMessageByID(id string) (bool, error) {
+	return queue.returnRejectedMessage(matchID(id))
+}
+
+func (queue *streamQueue) returnRejectedMessage(match func(wire string) bool) (bool, error) {
+	ids, err := queue.findRejected(match)
+	if err != nil {
+		return false, err
+	}
+	for _, id := range ids {
+		moved, err := queue.returnRejected(id)
+		if err != nil {
+			return false, err
+		}
+		if moved == 1 {
+			return true, nil
+		}
+		// removed meanwhile, try the next match
+	}
+	return false, nil
+}
+
+// WatchRejected is like queue.WatchRejected() of list queues, watching the
+// rejected stream
+func (queue *streamQueue) WatchRejected(threshold int64, interval time.Duration, fn func(count int64)) {
+	if queue.watchersStopped == nil {
+		queue.watchersStopped = make(chan struct{})
+	}
+	go queue.watchRejected(&rejectedWatch{threshold: threshold}, interval, func() (int64, error) {
+		counts, err := queue.counts()
+		return counts.rejected, err
+	}, fn)
+}
+
+// Close purges the queue and removes it from the list of queues
+func (queue *streamQueue) Close() bool {
+	queue.PurgeRejected()
+	queue.PurgeReady()
+	_, err := queue.backend.removeMember(streamQueuesKey, queue.name)
+	backendErr(err)
+	return queue.redisQueue.Close()
+}
+
+func (queue *streamQueue) ReturnAllRejectedThrottled(ctx context.Context, perSecond int) (returned int, err error) {
+	return 0, ErrStreamUnsupported
+}
+
+func (queue *streamQueue) DrainTo(destinationQueue string, max int) (moved int, err error) {
+	return 0, ErrStreamUnsupported
+}
+
+func (queue *streamQueue) Destroy() (PurgeCounts, error) {
+	return PurgeCounts{}, ErrStreamUnsupported
+}
+
+func (queue *streamQueue) ForceDestroy() (PurgeCounts, error) {
+	return PurgeCounts{}, ErrStreamUnsupported
+}
+
+func (queue *streamQueue) Export(w io.Writer, lists ...string) (n int, err error) {
+	return 0, ErrStreamUnsupported
+}
+
+func (queue *streamQueue) Import(r io.Reader) (n int, err error) {
+	return 0, ErrStreamUnsupported
+}
+
+func (queue *streamQueue) DedupeReady() (removed int64, err error) {
+	return 0, ErrStreamUnsupported
+}
+
+func (queue *streamQueue) DedupeReadyPayloads() (removed int64, err error) {
+	return 0, ErrStreamUnsupported
+}
+
+// reclaimIdle adds the entries of the stream at streamKey pending for at least
+// minIdle back to the stream, so they're ready again, and returns how many it
+// reclaimed. claimer is the consumer name the entries get claimed as first
+func reclaimIdle(redisClient redis.Cmdable, streamKey, claimer string, minIdle time.Duration) (reclaimed int, err error) {
+	start := "0-0"
+	for {
+		result := streamReclaimScript.run(redisClient, []string{streamKey}, streamGroup, claimer, int64(minIdle/time.Millisecond), streamScanSize, start)
+		if err := redisErr(result); err != nil {
+			return reclaimed, err
+		}
+		values, _ := result.Val().([]interface{})
+		if len(values) < 2 {
+			return reclaimed, nil
+		}
+		batch, _ := values[0].(int64)
+		reclaimed += int(batch)
+		start, _ = values[1].(string)
+		if start == "" || start == "0-0" {
+			return reclaimed, nil
+		}
+	}
+}
+
+// encodeRejection returns the JSON encoded rejection stored along with a
+// rejected entry, empty if there's no reason or it can't be encoded
+func encodeRejection(reason, connection, consumer string, now time.Time) string {
+	if reason == "" {
+		return ""
+	}
+	bytes, err := json.Marshal(rejection{
+		Reason:     reason,
+		RejectedAt: now,
+		Connection: connection,
+		Consumer:   consumer,
+	})
+	if err != nil {
+		return ""
+	}
+	return string(bytes)
+}
+
+// stringValues returns the strings in a script result, skipping other values
+func stringValues(val interface{}) []string {
+	values, _ := val.([]interface{})
+	strs := make([]string, 0, len(values))
+	for _, value := range values {
+		if str, ok := value.(string); ok {
+			strs = append(strs, str)
+		}
+	}
+	return strs
+}
+
+func stringArgs(strs []string) []interface{} {
+	args := make([]interface{}, len(strs))
+	for i, str := range strs {
+		args[i] = str
+	}
+	return args
+}
+
+// streamQueueKeys returns the stream and rejected stream keys of the stream
+// queue with the given name
+func streamQueueKeys(name string) (streamKey, rejectedStreamKey string) {
+	return strings.Replace(queueStreamTemplate, phQueue, name, 1), strings.Replace(queueRejectedStreamTemplate, phQueue, name, 1)
+}
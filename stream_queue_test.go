@@ -0,0 +1,222 @@
+package rmq
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/adjust/gocheck"
+)
+
+func TestStreamSuite(t *testing.T) {
+	TestingSuiteT(&StreamSuite{}, t)
+}
+
+// StreamSuite needs Redis 6.2 or later
+type StreamSuite struct{}
+
+// openStreamConnection returns a synchronous connection to a flushed database
+func openStreamConnection(tag string) *RedisConnection {
+	connection := OpenConnection(tag, testRedisAddr, 1)
+	connection.flushDb()
+	connection.SetSynchronous(true)
+	return connection
+}
+
+func (suite *StreamSuite) TestStreamConsume(c *C) {
+	connection := openStreamConnection("stream-conn")
+	queue := connection.OpenStreamQueue("stream-q")
+	c.Check(fmt.Sprint(queue), Equals, fmt.Sprintf("[stream-q conn:%s stream]", connection.Name))
+	c.Check(connection.GetOpenQueues(), DeepEquals, []string{"stream-q"})
+
+	for i := 0; i < 3; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("stream-d%d", i)), Equals, true)
+	}
+	c.Check(queue.ReadyCount(), Equals, 3)
+	c.Check(queue.PeekReady(1, 5), DeepEquals, []string{"stream-d1", "stream-d2"})
+
+	queue.StartConsuming(2, time.Millisecond)
+	consumer := NewTestConsumer("stream-A")
+	consumer.AutoAck = false
+	queue.AddConsumer("stream-cons", consumer)
+	c.Check(queue.ConsumeOnce(), Equals, 2)
+	c.Assert(consumer.Deliveries(), HasLen, 2)
+	c.Check(queue.ReadyCount(), Equals, 1)
+	c.Check(queue.UnackedCount(), Equals, 2)
+	c.Check(queue.PeekUnacked(5), DeepEquals, []string{"stream-d1", "stream-d0"})
+
+	first := consumer.Deliveries()[0]
+	c.Check(first.Payload(), Equals, "stream-d0")
+	c.Check(first.Extend(time.Minute), Equals, true)
+	c.Check(first.Ack(), Equals, true)
+	c.Check(first.Ack(), Equals, false)
+	c.Check(first.State(), Equals, Acked)
+	c.Check(queue.UnackedCount(), Equals, 1)
+	c.Check(queue.Counters().Acked, Equals, int64(1))
+
+	returned, err := queue.ReturnAllUnacked()
+	c.Check(err, Equals, ErrConsumersActive)
+	queue.StopConsuming()
+	returned, err = queue.ReturnAllUnacked()
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 1)
+	c.Check(queue.ReadyCount(), Equals, 2)
+	c.Check(queue.PeekReady(0, 5), DeepEquals, []string{"stream-d2", "stream-d1"})
+	c.Check(consumer.Deliveries()[1].AckErr(), Equals, ErrDeliveryNotFound)
+
+	removed, err := queue.PurgeReadyErr()
+	c.Check(err, IsNil)
+	c.Check(removed, Equals, int64(2))
+	c.Check(queue.ReadyCount(), Equals, 0)
+
+	_, err = queue.DrainTo("other-q", 1)
+	c.Check(err, Equals, ErrStreamUnsupported)
+	c.Check(queue.Close(), Equals, true)
+	c.Check(connection.GetOpenQueues(), HasLen, 0)
+	connection.StopHeartbeat()
+}
+
+func (suite *StreamSuite) TestStreamReject(c *C) {
+	connection := openStreamConnection("stream-rej-conn")
+	queue := connection.OpenStreamQueue("stream-rej-q")
+	queue.SetRejectedMaxLength(2)
+	trimmed := int64(0)
+	queue.SetHooks(Hooks{OnRejectedTrimmed: func(queueName string, dropped int64) { trimmed += dropped }})
+	for i := 0; i < 3; i++ {
+		queue.Publish(fmt.Sprintf("stream-rej-d%d", i))
+	}
+
+	queue.StartConsuming(3, time.Millisecond)
+	consumer := NewTestConsumer("stream-rej-A")
+	consumer.AutoAck = false
+	queue.AddConsumer("stream-rej-cons", consumer)
+	c.Check(queue.ConsumeOnce(), Equals, 3)
+	c.Assert(consumer.Deliveries(), HasLen, 3)
+
+	c.Check(consumer.Deliveries()[0].Reject(), Equals, true)
+	c.Check(consumer.Deliveries()[1].RejectWithReason("stream-rej-reason"), Equals, true)
+	c.Check(consumer.Deliveries()[2].Push(), Equals, true) // no push queue
+	c.Check(consumer.Deliveries()[2].State(), Equals, Rejected)
+	c.Check(queue.RejectedCount(), Equals, 2)
+	c.Check(trimmed, Equals, int64(1))
+	c.Check(queue.Counters().Rejected, Equals, int64(3))
+
+	rejected := queue.ListRejected(0, 5)
+	c.Assert(rejected, HasLen, 2)
+	c.Check(rejected[0].Payload, Equals, "stream-rej-d2")
+	c.Check(rejected[1].Payload, Equals, "stream-rej-d1")
+	c.Check(rejected[1].Reason, Equals, "stream-rej-reason")
+	c.Check(rejected[1].Consumer, Equals, "stream-rej-cons")
+	c.Check(queue.GetRejected(1), DeepEquals, []string{"stream-rej-d2"})
+
+	removed, err := queue.DeleteRejected([]byte("stream-rej-d2"))
+	c.Check(err, IsNil)
+	c.Check(removed, Equals, int64(1))
+	c.Check(queue.ReturnAllRejected(), Equals, 1)
+	c.Check(queue.RejectedCount(), Equals, 0)
+	c.Check(queue.ConsumeOnce(), Equals, 1)
+	c.Check(consumer.Last().Payload(), Equals, "stream-rej-d1")
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *StreamSuite) TestStreamPushDead(c *C) {
+	connection := openStreamConnection("stream-push-conn")
+	connection.SetDeadLetterQueue("stream-dead-q")
+	queue := connection.OpenStreamQueue("stream-push-q")
+	pushQueue := connection.OpenStreamQueue("stream-push-q2")
+	listQueue := connection.OpenQueue("stream-push-list")
+	c.Check(queue.SetPushQueue(queue), NotNil)
+	c.Check(queue.SetPushQueue(pushQueue), IsNil)
+	c.Check(queue.PushChain(), DeepEquals, []string{"stream-push-q", "stream-push-q2"})
+	queue.Publish("stream-push-d1")
+	queue.Publish("stream-push-d2")
+
+	queue.StartConsuming(2, time.Millisecond)
+	consumer := NewTestConsumer("stream-push-A")
+	consumer.AutoAck = false
+	queue.AddConsumer("stream-push-cons", consumer)
+	c.Check(queue.ConsumeOnce(), Equals, 2)
+	c.Assert(consumer.Deliveries(), HasLen, 2)
+
+	c.Check(consumer.Deliveries()[0].CopyTo("stream-push-list"), IsNil)
+	c.Check(consumer.Deliveries()[0].Push(), Equals, true)
+	c.Check(consumer.Deliveries()[1].Dead(), IsNil)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(pushQueue.PeekReady(0, 1), DeepEquals, []string{"stream-push-d1"})
+	c.Check(listQueue.PeekReady(0, 1), DeepEquals, []string{"stream-push-d1"})
+	deadQueue := connection.OpenQueue("stream-dead-q")
+	c.Check(deadQueue.PeekReady(0, 1), DeepEquals, []string{"stream-push-d2"})
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *StreamSuite) TestStreamReclaim(c *C) {
+	connection := openStreamConnection("stream-reclaim-conn")
+	queue := connection.OpenStreamQueue("stream-reclaim-q")
+	queue.Publish("stream-reclaim-d1")
+	queue.StartConsuming(1, time.Millisecond)
+	consumer := NewTestConsumer("stream-reclaim-A")
+	consumer.AutoAck = false
+	queue.AddConsumer("stream-reclaim-cons", consumer)
+	c.Check(queue.ConsumeOnce(), Equals, 1)
+
+	cleaner := NewCleaner(OpenConnection("stream-reclaim-cleaner", testRedisAddr, 1))
+	report, err := cleaner.CleanWithReport()
+	c.Check(err, IsNil)
+	c.Check(report.Reclaimed, Equals, 0) // not idle for long enough yet
+
+	cleaner.SetStreamMinIdle(time.Millisecond)
+	time.Sleep(delayMs * time.Millisecond)
+	report, err = cleaner.CleanWithReport()
+	c.Check(err, IsNil)
+	c.Check(report.Reclaimed, Equals, 1)
+	c.Check(cleaner.Stats().Reclaimed, Equals, int64(1))
+	c.Check(queue.ReadyCount(), Equals, 1)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(consumer.Last().Ack(), Equals, false)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *StreamSuite) TestStreamStats(c *C) {
+	connection := openStreamConnection("stream-stats-conn")
+	queue := connection.OpenStreamQueue("stream-stats-q")
+	for i := 0; i < 3; i++ {
+		queue.Publish(fmt.Sprintf("stream-stats-d%d", i))
+	}
+	queue.StartConsuming(2, time.Millisecond)
+	consumer := NewTestConsumer("stream-stats-A")
+	consumer.AutoAck = false
+	queue.AddConsumer("stream-stats-cons", consumer)
+	queue.ConsumeOnce()
+	consumer.Last().Reject()
+
+	stat := connection.CollectStats([]string{"stream-stats-q"}).QueueStats["stream-stats-q"]
+	c.Check(stat.Stream, Equals, true)
+	c.Check(stat.ReadyCount, Equals, 1)
+	c.Check(stat.RejectedCount, Equals, 1)
+	c.Check(stat.UnackedCount(), Equals, 1)
+	c.Check(stat.ConsumerCount(), Equals, 1)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func TestParseStreamCounts(t *testing.T) {
+	counts := parseStreamCounts([]interface{}{int64(5), int64(3), int64(1), "conn-a", int64(2), "conn-b", int64(1)})
+	if counts.ready() != 2 || counts.rejected != 1 {
+		t.Errorf("ready %d rejected %d, want 2 and 1", counts.ready(), counts.rejected)
+	}
+	if counts.unacked["conn-a"] != 2 || counts.unacked["conn-b"] != 1 {
+		t.Errorf("unacked %v", counts.unacked)
+	}
+
+	counts = parseStreamCounts(nil)
+	if counts.ready() != 0 || len(counts.unacked) != 0 {
+		t.Errorf("empty counts %+v", counts)
+	}
+}
@@ -0,0 +1,28 @@
+package rmq
+
+import (
+	"log"
+	"os"
+	"testing"
+
+	"github.com/alicebob/miniredis"
+)
+
+// testRedisAddr is the address of the Redis the suites run against. Setting
+// RMQ_TEST_MINIREDIS runs them against an in process miniredis instead
+var testRedisAddr = "localhost:6379"
+
+func TestMain(m *testing.M) {
+	if os.Getenv("RMQ_TEST_MINIREDIS") == "" {
+		os.Exit(m.Run())
+	}
+
+	server, err := miniredis.Run()
+	if err != nil {
+		log.Fatalf("failed to start miniredis: %s", err)
+	}
+	testRedisAddr = server.Addr()
+	code := m.Run()
+	server.Close()
+	os.Exit(code)
+}
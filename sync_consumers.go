@@ -0,0 +1,68 @@
+package rmq
+
+// syncConsumer is a consumer added to a synchronous queue, see
+// connection.SetSynchronous()
+type syncConsumer struct {
+	name      string
+	consumer  Consumer      // nil for batch consumers
+	batch     BatchConsumer // nil for other consumers
+	batchSize int
+	stopper   chan int // nil for batch consumers, they can't be stopped
+}
+
+// syncConsumers are the consumers of a synchronous queue, ConsumeOnce()
+// hands the prefetched deliveries to them in turn. They are only used by the
+// goroutine calling ConsumeOnce(), so there's no locking
+type syncConsumers struct {
+	consumers []*syncConsumer
+	next      int
+}
+
+func (consumers *syncConsumers) add(consumer *syncConsumer) {
+	consumers.consumers = append(consumers.consumers, consumer)
+}
+
+// dispatch hands the deliveries buffered in deliveryChan to the consumers in
+// turn, one at a time or up to the batch size for batch consumers, and
+// returns how many it handed over. Consumers which got stopped are removed
+// and passed to stopped. Without consumers the deliveries stay buffered
+func (consumers *syncConsumers) dispatch(deliveryChan chan Delivery, stopped func(name string), consume func(consumer *syncConsumer, deliveries []Delivery)) int {
+	dispatched := 0
+	for len(deliveryChan) > 0 {
+		consumer := consumers.nextConsumer(stopped)
+		if consumer == nil {
+			break
+		}
+
+		size := 1
+		if consumer.batch != nil {
+			size = consumer.batchSize
+		}
+		deliveries := []Delivery{}
+		for len(deliveries) < size && len(deliveryChan) > 0 {
+			deliveries = append(deliveries, <-deliveryChan)
+		}
+		consume(consumer, deliveries)
+		dispatched += len(deliveries)
+	}
+	return dispatched
+}
+
+// nextConsumer returns the consumer to get the next deliveries, nil if there
+// is none
+func (consumers *syncConsumers) nextConsumer(stopped func(name string)) *syncConsumer {
+	for len(consumers.consumers) > 0 {
+		i := consumers.next % len(consumers.consumers)
+		consumer := consumers.consumers[i]
+		select {
+		case <-consumer.stopper:
+			consumers.consumers = append(consumers.consumers[:i], consumers.consumers[i+1:]...)
+			stopped(consumer.name)
+			continue
+		default:
+		}
+		consumers.next = i + 1
+		return consumer
+	}
+	return nil
+}
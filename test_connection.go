@@ -1,6 +1,14 @@
 package rmq
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// testConnectionName is the name under which TestConnection stats list the
+// consumers of its queues
+const testConnectionName = "rmq-test"
 
 type TestConnection struct {
 	queues map[string]*TestQueue
@@ -18,12 +26,42 @@ func (connection TestConnection) OpenQueue(name string) Queue {
 	}
 
 	queue := NewTestQueue(name)
+	queue.queues = connection.queues
 	connection.queues[name] = queue
 	return queue
 }
 
+// CollectStats returns stats synthesized from what was recorded by the given
+// queues opened through the connection: Payloads published but not delivered
+// by DeliverAll() are ready, those rejected by consumers are rejected and
+// those consumers didn't settle are unacked. Queues which weren't opened are
+// empty
 func (connection TestConnection) CollectStats(queueList []string) Stats {
-	return Stats{}
+	stats := NewStats()
+	consuming := false
+	for _, name := range queueList {
+		queue, ok := connection.queues[name]
+		if !ok {
+			stats.QueueStats[name] = NewQueueStat(0, 0)
+			continue
+		}
+		stat := queue.stat(testConnectionName)
+		consuming = consuming || stat.ConnectionCount() > 0
+		stats.QueueStats[name] = stat
+	}
+	if !consuming {
+		stats.otherConnections[testConnectionName] = true
+	}
+	return stats
+}
+
+func (connection TestConnection) CollectStatsCtx(ctx context.Context, queueList []string) (Stats, error) {
+	if err := ctx.Err(); err != nil {
+		stats := NewStats()
+		stats.Incomplete = true
+		return stats, err
+	}
+	return connection.CollectStats(queueList), nil
 }
 
 func (connection TestConnection) GetDeliveries(queueName string) []string {
@@ -50,6 +88,13 @@ func (connection TestConnection) Reset() {
 	}
 }
 
+// GetOpenQueues returns the names of the queues opened through the
+// connection, sorted
 func (connection TestConnection) GetOpenQueues() []string {
-	return []string{}
+	names := make([]string, 0, len(connection.queues))
+	for name := range connection.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
@@ -40,3 +40,41 @@ func (suite *ConnectionSuite) TestConnection(c *C) {
 	c.Check(connection.GetDelivery("things", 0), Equals, "blab")
 	c.Check(connection.GetDelivery("things", 1), Equals, "rmq.TestConnection: delivery not found: things[1]")
 }
+
+func (suite *ConnectionSuite) TestConnectionStats(c *C) {
+	connection := NewTestConnection()
+	c.Check(connection.GetOpenQueues(), HasLen, 0)
+	queue := connection.OpenQueue("things").(*TestQueue)
+	connection.OpenQueue("other")
+	c.Check(connection.GetOpenQueues(), DeepEquals, []string{"other", "things"})
+
+	for _, payload := range []string{"ack", "reject", "keep"} {
+		queue.Publish(payload)
+	}
+	queue.AddConsumerFunc("things-cons", func(delivery Delivery) {
+		switch delivery.Payload() {
+		case "ack":
+			delivery.Ack()
+		case "reject":
+			delivery.Reject()
+		}
+	})
+	c.Check(queue.DeliverAll(), DeepEquals, []State{Acked, Rejected, Unacked})
+	queue.Publish("ready")
+
+	stats := connection.CollectStats(connection.GetOpenQueues())
+	stat := stats.QueueStats["things"]
+	c.Check(stat.ReadyCount, Equals, 1)
+	c.Check(stat.RejectedCount, Equals, 1)
+	c.Check(stat.UnackedCount(), Equals, 1)
+	c.Check(stat.ConsumerCount(), Equals, 1)
+	c.Check(stat.Counters, Equals, QueueCounters{Published: 4, Acked: 1, Rejected: 1})
+	c.Check(stats.QueueStats["other"], DeepEquals, NewQueueStat(0, 0))
+	c.Check(queue.GetRejected(10), DeepEquals, []string{"reject"})
+
+	connection.Reset()
+	stats = connection.CollectStats([]string{"things", "unknown"})
+	c.Check(stats.QueueStats["things"].ReadyCount, Equals, 0)
+	c.Check(stats.QueueStats["things"].RejectedCount, Equals, 0)
+	c.Check(stats.QueueStats["unknown"].ConnectionCount(), Equals, 0)
+}
@@ -1,6 +1,7 @@
 package rmq
 
 import (
+	"sync"
 	"time"
 )
 
@@ -10,9 +11,28 @@ type TestConsumer struct {
 	AutoFinish    bool
 	SleepDuration time.Duration
 
-	LastDelivery   Delivery
+	// Behavior settles the i-th delivery (counting from 0) instead of AutoAck
+	// and FailEvery if it's set, e.g. to ack some deliveries, reject others
+	// and panic on one
+	Behavior func(i int, delivery Delivery)
+	// FailEvery rejects every FailEvery-th delivery instead of acking it,
+	// zero to reject none
+	FailEvery int
+	// AutoFinishAfter finishes the first AutoFinishAfter deliveries right away
+	// and waits for Finish() after each further one, regardless of
+	// AutoFinish. Zero leaves it to AutoFinish
+	AutoFinishAfter int
+
+	// Deprecated: LastDelivery races with the consuming goroutine, use Last()
+	LastDelivery Delivery
+	// Deprecated: LastDeliveries races with the consuming goroutine, use
+	// Deliveries() or WaitForDeliveries()
 	LastDeliveries []Delivery
 
+	mutex      sync.Mutex
+	deliveries []Delivery
+	consumed   chan struct{} // closed and replaced on each delivery, see WaitForDeliveries()
+
 	finish chan int
 }
 
@@ -30,16 +50,34 @@ func (consumer *TestConsumer) String() string {
 }
 
 func (consumer *TestConsumer) Consume(delivery Delivery) {
+	consumer.mutex.Lock()
+	i := len(consumer.deliveries)
+	consumer.deliveries = append(consumer.deliveries, delivery)
 	consumer.LastDelivery = delivery
 	consumer.LastDeliveries = append(consumer.LastDeliveries, delivery)
+	if consumer.consumed != nil {
+		close(consumer.consumed)
+		consumer.consumed = nil
+	}
+	consumer.mutex.Unlock()
 
 	if consumer.SleepDuration > 0 {
 		time.Sleep(consumer.SleepDuration)
 	}
-	if consumer.AutoAck {
+	switch {
+	case consumer.Behavior != nil:
+		consumer.Behavior(i, delivery)
+	case consumer.FailEvery > 0 && (i+1)%consumer.FailEvery == 0:
+		delivery.Reject()
+	case consumer.AutoAck:
 		delivery.Ack()
 	}
-	if !consumer.AutoFinish {
+
+	if consumer.AutoFinishAfter > 0 {
+		if i >= consumer.AutoFinishAfter {
+			<-consumer.finish
+		}
+	} else if !consumer.AutoFinish {
 		<-consumer.finish
 	}
 }
@@ -47,3 +85,73 @@ func (consumer *TestConsumer) Consume(delivery Delivery) {
 func (consumer *TestConsumer) Finish() {
 	consumer.finish <- 1
 }
+
+// Deliveries returns a copy of the deliveries consumed so far, oldest first
+func (consumer *TestConsumer) Deliveries() []Delivery {
+	consumer.mutex.Lock()
+	defer consumer.mutex.Unlock()
+	return append([]Delivery{}, consumer.deliveries...)
+}
+
+// AckedCount returns the number of consumed deliveries which are acked now,
+// including those acked by the test after consuming
+func (consumer *TestConsumer) AckedCount() int {
+	return consumer.count(Acked)
+}
+
+// RejectedCount is like AckedCount for rejected deliveries
+func (consumer *TestConsumer) RejectedCount() int {
+	return consumer.count(Rejected)
+}
+
+// PushedCount is like AckedCount for pushed deliveries
+func (consumer *TestConsumer) PushedCount() int {
+	return consumer.count(Pushed)
+}
+
+func (consumer *TestConsumer) count(state State) int {
+	consumer.mutex.Lock()
+	defer consumer.mutex.Unlock()
+	count := 0
+	for _, delivery := range consumer.deliveries {
+		if delivery.State() == state {
+			count++
+		}
+	}
+	return count
+}
+
+// Last returns the delivery consumed last, nil if there's none yet
+func (consumer *TestConsumer) Last() Delivery {
+	consumer.mutex.Lock()
+	defer consumer.mutex.Unlock()
+	if len(consumer.deliveries) == 0 {
+		return nil
+	}
+	return consumer.deliveries[len(consumer.deliveries)-1]
+}
+
+// WaitForDeliveries waits until the consumer consumed at least n deliveries
+// in total and returns true, or false if that didn't happen within timeout
+func (consumer *TestConsumer) WaitForDeliveries(n int, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		consumer.mutex.Lock()
+		if len(consumer.deliveries) >= n {
+			consumer.mutex.Unlock()
+			return true
+		}
+		if consumer.consumed == nil {
+			consumer.consumed = make(chan struct{})
+		}
+		consumed := consumer.consumed
+		consumer.mutex.Unlock()
+
+		select {
+		case <-consumed:
+		case <-timer.C:
+			return false
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package rmq
+
+import (
+	"time"
+
+	. "github.com/adjust/gocheck"
+)
+
+func (suite *MockQueueSuite) TestConsumerBehavior(c *C) {
+	queue := NewTestQueue("test-behavior")
+	consumer := NewTestConsumer("test-B")
+	consumer.Behavior = func(i int, delivery Delivery) {
+		switch i {
+		case 0, 1:
+			delivery.Ack()
+		case 2:
+			delivery.Reject()
+		case 3:
+			delivery.Push()
+		}
+	}
+	queue.AddConsumer("test-cons", consumer)
+	for i := 0; i < 5; i++ {
+		queue.Publish("b")
+	}
+	c.Check(queue.DeliverAll(), DeepEquals, []State{Acked, Acked, Rejected, Rejected, Unacked}) // no push queue
+	c.Check(consumer.AckedCount(), Equals, 2)
+	c.Check(consumer.RejectedCount(), Equals, 2)
+	c.Check(consumer.PushedCount(), Equals, 0)
+
+	consumer.Deliveries()[4].Ack()
+	c.Check(consumer.AckedCount(), Equals, 3)
+}
+
+func (suite *MockQueueSuite) TestConsumerFailEvery(c *C) {
+	queue := NewTestQueue("test-fail-every")
+	consumer := NewTestConsumer("test-F")
+	consumer.FailEvery = 2
+	queue.AddConsumer("test-cons", consumer)
+	for i := 0; i < 4; i++ {
+		queue.Publish("f")
+	}
+	c.Check(queue.DeliverAll(), DeepEquals, []State{Acked, Rejected, Acked, Rejected})
+
+	// the zero value acks everything
+	consumer = &TestConsumer{AutoAck: true, AutoFinish: true}
+	delivery := NewTestDelivery("z")
+	consumer.Consume(delivery)
+	c.Check(delivery.State(), Equals, Acked)
+}
+
+func (suite *MockQueueSuite) TestConsumerAutoFinishAfter(c *C) {
+	consumer := NewTestConsumer("test-W")
+	consumer.AutoFinishAfter = 1
+	consumer.Consume(NewTestDelivery("w1")) // finishes right away
+
+	finished := make(chan struct{})
+	go func() {
+		consumer.Consume(NewTestDelivery("w2"))
+		close(finished)
+	}()
+	c.Assert(consumer.WaitForDeliveries(2, time.Second), Equals, true)
+	select {
+	case <-finished:
+		c.Fatal("expected the consumer to wait for Finish()")
+	case <-time.After(10 * time.Millisecond):
+	}
+	consumer.Finish()
+	<-finished
+	c.Check(consumer.AckedCount(), Equals, 2)
+}
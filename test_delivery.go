@@ -1,18 +1,42 @@
 package rmq
 
-import "encoding/json"
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+)
 
 type TestDelivery struct {
-	State   State
-	payload string
+	state    State
+	Reason   string   // set by RejectWithReason and RejectWithError
+	CopiedTo []string // queue names passed to CopyTo
+	payload  string
+	headers  map[string]string
+	queue    *TestQueue // the queue delivering it, nil for deliveries created by tests
+
+	// number of calls of the settle methods, including their Err and reason
+	// variants and calls after the delivery was settled
+	AckCalls, RejectCalls, PushCalls, DeadCalls int
+	// number of settle calls after it was settled, which fail with
+	// ErrAlreadySettled and call Hooks.OnDoubleSettle for real deliveries
+	DoubleSettles int
 }
 
+// NewTestDelivery returns a delivery of the payload if content is a string,
+// otherwise of content marshalled to JSON
 func NewTestDelivery(content interface{}) *TestDelivery {
 	if payload, ok := content.(string); ok {
 		return NewTestDeliveryString(payload)
 	}
+	return NewTestDeliveryJSON(content)
+}
 
-	bytes, err := json.Marshal(content)
+// NewTestDeliveryJSON returns a delivery of v marshalled to JSON, even if v is
+// a string
+func NewTestDeliveryJSON(v interface{}) *TestDelivery {
+	bytes, err := json.Marshal(v)
 	if err != nil {
 		bytes = []byte("rmq.NewTestDelivery failed to marshal")
 	}
@@ -26,6 +50,11 @@ func NewTestDeliveryString(payload string) *TestDelivery {
 	}
 }
 
+// State returns how the delivery was settled, Unacked if it wasn't
+func (delivery *TestDelivery) State() State {
+	return delivery.state
+}
+
 func (delivery *TestDelivery) Payload() string {
 	return delivery.payload
 }
@@ -34,26 +63,143 @@ func (delivery *TestDelivery) PayloadBytes() []byte {
 	return []byte(delivery.payload)
 }
 
+func (delivery *TestDelivery) PayloadReader() io.Reader {
+	return bytes.NewReader([]byte(delivery.payload))
+}
+
 func (delivery *TestDelivery) Ack() bool {
-	if delivery.State == Unacked {
-		delivery.State = Acked
-		return true
+	delivery.AckCalls++
+	return delivery.settle(Acked)
+}
+
+func (delivery *TestDelivery) AckErr() error {
+	if delivery.Ack() {
+		return nil
 	}
-	return false
+	return ErrAlreadySettled
 }
 
 func (delivery *TestDelivery) Reject() bool {
-	if delivery.State == Unacked {
-		delivery.State = Rejected
+	delivery.RejectCalls++
+	return delivery.settle(Rejected)
+}
+
+func (delivery *TestDelivery) RejectErr() error {
+	if delivery.Reject() {
+		return nil
+	}
+	return ErrAlreadySettled
+}
+
+func (delivery *TestDelivery) RejectWithReason(reason string) bool {
+	if delivery.Reject() {
+		delivery.Reason = reason
 		return true
 	}
 	return false
 }
 
+func (delivery *TestDelivery) RejectWithError(err error) bool {
+	return delivery.RejectWithReason(errorReason(err))
+}
+
+// Push pushes the delivery, like for real queues a delivery of a TestQueue
+// without push queue gets rejected instead
 func (delivery *TestDelivery) Push() bool {
-	if delivery.State == Unacked {
-		delivery.State = Pushed
-		return true
+	delivery.PushCalls++
+	if delivery.queue != nil && delivery.queue.pushQueue == nil {
+		return delivery.settle(Rejected)
+	}
+	return delivery.settle(Pushed)
+}
+
+func (delivery *TestDelivery) PushErr() error {
+	if delivery.Push() {
+		return nil
+	}
+	return ErrAlreadySettled
+}
+
+func (delivery *TestDelivery) Dead() error {
+	delivery.DeadCalls++
+	if delivery.settle(Dead) {
+		return nil
+	}
+	return ErrAlreadySettled
+}
+
+// settle sets the state of an unacked delivery, otherwise it counts a double
+// settle and returns false
+func (delivery *TestDelivery) settle(state State) bool {
+	if delivery.state != Unacked {
+		delivery.DoubleSettles++
+		return false
+	}
+	delivery.state = state
+	return true
+}
+
+func (delivery *TestDelivery) CopyTo(queueName string) error {
+	delivery.CopiedTo = append(delivery.CopiedTo, queueName)
+	return nil
+}
+
+func (delivery *TestDelivery) Headers() map[string]string {
+	return delivery.headers
+}
+
+func (delivery *TestDelivery) Header(key string) (string, bool) {
+	value, ok := delivery.headers[key]
+	return value, ok
+}
+
+// WithHeader sets the header on the TestDelivery itself and returns it, so
+// that its State reflects how the returned delivery got settled
+func (delivery *TestDelivery) WithHeader(key, value string) Delivery {
+	if delivery.headers == nil {
+		delivery.headers = map[string]string{}
+	}
+	delivery.headers[key] = value
+	return delivery
+}
+
+func (delivery *TestDelivery) Extend(timeout time.Duration) bool {
+	return delivery.state == Unacked
+}
+
+// AssertAcked fails the test right away unless the delivery was acked exactly
+// once
+func (delivery *TestDelivery) AssertAcked(t testing.TB) {
+	t.Helper()
+	delivery.assertSettled(t, Acked)
+}
+
+// AssertRejected is like AssertAcked for rejected deliveries
+func (delivery *TestDelivery) AssertRejected(t testing.TB) {
+	t.Helper()
+	delivery.assertSettled(t, Rejected)
+}
+
+// AssertPushed is like AssertAcked for pushed deliveries
+func (delivery *TestDelivery) AssertPushed(t testing.TB) {
+	t.Helper()
+	delivery.assertSettled(t, Pushed)
+}
+
+// AssertUnacked fails the test right away if the delivery was settled
+func (delivery *TestDelivery) AssertUnacked(t testing.TB) {
+	t.Helper()
+	if delivery.state != Unacked {
+		t.Fatalf("rmq.TestDelivery %q: expected to be unacked, got %s", delivery.payload, delivery.state)
+	}
+}
+
+func (delivery *TestDelivery) assertSettled(t testing.TB, state State) {
+	t.Helper()
+	if delivery.state != state {
+		t.Fatalf("rmq.TestDelivery %q: expected %s, got %s", delivery.payload, state, delivery.state)
+	}
+	if delivery.DoubleSettles > 0 {
+		t.Fatalf("rmq.TestDelivery %q: %s, but settled %d more times", delivery.payload, state, delivery.DoubleSettles)
 	}
-	return false
 }
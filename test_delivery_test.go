@@ -1,6 +1,7 @@
 package rmq
 
 import (
+	"errors"
 	"testing"
 
 	. "github.com/adjust/gocheck"
@@ -22,22 +23,82 @@ func (suite *DeliverySuite) TestDeliveryPayload(c *C) {
 
 func (suite *DeliverySuite) TestDeliveryAck(c *C) {
 	delivery := NewTestDelivery("p")
-	c.Check(delivery.State, Equals, Unacked)
+	c.Check(delivery.State(), Equals, Unacked)
 	c.Check(delivery.Ack(), Equals, true)
-	c.Check(delivery.State, Equals, Acked)
+	c.Check(delivery.State(), Equals, Acked)
 
 	c.Check(delivery.Ack(), Equals, false)
 	c.Check(delivery.Reject(), Equals, false)
-	c.Check(delivery.State, Equals, Acked)
+	c.Check(delivery.State(), Equals, Acked)
 }
 
 func (suite *DeliverySuite) TestDeliveryReject(c *C) {
 	delivery := NewTestDelivery("p")
-	c.Check(delivery.State, Equals, Unacked)
+	c.Check(delivery.State(), Equals, Unacked)
 	c.Check(delivery.Reject(), Equals, true)
-	c.Check(delivery.State, Equals, Rejected)
+	c.Check(delivery.State(), Equals, Rejected)
 
 	c.Check(delivery.Reject(), Equals, false)
 	c.Check(delivery.Ack(), Equals, false)
-	c.Check(delivery.State, Equals, Rejected)
+	c.Check(delivery.State(), Equals, Rejected)
+}
+
+func (suite *DeliverySuite) TestDeliveryRejectWithReason(c *C) {
+	delivery := NewTestDelivery("p")
+	c.Check(delivery.RejectWithReason("bad"), Equals, true)
+	c.Check(delivery.State(), Equals, Rejected)
+	c.Check(delivery.Reason, Equals, "bad")
+	c.Check(delivery.RejectWithReason("worse"), Equals, false)
+	c.Check(delivery.Reason, Equals, "bad")
+
+	delivery = NewTestDelivery("p")
+	c.Check(delivery.RejectWithError(errors.New("failed")), Equals, true)
+	c.Check(delivery.Reason, Equals, "failed")
+}
+
+func (suite *DeliverySuite) TestDeliveryDead(c *C) {
+	delivery := NewTestDelivery("p")
+	c.Check(delivery.Dead(), IsNil)
+	c.Check(delivery.State(), Equals, Dead)
+	c.Check(delivery.Dead(), NotNil)
+	c.Check(delivery.Ack(), Equals, false)
+}
+
+func (suite *DeliverySuite) TestDeliveryCalls(c *C) {
+	delivery := NewTestDelivery("p")
+	c.Check(delivery.Ack(), Equals, true)
+	c.Check(delivery.AckErr(), Equals, ErrAlreadySettled)
+	c.Check(delivery.RejectWithReason("late"), Equals, false)
+	c.Check(delivery.Push(), Equals, false)
+	c.Check(delivery.AckCalls, Equals, 2)
+	c.Check(delivery.RejectCalls, Equals, 1)
+	c.Check(delivery.PushCalls, Equals, 1)
+	c.Check(delivery.DeadCalls, Equals, 0)
+	c.Check(delivery.DoubleSettles, Equals, 3)
+	c.Check(delivery.Reason, Equals, "")
+}
+
+func (suite *DeliverySuite) TestDeliveryJSON(c *C) {
+	c.Check(NewTestDeliveryJSON("p").Payload(), Equals, `"p"`)
+	c.Check(NewTestDeliveryJSON(map[string]int{"a": 1}).Payload(), Equals, `{"a":1}`)
+	c.Check(NewTestDelivery(map[string]int{"a": 1}).Payload(), Equals, `{"a":1}`)
+}
+
+func TestDeliveryAssertions(t *testing.T) {
+	acked := NewTestDelivery("p")
+	acked.Ack()
+	acked.AssertAcked(t)
+	NewTestDelivery("p").AssertUnacked(t)
+
+	pushed := NewTestDelivery("p")
+	pushed.Push()
+	pushed.AssertPushed(t)
+
+	rejected := NewTestDelivery("p")
+	rejected.Reject()
+	rejected.AssertRejected(t)
+	rejected.Reject()
+	if rejected.DoubleSettles != 1 {
+		t.Errorf("expected one double settle, got %d", rejected.DoubleSettles)
+	}
 }
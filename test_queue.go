@@ -1,10 +1,36 @@
 package rmq
 
-import "time"
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
 
 type TestQueue struct {
 	name           string
 	LastDeliveries []string
+
+	pushQueue *TestQueue            // nil if there's none, see SetPushQueue()
+	queues    map[string]*TestQueue // of the TestConnection which opened the queue, nil if there's none
+
+	delivered    int                // number of LastDeliveries delivered by DeliverAll() or purged
+	unacked      int                // number of deliveries consumers didn't settle
+	rejected     []RejectedDelivery // deliveries rejected by consumers, newest first
+	counters     QueueCounters
+	consumers    []*testQueueConsumer
+	nextConsumer int
+}
+
+// testQueueConsumer is a consumer added to a TestQueue, see Deliver()
+type testQueueConsumer struct {
+	name    string
+	consume func(delivery Delivery)
+	stopper chan int
+	stopped bool
 }
 
 func NewTestQueue(name string) *TestQueue {
@@ -19,6 +45,7 @@ func (queue *TestQueue) String() string {
 
 func (queue *TestQueue) Publish(payload string) bool {
 	queue.LastDeliveries = append(queue.LastDeliveries, payload)
+	queue.counters.Published++
 	return true
 }
 
@@ -26,19 +53,206 @@ func (queue *TestQueue) PublishBytes(payload []byte) bool {
 	return queue.Publish(string(payload))
 }
 
-func (queue *TestQueue) SetPushQueue(pushQueue Queue) {
+func (queue *TestQueue) PublishWithHeaders(payload string, headers map[string]string) bool {
+	return queue.Publish(payload)
+}
+
+func (queue *TestQueue) PublishWithContext(ctx context.Context, payload string) bool {
+	return queue.Publish(payload)
+}
+
+// SetPushQueue sets the test queue deliveries get moved to by Push(),
+// replacing the previous one. Pass nil to remove the push queue. Pushed
+// payloads get appended to the LastDeliveries of the push queue, so calling
+// its DeliverAll() passes them on to its consumers. If the queue was opened
+// through a TestConnection, the push queue gets opened there too
+func (queue *TestQueue) SetPushQueue(pushQueue Queue) error {
+	if pushQueue == nil {
+		queue.pushQueue = nil
+		return nil
+	}
+
+	testPushQueue, ok := pushQueue.(*TestQueue)
+	if !ok {
+		return fmt.Errorf("rmq queue push queue must be a test queue %s %s", queue, pushQueue)
+	}
+
+	chain := append([]string{queue.name}, testPushQueue.PushChain()...)
+	for _, name := range chain[1:] {
+		if name == queue.name {
+			return fmt.Errorf("rmq queue push queue would introduce a cycle %s", strings.Join(chain, " -> "))
+		}
+	}
+
+	if queue.queues != nil {
+		if _, ok := queue.queues[testPushQueue.name]; !ok {
+			queue.queues[testPushQueue.name] = testPushQueue
+			testPushQueue.queues = queue.queues
+		}
+	}
+	queue.pushQueue = testPushQueue
+	return nil
+}
+
+func (queue *TestQueue) PushQueueName() string {
+	if queue.pushQueue == nil {
+		return ""
+	}
+	return queue.pushQueue.name
+}
+
+// PushChain returns the names of the queues deliveries pushed from this queue
+// pass through, starting with this queue
+func (queue *TestQueue) PushChain() []string {
+	chain := []string{}
+	for current := queue; current != nil && len(chain) <= maxPushDepth; current = current.pushQueue {
+		chain = append(chain, current.name)
+	}
+	return chain
+}
+
+func (queue *TestQueue) SetDeadLetterQueue(deadQueue Queue) {
 }
 
 func (queue *TestQueue) StartConsuming(prefetchLimit int, pollDuration time.Duration) bool {
 	return true
 }
 
+func (queue *TestQueue) StartConsumingErr(prefetchLimit int, pollDuration time.Duration) error {
+	return nil
+}
+
 func (queue *TestQueue) StopConsuming() bool {
 	return true
 }
 
+func (queue *TestQueue) StopConsumingErr() error {
+	return nil
+}
+
+// AddConsumer registers the consumer for Deliver() and DeliverAll(). Sending
+// to stopper stops it from getting further deliveries
 func (queue *TestQueue) AddConsumer(tag string, consumer Consumer) (name string, stopper chan<- int) {
-	return "", nil
+	return queue.addConsumer(tag, consumer.Consume)
+}
+
+func (queue *TestQueue) AddConsumerFunc(tag string, consumerFunc ConsumerFunc) (name string, stopper chan<- int) {
+	return queue.addConsumer(tag, consumerFunc)
+}
+
+// AddContextConsumer is like AddConsumer, the consumer gets a background
+// context
+func (queue *TestQueue) AddContextConsumer(tag string, consumer ConsumerWithContext) (name string, stopper chan<- int) {
+	return queue.addConsumer(tag, func(delivery Delivery) {
+		consumer.Consume(context.Background(), delivery)
+	})
+}
+
+func (queue *TestQueue) addConsumer(tag string, consume func(delivery Delivery)) (name string, stopper chan<- int) {
+	consumer := &testQueueConsumer{
+		name:    fmt.Sprintf("%s-%d", tag, len(queue.consumers)),
+		consume: consume,
+		stopper: make(chan int, 1),
+	}
+	queue.consumers = append(queue.consumers, consumer)
+	return consumer.name, consumer.stopper
+}
+
+// Deliver passes a TestDelivery of the payload to the next registered
+// consumer, taking turns like the consumers of a real queue, and returns its
+// state once the consumer returned. It's called synchronously, so tests don't
+// need to wait for anything. Without consumers the delivery stays Unacked
+func (queue *TestQueue) Deliver(payload string) State {
+	delivery := NewTestDeliveryString(payload)
+	delivery.queue = queue
+	consumerName := ""
+	if consumer := queue.next(); consumer != nil {
+		consumerName = consumer.name
+		consumer.consume(delivery)
+	}
+	queue.record(delivery, consumerName)
+	return delivery.State()
+}
+
+// record counts how the delivery got settled for Counters() and the stats
+func (queue *TestQueue) record(delivery *TestDelivery, consumerName string) {
+	switch delivery.State() {
+	case Unacked:
+		queue.unacked++
+	case Acked:
+		queue.counters.Acked++
+	case Rejected:
+		rejected := RejectedDelivery{
+			Payload:    delivery.Payload(),
+			Reason:     delivery.Reason,
+			RejectedAt: time.Now(),
+			Consumer:   consumerName,
+		}
+		queue.rejected = append([]RejectedDelivery{rejected}, queue.rejected...)
+		queue.counters.Rejected++
+	case Pushed:
+		if queue.pushQueue != nil { // nil if the consumer removed it after pushing
+			queue.pushQueue.LastDeliveries = append(queue.pushQueue.LastDeliveries, delivery.Payload())
+		}
+		queue.counters.Pushed++
+	case Dead:
+		queue.counters.Dead++
+	}
+}
+
+// stat returns the stat of the queue, consumers are listed under the
+// connection name given
+func (queue *TestQueue) stat(connectionName string) QueueStat {
+	stat := NewQueueStat(queue.ReadyCount(), len(queue.rejected))
+	stat.Counters = queue.counters
+	if len(queue.consumers) > 0 || queue.unacked > 0 {
+		connectionStat := ConnectionStat{
+			Active:        true,
+			UnackedCount:  queue.unacked,
+			Consumers:     []string{},
+			ConsumerStats: map[string]ConsumerStat{},
+		}
+		connectionStat.Consumers = queue.GetConsumers()
+		stat.ConnectionStats[connectionName] = connectionStat
+	}
+	return stat
+}
+
+// DeliverAll delivers all payloads published since the last DeliverAll() or
+// Reset() call like Deliver and returns their states in publish order. The
+// payloads stay in LastDeliveries
+func (queue *TestQueue) DeliverAll() []State {
+	if queue.delivered > len(queue.LastDeliveries) {
+		queue.delivered = len(queue.LastDeliveries) // some got removed
+	}
+	states := []State{}
+	for ; queue.delivered < len(queue.LastDeliveries); queue.delivered++ {
+		states = append(states, queue.Deliver(queue.LastDeliveries[queue.delivered]))
+	}
+	return states
+}
+
+// ConsumeOnce is like DeliverAll, test queues always consume synchronously.
+// Returns the number of delivered payloads
+func (queue *TestQueue) ConsumeOnce() int {
+	return len(queue.DeliverAll())
+}
+
+// next returns the consumer to get the next delivery, nil if there's none
+func (queue *TestQueue) next() *testQueueConsumer {
+	for range queue.consumers {
+		consumer := queue.consumers[queue.nextConsumer%len(queue.consumers)]
+		queue.nextConsumer++
+		select {
+		case <-consumer.stopper:
+			consumer.stopped = true
+		default:
+		}
+		if !consumer.stopped {
+			return consumer
+		}
+	}
+	return nil
 }
 
 func (queue *TestQueue) AddBatchConsumer(tag string, batchSize int, consumer BatchConsumer) string {
@@ -49,26 +263,338 @@ func (queue *TestQueue) AddBatchConsumerWithTimeout(tag string, batchSize int, t
 	return ""
 }
 
-func (queue *TestQueue) ReturnRejected(count int) int {
+func (queue *TestQueue) AckMany(deliveries []Delivery) (acked int, failed []Delivery, err error) {
+	return ackMany(deliveries)
+}
+
+func (queue *TestQueue) SetVisibilityTimeout(timeout time.Duration) {
+}
+
+func (queue *TestQueue) SetPerDeliveryTimeout(timeout time.Duration) {
+}
+
+func (queue *TestQueue) SetHooks(hooks Hooks) {
+}
+
+func (queue *TestQueue) SetChecksums(enabled bool) {
+}
+
+func (queue *TestQueue) SetRetryPolicy(policy *RetryPolicy) {
+}
+
+func (queue *TestQueue) SetAckCoalescing(interval time.Duration) {
+}
+
+func (queue *TestQueue) FlushAcks() error {
+	return nil
+}
+
+func (queue *TestQueue) SetQuarantineFilter(filter func(payload []byte) bool, quarantineQueue string) {
+}
+
+// ReadyCount returns the number of published payloads which weren't
+// delivered by DeliverAll() or purged yet
+func (queue *TestQueue) ReadyCount() int {
+	if queue.delivered > len(queue.LastDeliveries) {
+		return 0
+	}
+	return len(queue.LastDeliveries) - queue.delivered
+}
+
+// UnackedCount returns the number of deliveries consumers didn't settle
+func (queue *TestQueue) UnackedCount() int {
+	return queue.unacked
+}
+
+func (queue *TestQueue) DelayedCount() int {
 	return 0
 }
 
+// GetConsumers returns the names of the consumers which weren't stopped, in
+// the order they got added
+func (queue *TestQueue) GetConsumers() []string {
+	names := []string{}
+	for _, consumer := range queue.consumers {
+		if !consumer.stopped {
+			names = append(names, consumer.name)
+		}
+	}
+	return names
+}
+
+func (queue *TestQueue) ReturnRejected(count int) int {
+	returned, _ := queue.ReturnRejectedErr(count)
+	return returned
+}
+
+// ReturnRejectedErr publishes up to max rejected payloads again, oldest
+// first, so the next DeliverAll() delivers them. Returned payloads don't
+// count as published
+func (queue *TestQueue) ReturnRejectedErr(max int) (returned int, err error) {
+	for ; returned < max && len(queue.rejected) > 0; returned++ {
+		oldest := queue.rejected[len(queue.rejected)-1]
+		queue.rejected = queue.rejected[:len(queue.rejected)-1]
+		queue.LastDeliveries = append(queue.LastDeliveries, oldest.Payload)
+	}
+	return returned, nil
+}
+
+func (queue *TestQueue) GetRejectedWithReasons(count int) []RejectedDelivery {
+	return queue.ListRejected(0, count)
+}
+
+// ListRejected returns up to limit rejected deliveries starting at offset,
+// newest first
+func (queue *TestQueue) ListRejected(offset, limit int) []RejectedDelivery {
+	if offset < 0 || limit <= 0 || offset >= len(queue.rejected) {
+		return []RejectedDelivery{}
+	}
+	end := offset + limit
+	if end > len(queue.rejected) {
+		end = len(queue.rejected)
+	}
+	return append([]RejectedDelivery{}, queue.rejected[offset:end]...)
+}
+
+// GetRejected returns up to count payloads rejected by consumers, newest
+// first
+func (queue *TestQueue) GetRejected(count int) []string {
+	payloads := []string{}
+	for _, rejected := range queue.ListRejected(0, count) {
+		payloads = append(payloads, rejected.Payload)
+	}
+	return payloads
+}
+
+// PeekReady returns up to count of the payloads ReadyCount() counts,
+// starting at offset
+func (queue *TestQueue) PeekReady(offset, count int) []string {
+	ready := len(queue.LastDeliveries) - queue.ReadyCount()
+	return append([]string{}, page(queue.LastDeliveries[ready:], offset, count)...)
+}
+
+func (queue *TestQueue) DrainTo(destinationQueue string, max int) (moved int, err error) {
+	return 0, nil
+}
+
+func (queue *TestQueue) Destroy() (PurgeCounts, error) {
+	counts := PurgeCounts{
+		Ready:    int64(queue.ReadyCount()),
+		Rejected: int64(len(queue.rejected)),
+		Unacked:  int64(queue.unacked),
+	}
+	queue.Reset()
+	return counts, nil
+}
+
+func (queue *TestQueue) ForceDestroy() (PurgeCounts, error) {
+	return queue.Destroy()
+}
+
+func (queue *TestQueue) Export(w io.Writer, lists ...string) (n int, err error) {
+	return 0, nil
+}
+
+// Import adds the payloads of records written by queue.Export() to the
+// queue: Ready and delayed ones get appended to LastDeliveries without
+// counting as published, rejected ones get recorded as rejected without
+// reason
+func (queue *TestQueue) Import(r io.Reader) (n int, err error) {
+	reader := bufio.NewReader(r)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			record := exportRecord{}
+			if err := json.Unmarshal(line, &record); err != nil {
+				return n, fmt.Errorf("rmq queue failed to import record %d: %s", n+1, err)
+			}
+			if record.Version > exportVersion {
+				return n, fmt.Errorf("rmq queue can't import export version %d", record.Version)
+			}
+
+			payload := decodePayload(string(record.Entry))
+			switch record.List {
+			case ExportReady, ExportDelayed:
+				queue.LastDeliveries = append(queue.LastDeliveries, payload)
+			case ExportRejected:
+				queue.rejected = append([]RejectedDelivery{{Payload: payload}}, queue.rejected...)
+			default:
+				return n, fmt.Errorf("rmq queue can't import unknown list %q", record.List)
+			}
+			n++
+		}
+
+		if readErr == io.EOF {
+			return n, nil
+		}
+		if readErr != nil {
+			return n, readErr
+		}
+	}
+}
+
+func (queue *TestQueue) DedupeReady() (removed int64, err error) {
+	seen := map[string]bool{}
+	deduped := queue.LastDeliveries[:0]
+	for _, payload := range queue.LastDeliveries {
+		if seen[payload] {
+			removed++
+			continue
+		}
+		seen[payload] = true
+		deduped = append(deduped, payload)
+	}
+	queue.LastDeliveries = deduped
+	return removed, nil
+}
+
+func (queue *TestQueue) DedupeReadyPayloads() (removed int64, err error) {
+	return queue.DedupeReady()
+}
+
+func (queue *TestQueue) PeekUnacked(count int) []string {
+	return []string{}
+}
+
+func (queue *TestQueue) OldestUnackedAge() (age time.Duration, ok bool) {
+	return 0, false
+}
+
+func (queue *TestQueue) GetRejectedBytes(count int) [][]byte {
+	payloads := queue.GetRejected(count)
+	bytes := make([][]byte, len(payloads))
+	for i, payload := range payloads {
+		bytes[i] = []byte(payload)
+	}
+	return bytes
+}
+
+func (queue *TestQueue) RejectedCount() int {
+	return len(queue.rejected)
+}
+
+// ReturnRejectedMessage publishes the newest rejected delivery of the
+// payload again, see ReturnRejectedErr()
+func (queue *TestQueue) ReturnRejectedMessage(payload []byte) (bool, error) {
+	for i, rejected := range queue.rejected {
+		if rejected.Payload == string(payload) {
+			queue.rejected = append(queue.rejected[:i], queue.rejected[i+1:]...)
+			queue.LastDeliveries = append(queue.LastDeliveries, rejected.Payload)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (queue *TestQueue) ReturnRejectedMessageByID(id string) (bool, error) {
+	return false, nil
+}
+
+func (queue *TestQueue) WatchRejected(threshold int64, interval time.Duration, fn func(count int64)) {
+}
+
+func (queue *TestQueue) ReturnAllUnacked() (returned int, err error) {
+	return 0, nil
+}
+
+func (queue *TestQueue) ForceReturnAllUnacked() (returned int, err error) {
+	return 0, nil
+}
+
 func (queue *TestQueue) ReturnAllRejected() int {
-	return 0
+	return queue.ReturnRejected(len(queue.rejected))
+}
+
+// ReturnAllRejectedThrottled returns all rejected deliveries at once, there's
+// nothing to throttle
+func (queue *TestQueue) ReturnAllRejectedThrottled(ctx context.Context, perSecond int) (returned int, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return queue.ReturnRejectedErr(len(queue.rejected))
+}
+
+// Counters returns how many payloads got published and how many deliveries
+// consumers settled how since the last Reset()
+func (queue *TestQueue) Counters() QueueCounters {
+	return queue.counters
+}
+
+func (queue *TestQueue) ResetCounters() (QueueCounters, error) {
+	counters := queue.counters
+	queue.counters = QueueCounters{}
+	return counters, nil
 }
 
 func (queue *TestQueue) PurgeReady() bool {
-	return false
+	removed, _ := queue.PurgeReadyErr()
+	return removed > 0
+}
+
+// PurgeReadyErr drops the payloads which weren't delivered yet, so
+// DeliverAll() skips them. They stay in LastDeliveries
+func (queue *TestQueue) PurgeReadyErr() (removed int64, err error) {
+	removed = int64(queue.ReadyCount())
+	queue.delivered = len(queue.LastDeliveries)
+	return removed, nil
+}
+
+func (queue *TestQueue) PurgeRejectedErr() (removed int64, err error) {
+	removed = int64(len(queue.rejected))
+	queue.rejected = []RejectedDelivery{}
+	return removed, nil
+}
+
+func (queue *TestQueue) PurgeUnacked() (removed int64, err error) {
+	return 0, nil
+}
+
+// TrimRejected drops the oldest rejected deliveries beyond maxLength
+func (queue *TestQueue) TrimRejected(maxLength int64) (dropped int64, err error) {
+	if maxLength < 0 || int64(len(queue.rejected)) <= maxLength {
+		return 0, nil
+	}
+	dropped = int64(len(queue.rejected)) - maxLength
+	queue.rejected = queue.rejected[:maxLength]
+	return dropped, nil
+}
+
+func (queue *TestQueue) SetRejectedMaxLength(maxLength int64) {
+}
+
+// DeleteRejected drops all rejected deliveries of the payload
+func (queue *TestQueue) DeleteRejected(payload []byte) (removed int64, err error) {
+	kept := queue.rejected[:0]
+	for _, rejected := range queue.rejected {
+		if rejected.Payload == string(payload) {
+			removed++
+			continue
+		}
+		kept = append(kept, rejected)
+	}
+	queue.rejected = kept
+	return removed, nil
+}
+
+func (queue *TestQueue) DeleteRejectedByID(id string) (removed int64, err error) {
+	return 0, nil
 }
 
 func (queue *TestQueue) PurgeRejected() bool {
-	return false
+	removed, _ := queue.PurgeRejectedErr()
+	return removed > 0
 }
 
 func (queue *TestQueue) Close() bool {
 	return false
 }
 
+// Reset forgets the published payloads and what consumers did, registered
+// consumers stay
 func (queue *TestQueue) Reset() {
 	queue.LastDeliveries = []string{}
+	queue.delivered = 0
+	queue.unacked = 0
+	queue.rejected = []RejectedDelivery{}
+	queue.counters = QueueCounters{}
 }
@@ -0,0 +1,130 @@
+package rmq
+
+import (
+	"testing"
+
+	. "github.com/adjust/gocheck"
+)
+
+func TestMockQueueSuite(t *testing.T) {
+	TestingSuiteT(&MockQueueSuite{}, t)
+}
+
+type MockQueueSuite struct{}
+
+func (suite *MockQueueSuite) TestDeliver(c *C) {
+	queue := NewTestQueue("test-deliver")
+	var q Queue
+	c.Check(queue, Implements, &q)
+	c.Check(queue.Deliver("d0"), Equals, Unacked) // no consumers
+
+	consumer := NewTestConsumer("test-A")
+	name, stopper := queue.AddConsumer("test-cons", consumer)
+	c.Check(name, Equals, "test-cons-0")
+	queue.AddConsumerFunc("test-func", func(delivery Delivery) {
+		delivery.Reject()
+	})
+
+	c.Check(queue.Deliver("d1"), Equals, Acked)
+	c.Check(queue.Deliver("d2"), Equals, Rejected)
+	c.Check(queue.Deliver("d3"), Equals, Acked)
+	c.Assert(consumer.LastDeliveries, HasLen, 2)
+	c.Check(consumer.LastDelivery.Payload(), Equals, "d3")
+
+	queue.Publish("p1")
+	queue.Publish("p2")
+	c.Check(queue.DeliverAll(), DeepEquals, []State{Rejected, Acked})
+	c.Check(queue.DeliverAll(), HasLen, 0)
+	c.Check(queue.LastDeliveries, DeepEquals, []string{"p1", "p2"})
+
+	stopper <- 1
+	c.Check(queue.Deliver("d4"), Equals, Rejected)
+	c.Check(queue.Deliver("d5"), Equals, Rejected)
+	c.Check(consumer.LastDeliveries, HasLen, 3)
+
+	queue.Reset()
+	queue.Publish("p3")
+	c.Check(queue.DeliverAll(), DeepEquals, []State{Rejected})
+}
+
+func (suite *MockQueueSuite) TestRejectedAndPurge(c *C) {
+	queue := NewTestQueue("test-rejected")
+	queue.AddConsumerFunc("test-func", func(delivery Delivery) {
+		if delivery.Payload() == "ack" {
+			delivery.Ack()
+			return
+		}
+		delivery.RejectWithReason("reason-" + delivery.Payload())
+	})
+	c.Check(queue.GetConsumers(), DeepEquals, []string{"test-func-0"})
+
+	queue.Publish("r1")
+	queue.Publish("ack")
+	queue.Publish("r2")
+	c.Check(queue.ReadyCount(), Equals, 3)
+	c.Check(queue.PeekReady(1, 5), DeepEquals, []string{"ack", "r2"})
+	queue.DeliverAll()
+	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 2)
+	c.Check(queue.GetRejected(5), DeepEquals, []string{"r2", "r1"})
+	rejected := queue.ListRejected(1, 5)
+	c.Assert(rejected, HasLen, 1)
+	c.Check(rejected[0].Payload, Equals, "r1")
+	c.Check(rejected[0].Reason, Equals, "reason-r1")
+	c.Check(rejected[0].Consumer, Equals, "test-func-0")
+
+	// returned oldest first
+	c.Check(queue.ReturnRejected(1), Equals, 1)
+	c.Check(queue.PeekReady(0, 5), DeepEquals, []string{"r1"})
+	c.Check(queue.GetRejected(5), DeepEquals, []string{"r2"})
+	c.Check(queue.ReturnAllRejected(), Equals, 1)
+	c.Check(queue.ReadyCount(), Equals, 2)
+	c.Check(queue.Counters().Published, Equals, int64(3))
+
+	c.Check(queue.PurgeReady(), Equals, true)
+	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(queue.DeliverAll(), HasLen, 0)
+	c.Check(queue.PurgeReady(), Equals, false)
+
+	queue.Publish("r3")
+	queue.DeliverAll()
+	c.Check(queue.PurgeRejected(), Equals, true)
+	c.Check(queue.RejectedCount(), Equals, 0)
+	c.Check(queue.PurgeRejected(), Equals, false)
+}
+
+func (suite *MockQueueSuite) TestPushChain(c *C) {
+	connection := NewTestConnection()
+	orders := connection.OpenQueue("orders").(*TestQueue)
+	retry := NewTestQueue("orders-retry")
+	dead := connection.OpenQueue("orders-dead").(*TestQueue)
+	c.Check(orders.SetPushQueue(retry), IsNil)
+	c.Check(retry.SetPushQueue(dead), IsNil)
+	c.Check(orders.PushChain(), DeepEquals, []string{"orders", "orders-retry", "orders-dead"})
+	c.Check(dead.SetPushQueue(orders), ErrorMatches, ".*cycle orders-dead -> orders -> orders-retry -> orders-dead")
+	c.Check(dead.SetPushQueue(NewMemoryConnection().OpenQueue("memory")), NotNil)
+	c.Check(connection.GetOpenQueues(), DeepEquals, []string{"orders", "orders-dead", "orders-retry"})
+
+	failing := func(delivery Delivery) {
+		delivery.Push()
+	}
+	orders.AddConsumerFunc("orders-cons", failing)
+	retry.AddConsumerFunc("retry-cons", failing)
+	dead.AddConsumerFunc("dead-cons", failing)
+
+	c.Check(orders.Deliver("o1"), Equals, Pushed)
+	c.Check(connection.GetDeliveries("orders-retry"), DeepEquals, []string{"o1"})
+	c.Check(retry.DeliverAll(), DeepEquals, []State{Pushed})
+	c.Check(dead.LastDeliveries, DeepEquals, []string{"o1"})
+
+	// without push queue the delivery gets rejected
+	c.Check(dead.DeliverAll(), DeepEquals, []State{Rejected})
+	c.Check(dead.GetRejected(10), DeepEquals, []string{"o1"})
+	c.Check(dead.Counters(), Equals, QueueCounters{Rejected: 1})
+	c.Check(orders.Counters(), Equals, QueueCounters{Pushed: 1})
+
+	c.Check(orders.SetPushQueue(nil), IsNil)
+	c.Check(orders.PushQueueName(), Equals, "")
+	c.Check(orders.Deliver("o2"), Equals, Rejected)
+}
@@ -0,0 +1,29 @@
+package rmq
+
+import "context"
+
+// HeaderTraceParent is the header a Tracer should use to store the W3C trace
+// context of a published delivery
+const HeaderTraceParent = "traceparent"
+
+// Tracer integrates a tracing library like OpenTelemetry with rmq, so that
+// consumer spans can be children of the spans which published the deliveries.
+// Set one with connection.SetTracer().
+type Tracer interface {
+	// Inject stores the trace context of ctx in the headers of a delivery
+	// which is about to be published by queue.PublishWithContext()
+	Inject(ctx context.Context, headers map[string]string)
+
+	// StartConsume extracts the trace context from the delivery's headers and
+	// starts a consumer span as its child. The returned context is passed to
+	// context consumers, end is called once the consumer returned.
+	StartConsume(ctx context.Context, delivery Delivery, span ConsumeSpan) (spanCtx context.Context, end func())
+}
+
+// ConsumeSpan describes a consumer consuming a delivery for tracing
+type ConsumeSpan struct {
+	Queue       string
+	Consumer    string
+	Attempts    int // number of times the delivery was redelivered before
+	PayloadSize int
+}
@@ -0,0 +1,23 @@
+package rmq
+
+// rejectedWatch decides when a rejected list watcher should fire. It fires
+// once the count reaches threshold and rearms once the count dropped below
+// half the threshold, so it doesn't fire on every check while the rejected
+// list stays long
+type rejectedWatch struct {
+	threshold int64
+	fired     bool
+}
+
+// check returns true if the watcher should fire for the given count
+func (watch *rejectedWatch) check(count int64) bool {
+	if watch.fired {
+		if count < watch.threshold/2 {
+			watch.fired = false
+		}
+		return false
+	}
+
+	watch.fired = count >= watch.threshold
+	return watch.fired
+}
@@ -0,0 +1,15 @@
+package rmq
+
+import "testing"
+
+func TestRejectedWatch(t *testing.T) {
+	watch := &rejectedWatch{threshold: 10}
+	counts := []int64{0, 9, 10, 12, 30, 6, 5, 4, 9, 10, 11}
+	fired := []bool{false, false, true, false, false, false, false, false, false, true, false}
+
+	for i, count := range counts {
+		if got := watch.check(count); got != fired[i] {
+			t.Errorf("check(%d) at %d = %t, expected %t", count, i, got, fired[i])
+		}
+	}
+}